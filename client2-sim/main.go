@@ -38,15 +38,25 @@ func main() {
 	sendDuration := 5 * time.Second
 
 
-	runtime.GOMAXPROCS(4 * senderCount)
+	// the sim runs a few goroutines per sender, but these mostly wait on timers,
+	// so procs scale with the available cores rather than the sender count.
+	// With too few procs, scheduler delay shows up as added rtt in the stats.
+	procs := runtime.NumCPU()
+	runtime.GOMAXPROCS(procs)
+	fmt.Printf("Run %d senders on %d procs\n", senderCount, procs)
 
 
 	egressStatsWindow := 15 * time.Second
+	// per destination transfer is sparser than net transfer, so use a longer window
+	egressStatsToDstWindow := 45 * time.Second
 	egressStatsReconnectWindow := 120 * time.Second
 	dropProbabilityPerSend := 0.2
 	blockProbabilityPerDst := 0.75
 	egressInitialCapacityWeight := 0.1
 	egressInitialCapacityToDstWeight := 0.1
+	// set a fixed seed to reproduce a run, e.g. from the seed in the export
+	randSeed := time.Now().UnixNano()
+	fmt.Printf("Seed %d\n", randSeed)
 
 
 	statsWindowSim := &StatisticalHopWindow{
@@ -60,15 +70,19 @@ func main() {
 		sendDuration: sendDuration,
 
 		egressWindowSize: 5,
-		// TODO have a sweep of this that looks for no activity in past N time and removes down to initial size
 		egressWindowMaxSize: 10,
+		egressIdleWindow: 60 * time.Second,
 		egressStatsWindow: egressStatsWindow,
+		egressStatsToDstWindow: egressStatsToDstWindow,
 		egressStatsReconnectWindow: egressStatsReconnectWindow,
 		// expressed as a fraction of maximum transfer
 		egressStatsWindowEstimateNetTransfer: int64(egressInitialCapacityWeight * float64(sendSize) * float64(egressStatsWindow) / float64(sendDuration)),
 		// expressed as a fraction of maximum transfer
-		egressStatsWindowEstimateNetTransferToDst: int64(egressInitialCapacityToDstWeight * float64(sendSize) * float64(egressStatsWindow) / float64(sendDuration)),
+		egressStatsWindowEstimateNetTransferToDst: int64(egressInitialCapacityToDstWeight * float64(sendSize) * float64(egressStatsToDstWindow) / float64(sendDuration)),
 		dstWeight: 0.75,
+		// an egress with no transfer for this long is credited half the estimate
+		egressStatsEstimateDecayHalfLife: 30 * time.Second,
+		egressStatsEstimateMinFraction: 0,
 
 		egressWindowContractTimeout: 1 * time.Second,
 		egressWindowContractGracePeriod: 5 * time.Second,
@@ -76,6 +90,8 @@ func main() {
 		egressWindowExpandStep: 2,
 
 		rand: &EgressRandomSettings{
+			seed: randSeed,
+
 			// p = 1 - pow(1 - K, sendDuration / time.Second)
 			// K = 1 - (1 - p)^(time.Second / sendDuration)
 			dropProbabilityPerSecond: 1 - math.Pow(
@@ -89,7 +105,20 @@ func main() {
 			blockDelay: 3 * time.Second,
 			blockMin: 60 * time.Second,
 			blockMax: 3600 * time.Second,
+
+			// set different loss to simulate an asymmetric link
+			forward: EgressLinkSettings{
+				lossProbability: 0,
+			},
+			reverse: EgressLinkSettings{
+				lossProbability: 0,
+			},
 		},
+
+		exportInternConnectionTuples: true,
+		// set to keep only the recent packets individually, so that long runs fit in memory.
+		// The export then has the older packets aggregated in `PacketIntervals` instead of `Packets`
+		boundedStats: false,
 	}
 
 	if err := statsWindowSim.Run(); err != nil {
@@ -221,7 +250,7 @@ func (self *Sender) Run(connectEgress EgressFunction) {
 		egress := connectEgress(connectionTuple)
 		// fmt.Printf("Get egress done\n")
 		egressId = egress.EgressId
-		fmt.Printf("Connect to %d from %s\n", egressId, connectionTuple)
+		fmt.Printf("Connect to %d from %v\n", egressId, connectionTuple)
 
 		out = make(chan *Packet)
 		in = make(chan *Packet)
@@ -281,6 +310,7 @@ func (self *Sender) Run(connectEgress EgressFunction) {
 					if !ok {
 						// reconnect
 						fmt.Printf("Reconnect 1\n")
+						self.reconnect(egressId, connectionTuple.Dst())
 						closeOut()
 						sendSeq()
 						return
@@ -313,6 +343,7 @@ func (self *Sender) Run(connectEgress EgressFunction) {
 				case <- time.After(readTimeoutTime.Sub(time.Now())):
 					// reconnect
 					fmt.Printf("Reconnect 2\n")
+					self.reconnect(egressId, connectionTuple.Dst())
 					closeOut()
 					sendSeq()
 					return
@@ -344,6 +375,15 @@ func (self *Sender) Run(connectEgress EgressFunction) {
 
 }
 
+// the sender leaves the egress and connects again
+func (self *Sender) reconnect(egressId Id, dst ConnectionTuple) {
+	self.stats.AddReconnect(&ReconnectMeta{
+		eventTime: time.Now(),
+		egressId: egressId,
+		dst: dst,
+	})
+}
+
 
 type BlackholeState struct {
 	Active bool
@@ -353,6 +393,9 @@ type BlackholeState struct {
 
 
 type EgressRandomSettings struct {
+	// all random choices in the sim derive from this seed
+	seed int64
+
 	dropProbabilityPerSecond float64
 	dropMin time.Duration
 	dropMax time.Duration
@@ -361,6 +404,31 @@ type EgressRandomSettings struct {
 	blockDelay time.Duration
 	blockMin time.Duration
 	blockMax time.Duration
+
+	// the egress link can be asymmetric, e.g. good download and lossy upload
+	// client->egress
+	forward EgressLinkSettings
+	// egress->client
+	reverse EgressLinkSettings
+}
+
+
+// the loss profile of one direction of the egress link
+type EgressLinkSettings struct {
+	// each packet in this direction is lost with this probability,
+	// independent of the drop and block windows
+	lossProbability float64
+	// the drop and block windows do not blackhole this direction
+	skipBlackhole bool
+}
+
+
+// packets of each direction of the egress link
+type EgressLinkCounts struct {
+	ForwardCount int
+	ForwardLossCount int
+	ReverseCount int
+	ReverseLossCount int
 }
 
 
@@ -378,8 +446,11 @@ type Egress struct {
 	CreateTime time.Time
 
 	stateLock sync.Mutex
+	// must be used with the state lock
+	r *mathrand.Rand
 	drop BlackholeState
 	blockDst map[ConnectionTuple]BlackholeState
+	linkCounts EgressLinkCounts
 }
 
 func NewEgress(
@@ -387,6 +458,7 @@ func NewEgress(
 	egressId Id,
 	forever time.Duration,
 	rand *EgressRandomSettings,
+	r *mathrand.Rand,
 	stats *PacketIntervalWindow,
 ) *Egress {
 	cancelCtx, cancel := context.WithCancel(ctx)
@@ -404,6 +476,7 @@ func NewEgress(
 		CreateTime: time.Now(),
 
 		stateLock: sync.Mutex{},
+		r: r,
 		drop: BlackholeState{},
 		blockDst: map[ConnectionTuple]BlackholeState{},
 	}
@@ -412,7 +485,7 @@ func NewEgress(
 		previousEvalTime := time.Now()
 		for {
 			select {
-			case <- ctx.Done():
+			case <- cancelCtx.Done():
 				return
 			case <- time.After(time.Second):
 				t := time.Now()
@@ -425,37 +498,66 @@ func NewEgress(
 	return egress
 }
 
+// must be called with the state lock
 func (self *Egress) testDrop(elapsed time.Duration) (out BlackholeState) {
 	p := 1 - math.Pow(
 		1 - self.rand.dropProbabilityPerSecond,
 		float64(elapsed) / float64(time.Second),
 	)
 
-	if mathrand.Float64() < p {
+	if self.r.Float64() < p {
 		out.Active = true
 
 		out.StartTime = time.Now()
 		out.EndTime = out.StartTime.Add(
-			time.Duration(mathrand.Int63n(int64((self.rand.dropMax - self.rand.dropMin) / time.Second))) * time.Second,
+			time.Duration(self.r.Int63n(int64((self.rand.dropMax - self.rand.dropMin) / time.Second))) * time.Second,
 		)
 	}
 	return
 }
 
+// must be called with the state lock
 func (self *Egress) testBlockPerDst() (out BlackholeState) {
-	if mathrand.Float64() < self.rand.blockProbabilityPerDst {
+	if self.r.Float64() < self.rand.blockProbabilityPerDst {
 		out.Active = true
 
 		out.StartTime = time.Now().Add(
-			time.Duration(mathrand.Int63n(int64(self.rand.blockDelay / time.Second))) * time.Second,
+			time.Duration(self.r.Int63n(int64(self.rand.blockDelay / time.Second))) * time.Second,
 		)
 		out.EndTime = out.StartTime.Add(
-			time.Duration(mathrand.Int63n(int64((self.rand.blockMax - self.rand.blockMin) / time.Second))) * time.Second,
+			time.Duration(self.r.Int63n(int64((self.rand.blockMax - self.rand.blockMin) / time.Second))) * time.Second,
 		)
 	}
 	return
 }
 
+// returns true if the packet is lost in the direction of the link
+func (self *Egress) testLoss(link *EgressLinkSettings, blackhole bool) bool {
+	if blackhole && !link.skipBlackhole {
+		return true
+	}
+	if link.lossProbability <= 0 {
+		return false
+	}
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.r.Float64() < link.lossProbability
+}
+
+// the forward and reverse packets of all connections to the egress
+func (self *Egress) LinkCounts() EgressLinkCounts {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.linkCounts
+}
+
+func (self *Egress) countLink(update func(*EgressLinkCounts)) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	update(&self.linkCounts)
+}
+
 func (self *Egress) maybeDrop(elapsed time.Duration) {
 	self.stateLock.Lock()
 	defer self.stateLock.Unlock()
@@ -575,17 +677,34 @@ func (self *Egress) Connect(
 				if !ok {
 					// fmt.Printf("Closed\n")
 					return
-				} else if blocked {
-					// blackhole
+				}
+				if blocked {
 					fmt.Printf("Blackhole blocked\n")
 				} else if dropped {
-					// blackhole
 					fmt.Printf("Blackhole dropped\n")
-				} else {
-					select {
-					case <- self.ctx.Done():
-					case out <- packet:
-					}
+				}
+				if self.testLoss(&self.rand.forward, blocked || dropped) {
+					self.countLink(func(linkCounts *EgressLinkCounts) {
+						linkCounts.ForwardLossCount += 1
+					})
+					continue
+				}
+				self.countLink(func(linkCounts *EgressLinkCounts) {
+					linkCounts.ForwardCount += 1
+				})
+				// the echo
+				if self.testLoss(&self.rand.reverse, blocked || dropped) {
+					self.countLink(func(linkCounts *EgressLinkCounts) {
+						linkCounts.ReverseLossCount += 1
+					})
+					continue
+				}
+				select {
+				case <- self.ctx.Done():
+				case out <- packet:
+					self.countLink(func(linkCounts *EgressLinkCounts) {
+						linkCounts.ReverseCount += 1
+					})
 				}
 			}
 		}
@@ -611,11 +730,26 @@ type StatisticalHopWindow struct {
 
 	egressWindowSize int
 	egressWindowMaxSize int
+	// an egress with no transfer over this window is removed,
+	// down to `egressWindowSize`
+	// 0 disables the idle sweep
+	egressIdleWindow time.Duration
+	// window for the net transfer of each egress
 	egressStatsWindow time.Duration
+	// window for the transfer of each egress to the destination
+	egressStatsToDstWindow time.Duration
 	egressStatsReconnectWindow time.Duration
+	// estimate over `egressStatsWindow`
 	egressStatsWindowEstimateNetTransfer int64
+	// estimate over `egressStatsToDstWindow`
 	egressStatsWindowEstimateNetTransferToDst int64
 	dstWeight float64
+	// the estimates decay exponentially with the time the egress has had no transfer,
+	// so that idle egresses are less likely to be chosen
+	// 0 disables the decay
+	egressStatsEstimateDecayHalfLife time.Duration
+	// the estimates do not decay below this fraction
+	egressStatsEstimateMinFraction float64
 
 	egressWindowContractTimeout time.Duration
 	egressWindowContractGracePeriod time.Duration
@@ -623,8 +757,115 @@ type StatisticalHopWindow struct {
 	egressWindowExpandStep int
 
 	rand *EgressRandomSettings
+
+	// write each packet connection tuple once in the export, see `PacketIntervalWindow.Export`
+	exportInternConnectionTuples bool
+	// see `NewBoundedPacketIntervalWindow`
+	boundedStats bool
+}
+
+
+
+// the fraction of the estimates to credit the egress
+func (self *StatisticalHopWindow) estimateDecay(stats *PacketIntervalWindow, egress *Egress) float64 {
+	if self.egressStatsEstimateDecayHalfLife <= 0 {
+		return 1
+	}
+	lastActiveTime := egress.CreateTime
+	if lastTransferTime, ok := stats.LastTransferTime(egress.EgressId); ok && lastActiveTime.Before(lastTransferTime) {
+		lastActiveTime = lastTransferTime
+	}
+	idleDuration := time.Now().Sub(lastActiveTime)
+	if idleDuration <= 0 {
+		return 1
+	}
+	decay := math.Pow(0.5, float64(idleDuration) / float64(self.egressStatsEstimateDecayHalfLife))
+	return max(self.egressStatsEstimateMinFraction, decay)
+}
+
+func (self *StatisticalHopWindow) netTransferEstimate(stats *PacketIntervalWindow, egress *Egress) int64 {
+	return int64(float64(self.egressStatsWindowEstimateNetTransfer) * self.estimateDecay(stats, egress))
 }
 
+func (self *StatisticalHopWindow) netTransferToDstEstimate(stats *PacketIntervalWindow, egress *Egress) int64 {
+	return int64(float64(self.egressStatsWindowEstimateNetTransferToDst) * self.estimateDecay(stats, egress))
+}
+
+// the idle egresses to remove from the window, oldest first
+// the window is not reduced below `egressWindowSize`
+func (self *StatisticalHopWindow) idleEgresses(stats *PacketIntervalWindow, egressWindow []*Egress) []*Egress {
+	if self.egressIdleWindow <= 0 {
+		return nil
+	}
+	n := len(egressWindow) - self.egressWindowSize
+	if n <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	idleEgresses := []*Egress{}
+	for _, egress := range egressWindow {
+		// a new egress has not had the full window to transfer
+		if now.Before(egress.CreateTime.Add(self.egressIdleWindow)) {
+			continue
+		}
+		if stats.NetTransfer(egress.EgressId, self.egressIdleWindow) == 0 {
+			idleEgresses = append(idleEgresses, egress)
+		}
+	}
+	slices.SortFunc(idleEgresses, func(a *Egress, b *Egress)(int) {
+		return a.CreateTime.Compare(b.CreateTime)
+	})
+	if n < len(idleEgresses) {
+		idleEgresses = idleEgresses[:n]
+	}
+	return idleEgresses
+}
+
+// the probability to choose each egress in the window for the destination
+// weights the net transfer over `egressStatsWindow` and the transfer to the destination over `egressStatsToDstWindow`
+func (self *StatisticalHopWindow) egressProbabilities(
+	stats *PacketIntervalWindow,
+	egressWindow []*Egress,
+	dst ConnectionTuple,
+) []float64 {
+	netTransfer := map[Id]int64{}
+	net := int64(0)
+	netTransferToDst := map[Id]int64{}
+	netToDst := int64(0)
+	for _, egress := range egressWindow {
+		t := stats.NetTransfer(egress.EgressId, self.egressStatsWindow)
+		if t == 0 {
+			t = self.netTransferEstimate(stats, egress)
+		}
+		netTransfer[egress.EgressId] = t
+		net += t
+
+		tToDst := stats.NetTransferToDst(egress.EgressId, self.egressStatsToDstWindow, dst)
+		if tToDst == 0 {
+			tToDst = self.netTransferToDstEstimate(stats, egress)
+		}
+		netTransferToDst[egress.EgressId] = tToDst
+		netToDst += tToDst
+	}
+
+	ps := []float64{}
+	if 0 < net && 0 < netToDst {
+		for _, egress := range egressWindow {
+			pNet := float64(netTransfer[egress.EgressId]) / float64(net)
+			pNetTpDst := float64(netTransferToDst[egress.EgressId]) / float64(netToDst)
+			p := (1 - self.dstWeight) * pNet + self.dstWeight * pNetTpDst
+			ps = append(ps, p)
+		}
+	} else {
+		for i := 0; i < len(egressWindow); i += 1 {
+			p := 1 / float64(len(egressWindow))
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
 
 
 // at the end computes amount of data sent / time
@@ -634,9 +875,18 @@ func (self *StatisticalHopWindow) Run() error {
 	defer cancel()
 
 
-	stats := NewPacketIntervalWindow(self.packetInterval, self.timeout)
+	var stats *PacketIntervalWindow
+	if self.boundedStats {
+		stats = NewBoundedPacketIntervalWindow(self.packetInterval, self.timeout)
+	} else {
+		stats = NewPacketIntervalWindow(self.packetInterval, self.timeout)
+	}
+
+	// must be used with the state lock
+	r := mathrand.New(mathrand.NewSource(self.rand.seed))
 
 
+	// must be called with the state lock
 	newEgress := func()(*Egress) {
 		return NewEgress(
 			cancelCtx,
@@ -645,18 +895,12 @@ func (self *StatisticalHopWindow) Run() error {
 			self.timeout,
 
 			self.rand,
+			// each egress has its own source, so that the egress sequence does not depend on the order of the egress goroutines
+			mathrand.New(mathrand.NewSource(r.Int63())),
 			stats,
 		)
 	}
 
-	netTransferEstimate := func(egressId Id)(int64) {
-		return self.egressStatsWindowEstimateNetTransfer
-	}
-
-	netTransferToDstEstimate := func(egressId Id)(int64) {
-		return self.egressStatsWindowEstimateNetTransferToDst
-	}
-
 
 	stateLock := sync.Mutex{}
 	egressWindow := []*Egress{}
@@ -730,6 +974,32 @@ func (self *StatisticalHopWindow) Run() error {
 		}
 	}
 
+	sweepIdleEgressWindow := func() {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+
+		idleEgresses := self.idleEgresses(stats, egressWindow)
+		if len(idleEgresses) == 0 {
+			return
+		}
+
+		fmt.Printf("Contract window size idle (%d)\n", len(idleEgresses))
+
+		for _, egress := range idleEgresses {
+			egressWindow = slices.DeleteFunc(egressWindow, func(windowEgress *Egress)(bool) {
+				return windowEgress == egress
+			})
+
+			egress.Close()
+
+			stats.AddEvent(&EventMeta{
+				eventTime: time.Now(),
+				eventType: EventTypeWindowContract,
+				clientId: egress.EgressId,
+			})
+		}
+	}
+
 	chooseEgress := func(connectionTuple ConnectionTuple)(*Egress) {
 		stateLock.Lock()
 		defer stateLock.Unlock()
@@ -762,50 +1032,23 @@ func (self *StatisticalHopWindow) Run() error {
 			})
 		}
 
-		netTransfer := map[Id]int64{}
-		net := int64(0)
-		netTransferToDst := map[Id]int64{}
-		netToDst := int64(0)
-		for _, egress := range egressWindow {
-			t := stats.NetTransfer(egress.EgressId, self.egressStatsWindow)
-			if t == 0 {
-				t = netTransferEstimate(egress.EgressId)
-			}
-			netTransfer[egress.EgressId] = t
-			net += t
-
-			tToDst := stats.NetTransferToDst(egress.EgressId, self.egressStatsWindow, dst)
-			if tToDst == 0 {
-				tToDst = netTransferToDstEstimate(egress.EgressId)
-			}
-			netTransferToDst[egress.EgressId] = tToDst
-			netToDst += tToDst
-		}
-
-		ps := []float64{}
-		if 0 < net && 0 < netToDst {
-			for _, egress := range egressWindow {
-				pNet := float64(netTransfer[egress.EgressId]) / float64(net)
-				pNetTpDst := float64(netTransferToDst[egress.EgressId]) / float64(netToDst)
-				p := (1 - self.dstWeight) * pNet + self.dstWeight * pNetTpDst
-				ps = append(ps, p)
-			}
-		} else {
-			for i := 0; i < len(egressWindow); i += 1 {
-				p := 1 / float64(len(egressWindow))
-				ps = append(ps, p)
-			}
-		}
-		fmt.Printf("ps = %s\n", ps)
-		r := mathrand.Float64()
+		ps := self.egressProbabilities(stats, egressWindow, dst)
+		stats.AddSelection(&SelectionMeta{
+			eventTime: time.Now(),
+			dst: dst,
+			egressCount: len(ps),
+			entropy: selectionEntropy(ps),
+		})
+		fmt.Printf("ps = %v\n", ps)
+		u := r.Float64()
 		for i, p := range ps {
-			r -= p
-			if r <= 0 {
+			u -= p
+			if u <= 0 {
 				fmt.Printf("Choose [%d]\n", i)
 				return egressWindow[i]
 			}
 		}
-		// r was ~ 1 and there was some floating point error
+		// u was ~ 1 and there was some floating point error
 		return egressWindow[len(egressWindow) - 1]
 	}
 
@@ -817,6 +1060,7 @@ func (self *StatisticalHopWindow) Run() error {
 			case <- time.After(self.egressWindowContractTimeout):
 			}
 			contractEgressWindow()
+			sweepIdleEgressWindow()
 		}
 	}()
 
@@ -852,8 +1096,9 @@ func (self *StatisticalHopWindow) Run() error {
 
 	stats.PrintSummary()
 
-	export := stats.Export()
-	fmt.Printf("Exported %d packets, %d events.\n", len(export.Packets), len(export.Events))
+	export := stats.Export(self.exportInternConnectionTuples)
+	export.Seed = self.rand.seed
+	fmt.Printf("Exported %d packets, %d events, %d selection intervals, %d reconnect egresses.\n", len(export.Packets), len(export.Events), len(export.SelectionEntropies), len(export.EgressReconnects))
 	if exportBytes, err := json.Marshal(export); err == nil {
 		if err := os.WriteFile("export.json", exportBytes, 0777); err != nil {
 			panic(err)
@@ -876,6 +1121,34 @@ type PacketMeta struct {
 	seqSize int
 }
 
+// one egress choice in `chooseEgress`
+type SelectionMeta struct {
+	eventTime time.Time
+	dst ConnectionTuple
+	egressCount int
+	// shannon entropy in bits of the choice probabilities
+	entropy float64
+}
+
+// low entropy means the choice collapsed to one egress,
+// and `log2(egressCount)` means an even spread over the window
+func selectionEntropy(ps []float64) float64 {
+	entropy := 0.0
+	for _, p := range ps {
+		if 0 < p {
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// a sender reconnect away from an egress
+type ReconnectMeta struct {
+	eventTime time.Time
+	egressId Id
+	dst ConnectionTuple
+}
+
 const (
 	EventTypeSenderStart string = "sender-start"
 	EventTypeSenderEnd string = "sender-end"
@@ -885,6 +1158,7 @@ const (
 	EventTypeEgressDropEnd string = "drop-end"
 	EventTypeEgressBlockStart string = "block-start"
 	EventTypeEgressBlockEnd string = "block-end"
+	EventTypeReconnect string = "reconnect"
 	EventTypeSimEnd string = "sim-end"
 )
 
@@ -901,7 +1175,10 @@ type PacketMetaExport struct {
 	EventTimeOffsetMillis int64 `json:"event_time_offset_millis"`
 	SrcClientId Id `json:"src_client_id,omitempty"`
 	DstClientId Id `json:"dst_client_id,omitempty"`
-	ConnectionTuple ConnectionTuple `json:"connection_tuple,omitempty"`
+	// unset when the tuple is interned
+	ConnectionTuple *ConnectionTuple `json:"connection_tuple,omitempty"`
+	// index into `PacketIntervalWindowExport.ConnectionTuples` when the tuple is interned
+	ConnectionTupleIndex *int `json:"connection_tuple_index,omitempty"`
 	Index int `json:"index"` 
 	Size int64 `json:"size"`
 	SeqSize int `json:"seq_size"`
@@ -915,19 +1192,100 @@ type EventMetaExport struct {
 	Dst ConnectionTuple `json:"dst,omitempty"`
 }
 
+// the selections in one interval of the window
+type SelectionEntropyExport struct {
+	IntervalOffsetMillis int64 `json:"interval_offset_millis"`
+	SelectionCount int `json:"selection_count"`
+	MeanEntropy float64 `json:"mean_entropy"`
+	MinEntropy float64 `json:"min_entropy"`
+	MaxEntropy float64 `json:"max_entropy"`
+	// mean of `log2(egressCount)`, the entropy of an even spread
+	MeanEvenEntropy float64 `json:"mean_even_entropy"`
+}
+
+type EgressReconnectExport struct {
+	EgressId Id `json:"egress_id"`
+	ReconnectCount int `json:"reconnect_count"`
+}
+
+type DstReconnectExport struct {
+	Dst ConnectionTuple `json:"dst"`
+	ReconnectCount int `json:"reconnect_count"`
+}
+
+// the packets to one egress and destination in one interval, for packets that aged out of a bounded window
+type PacketIntervalExport struct {
+	IntervalOffsetMillis int64 `json:"interval_offset_millis"`
+	EgressId Id `json:"egress_id"`
+	Dst ConnectionTuple `json:"dst"`
+	PacketCount int `json:"packet_count"`
+	ByteCount int64 `json:"byte_count"`
+}
+
 type PacketIntervalWindowExport struct {
+	// the `EgressRandomSettings` seed of the run
+	Seed int64 `json:"seed"`
+	// the distinct packet connection tuples, when the tuples are interned
+	ConnectionTuples []ConnectionTuple `json:"connection_tuples,omitempty"`
 	Packets []*PacketMetaExport `json:"packets,omitempty"`
+	// the packets older than `Packets`, when the window is bounded. In interval order
+	PacketIntervals []*PacketIntervalExport `json:"packet_intervals,omitempty"`
 	Events []*EventMetaExport `json:"events,omitempty"`
+	SelectionEntropies []*SelectionEntropyExport `json:"selection_entropies,omitempty"`
+	// reconnects away from each egress, in egress id order
+	EgressReconnects []*EgressReconnectExport `json:"egress_reconnects,omitempty"`
+	// reconnects for each destination, in destination order
+	DstReconnects []*DstReconnectExport `json:"dst_reconnects,omitempty"`
+}
+
+type egressDstKey struct {
+	egressId Id
+	dst ConnectionTuple
+}
+
+type egressConnectionTupleKey struct {
+	egressId Id
+	dst ConnectionTuple
+	connectionTuple ConnectionTuple
+}
+
+type packetIntervalKey struct {
+	// interval index since the start time
+	index int64
+	egressId Id
+	dst ConnectionTuple
+}
+
+type packetInterval struct {
+	packetCount int
+	byteCount int64
 }
 
 type PacketIntervalWindow struct {
 	startTime time.Time
 	interval time.Duration
 	duration time.Duration
+	bounded bool
 
 	stateLock sync.Mutex
+	// all packets are kept for the export, or when bounded, the packets over the last `duration`
 	packetMetas []*PacketMeta
+	// when bounded, the packets older than `packetMetas`
+	packetIntervals map[packetIntervalKey]*packetInterval
+	packetCount int
+	// when bounded, the next time to move old packets into `packetIntervals`
+	nextAggregateTime time.Time
 	eventMetas []*EventMeta
+	selectionMetas []*SelectionMeta
+	// reconnects are also kept as events for the export
+	reconnectCounts map[Id]int
+	reconnectCountsToDst map[ConnectionTuple]int
+
+	// indexes of `packetMetas` for the windowed queries, over the last `duration`
+	netTransfers *MovingWindow[Id]
+	netTransfersToDst *MovingWindow[egressDstKey]
+	connectionTuples *MovingWindow[egressConnectionTupleKey]
+	lastTransferTimes map[Id]time.Time
 }
 
 func NewPacketIntervalWindow(interval time.Duration, duration time.Duration) *PacketIntervalWindow {
@@ -935,15 +1293,90 @@ func NewPacketIntervalWindow(interval time.Duration, duration time.Duration) *Pa
 		startTime: time.Now(),
 		interval: interval,
 		duration: duration,
+		netTransfers: NewMovingWindow[Id](interval, duration),
+		netTransfersToDst: NewMovingWindow[egressDstKey](interval, duration),
+		connectionTuples: NewMovingWindow[egressConnectionTupleKey](interval, duration),
+		lastTransferTimes: map[Id]time.Time{},
+		reconnectCounts: map[Id]int{},
+		reconnectCountsToDst: map[ConnectionTuple]int{},
+		packetIntervals: map[packetIntervalKey]*packetInterval{},
 	}
 }
 
+// keeps the packets over the last `duration` individually,
+// and aggregates older packets into interval buckets per egress and destination.
+// The windowed stats cover the last `duration`, so they are the same as an unbounded window.
+// The export has the aggregated packets in `PacketIntervals`
+func NewBoundedPacketIntervalWindow(interval time.Duration, duration time.Duration) *PacketIntervalWindow {
+	packetIntervalWindow := NewPacketIntervalWindow(interval, duration)
+	packetIntervalWindow.bounded = true
+	return packetIntervalWindow
+}
+
 func (self *PacketIntervalWindow) AddPacket(packetMeta *PacketMeta) {
 	// fmt.Printf("Packet\n")
 	self.stateLock.Lock()
 	defer self.stateLock.Unlock()
 
 	self.packetMetas = append(self.packetMetas, packetMeta)
+	self.packetCount += 1
+	if self.bounded && !packetMeta.eventTime.Before(self.nextAggregateTime) {
+		self.aggregatePackets(packetMeta.eventTime.Add(-self.duration))
+		self.nextAggregateTime = packetMeta.eventTime.Add(self.interval)
+	}
+
+	self.netTransfers.Add(packetMeta.eventTime, packetMeta.dstClientId, packetMeta.size)
+	self.netTransfersToDst.Add(
+		packetMeta.eventTime,
+		egressDstKey{
+			egressId: packetMeta.dstClientId,
+			dst: packetMeta.dst,
+		},
+		packetMeta.size,
+	)
+	self.connectionTuples.Add(
+		packetMeta.eventTime,
+		egressConnectionTupleKey{
+			egressId: packetMeta.dstClientId,
+			dst: packetMeta.dst,
+			connectionTuple: packetMeta.connectionTuple,
+		},
+		1,
+	)
+	if lastTransferTime, ok := self.lastTransferTimes[packetMeta.dstClientId]; !ok || lastTransferTime.Before(packetMeta.eventTime) {
+		self.lastTransferTimes[packetMeta.dstClientId] = packetMeta.eventTime
+	}
+}
+
+// moves the packets before `endTime` into `packetIntervals`
+// must be called with the state lock
+func (self *PacketIntervalWindow) aggregatePackets(endTime time.Time) {
+	self.packetMetas = slices.DeleteFunc(self.packetMetas, func(packetMeta *PacketMeta)(bool) {
+		if !packetMeta.eventTime.Before(endTime) {
+			return false
+		}
+		key := packetIntervalKey{
+			index: int64(packetMeta.eventTime.Sub(self.startTime) / self.interval),
+			egressId: packetMeta.dstClientId,
+			dst: packetMeta.dst,
+		}
+		bucket, ok := self.packetIntervals[key]
+		if !ok {
+			bucket = &packetInterval{}
+			self.packetIntervals[key] = bucket
+		}
+		bucket.packetCount += 1
+		bucket.byteCount += packetMeta.size
+		return true
+	})
+}
+
+// the packets kept individually
+func (self *PacketIntervalWindow) PacketMetaCount() int {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return len(self.packetMetas)
 }
 
 func (self *PacketIntervalWindow) AddEvent(eventMeta *EventMeta) {
@@ -953,6 +1386,43 @@ func (self *PacketIntervalWindow) AddEvent(eventMeta *EventMeta) {
 	self.eventMetas = append(self.eventMetas, eventMeta)
 }
 
+func (self *PacketIntervalWindow) AddSelection(selectionMeta *SelectionMeta) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.selectionMetas = append(self.selectionMetas, selectionMeta)
+}
+
+func (self *PacketIntervalWindow) AddReconnect(reconnectMeta *ReconnectMeta) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.eventMetas = append(self.eventMetas, &EventMeta{
+		eventTime: reconnectMeta.eventTime,
+		eventType: EventTypeReconnect,
+		clientId: reconnectMeta.egressId,
+		dst: reconnectMeta.dst,
+	})
+	self.reconnectCounts[reconnectMeta.egressId] += 1
+	self.reconnectCountsToDst[reconnectMeta.dst] += 1
+}
+
+// reconnects away from the egress over the run
+func (self *PacketIntervalWindow) ReconnectCount(egressId Id) int {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return self.reconnectCounts[egressId]
+}
+
+// reconnects for the destination over the run
+func (self *PacketIntervalWindow) ReconnectCountToDst(dst ConnectionTuple) int {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return self.reconnectCountsToDst[dst]
+}
+
 func (self *PacketIntervalWindow) NetTransfer(egressId Id, egressStatsWindow time.Duration) int64 {
 	self.stateLock.Lock()
 	defer self.stateLock.Unlock()
@@ -960,14 +1430,16 @@ func (self *PacketIntervalWindow) NetTransfer(egressId Id, egressStatsWindow tim
 	endTime := time.Now()
 	startTime := endTime.Add(-egressStatsWindow)
 
-	net := int64(0)
-	for _, packetMeta := range self.packetMetas {
-		if packetMeta.dstClientId == egressId && !startTime.After(packetMeta.eventTime) && packetMeta.eventTime.Before(endTime) {
-			net += packetMeta.size
-		}
-	}
+	return self.netTransfers.Sum(egressId, startTime, endTime)
+}
 
-	return net
+// the time of the last transfer to the egress, if any
+func (self *PacketIntervalWindow) LastTransferTime(egressId Id) (time.Time, bool) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	lastTransferTime, ok := self.lastTransferTimes[egressId]
+	return lastTransferTime, ok
 }
 
 func (self *PacketIntervalWindow) NetTransferToDst(egressId Id, egressStatsWindow time.Duration, dst ConnectionTuple) int64 {
@@ -977,14 +1449,14 @@ func (self *PacketIntervalWindow) NetTransferToDst(egressId Id, egressStatsWindo
 	endTime := time.Now()
 	startTime := endTime.Add(-egressStatsWindow)
 
-	netToDst := int64(0)
-	for _, packetMeta := range self.packetMetas {
-		if packetMeta.dstClientId == egressId && dst == packetMeta.dst && !startTime.After(packetMeta.eventTime) && packetMeta.eventTime.Before(endTime) {
-			netToDst += packetMeta.size
-		}
-	}
-
-	return netToDst
+	return self.netTransfersToDst.Sum(
+		egressDstKey{
+			egressId: egressId,
+			dst: dst,
+		},
+		startTime,
+		endTime,
+	)
 }
 
 func (self *PacketIntervalWindow) GetConnectionTuplesForDst(dst ConnectionTuple, egressIds map[Id]bool, egressStatsWindow time.Duration) []ConnectionTuple {
@@ -995,9 +1467,9 @@ func (self *PacketIntervalWindow) GetConnectionTuplesForDst(dst ConnectionTuple,
 	startTime := endTime.Add(-egressStatsWindow)
 
 	connectionTuples := map[ConnectionTuple]bool{}
-	for _, packetMeta := range self.packetMetas {
-		if !startTime.After(packetMeta.eventTime) && packetMeta.eventTime.Before(endTime) && dst == packetMeta.dst && egressIds[packetMeta.dstClientId] {
-			connectionTuples[packetMeta.connectionTuple] = true
+	for key, _ := range self.connectionTuples.Sums(startTime, endTime) {
+		if dst == key.dst && egressIds[key.egressId] {
+			connectionTuples[key.connectionTuple] = true
 		}
 	}
 
@@ -1008,28 +1480,53 @@ func (self *PacketIntervalWindow) PrintSummary() {
 	self.stateLock.Lock()
 	defer self.stateLock.Unlock()
 
+	reconnectCount := 0
+	for _, count := range self.reconnectCounts {
+		reconnectCount += count
+	}
+
 	fmt.Printf(
-		"Done. %d packets. %d events.\n",
-		len(self.packetMetas),
+		"Done. %d packets. %d events. %d selections. %d reconnects.\n",
+		self.packetCount,
 		len(self.eventMetas),
+		len(self.selectionMetas),
+		reconnectCount,
 	)
 }
 
-func (self *PacketIntervalWindow) Export() *PacketIntervalWindowExport {
+// when `internConnectionTuples` is set, each distinct packet connection tuple is written once
+// to `ConnectionTuples` and packets reference the tuple by index.
+// This shrinks the export for long runs, where the same tuple repeats across many packets.
+// Use `LoadPacketIntervalWindowExport` to read either form.
+func (self *PacketIntervalWindow) Export(internConnectionTuples bool) *PacketIntervalWindowExport {
 	self.stateLock.Lock()
 	defer self.stateLock.Unlock()
 
+	var connectionTuples []ConnectionTuple
+	connectionTupleIndexes := map[ConnectionTuple]int{}
+
 	packets := []*PacketMetaExport{}
 	for _, packetMeta := range self.packetMetas {
 		packet := &PacketMetaExport{
 			EventTimeOffsetMillis: int64(packetMeta.eventTime.Sub(self.startTime) / time.Millisecond),
 			SrcClientId: packetMeta.srcClientId,
 			DstClientId: packetMeta.dstClientId,
-			ConnectionTuple: packetMeta.connectionTuple,
 			Index: packetMeta.index,
 			Size: packetMeta.size,
 			SeqSize: packetMeta.seqSize,
 		}
+		if internConnectionTuples {
+			connectionTupleIndex, ok := connectionTupleIndexes[packetMeta.connectionTuple]
+			if !ok {
+				connectionTupleIndex = len(connectionTuples)
+				connectionTuples = append(connectionTuples, packetMeta.connectionTuple)
+				connectionTupleIndexes[packetMeta.connectionTuple] = connectionTupleIndex
+			}
+			packet.ConnectionTupleIndex = &connectionTupleIndex
+		} else {
+			connectionTuple := packetMeta.connectionTuple
+			packet.ConnectionTuple = &connectionTuple
+		}
 		packets = append(packets, packet)
 	}
 	slices.SortStableFunc(packets, func(a *PacketMetaExport, b *PacketMetaExport)(int) {
@@ -1066,9 +1563,163 @@ func (self *PacketIntervalWindow) Export() *PacketIntervalWindowExport {
 	})
 
 	return &PacketIntervalWindowExport{
+		ConnectionTuples: connectionTuples,
 		Packets: packets,
+		PacketIntervals: self.exportPacketIntervals(),
 		Events: events,
+		SelectionEntropies: self.exportSelectionEntropies(),
+		EgressReconnects: self.exportEgressReconnects(),
+		DstReconnects: self.exportDstReconnects(),
+	}
+}
+
+// must be called with the state lock
+func (self *PacketIntervalWindow) exportEgressReconnects() []*EgressReconnectExport {
+	egressReconnects := []*EgressReconnectExport{}
+	for egressId, reconnectCount := range self.reconnectCounts {
+		egressReconnects = append(egressReconnects, &EgressReconnectExport{
+			EgressId: egressId,
+			ReconnectCount: reconnectCount,
+		})
+	}
+	slices.SortFunc(egressReconnects, func(a *EgressReconnectExport, b *EgressReconnectExport)(int) {
+		c := a.EgressId - b.EgressId
+		if c < 0 {
+			return -1
+		} else if 0 < c {
+			return 1
+		} else {
+			return 0
+		}
+	})
+	return egressReconnects
+}
+
+// in interval, egress, and destination order
+// must be called with the state lock
+func (self *PacketIntervalWindow) exportPacketIntervals() []*PacketIntervalExport {
+	packetIntervals := []*PacketIntervalExport{}
+	for key, packetInterval := range self.packetIntervals {
+		packetIntervals = append(packetIntervals, &PacketIntervalExport{
+			IntervalOffsetMillis: int64(time.Duration(key.index) * self.interval / time.Millisecond),
+			EgressId: key.egressId,
+			Dst: key.dst,
+			PacketCount: packetInterval.packetCount,
+			ByteCount: packetInterval.byteCount,
+		})
 	}
+	slices.SortFunc(packetIntervals, func(a *PacketIntervalExport, b *PacketIntervalExport)(int) {
+		c := a.IntervalOffsetMillis - b.IntervalOffsetMillis
+		if c == 0 {
+			c = int64(a.EgressId - b.EgressId)
+		}
+		if c == 0 {
+			c = int64(a.Dst.DstIp - b.Dst.DstIp)
+		}
+		if c == 0 {
+			c = int64(a.Dst.DstPort - b.Dst.DstPort)
+		}
+		if c < 0 {
+			return -1
+		} else if 0 < c {
+			return 1
+		} else {
+			return 0
+		}
+	})
+	return packetIntervals
+}
+
+// must be called with the state lock
+func (self *PacketIntervalWindow) exportDstReconnects() []*DstReconnectExport {
+	dstReconnects := []*DstReconnectExport{}
+	for dst, reconnectCount := range self.reconnectCountsToDst {
+		dstReconnects = append(dstReconnects, &DstReconnectExport{
+			Dst: dst,
+			ReconnectCount: reconnectCount,
+		})
+	}
+	slices.SortFunc(dstReconnects, func(a *DstReconnectExport, b *DstReconnectExport)(int) {
+		c := a.Dst.DstIp - b.Dst.DstIp
+		if c == 0 {
+			c = Id(a.Dst.DstPort - b.Dst.DstPort)
+		}
+		if c < 0 {
+			return -1
+		} else if 0 < c {
+			return 1
+		} else {
+			return 0
+		}
+	})
+	return dstReconnects
+}
+
+// reads an export written by `Export`, with or without interned tuples.
+// Interned tuples are resolved so that each packet has its `ConnectionTuple`,
+// which makes the loaded export the same as one exported without interning.
+func LoadPacketIntervalWindowExport(exportBytes []byte) (*PacketIntervalWindowExport, error) {
+	var export PacketIntervalWindowExport
+	if err := json.Unmarshal(exportBytes, &export); err != nil {
+		return nil, err
+	}
+	for _, packet := range export.Packets {
+		if packet.ConnectionTupleIndex == nil {
+			continue
+		}
+		connectionTupleIndex := *packet.ConnectionTupleIndex
+		if connectionTupleIndex < 0 || len(export.ConnectionTuples) <= connectionTupleIndex {
+			return nil, fmt.Errorf("Connection tuple index out of range: %d", connectionTupleIndex)
+		}
+		connectionTuple := export.ConnectionTuples[connectionTupleIndex]
+		packet.ConnectionTuple = &connectionTuple
+		packet.ConnectionTupleIndex = nil
+	}
+	export.ConnectionTuples = nil
+	return &export, nil
+}
+
+// aggregates the selections per interval, in interval order
+// must be called with the state lock
+func (self *PacketIntervalWindow) exportSelectionEntropies() []*SelectionEntropyExport {
+	intervalSelections := map[int64]*SelectionEntropyExport{}
+	for _, selectionMeta := range self.selectionMetas {
+		intervalIndex := int64(selectionMeta.eventTime.Sub(self.startTime) / self.interval)
+		selection, ok := intervalSelections[intervalIndex]
+		if !ok {
+			selection = &SelectionEntropyExport{
+				IntervalOffsetMillis: int64(time.Duration(intervalIndex) * self.interval / time.Millisecond),
+				MinEntropy: selectionMeta.entropy,
+				MaxEntropy: selectionMeta.entropy,
+			}
+			intervalSelections[intervalIndex] = selection
+		}
+		selection.SelectionCount += 1
+		// sums are divided by the count below
+		selection.MeanEntropy += selectionMeta.entropy
+		selection.MinEntropy = min(selection.MinEntropy, selectionMeta.entropy)
+		selection.MaxEntropy = max(selection.MaxEntropy, selectionMeta.entropy)
+		if 0 < selectionMeta.egressCount {
+			selection.MeanEvenEntropy += math.Log2(float64(selectionMeta.egressCount))
+		}
+	}
+
+	selections := maps.Values(intervalSelections)
+	for _, selection := range selections {
+		selection.MeanEntropy /= float64(selection.SelectionCount)
+		selection.MeanEvenEntropy /= float64(selection.SelectionCount)
+	}
+	slices.SortFunc(selections, func(a *SelectionEntropyExport, b *SelectionEntropyExport)(int) {
+		c := a.IntervalOffsetMillis - b.IntervalOffsetMillis
+		if c < 0 {
+			return -1
+		} else if 0 < c {
+			return 1
+		} else {
+			return 0
+		}
+	})
+	return selections
 }
 
 
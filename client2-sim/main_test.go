@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	mathrand "math/rand"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+
+func TestEgressCloseNoGoroutineLeak(t *testing.T) {
+	// egresses expanded and contracted out of the window stop their background goroutines
+	// while the sim context is still open
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, 1 * time.Second)
+	rand := &EgressRandomSettings{}
+
+	baselineGoroutineCount := runtime.NumGoroutine()
+
+	for i := 0; i < 64; i += 1 {
+		egresses := []*Egress{}
+		for j := 0; j < 16; j += 1 {
+			egresses = append(egresses, NewEgress(ctx, NewId(), time.Hour, rand, mathrand.New(mathrand.NewSource(0)), stats))
+		}
+		for _, egress := range egresses {
+			egress.Close()
+		}
+	}
+
+	endTime := time.Now().Add(5 * time.Second)
+	for baselineGoroutineCount < runtime.NumGoroutine() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if goroutineCount := runtime.NumGoroutine(); baselineGoroutineCount < goroutineCount {
+		t.Fatalf("Goroutine leak: %d > %d", goroutineCount, baselineGoroutineCount)
+	}
+}
+
+
+func TestEgressStatsToDstWindowStability(t *testing.T) {
+	// egress a sends to the destination sparsely, egress b never does.
+	// Both have the same net transfer to other destinations.
+	// Sweep the per destination window and evaluate the choice probability of a
+	// at offsets across one period of the sparse sends.
+	// A window shorter than the period swings between the stats and the estimate,
+	// while a longer window keeps a stable preference for a
+
+	sendSize := 1000
+	sendDuration := 5 * time.Second
+	dstPeriod := 20 * time.Second
+	history := 120 * time.Second
+
+	a := &Egress{EgressId: NewId()}
+	b := &Egress{EgressId: NewId()}
+	egressWindow := []*Egress{a, b}
+
+	connectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+	dst := connectionTuple.Dst()
+	otherConnectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+	otherDst := otherConnectionTuple.Dst()
+
+	// the stats with the history shifted back by `offset`
+	newStats := func(offset time.Duration) *PacketIntervalWindow {
+		stats := NewPacketIntervalWindow(10 * time.Millisecond, history)
+		now := time.Now()
+		for d := time.Duration(0); d < history; d += time.Second {
+			for _, egress := range egressWindow {
+				stats.AddPacket(&PacketMeta{
+					eventTime: now.Add(-offset - d),
+					dstClientId: egress.EgressId,
+					dst: otherDst,
+					size: int64(sendSize),
+				})
+			}
+		}
+		for d := dstPeriod / 4; d < history; d += dstPeriod {
+			stats.AddPacket(&PacketMeta{
+				eventTime: now.Add(-offset - d),
+				dstClientId: a.EgressId,
+				dst: dst,
+				size: int64(10 * sendSize),
+			})
+		}
+		return stats
+	}
+
+	swing := func(egressStatsToDstWindow time.Duration) float64 {
+		egressStatsWindow := 15 * time.Second
+		hopWindow := &StatisticalHopWindow{
+			egressStatsWindow: egressStatsWindow,
+			egressStatsToDstWindow: egressStatsToDstWindow,
+			egressStatsWindowEstimateNetTransfer: int64(0.1 * float64(sendSize) * float64(egressStatsWindow) / float64(sendDuration)),
+			egressStatsWindowEstimateNetTransferToDst: int64(0.1 * float64(sendSize) * float64(egressStatsToDstWindow) / float64(sendDuration)),
+			dstWeight: 0.75,
+		}
+		minP := 1.0
+		maxP := 0.0
+		for offset := time.Duration(0); offset < dstPeriod; offset += time.Second {
+			ps := hopWindow.egressProbabilities(newStats(offset), egressWindow, dst)
+			minP = min(minP, ps[0])
+			maxP = max(maxP, ps[0])
+		}
+		t.Logf("dst window %s: p(a) in [%.2f, %.2f]", egressStatsToDstWindow, minP, maxP)
+		return maxP - minP
+	}
+
+	shortSwing := swing(15 * time.Second)
+	longSwing := swing(45 * time.Second)
+	swing(90 * time.Second)
+
+	if longSwing >= shortSwing {
+		t.Fatalf("Longer dst window should be more stable: %.2f >= %.2f", longSwing, shortSwing)
+	}
+}
+
+
+func TestSelectionEntropyExport(t *testing.T) {
+	interval := 100 * time.Millisecond
+	stats := NewPacketIntervalWindow(interval, time.Minute)
+
+	connectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+	dst := connectionTuple.Dst()
+
+	// collapsed to one egress
+	stats.AddSelection(&SelectionMeta{
+		eventTime: stats.startTime,
+		dst: dst,
+		egressCount: 4,
+		entropy: selectionEntropy([]float64{1, 0, 0, 0}),
+	})
+	// even spread
+	stats.AddSelection(&SelectionMeta{
+		eventTime: stats.startTime.Add(interval / 2),
+		dst: dst,
+		egressCount: 4,
+		entropy: selectionEntropy([]float64{0.25, 0.25, 0.25, 0.25}),
+	})
+	stats.AddSelection(&SelectionMeta{
+		eventTime: stats.startTime.Add(3 * interval),
+		dst: dst,
+		egressCount: 2,
+		entropy: selectionEntropy([]float64{0.5, 0.5}),
+	})
+
+	selections := stats.Export(false).SelectionEntropies
+	if len(selections) != 2 {
+		t.Fatalf("Expected 2 intervals: %d", len(selections))
+	}
+
+	first := selections[0]
+	if first.IntervalOffsetMillis != 0 || first.SelectionCount != 2 {
+		t.Fatalf("Unexpected first interval: %+v", first)
+	}
+	if first.MinEntropy != 0 || first.MaxEntropy != 2 || first.MeanEntropy != 1 || first.MeanEvenEntropy != 2 {
+		t.Fatalf("Unexpected first interval entropy: %+v", first)
+	}
+
+	second := selections[1]
+	if second.IntervalOffsetMillis != int64(3 * interval / time.Millisecond) || second.SelectionCount != 1 {
+		t.Fatalf("Unexpected second interval: %+v", second)
+	}
+	if second.MeanEntropy != 1 || second.MeanEvenEntropy != 1 {
+		t.Fatalf("Unexpected second interval entropy: %+v", second)
+	}
+}
+
+
+func TestEgressEstimateDecay(t *testing.T) {
+	// a dead egress with no transfer is credited a decaying estimate,
+	// so its choice probability decreases the longer it is idle
+
+	sendSize := 1000
+	sendDuration := 5 * time.Second
+	egressStatsWindow := 15 * time.Second
+
+	connectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+	dst := connectionTuple.Dst()
+	otherConnectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+	otherDst := otherConnectionTuple.Dst()
+
+	hopWindow := &StatisticalHopWindow{
+		egressStatsWindow: egressStatsWindow,
+		egressStatsToDstWindow: egressStatsWindow,
+		egressStatsWindowEstimateNetTransfer: int64(0.1 * float64(sendSize) * float64(egressStatsWindow) / float64(sendDuration)),
+		egressStatsWindowEstimateNetTransferToDst: int64(0.1 * float64(sendSize) * float64(egressStatsWindow) / float64(sendDuration)),
+		dstWeight: 0.75,
+		egressStatsEstimateDecayHalfLife: 30 * time.Second,
+		egressStatsEstimateMinFraction: 0,
+	}
+
+	now := time.Now()
+	live := &Egress{
+		EgressId: NewId(),
+		CreateTime: now.Add(-time.Hour),
+	}
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, time.Hour)
+	for d := time.Duration(0); d < egressStatsWindow; d += time.Second {
+		stats.AddPacket(&PacketMeta{
+			eventTime: now.Add(-d),
+			dstClientId: live.EgressId,
+			dst: otherDst,
+			size: int64(sendSize),
+		})
+	}
+
+	previousP := 1.0
+	for _, idleDuration := range []time.Duration{0, 30 * time.Second, 60 * time.Second, 120 * time.Second} {
+		dead := &Egress{
+			EgressId: NewId(),
+			CreateTime: now.Add(-idleDuration),
+		}
+		ps := hopWindow.egressProbabilities(stats, []*Egress{live, dead}, dst)
+		t.Logf("idle %s: p(dead) = %.3f", idleDuration, ps[1])
+		if previousP <= ps[1] {
+			t.Fatalf("Dead egress probability should decay: %.3f <= %.3f", previousP, ps[1])
+		}
+		previousP = ps[1]
+	}
+
+	// with no decay the dead egress keeps the full estimate
+	hopWindow.egressStatsEstimateDecayHalfLife = 0
+	fresh := hopWindow.egressProbabilities(stats, []*Egress{live, &Egress{EgressId: NewId(), CreateTime: now}}, dst)
+	old := hopWindow.egressProbabilities(stats, []*Egress{live, &Egress{EgressId: NewId(), CreateTime: now.Add(-time.Hour)}}, dst)
+	if 0.001 < math.Abs(fresh[1] - old[1]) {
+		t.Fatalf("No decay should not depend on idle time: %.3f <> %.3f", fresh[1], old[1])
+	}
+}
+
+
+func TestEgressIdleSweep(t *testing.T) {
+	// idle egresses are removed below the max size, but not below the initial size
+
+	egressIdleWindow := 60 * time.Second
+
+	hopWindow := &StatisticalHopWindow{
+		egressWindowSize: 2,
+		egressWindowMaxSize: 10,
+		egressIdleWindow: egressIdleWindow,
+	}
+
+	now := time.Now()
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, time.Hour)
+	connectionTuple := NewConnectionTuple(NewId(), 0, NewId(), 443)
+
+	newEgress := func(age time.Duration, active bool) *Egress {
+		egress := &Egress{
+			EgressId: NewId(),
+			CreateTime: now.Add(-age),
+		}
+		if active {
+			stats.AddPacket(&PacketMeta{
+				eventTime: now.Add(-time.Second),
+				dstClientId: egress.EgressId,
+				connectionTuple: connectionTuple,
+				dst: connectionTuple.Dst(),
+				size: 1000,
+			})
+		}
+		return egress
+	}
+
+	active := newEgress(time.Hour, true)
+	idleOld := newEgress(3 * time.Hour, false)
+	idle := newEgress(2 * time.Hour, false)
+	// newer than the idle window
+	idleNew := newEgress(egressIdleWindow / 2, false)
+
+	idleEgresses := hopWindow.idleEgresses(stats, []*Egress{active, idle, idleNew, idleOld})
+	if len(idleEgresses) != 2 || idleEgresses[0] != idleOld || idleEgresses[1] != idle {
+		t.Fatalf("Expected the idle egresses oldest first: %v", idleEgresses)
+	}
+
+	idleEgresses = hopWindow.idleEgresses(stats, []*Egress{active, idle, idleOld})
+	if len(idleEgresses) != 1 || idleEgresses[0] != idleOld {
+		t.Fatalf("Expected the window to stay at the initial size: %v", idleEgresses)
+	}
+
+	idleEgresses = hopWindow.idleEgresses(stats, []*Egress{active, idle})
+	if len(idleEgresses) != 0 {
+		t.Fatalf("Expected no eviction at the initial size: %v", idleEgresses)
+	}
+
+	hopWindow.egressIdleWindow = 0
+	idleEgresses = hopWindow.idleEgresses(stats, []*Egress{active, idle, idleNew, idleOld})
+	if len(idleEgresses) != 0 {
+		t.Fatalf("Expected no eviction when disabled: %v", idleEgresses)
+	}
+}
+
+
+func TestEgressRandomSeed(t *testing.T) {
+	// egresses with the same seed make the same drop and block choices
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, 1 * time.Second)
+	rand := &EgressRandomSettings{
+		seed: 1,
+		dropProbabilityPerSecond: 0.5,
+		dropMin: 60 * time.Second,
+		dropMax: 3600 * time.Second,
+		blockProbabilityPerDst: 0.5,
+		blockDelay: 3 * time.Second,
+		blockMin: 60 * time.Second,
+		blockMax: 3600 * time.Second,
+	}
+
+	choices := func(seed int64)([]time.Duration) {
+		egress := NewEgress(ctx, NewId(), time.Hour, rand, mathrand.New(mathrand.NewSource(seed)), stats)
+		defer egress.Close()
+
+		egress.stateLock.Lock()
+		defer egress.stateLock.Unlock()
+
+		durations := []time.Duration{}
+		for i := 0; i < 64; i += 1 {
+			drop := egress.testDrop(time.Second)
+			durations = append(durations, drop.EndTime.Sub(drop.StartTime))
+			block := egress.testBlockPerDst()
+			durations = append(durations, block.EndTime.Sub(block.StartTime))
+		}
+		return durations
+	}
+
+	a := choices(rand.seed)
+	b := choices(rand.seed)
+	if !slices.Equal(a, b) {
+		t.Fatalf("Expected the same choices for the same seed: %v != %v", a, b)
+	}
+	if c := choices(rand.seed + 1); slices.Equal(a, c) {
+		t.Fatalf("Expected different choices for a different seed")
+	}
+}
+
+
+func TestExportInternConnectionTuples(t *testing.T) {
+	// the interned export loads to the same data as the plain export, in fewer bytes
+
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, time.Minute)
+
+	connectionTuples := []ConnectionTuple{}
+	for i := 0; i < 4; i += 1 {
+		connectionTuples = append(connectionTuples, NewConnectionTuple(NewId(), i, NewId(), 443))
+	}
+	egressId := NewId()
+	for i := 0; i < 256; i += 1 {
+		connectionTuple := connectionTuples[i % len(connectionTuples)]
+		stats.AddPacket(&PacketMeta{
+			eventTime: stats.startTime.Add(time.Duration(i) * time.Millisecond),
+			srcClientId: egressId,
+			dstClientId: connectionTuple.SrcIp,
+			connectionTuple: connectionTuple,
+			dst: connectionTuple.Dst(),
+			index: i,
+			size: 1,
+			seqSize: 1,
+		})
+	}
+	stats.AddEvent(&EventMeta{
+		eventTime: stats.startTime,
+		eventType: EventTypeSimEnd,
+	})
+
+	exportBytes, err := json.Marshal(stats.Export(false))
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	internedExport := stats.Export(true)
+	if len(internedExport.ConnectionTuples) != len(connectionTuples) {
+		t.Fatalf("Expected %d interned tuples: %d", len(connectionTuples), len(internedExport.ConnectionTuples))
+	}
+	internedExportBytes, err := json.Marshal(internedExport)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if len(exportBytes) <= len(internedExportBytes) {
+		t.Fatalf("Expected the interned export to be smaller: %d <= %d", len(exportBytes), len(internedExportBytes))
+	}
+
+	export, err := LoadPacketIntervalWindowExport(exportBytes)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	loadedInternedExport, err := LoadPacketIntervalWindowExport(internedExportBytes)
+	if err != nil {
+		t.Fatalf("Load interned: %s", err)
+	}
+	if !reflect.DeepEqual(export, loadedInternedExport) {
+		t.Fatalf("Expected the interned export to load to the same data")
+	}
+	for i, packet := range loadedInternedExport.Packets {
+		if packet.ConnectionTuple == nil || *packet.ConnectionTuple != connectionTuples[i % len(connectionTuples)] {
+			t.Fatalf("Unexpected connection tuple for packet %d: %v", i, packet.ConnectionTuple)
+		}
+	}
+
+	// an index outside the tuples is an error
+	internedExport.Packets[0].ConnectionTupleIndex = &[]int{len(connectionTuples)}[0]
+	internedExportBytes, err = json.Marshal(internedExport)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if _, err := LoadPacketIntervalWindowExport(internedExportBytes); err == nil {
+		t.Fatalf("Expected an error for an out of range tuple index")
+	}
+}
+
+
+func TestBoundedPacketIntervalWindow(t *testing.T) {
+	// a bounded window keeps only the packets over the last duration,
+	// with the same windowed stats as an unbounded window and all packets accounted in the export
+
+	interval := 10 * time.Millisecond
+	duration := 100 * time.Millisecond
+	n := 1000
+
+	stats := NewPacketIntervalWindow(interval, duration)
+	boundedStats := NewBoundedPacketIntervalWindow(interval, duration)
+
+	egressIds := []Id{NewId(), NewId()}
+	dsts := []ConnectionTuple{
+		NewConnectionTuple(NewId(), 1, NewId(), 443),
+		NewConnectionTuple(NewId(), 2, NewId(), 80),
+	}
+	startTime := time.Now().Add(-time.Duration(n) * time.Millisecond)
+	for i := 0; i < n; i += 1 {
+		dst := dsts[i % len(dsts)]
+		packetMeta := &PacketMeta{
+			eventTime: startTime.Add(time.Duration(i) * time.Millisecond),
+			srcClientId: NewId(),
+			dstClientId: egressIds[(i / 3) % len(egressIds)],
+			connectionTuple: dst,
+			dst: dst.Dst(),
+			index: i,
+			size: int64(1 + i % 7),
+			seqSize: 1,
+		}
+		stats.AddPacket(packetMeta)
+		boundedStats.AddPacket(packetMeta)
+	}
+
+	if maxCount := int((duration + interval) / time.Millisecond) + 1; maxCount < boundedStats.PacketMetaCount() {
+		t.Fatalf("Expected at most %d packets kept: %d", maxCount, boundedStats.PacketMetaCount())
+	}
+	if stats.PacketMetaCount() != n {
+		t.Fatalf("Expected %d packets kept: %d", n, stats.PacketMetaCount())
+	}
+
+	for _, egressId := range egressIds {
+		netTransfer := stats.NetTransfer(egressId, duration)
+		if netTransfer == 0 {
+			t.Fatalf("Expected a net transfer")
+		}
+		if boundedNetTransfer := boundedStats.NetTransfer(egressId, duration); boundedNetTransfer != netTransfer {
+			t.Fatalf("Expected the same net transfer: %d <> %d", netTransfer, boundedNetTransfer)
+		}
+		for _, dst := range dsts {
+			netTransferToDst := stats.NetTransferToDst(egressId, duration, dst.Dst())
+			if boundedNetTransferToDst := boundedStats.NetTransferToDst(egressId, duration, dst.Dst()); boundedNetTransferToDst != netTransferToDst {
+				t.Fatalf("Expected the same net transfer to dst: %d <> %d", netTransferToDst, boundedNetTransferToDst)
+			}
+		}
+	}
+
+	export := stats.Export(false)
+	if len(export.PacketIntervals) != 0 {
+		t.Fatalf("Expected no packet intervals: %d", len(export.PacketIntervals))
+	}
+	byteCount := int64(0)
+	for _, packet := range export.Packets {
+		byteCount += packet.Size
+	}
+
+	boundedExport := boundedStats.Export(false)
+	if len(boundedExport.PacketIntervals) == 0 {
+		t.Fatalf("Expected packet intervals")
+	}
+	boundedPacketCount := len(boundedExport.Packets)
+	boundedByteCount := int64(0)
+	for _, packet := range boundedExport.Packets {
+		boundedByteCount += packet.Size
+	}
+	for i, packetInterval := range boundedExport.PacketIntervals {
+		if 0 < i && packetInterval.IntervalOffsetMillis < boundedExport.PacketIntervals[i - 1].IntervalOffsetMillis {
+			t.Fatalf("Expected packet intervals in interval order")
+		}
+		boundedPacketCount += packetInterval.PacketCount
+		boundedByteCount += packetInterval.ByteCount
+	}
+	if boundedPacketCount != n {
+		t.Fatalf("Expected %d packets in the export: %d", n, boundedPacketCount)
+	}
+	if boundedByteCount != byteCount {
+		t.Fatalf("Expected %d bytes in the export: %d", byteCount, boundedByteCount)
+	}
+}
+
+
+func TestSenderReconnectCounts(t *testing.T) {
+	// scripted egresses close the first connections, and each reconnect is counted
+	// for the egress that was left and for the destination
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, time.Minute)
+	rand := &EgressRandomSettings{
+		seed: 1,
+		dropMin: 60 * time.Second,
+		dropMax: 3600 * time.Second,
+		blockDelay: 3 * time.Second,
+		blockMin: 60 * time.Second,
+		blockMax: 3600 * time.Second,
+	}
+	newEgress := func()(*Egress) {
+		return NewEgress(ctx, NewId(), time.Hour, rand, mathrand.New(mathrand.NewSource(rand.seed)), stats)
+	}
+
+	// a closed egress closes each connection
+	closedEgresses := []*Egress{newEgress(), newEgress()}
+	for _, egress := range closedEgresses {
+		egress.Close()
+	}
+	egress := newEgress()
+	defer egress.Close()
+
+	script := []*Egress{closedEgresses[0], closedEgresses[0], closedEgresses[1]}
+	var dst ConnectionTuple
+	connectCount := 0
+	connectEgress := func(connectionTuple ConnectionTuple)(*Egress) {
+		dst = connectionTuple.Dst()
+		connectCount += 1
+		if connectCount <= len(script) {
+			return script[connectCount - 1]
+		}
+		return egress
+	}
+
+	sender := NewSender(ctx, stats, 4, 40 * time.Millisecond)
+	sender.Run(connectEgress)
+
+	if connectCount != len(script) + 1 {
+		t.Fatalf("Expected %d connects: %d", len(script) + 1, connectCount)
+	}
+	if c := stats.ReconnectCount(closedEgresses[0].EgressId); c != 2 {
+		t.Fatalf("Expected 2 reconnects for the first egress: %d", c)
+	}
+	if c := stats.ReconnectCount(closedEgresses[1].EgressId); c != 1 {
+		t.Fatalf("Expected 1 reconnect for the second egress: %d", c)
+	}
+	if c := stats.ReconnectCount(egress.EgressId); c != 0 {
+		t.Fatalf("Expected no reconnects for the open egress: %d", c)
+	}
+	if c := stats.ReconnectCountToDst(dst); c != len(script) {
+		t.Fatalf("Expected %d reconnects for the destination: %d", len(script), c)
+	}
+
+	export := stats.Export(false)
+	expectedEgressReconnects := []EgressReconnectExport{
+		EgressReconnectExport{
+			EgressId: closedEgresses[0].EgressId,
+			ReconnectCount: 2,
+		},
+		EgressReconnectExport{
+			EgressId: closedEgresses[1].EgressId,
+			ReconnectCount: 1,
+		},
+	}
+	if len(export.EgressReconnects) != len(expectedEgressReconnects) {
+		t.Fatalf("Expected %d egress reconnects: %d", len(expectedEgressReconnects), len(export.EgressReconnects))
+	}
+	for i, egressReconnect := range export.EgressReconnects {
+		if *egressReconnect != expectedEgressReconnects[i] {
+			t.Fatalf("Unexpected egress reconnect: %+v != %+v", *egressReconnect, expectedEgressReconnects[i])
+		}
+	}
+	if len(export.DstReconnects) != 1 || export.DstReconnects[0].Dst != dst || export.DstReconnects[0].ReconnectCount != len(script) {
+		t.Fatalf("Unexpected destination reconnects: %+v", export.DstReconnects)
+	}
+
+	reconnectEventCount := 0
+	for _, event := range export.Events {
+		if event.EventType == EventTypeReconnect {
+			reconnectEventCount += 1
+		}
+	}
+	if reconnectEventCount != len(script) {
+		t.Fatalf("Expected %d reconnect events: %d", len(script), reconnectEventCount)
+	}
+}
+
+
+func TestEgressAsymmetricLink(t *testing.T) {
+	// with high reverse loss the egress receives the packets but the echoes are lost,
+	// so the sender times out and reconnects to another egress
+
+	n := 1000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stats := NewPacketIntervalWindow(10 * time.Millisecond, time.Minute)
+	newEgress := func(forwardLossProbability float64, reverseLossProbability float64)(*Egress) {
+		rand := &EgressRandomSettings{
+			seed: 1,
+			dropMin: 60 * time.Second,
+			dropMax: 3600 * time.Second,
+			blockDelay: 3 * time.Second,
+			blockMin: 60 * time.Second,
+			blockMax: 3600 * time.Second,
+			forward: EgressLinkSettings{
+				lossProbability: forwardLossProbability,
+			},
+			reverse: EgressLinkSettings{
+				lossProbability: reverseLossProbability,
+			},
+		}
+		return NewEgress(ctx, NewId(), time.Hour, rand, mathrand.New(mathrand.NewSource(rand.seed)), stats)
+	}
+
+	// lossy reverse path
+	egress := newEgress(0, 0.5)
+	defer egress.Close()
+
+	in := make(chan *Packet)
+	out := make(chan *Packet)
+	egress.Connect(NewConnectionTuple(NewId(), 1, NewId(), 1), in, out)
+	echoCount := 0
+	echoesDone := make(chan struct{})
+	go func() {
+		defer close(echoesDone)
+		for range out {
+			echoCount += 1
+		}
+	}()
+	for i := 0; i < n; i += 1 {
+		in <- NewPacket(i)
+	}
+	close(in)
+	<- echoesDone
+
+	linkCounts := egress.LinkCounts()
+	if linkCounts.ForwardCount != n || linkCounts.ForwardLossCount != 0 {
+		t.Fatalf("Expected no forward loss: %+v", linkCounts)
+	}
+	if linkCounts.ReverseCount != echoCount || linkCounts.ReverseCount + linkCounts.ReverseLossCount != n {
+		t.Fatalf("Unexpected reverse counts (%d echoes): %+v", echoCount, linkCounts)
+	}
+	if linkCounts.ReverseLossCount < 4 * n / 10 || 6 * n / 10 < linkCounts.ReverseLossCount {
+		t.Fatalf("Expected about half reverse loss: %+v", linkCounts)
+	}
+
+	// the sender leaves an egress with total reverse loss
+	lossyEgress := newEgress(0, 1)
+	defer lossyEgress.Close()
+	goodEgress := newEgress(0, 0)
+	defer goodEgress.Close()
+
+	connectCount := 0
+	connectEgress := func(connectionTuple ConnectionTuple)(*Egress) {
+		connectCount += 1
+		if connectCount == 1 {
+			return lossyEgress
+		}
+		return goodEgress
+	}
+
+	size := 4
+	sender := NewSender(ctx, stats, size, 40 * time.Millisecond)
+	sender.Run(connectEgress)
+
+	if connectCount != 2 {
+		t.Fatalf("Expected 2 connects: %d", connectCount)
+	}
+	if c := stats.ReconnectCount(lossyEgress.EgressId); c != 1 {
+		t.Fatalf("Expected 1 reconnect for the lossy egress: %d", c)
+	}
+	if linkCounts := lossyEgress.LinkCounts(); linkCounts.ForwardCount != 1 || linkCounts.ReverseLossCount != 1 || linkCounts.ReverseCount != 0 {
+		t.Fatalf("Unexpected lossy egress counts: %+v", linkCounts)
+	}
+	if linkCounts := goodEgress.LinkCounts(); linkCounts.ForwardCount != size || linkCounts.ReverseCount != size {
+		t.Fatalf("Unexpected good egress counts: %+v", linkCounts)
+	}
+}
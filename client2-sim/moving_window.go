@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+)
+
+
+// Windowed sums by key over a ring of time buckets.
+// A query sums the buckets fully inside the window and scans the samples
+// of the partial buckets at the window edges, so the result matches a scan of all samples
+// for any window within the retained duration. Buckets older than the duration are evicted.
+// Not safe for concurrent use. Callers hold their own lock.
+type MovingWindow[K comparable] struct {
+	interval time.Duration
+	buckets []*movingWindowBucket[K]
+}
+
+type movingWindowBucket[K comparable] struct {
+	// bucket start time is `index * interval` since the unix epoch
+	index int64
+	sums map[K]int64
+	samples []movingWindowSample[K]
+}
+
+type movingWindowSample[K comparable] struct {
+	eventTime time.Time
+	key K
+	value int64
+}
+
+func NewMovingWindow[K comparable](interval time.Duration, duration time.Duration) *MovingWindow[K] {
+	bucketCount := int(duration / interval) + 2
+	return &MovingWindow[K]{
+		interval: interval,
+		buckets: make([]*movingWindowBucket[K], bucketCount),
+	}
+}
+
+func (self *MovingWindow[K]) bucketIndex(eventTime time.Time) int64 {
+	return eventTime.UnixNano() / int64(self.interval)
+}
+
+func (self *MovingWindow[K]) bucket(index int64) *movingWindowBucket[K] {
+	bucket := self.buckets[index % int64(len(self.buckets))]
+	if bucket == nil || bucket.index != index {
+		return nil
+	}
+	return bucket
+}
+
+func (self *MovingWindow[K]) Add(eventTime time.Time, key K, value int64) {
+	index := self.bucketIndex(eventTime)
+	i := index % int64(len(self.buckets))
+	bucket := self.buckets[i]
+	if bucket == nil || bucket.index < index {
+		// evict the expired bucket
+		bucket = &movingWindowBucket[K]{
+			index: index,
+			sums: map[K]int64{},
+		}
+		self.buckets[i] = bucket
+	} else if index < bucket.index {
+		// older than the retained duration
+		return
+	}
+	bucket.sums[key] += value
+	bucket.samples = append(bucket.samples, movingWindowSample[K]{
+		eventTime: eventTime,
+		key: key,
+		value: value,
+	})
+}
+
+// calls `callback` for each bucket sum or sample in `[startTime, endTime)`
+func (self *MovingWindow[K]) each(startTime time.Time, endTime time.Time, bucketCallback func(sums map[K]int64), sampleCallback func(sample *movingWindowSample[K])) {
+	if !startTime.Before(endTime) {
+		return
+	}
+	startIndex := self.bucketIndex(startTime)
+	endIndex := self.bucketIndex(endTime)
+	// only the retained buckets
+	startIndex = max(startIndex, endIndex - int64(len(self.buckets)) + 1)
+	for index := startIndex; index <= endIndex; index += 1 {
+		bucket := self.bucket(index)
+		if bucket == nil {
+			continue
+		}
+		bucketStartTime := time.Unix(0, index * int64(self.interval))
+		bucketEndTime := bucketStartTime.Add(self.interval)
+		if !startTime.After(bucketStartTime) && !bucketEndTime.After(endTime) {
+			bucketCallback(bucket.sums)
+		} else {
+			for i := range bucket.samples {
+				sample := &bucket.samples[i]
+				if !startTime.After(sample.eventTime) && sample.eventTime.Before(endTime) {
+					sampleCallback(sample)
+				}
+			}
+		}
+	}
+}
+
+// the sum for the key in `[startTime, endTime)`
+func (self *MovingWindow[K]) Sum(key K, startTime time.Time, endTime time.Time) int64 {
+	sum := int64(0)
+	self.each(
+		startTime,
+		endTime,
+		func(sums map[K]int64) {
+			sum += sums[key]
+		},
+		func(sample *movingWindowSample[K]) {
+			if sample.key == key {
+				sum += sample.value
+			}
+		},
+	)
+	return sum
+}
+
+// the sums for all keys in `[startTime, endTime)`
+func (self *MovingWindow[K]) Sums(startTime time.Time, endTime time.Time) map[K]int64 {
+	keySums := map[K]int64{}
+	self.each(
+		startTime,
+		endTime,
+		func(sums map[K]int64) {
+			for key, sum := range sums {
+				keySums[key] += sum
+			}
+		},
+		func(sample *movingWindowSample[K]) {
+			keySums[sample.key] += sample.value
+		},
+	)
+	return keySums
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"testing"
+	"time"
+)
+
+
+type movingWindowTestSample struct {
+	eventTime time.Time
+	key int
+	value int64
+}
+
+func naiveSum(samples []movingWindowTestSample, key int, startTime time.Time, endTime time.Time) int64 {
+	sum := int64(0)
+	for _, sample := range samples {
+		if sample.key == key && !startTime.After(sample.eventTime) && sample.eventTime.Before(endTime) {
+			sum += sample.value
+		}
+	}
+	return sum
+}
+
+func newMovingWindowTestSamples(endTime time.Time, duration time.Duration, keyCount int, n int) []movingWindowTestSample {
+	samples := []movingWindowTestSample{}
+	for i := 0; i < n; i += 1 {
+		samples = append(samples, movingWindowTestSample{
+			eventTime: endTime.Add(-time.Duration(mathrand.Int63n(int64(duration)))),
+			key: mathrand.Intn(keyCount),
+			value: 1 + mathrand.Int63n(1500),
+		})
+	}
+	return samples
+}
+
+
+func TestMovingWindowMatchesScan(t *testing.T) {
+	interval := 50 * time.Millisecond
+	duration := 60 * time.Second
+	keyCount := 8
+
+	endTime := time.Now()
+	samples := newMovingWindowTestSamples(endTime, duration, keyCount, 10000)
+
+	movingWindow := NewMovingWindow[int](interval, duration)
+	for _, sample := range samples {
+		movingWindow.Add(sample.eventTime, sample.key, sample.value)
+	}
+
+	for i := 0; i < 200; i += 1 {
+		// windows with edges inside buckets
+		windowEndTime := endTime.Add(-time.Duration(mathrand.Int63n(int64(duration / 4))))
+		window := time.Duration(mathrand.Int63n(int64(duration / 2)))
+		windowStartTime := windowEndTime.Add(-window)
+
+		sums := movingWindow.Sums(windowStartTime, windowEndTime)
+		for key := 0; key < keyCount; key += 1 {
+			expected := naiveSum(samples, key, windowStartTime, windowEndTime)
+			if sum := movingWindow.Sum(key, windowStartTime, windowEndTime); sum != expected {
+				t.Fatalf("Sum [%d] %d <> %d", key, sum, expected)
+			}
+			if sums[key] != expected {
+				t.Fatalf("Sums [%d] %d <> %d", key, sums[key], expected)
+			}
+		}
+	}
+}
+
+
+func TestMovingWindowEvict(t *testing.T) {
+	interval := 100 * time.Millisecond
+	duration := 1 * time.Second
+
+	movingWindow := NewMovingWindow[int](interval, duration)
+
+	startTime := time.Now()
+	movingWindow.Add(startTime, 0, 1)
+	// reuses the ring slot of the first sample
+	evictTime := startTime.Add(time.Duration(len(movingWindow.buckets)) * interval)
+	movingWindow.Add(evictTime, 0, 2)
+
+	if sum := movingWindow.Sum(0, startTime, evictTime.Add(interval)); sum != 2 {
+		t.Fatalf("Expected the first sample to be evicted: %d", sum)
+	}
+	// older than the retained duration
+	movingWindow.Add(startTime, 0, 4)
+	if sum := movingWindow.Sum(0, startTime, evictTime.Add(interval)); sum != 2 {
+		t.Fatalf("Expected the old sample to be dropped: %d", sum)
+	}
+}
+
+
+func BenchmarkMovingWindowSum(b *testing.B) {
+	// the sim queries 15s windows over a 300s retained duration
+
+	interval := 50 * time.Millisecond
+	duration := 300 * time.Second
+	window := 15 * time.Second
+	keyCount := 100
+
+	for _, n := range []int{10000, 100000, 1000000} {
+		endTime := time.Now()
+		samples := newMovingWindowTestSamples(endTime, duration, keyCount, n)
+		movingWindow := NewMovingWindow[int](interval, duration)
+		for _, sample := range samples {
+			movingWindow.Add(sample.eventTime, sample.key, sample.value)
+		}
+		windowStartTime := endTime.Add(-window)
+
+		b.Run(fmt.Sprintf("scan%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i += 1 {
+				naiveSum(samples, i % keyCount, windowStartTime, endTime)
+			}
+		})
+		b.Run(fmt.Sprintf("window%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i += 1 {
+				movingWindow.Sum(i % keyCount, windowStartTime, endTime)
+			}
+		})
+	}
+}
@@ -22,7 +22,8 @@ const defaultHttpConnectTimeout = 5 * time.Second
 const defaultHttpTlsTimeout = 5 * time.Second
 
 
-func defaultClient() *http.Client {
+// see `newTlsPinConfig`
+func newHttpClient(tlsPins []string) *http.Client {
 	// see https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
 	dialer := &net.Dialer{
     	Timeout: defaultHttpConnectTimeout,
@@ -30,6 +31,7 @@ func defaultClient() *http.Client {
 	transport := &http.Transport{
 	  	DialContext: dialer.DialContext,
 	  	TLSHandshakeTimeout: defaultHttpTlsTimeout,
+	  	TLSClientConfig: newTlsPinConfig(tlsPins),
 	}
 	return &http.Client{
 		Transport: transport,
@@ -83,11 +85,27 @@ func NewBlockingApiCallback[R any]() (apiCallback[R], chan ApiCallbackResult[R])
 }
 
 
+func DefaultBringYourApiSettings() *BringYourApiSettings {
+	return &BringYourApiSettings{
+		// pinning is off by default
+		TlsPins: nil,
+	}
+}
+
+
+type BringYourApiSettings struct {
+	// the api connection fails with `ErrTlsPinMismatch` unless the certificate chain matches a pin
+	// see `TlsPin`
+	TlsPins []string
+}
+
+
 type BringYourApi struct {
 	ctx context.Context
 	cancel context.CancelFunc
 
 	apiUrl string
+	settings *BringYourApiSettings
 
 	byJwt string
 }
@@ -99,15 +117,24 @@ func NewBringYourApi(apiUrl string) *BringYourApi {
 }
 
 func NewBringYourApiWithContext(ctx context.Context, apiUrl string) *BringYourApi {
+	return NewBringYourApiWithSettings(ctx, apiUrl, DefaultBringYourApiSettings())
+}
+
+func NewBringYourApiWithSettings(ctx context.Context, apiUrl string, settings *BringYourApiSettings) *BringYourApi {
 	cancelCtx, cancel := context.WithCancel(ctx)
 
 	return &BringYourApi{
 		ctx: cancelCtx,
 		cancel: cancel,
 		apiUrl: apiUrl,
+		settings: settings,
 	}
 }
 
+func (self *BringYourApi) client() *http.Client {
+	return newHttpClient(self.settings.TlsPins)
+}
+
 // this gets attached to api calls that need it
 func (self *BringYourApi) SetByJwt(byJwt string) {
 	self.byJwt = byJwt
@@ -146,6 +173,7 @@ type AuthLoginResultNetwork struct {
 func (self *BringYourApi) AuthLogin(authLogin *AuthLoginArgs, callback AuthLoginCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/auth/login", self.apiUrl),
 		authLogin,
 		self.byJwt,
@@ -184,6 +212,7 @@ type AuthLoginWithPasswordResultError struct {
 func (self *BringYourApi) AuthLoginWithPassword(authLoginWithPassword *AuthLoginWithPasswordArgs, callback AuthLoginWithPasswordCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/auth/login-with-password", self.apiUrl),
 		authLoginWithPassword,
 		self.byJwt,
@@ -216,6 +245,7 @@ type AuthVerifyResultError struct {
 func (self *BringYourApi) AuthVerify(authVerify *AuthVerifyArgs, callback AuthVerifyCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/auth/verify", self.apiUrl),
 		authVerify,
 		self.byJwt,
@@ -238,6 +268,7 @@ type AuthPasswordResetResult struct {
 func (self *BringYourApi) AuthPasswordReset(authPasswordReset *AuthPasswordResetArgs, callback AuthPasswordResetCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/auth/password-reset", self.apiUrl),
 		authPasswordReset,
 		self.byJwt,
@@ -260,6 +291,7 @@ type AuthVerifySendResult struct {
 func (self *BringYourApi) AuthVerifySend(authVerifySend *AuthVerifySendArgs, callback AuthVerifySendCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/auth/verify-send", self.apiUrl),
 		authVerifySend,
 		self.byJwt,
@@ -294,6 +326,7 @@ type AuthNetworkClientError struct {
 func (self *BringYourApi) AuthNetworkClient(authNetworkClient *AuthNetworkClientArgs, callback AuthNetworkClientCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/auth-client", self.apiUrl),
 		authNetworkClient,
 		self.byJwt,
@@ -305,6 +338,7 @@ func (self *BringYourApi) AuthNetworkClient(authNetworkClient *AuthNetworkClient
 func (self *BringYourApi) AuthNetworkClientSync(authNetworkClient *AuthNetworkClientArgs) (*AuthNetworkClientResult, error) {
 	return post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/auth-client", self.apiUrl),
 		authNetworkClient,
 		self.byJwt,
@@ -331,6 +365,7 @@ type RemoveNetworkClientError struct {
 func (self *BringYourApi) RemoveNetworkClient(removeNetworkClient *RemoveNetworkClientArgs, callback RemoveNetworkClientCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/remove-client", self.apiUrl),
 		removeNetworkClient,
 		self.byJwt,
@@ -342,6 +377,7 @@ func (self *BringYourApi) RemoveNetworkClient(removeNetworkClient *RemoveNetwork
 func (self *BringYourApi) RemoveNetworkClientSync(removeNetworkClient *RemoveNetworkClientArgs) (*RemoveNetworkClientResult, error) {
 	return post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/remove-client", self.apiUrl),
 		removeNetworkClient,
 		self.byJwt,
@@ -377,6 +413,7 @@ type FindProvidersProvider struct {
 func (self *BringYourApi) FindProviders2(findProviders2 *FindProviders2Args, callback FindProviders2Callback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/find-providers2", self.apiUrl),
 		findProviders2,
 		self.byJwt,
@@ -388,6 +425,7 @@ func (self *BringYourApi) FindProviders2(findProviders2 *FindProviders2Args, cal
 func (self *BringYourApi) FindProviders2Sync(findProviders2 *FindProviders2Args) (*FindProviders2Result, error) {
 	return post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/network/find-providers2", self.apiUrl),
 		findProviders2,
 		self.byJwt,
@@ -415,6 +453,7 @@ type ConnectControlError struct {
 func (self *BringYourApi) ConnectControl(connectControl *ConnectControlArgs, callback ConnectControlCallback) {
 	go post(
 		self.ctx,
+		self.client(),
 		fmt.Sprintf("%s/connect/control", self.apiUrl),
 		connectControl,
 		self.byJwt,
@@ -424,7 +463,7 @@ func (self *BringYourApi) ConnectControl(connectControl *ConnectControlArgs, cal
 }
 
 
-func post[R any](ctx context.Context, url string, args any, byJwt string, result R, callback apiCallback[R]) (R, error) {
+func post[R any](ctx context.Context, client *http.Client, url string, args any, byJwt string, result R, callback apiCallback[R]) (R, error) {
 	var requestBodyBytes []byte
 	if args == nil {
 		requestBodyBytes = make([]byte, 0)
@@ -452,7 +491,6 @@ func post[R any](ctx context.Context, url string, args any, byJwt string, result
 		req.Header.Add("Authorization", auth)
 	}
 
-	client := defaultClient()
 	r, err := client.Do(req)
 	if err != nil {
 		var empty R
@@ -488,7 +526,7 @@ func post[R any](ctx context.Context, url string, args any, byJwt string, result
 }
 
 
-func get[R any](ctx context.Context, url string, byJwt string, result R, callback apiCallback[R]) (R, error) {
+func get[R any](ctx context.Context, client *http.Client, url string, byJwt string, result R, callback apiCallback[R]) (R, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		var empty R
@@ -503,7 +541,6 @@ func get[R any](ctx context.Context, url string, byJwt string, result R, callbac
 		req.Header.Add("Authorization", auth)
 	}
 
-	client := defaultClient()
 	r, err := client.Do(req)
 	if err != nil {
 		var empty R
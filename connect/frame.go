@@ -32,6 +32,8 @@ func ToFrame(message proto.Message) (*protocol.Frame, error) {
         messageType = protocol.MessageType_TransferStreamOpen
     case *protocol.StreamClose:
         messageType = protocol.MessageType_TransferStreamClose
+    case *protocol.StreamChunk:
+        messageType = protocol.MessageType_TransferStreamChunk
     case *protocol.CreateContract:
         messageType = protocol.MessageType_TransferCreateContract
     case *protocol.CreateContractResult:
@@ -94,6 +96,8 @@ func FromFrame(frame *protocol.Frame) (proto.Message, error) {
         message = &protocol.StreamOpen{}
     case protocol.MessageType_TransferStreamClose:
         message = &protocol.StreamClose{}
+    case protocol.MessageType_TransferStreamChunk:
+        message = &protocol.StreamChunk{}
     case protocol.MessageType_TransferCreateContract:
         message = &protocol.CreateContract{}
     case protocol.MessageType_TransferCreateContractResult:
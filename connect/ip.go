@@ -13,6 +13,7 @@ import (
     "math"
     "io"
     "slices"
+    "syscall"
 
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
@@ -43,6 +44,129 @@ const TcpHeaderSizeWithoutExtensions = 20
 const debugVerifyHeaders = false
 
 
+// selects the dialer for egress sockets by provide mode
+// e.g. to egress different provide modes from different source ips
+type ProvideModeDialContextGenerator func(provideMode protocol.ProvideMode) DialContextFunc
+
+
+// binds egress sockets to the source ip of the provide mode
+// provide modes without a source ip use the default source ip
+// the source ip is bound only when the destination is the same address family,
+// so that e.g. a v4 source ip does not fail v6 dials
+// binds the source port if set on the dial context (see `ContextWithSourcePort`)
+func NewSourceIpDialContextGenerator(provideModeSourceIps map[protocol.ProvideMode]net.IP) ProvideModeDialContextGenerator {
+    return func(provideMode protocol.ProvideMode) DialContextFunc {
+        provideModeSourceIp, provideModeOk := provideModeSourceIps[provideMode]
+        return func(ctx context.Context, network string, address string) (net.Conn, error) {
+            dialer := &net.Dialer{}
+            var sourceIp net.IP
+            ok := provideModeOk && sameIpFamily(provideModeSourceIp, network, address)
+            if ok {
+                sourceIp = provideModeSourceIp
+            }
+            sourcePort, sourcePortOk := SourcePortFromContext(ctx)
+            if ok || sourcePortOk {
+                switch network {
+                case "udp", "udp4", "udp6":
+                    dialer.LocalAddr = &net.UDPAddr{IP: sourceIp, Port: sourcePort}
+                case "tcp", "tcp4", "tcp6":
+                    dialer.LocalAddr = &net.TCPAddr{IP: sourceIp, Port: sourcePort}
+                }
+            }
+            return dialer.DialContext(ctx, network, address)
+        }
+    }
+}
+
+
+// true if the destination of the dial can be reached from the source ip
+// a destination host name matches either family, since the dialer resolves it to the family of the source ip
+func sameIpFamily(sourceIp net.IP, network string, address string) bool {
+    sourceIpv4 := sourceIp.To4() != nil
+    switch network {
+    case "udp4", "tcp4":
+        return sourceIpv4
+    case "udp6", "tcp6":
+        return !sourceIpv4
+    }
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return true
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return true
+    }
+    return sourceIpv4 == (ip.To4() != nil)
+}
+
+
+type sourcePortContextKey struct{}
+
+
+// requests that the dialer bind the egress socket to the source port
+// dialers from `NewSourceIpDialContextGenerator` honor this
+func ContextWithSourcePort(ctx context.Context, sourcePort int) context.Context {
+    return context.WithValue(ctx, sourcePortContextKey{}, sourcePort)
+}
+
+
+func SourcePortFromContext(ctx context.Context) (int, bool) {
+    sourcePort, ok := ctx.Value(sourcePortContextKey{}).(int)
+    return sourcePort, ok
+}
+
+
+// attempts to dial from the source port, and falls back to an ephemeral port if the source port cannot be bound
+// Limitations:
+// - the source port is shared by all clients of the provider. Only the first sequence to bind the port keeps it
+// - a tcp port may not be rebound while the previous connection is in TIME_WAIT
+// - privileged ports (<1024) typically cannot be bound
+// returns true if the source port was bound
+func dialWithSourcePort(
+    ctx context.Context,
+    dialContext DialContextFunc,
+    network string,
+    address string,
+    sourcePort int,
+) (net.Conn, bool, error) {
+    socket, err := dialContext(ContextWithSourcePort(ctx, sourcePort), network, address)
+    if err == nil {
+        return socket, true, nil
+    }
+    if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+        glog.V(1).Infof("[init]source port %d not available, fall back to ephemeral = %s\n", sourcePort, err)
+        socket, err = dialContext(ctx, network, address)
+        return socket, false, err
+    }
+    return nil, false, err
+}
+
+
+// reasons a packet is dropped by `LocalUserNat.SendPacketDetailed`
+var ErrPacketDecode = errors.New("Bad ip packet.")
+var ErrPacketUnsupportedProtocol = errors.New("Unsupported protocol.")
+var ErrPacketFiltered = errors.New("Filtered by security policy.")
+var ErrPacketBufferFull = errors.New("Buffer full.")
+
+
+// the max payload that `DataPackets` fragments into at most `maxFragmentCount` packets
+// `maxFragmentCount <= 0` is unlimited
+func maxFragmentPayloadByteCount(ipVersion int, transportHeaderSize int, mtu int, maxFragmentCount int) int {
+    if maxFragmentCount <= 0 {
+        return math.MaxInt
+    }
+    headerSize := transportHeaderSize
+    switch ipVersion {
+    case 4:
+        headerSize += Ipv4HeaderSizeWithoutExtensions
+    case 6:
+        headerSize += Ipv6HeaderSize
+    }
+    return maxFragmentCount * max(0, mtu - headerSize)
+}
+
+
 // send from a raw socket
 // note `ipProtocol` is not supplied. The implementation must do a packet inspection to determine protocol
 type SendPacketFunction func(source Path, provideMode protocol.ProvideMode, packet []byte, timeout time.Duration) bool
@@ -51,6 +175,15 @@ type SendPacketFunction func(source Path, provideMode protocol.ProvideMode, pack
 // receive into a raw socket
 type ReceivePacketFunction func(source Path, ipProtocol IpProtocol, packet []byte)
 
+// records a packet received for a sequence. The service port is the destination port of the sequence
+type receiveStatsFunction func(ipVersion int, ipProtocol IpProtocol, servicePort int, byteCount int)
+
+
+// reports the result of dialing the upstream for a tcp connection
+// `source` has only the source set, since the nat does not know the client id it provides on.
+// `err` is nil on success
+type TcpConnectResultFunction func(source TransferPath, destination string, latency time.Duration, err error)
+
 
 type UserNatClient interface {
     // `SendPacketFunction`
@@ -65,11 +198,21 @@ func DefaultUdpBufferSettings() *UdpBufferSettings {
         ReadTimeout: 30 * time.Second,
         WriteTimeout: 15 * time.Second,
         IdleTimeout: 60 * time.Second,
+        // e.g. a short timeout for dns (53) and a long timeout for quic (443)
+        DestinationPortIdleTimeouts: map[int]time.Duration{},
+        DialContextGen: NewSourceIpDialContextGenerator(map[protocol.ProvideMode]net.IP{}),
         Mtu: DefaultMtu,
         // avoid fragmentation
         ReadBufferByteCount: DefaultMtu - max(Ipv4HeaderSizeWithoutExtensions, Ipv6HeaderSize) - max(UdpHeaderSize, TcpHeaderSizeWithoutExtensions),
+        // the max udp payload
+        MaxReadBufferByteCount: 65535,
+        // enough for the max udp datagram
+        MaxFragmentCount: 64,
         SequenceBufferSize: DefaultIpBufferSize,
         UserLimit: 128,
+        NewConnectionsPerSecond: 0,
+        NewConnectionBurstSize: 0,
+        PreserveSourcePort: false,
     }
 }
 
@@ -80,12 +223,21 @@ func DefaultTcpBufferSettings() *TcpBufferSettings {
         ReadTimeout: 30 * time.Second,
         WriteTimeout: 15 * time.Second,
         IdleTimeout: 60 * time.Second,
+        DialContextGen: NewSourceIpDialContextGenerator(map[protocol.ProvideMode]net.IP{}),
         SequenceBufferSize: DefaultIpBufferSize,
         Mtu: DefaultMtu,
         // avoid fragmentation
         ReadBufferByteCount: DefaultMtu - max(Ipv4HeaderSizeWithoutExtensions, Ipv6HeaderSize) - max(UdpHeaderSize, TcpHeaderSizeWithoutExtensions),
+        MaxFragmentCount: 64,
         WindowSize: int(mib(1)),
+        WindowProbeTimeout: 1 * time.Second,
+        SocketWriteBufferByteCount: 0,
+        SocketReadBufferByteCount: 0,
         UserLimit: 128,
+        NewConnectionsPerSecond: 0,
+        NewConnectionBurstSize: 0,
+        MaxConcurrentDialsPerSource: 0,
+        PreserveSourcePort: false,
     }
     return tcpBufferSettings
 }
@@ -97,6 +249,7 @@ func DefaultLocalUserNatSettings() *LocalUserNatSettings {
         BufferTimeout: 5 * time.Second,
         UdpBufferSettings: DefaultUdpBufferSettings(),
         TcpBufferSettings: DefaultTcpBufferSettings(),
+        MaxConcurrentDnsIntercepts: 32,
     }
 }
 
@@ -106,9 +259,50 @@ type LocalUserNatSettings struct {
     BufferTimeout time.Duration
     UdpBufferSettings *UdpBufferSettings
     TcpBufferSettings *TcpBufferSettings
+    // nil does not inspect packets
+    // the `RemoteUserNatProvider` already inspects packets before they are sent to the nat
+    SecurityPolicy *SecurityPolicy
+    // applied after the security policy. nil allows all packets
+    PacketFilter PacketFilter
+    // queries over the limit are dropped while the `DnsInterceptor` is busy
+    MaxConcurrentDnsIntercepts int
 }
 
 
+// returns true to allow the packet
+type PacketFilter func(ipPath *IpPath) bool
+
+// allows tcp and udp packets to the allow ports, or all ports if there are no allow ports,
+// except the deny ports
+func NewPortPacketFilter(allowPorts []int, denyPorts []int) PacketFilter {
+    allow := map[int]bool{}
+    for _, port := range allowPorts {
+        allow[port] = true
+    }
+    deny := map[int]bool{}
+    for _, port := range denyPorts {
+        deny[port] = true
+    }
+    return func(ipPath *IpPath) bool {
+        if 0 < len(allow) && !allow[ipPath.DestinationPort] {
+            return false
+        }
+        return !deny[ipPath.DestinationPort]
+    }
+}
+
+
+// called for udp dns queries to port 53 before they are forwarded
+// return a response and true to reply with the response instead of forwarding the query,
+// or false to forward the original query. The interceptor can log queries, and
+// steer names for split-horizon dns by answering them.
+// The interceptor is called on its own goroutine and may block, e.g. on a resolver.
+// Tcp dns queries to port 53 are out of scope and are always forwarded.
+// The tcp buffer proxies tcp as a byte stream to the destination, so answering a tcp query
+// would require terminating the connection locally
+type DnsInterceptor func(query *layers.DNS) (*layers.DNS, bool)
+
+
 // forwards packets using user space sockets
 // this assumes transfer between the packet source and this is lossless and in order,
 // so the protocol stack implementations do not implement any retransmit logic
@@ -123,6 +317,22 @@ type LocalUserNat struct {
 
     // receive callback
     receiveCallbacks *CallbackList[ReceivePacketFunction]
+
+    sequenceGate *sequenceGate
+
+    udp4Buffer *Udp4Buffer
+    udp6Buffer *Udp6Buffer
+    tcp4Buffer *Tcp4Buffer
+    tcp6Buffer *Tcp6Buffer
+
+    statsLock sync.Mutex
+    serviceStats map[NatServiceKey]*NatServiceStats
+
+    stateLock sync.Mutex
+    dnsInterceptor DnsInterceptor
+
+    // limits the concurrent `DnsInterceptor` calls
+    dnsInterceptSlots chan struct{}
 }
 
 func NewLocalUserNatWithDefaults(ctx context.Context, clientTag string) *LocalUserNat {
@@ -139,7 +349,42 @@ func NewLocalUserNat(ctx context.Context, clientTag string, settings *LocalUserN
         sendPackets: make(chan *SendPacket, settings.SequenceBufferSize),
         settings: settings,
         receiveCallbacks: NewCallbackList[ReceivePacketFunction](),
-    }
+        sequenceGate: newSequenceGate(),
+        serviceStats: map[NatServiceKey]*NatServiceStats{},
+        dnsInterceptSlots: make(chan struct{}, settings.MaxConcurrentDnsIntercepts),
+    }
+    localUserNat.udp4Buffer = NewUdp4Buffer(cancelCtx, localUserNat.receive, settings.UdpBufferSettings)
+    localUserNat.udp6Buffer = NewUdp6Buffer(cancelCtx, localUserNat.receive, settings.UdpBufferSettings)
+    localUserNat.tcp4Buffer = NewTcp4Buffer(cancelCtx, localUserNat.receive, settings.TcpBufferSettings)
+    localUserNat.tcp6Buffer = NewTcp6Buffer(cancelCtx, localUserNat.receive, settings.TcpBufferSettings)
+    localUserNat.udp4Buffer.sequenceGate = localUserNat.sequenceGate
+    localUserNat.udp6Buffer.sequenceGate = localUserNat.sequenceGate
+    localUserNat.tcp4Buffer.sequenceGate = localUserNat.sequenceGate
+    localUserNat.tcp6Buffer.sequenceGate = localUserNat.sequenceGate
+    // the new connection rate of a source is shared across ip versions
+    udpSourceLimiter := newSourceLimiter(
+        settings.UdpBufferSettings.NewConnectionsPerSecond,
+        settings.UdpBufferSettings.NewConnectionBurstSize,
+        localUserNat.addThrottledServiceStats,
+    )
+    tcpSourceLimiter := newSourceLimiter(
+        settings.TcpBufferSettings.NewConnectionsPerSecond,
+        settings.TcpBufferSettings.NewConnectionBurstSize,
+        localUserNat.addThrottledServiceStats,
+    )
+    localUserNat.udp4Buffer.sourceLimiter = udpSourceLimiter
+    localUserNat.udp6Buffer.sourceLimiter = udpSourceLimiter
+    localUserNat.tcp4Buffer.sourceLimiter = tcpSourceLimiter
+    localUserNat.tcp6Buffer.sourceLimiter = tcpSourceLimiter
+    // the dials of a source are shared across ip versions
+    tcpDialLimiter := newSourceDialLimiter(settings.TcpBufferSettings.MaxConcurrentDialsPerSource)
+    localUserNat.tcp4Buffer.dialLimiter = tcpDialLimiter
+    localUserNat.tcp6Buffer.dialLimiter = tcpDialLimiter
+    localUserNat.udp4Buffer.receiveStats = localUserNat.addReceiveServiceStats
+    localUserNat.udp6Buffer.receiveStats = localUserNat.addReceiveServiceStats
+    localUserNat.tcp4Buffer.receiveStats = localUserNat.addReceiveServiceStats
+    localUserNat.tcp6Buffer.receiveStats = localUserNat.addReceiveServiceStats
+
     go localUserNat.Run()
 
     return localUserNat
@@ -149,6 +394,30 @@ func NewLocalUserNat(ctx context.Context, clientTag string, settings *LocalUserN
 // TODO currently filter all local networks and non-encrypted traffic
 func (self *LocalUserNat) SendPacketWithTimeout(source Path, provideMode protocol.ProvideMode,
         packet []byte, timeout time.Duration) bool {
+    success, err := self.SendPacketDetailed(source, provideMode, packet, timeout)
+    return success && err == nil
+}
+
+// returns the reason the packet was dropped:
+// - `ErrPacketDecode`
+// - `ErrPacketUnsupportedProtocol`
+// - `ErrPacketFiltered`
+// - `ErrPacketBufferFull`
+// - `ErrDone`
+func (self *LocalUserNat) SendPacketDetailed(source Path, provideMode protocol.ProvideMode,
+        packet []byte, timeout time.Duration) (bool, error) {
+    ipPath, err := checkPacket(packet)
+    if err != nil {
+        return false, err
+    }
+    if self.settings.SecurityPolicy != nil && self.settings.SecurityPolicy.InspectPath(provideMode, ipPath) != SecurityPolicyResultAllow {
+        return false, ErrPacketFiltered
+    }
+    if self.settings.PacketFilter != nil && !self.settings.PacketFilter(ipPath) {
+        self.addFilteredServiceStats(ipPath.Version, ipPath.Protocol, ipPath.DestinationPort)
+        return false, ErrPacketFiltered
+    }
+
     sendPacket := &SendPacket{
         source: source,
         provideMode: provideMode,
@@ -157,29 +426,27 @@ func (self *LocalUserNat) SendPacketWithTimeout(source Path, provideMode protoco
     if timeout < 0 {
         select {
         case <- self.ctx.Done():
-            return false
+            return false, ErrDone
         case self.sendPackets <- sendPacket:
-            return true
+            return true, nil
         }
     } else if 0 == timeout {
         select {
         case <- self.ctx.Done():
-            return false
+            return false, ErrDone
         case self.sendPackets <- sendPacket:
-            return true
+            return true, nil
         default:
-            // full
-            return false
+            return false, ErrPacketBufferFull
         }
     } else {
         select {
         case <- self.ctx.Done():
-            return false
+            return false, ErrDone
         case self.sendPackets <- sendPacket:
-            return true
+            return true, nil
         case <- time.After(timeout):
-            // full
-            return false
+            return false, ErrPacketBufferFull
         }
     }
 }
@@ -205,6 +472,7 @@ func (self *LocalUserNat) AddReceivePacketCallback(receiveCallback ReceivePacket
 // }
 
 // `ReceivePacketFunction`
+// the receive stats are added by the sequences, which already know the service, see `addReceiveServiceStats`
 func (self *LocalUserNat) receive(source Path, ipProtocol IpProtocol, packet []byte) {
     for _, receiveCallback := range self.receiveCallbacks.Get() {
         HandleError(func() {
@@ -216,10 +484,10 @@ func (self *LocalUserNat) receive(source Path, ipProtocol IpProtocol, packet []b
 func (self *LocalUserNat) Run() {
     defer self.cancel()
 
-    udp4Buffer := NewUdp4Buffer(self.ctx, self.receive, self.settings.UdpBufferSettings)
-    udp6Buffer := NewUdp6Buffer(self.ctx, self.receive, self.settings.UdpBufferSettings)
-    tcp4Buffer := NewTcp4Buffer(self.ctx, self.receive, self.settings.TcpBufferSettings)
-    tcp6Buffer := NewTcp6Buffer(self.ctx, self.receive, self.settings.TcpBufferSettings)
+    udp4Buffer := self.udp4Buffer
+    udp6Buffer := self.udp6Buffer
+    tcp4Buffer := self.tcp4Buffer
+    tcp6Buffer := self.tcp6Buffer
 
     for {
         select {
@@ -236,6 +504,7 @@ func (self *LocalUserNat) Run() {
                 case layers.IPProtocolUDP:
                     udp := layers.UDP{}
                     udp.DecodeFromBytes(ipv4.Payload, gopacket.NilDecodeFeedback)
+                    self.addServiceStats(4, IpProtocolUdp, int(udp.DstPort), len(ipPacket), 0)
 
                     c := func()(bool) {
                         success, err := udp4Buffer.send(
@@ -247,17 +516,26 @@ func (self *LocalUserNat) Run() {
                         )
                         return success && err == nil
                     }
-                    if glog.V(2) {
-                        TraceWithReturn(
-                            fmt.Sprintf("[lnr]send udp4 %s<-%s", self.clientTag, sendPacket.source.ClientId),
-                            c,
-                        )
-                    } else {
-                        c()
+                    send := func() {
+                        if glog.V(2) {
+                            TraceWithReturn(
+                                fmt.Sprintf("[lnr]send udp4 %s<-%s", self.clientTag, sendPacket.source.ClientId),
+                                c,
+                            )
+                        } else {
+                            c()
+                        }
+                    }
+
+                    if self.interceptDns(sendPacket.source, sendPacket.provideMode, 4, ipv4.SrcIP, ipv4.DstIP, &udp, send) {
+                        // the interceptor replies or forwards on its own goroutine
+                        break
                     }
+                    send()
                 case layers.IPProtocolTCP:
                     tcp := layers.TCP{}
                     tcp.DecodeFromBytes(ipv4.Payload, gopacket.NilDecodeFeedback)
+                    self.addServiceStats(4, IpProtocolTcp, int(tcp.DstPort), len(ipPacket), 0)
 
                     c := func()(bool) {
                         success, err := tcp4Buffer.send(
@@ -287,6 +565,7 @@ func (self *LocalUserNat) Run() {
                 case layers.IPProtocolUDP:
                     udp := layers.UDP{}
                     udp.DecodeFromBytes(ipv6.Payload, gopacket.NilDecodeFeedback)
+                    self.addServiceStats(6, IpProtocolUdp, int(udp.DstPort), len(ipPacket), 0)
 
                     c := func()(bool) {
                         success, err := udp6Buffer.send(
@@ -298,17 +577,26 @@ func (self *LocalUserNat) Run() {
                         )
                         return success && err == nil
                     }
-                    if glog.V(2) {
-                        TraceWithReturn(
-                            fmt.Sprintf("[lnr]send udp6 %s<-%s", self.clientTag, sendPacket.source.ClientId),
-                            c,
-                        )
-                    } else {
-                        c()
+                    send := func() {
+                        if glog.V(2) {
+                            TraceWithReturn(
+                                fmt.Sprintf("[lnr]send udp6 %s<-%s", self.clientTag, sendPacket.source.ClientId),
+                                c,
+                            )
+                        } else {
+                            c()
+                        }
+                    }
+
+                    if self.interceptDns(sendPacket.source, sendPacket.provideMode, 6, ipv6.SrcIP, ipv6.DstIP, &udp, send) {
+                        // the interceptor replies or forwards on its own goroutine
+                        break
                     }
+                    send()
                 case layers.IPProtocolTCP:
                     tcp := layers.TCP{}
                     tcp.DecodeFromBytes(ipv6.Payload, gopacket.NilDecodeFeedback)
+                    self.addServiceStats(6, IpProtocolTcp, int(tcp.DstPort), len(ipPacket), 0)
 
                     c := func()(bool) {
                         success, err := tcp6Buffer.send(
@@ -336,10 +624,353 @@ func (self *LocalUserNat) Run() {
     }
 }
 
+// nil forwards all dns queries
+func (self *LocalUserNat) SetDnsInterceptor(dnsInterceptor DnsInterceptor) {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    self.dnsInterceptor = dnsInterceptor
+}
+
+func (self *LocalUserNat) DnsInterceptor() DnsInterceptor {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    return self.dnsInterceptor
+}
+
+// returns true if the query was handed to the dns interceptor
+// the interceptor runs on its own goroutine so that a slow resolver does not block the nat.
+// If the interceptor answers, the response is sent back to the source as if from the original destination
+// via the receive callbacks. Otherwise `forward` is called to forward the original query.
+// Only udp queries are intercepted. Tcp queries to port 53 are out of scope and are forwarded by the tcp buffer as is
+func (self *LocalUserNat) interceptDns(
+    source Path,
+    provideMode protocol.ProvideMode,
+    ipVersion int,
+    sourceIp net.IP,
+    destinationIp net.IP,
+    udp *layers.UDP,
+    forward func(),
+) bool {
+    if udp.DstPort != 53 {
+        return false
+    }
+    dnsInterceptor := self.DnsInterceptor()
+    if dnsInterceptor == nil {
+        return false
+    }
+
+    query := &layers.DNS{}
+    if err := query.DecodeFromBytes(udp.Payload, gopacket.NilDecodeFeedback); err != nil {
+        // not a dns message. Forward as is
+        return false
+    }
+
+    select {
+    case self.dnsInterceptSlots <- struct{}{}:
+    default:
+        // the client will retry the query
+        glog.Infof("[lnr]dns query drop max concurrent intercepts\n")
+        return true
+    }
+    go HandleError(func() {
+        defer func() {
+            <- self.dnsInterceptSlots
+        }()
+
+        var response *layers.DNS
+        var ok bool
+        HandleError(func() {
+            response, ok = dnsInterceptor(query)
+        })
+        if !ok || response == nil {
+            forward()
+            return
+        }
+        // the reply is a one-off packet and is not tracked for activity,
+        // so the stream state does not set `userLimited`
+        self.replyDns(&StreamState{
+            source: source,
+            provideMode: provideMode,
+            ipVersion: ipVersion,
+            sourceIp: sourceIp,
+            sourcePort: udp.SrcPort,
+            destinationIp: destinationIp,
+            destinationPort: udp.DstPort,
+        }, response)
+    })
+    return true
+}
+
+func (self *LocalUserNat) replyDns(streamState *StreamState, response *layers.DNS) {
+    buffer := gopacket.NewSerializeBuffer()
+    if err := response.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+        glog.Infof("[lnr]dns response drop = %s\n", err)
+        return
+    }
+    payload := buffer.Bytes()
+
+    packets, err := streamState.DataPackets(payload, len(payload), self.settings.UdpBufferSettings.Mtu)
+    if err != nil {
+        glog.Infof("[lnr]dns response drop = %s\n", err)
+        return
+    }
+    for _, packet := range packets {
+        self.addReceiveServiceStats(streamState.ipVersion, IpProtocolUdp, int(streamState.destinationPort), len(packet))
+        self.receive(streamState.source, IpProtocolUdp, packet)
+    }
+}
+
+// stops creating new sequences. Packets for existing sequences continue to be sent
+// until the sequences close, e.g. from the idle timeout or a tcp close
+func (self *LocalUserNat) Quiesce() {
+    self.sequenceGate.quiesce()
+}
+
+func (self *LocalUserNat) IsQuiesced() bool {
+    return self.sequenceGate.isQuiesced()
+}
+
+// the number of open udp and tcp sequences
+func (self *LocalUserNat) SequenceCount() int {
+    return self.sequenceGate.openCount()
+}
+
+// closed when quiesced and all existing sequences have closed
+func (self *LocalUserNat) QuiescedAndDrained() <-chan struct{} {
+    return self.sequenceGate.drained
+}
+
+func (self *LocalUserNat) addServiceStats(ipVersion int, ipProtocol IpProtocol, servicePort int, sendByteCount int, receiveByteCount int) {
+    key := NatServiceKey{
+        IpVersion: ipVersion,
+        Protocol: ipProtocol,
+        Service: ClassifyNatService(ipProtocol, servicePort),
+    }
+
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    stats, ok := self.serviceStats[key]
+    if !ok {
+        stats = &NatServiceStats{}
+        self.serviceStats[key] = stats
+    }
+    if 0 < sendByteCount {
+        stats.SendPacketCount += 1
+        stats.SendByteCount += ByteCount(sendByteCount)
+    }
+    if 0 < receiveByteCount {
+        stats.ReceivePacketCount += 1
+        stats.ReceiveByteCount += ByteCount(receiveByteCount)
+    }
+}
+
+func (self *LocalUserNat) addFilteredServiceStats(ipVersion int, ipProtocol IpProtocol, servicePort int) {
+    key := NatServiceKey{
+        IpVersion: ipVersion,
+        Protocol: ipProtocol,
+        Service: ClassifyNatService(ipProtocol, servicePort),
+    }
+
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    stats, ok := self.serviceStats[key]
+    if !ok {
+        stats = &NatServiceStats{}
+        self.serviceStats[key] = stats
+    }
+    stats.FilteredPacketCount += 1
+}
+
+// `receiveStatsFunction`
+func (self *LocalUserNat) addReceiveServiceStats(ipVersion int, ipProtocol IpProtocol, servicePort int, byteCount int) {
+    self.addServiceStats(ipVersion, ipProtocol, servicePort, 0, byteCount)
+}
+
+func (self *LocalUserNat) addThrottledServiceStats(ipVersion int, ipProtocol IpProtocol, servicePort int) {
+    key := NatServiceKey{
+        IpVersion: ipVersion,
+        Protocol: ipProtocol,
+        Service: ClassifyNatService(ipProtocol, servicePort),
+    }
+
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    stats, ok := self.serviceStats[key]
+    if !ok {
+        stats = &NatServiceStats{}
+        self.serviceStats[key] = stats
+    }
+    stats.ThrottledConnectionCount += 1
+}
+
+// packet and byte counts by ip version, protocol, and service since the nat started
+// send counts are packets from clients to the internet, and receive counts are the return packets
+func (self *LocalUserNat) ServiceStats() map[NatServiceKey]NatServiceStats {
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    serviceStats := map[NatServiceKey]NatServiceStats{}
+    for key, stats := range self.serviceStats {
+        serviceStats[key] = *stats
+    }
+    return serviceStats
+}
+
+// live counts for the nat
+func (self *LocalUserNat) Stats() LocalUserNatStats {
+    stats := LocalUserNatStats{
+        UdpSequenceCount: self.udp4Buffer.sequenceCount() + self.udp6Buffer.sequenceCount(),
+        TcpSequenceCount: self.tcp4Buffer.sequenceCount() + self.tcp6Buffer.sequenceCount(),
+    }
+    for _, serviceStats := range self.ServiceStats() {
+        stats.SendByteCount += serviceStats.SendByteCount
+        stats.ReceiveByteCount += serviceStats.ReceiveByteCount
+    }
+    return stats
+}
+
 func (self *LocalUserNat) Close() {
     self.cancel()
 }
 
+
+// counts the open sequences across the buffers of a local user nat,
+// and refuses new sequences when quiesced
+// a nil gate is always open
+type sequenceGate struct {
+    mutex sync.Mutex
+    quiesced bool
+    sequenceCount int
+    drained chan struct{}
+}
+
+func newSequenceGate() *sequenceGate {
+    return &sequenceGate{
+        drained: make(chan struct{}),
+    }
+}
+
+// returns false if the new sequence is refused
+// each successful open must be followed by a close
+func (self *sequenceGate) open() bool {
+    if self == nil {
+        return true
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.quiesced {
+        return false
+    }
+    self.sequenceCount += 1
+    return true
+}
+
+func (self *sequenceGate) close() {
+    if self == nil {
+        return
+    }
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.sequenceCount -= 1
+    if self.quiesced && self.sequenceCount == 0 {
+        close(self.drained)
+    }
+}
+
+func (self *sequenceGate) quiesce() {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.quiesced {
+        return
+    }
+    self.quiesced = true
+    if self.sequenceCount == 0 {
+        close(self.drained)
+    }
+}
+
+func (self *sequenceGate) isQuiesced() bool {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.quiesced
+}
+
+func (self *sequenceGate) openCount() int {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return self.sequenceCount
+}
+
+// checks that the packet can be decoded and forwarded
+// returns the path of the packet, so that the packet is parsed once for the filters
+func checkPacket(ipPacket []byte) (*IpPath, error) {
+    if len(ipPacket) == 0 {
+        return nil, ErrPacketDecode
+    }
+    ipPath := &IpPath{}
+    var transport []byte
+    var transportProtocol layers.IPProtocol
+    ipVersion := uint8(ipPacket[0]) >> 4
+    switch ipVersion {
+    case 4:
+        ipv4 := layers.IPv4{}
+        if err := ipv4.DecodeFromBytes(ipPacket, gopacket.NilDecodeFeedback); err != nil {
+            return nil, fmt.Errorf("%w %s", ErrPacketDecode, err)
+        }
+        ipPath.SourceIp = ipv4.SrcIP
+        ipPath.DestinationIp = ipv4.DstIP
+        transport = ipv4.Payload
+        transportProtocol = ipv4.Protocol
+    case 6:
+        ipv6 := layers.IPv6{}
+        if err := ipv6.DecodeFromBytes(ipPacket, gopacket.NilDecodeFeedback); err != nil {
+            return nil, fmt.Errorf("%w %s", ErrPacketDecode, err)
+        }
+        ipPath.SourceIp = ipv6.SrcIP
+        ipPath.DestinationIp = ipv6.DstIP
+        transport = ipv6.Payload
+        transportProtocol = ipv6.NextHeader
+    default:
+        return nil, fmt.Errorf("%w No support for ip version %d", ErrPacketDecode, ipVersion)
+    }
+    ipPath.Version = int(ipVersion)
+
+    switch transportProtocol {
+    case layers.IPProtocolUDP:
+        udp := layers.UDP{}
+        if err := udp.DecodeFromBytes(transport, gopacket.NilDecodeFeedback); err != nil {
+            return nil, fmt.Errorf("%w %s", ErrPacketDecode, err)
+        }
+        ipPath.Protocol = IpProtocolUdp
+        ipPath.SourcePort = int(udp.SrcPort)
+        ipPath.DestinationPort = int(udp.DstPort)
+    case layers.IPProtocolTCP:
+        tcp := layers.TCP{}
+        if err := tcp.DecodeFromBytes(transport, gopacket.NilDecodeFeedback); err != nil {
+            return nil, fmt.Errorf("%w %s", ErrPacketDecode, err)
+        }
+        ipPath.Protocol = IpProtocolTcp
+        ipPath.SourcePort = int(tcp.SrcPort)
+        ipPath.DestinationPort = int(tcp.DstPort)
+    default:
+        return nil, fmt.Errorf("%w %s", ErrPacketUnsupportedProtocol, transportProtocol)
+    }
+    return ipPath, nil
+}
+
+
 type SendPacket struct {
     source Path
     provideMode protocol.ProvideMode
@@ -391,12 +1022,51 @@ type UdpBufferSettings struct {
     ReadTimeout time.Duration
     WriteTimeout time.Duration
     IdleTimeout time.Duration
+    // destination port -> idle timeout
+    // overrides `IdleTimeout` for the destination port
+    DestinationPortIdleTimeouts map[int]time.Duration
+    // selects the egress dialer by the provide mode of the source
+    DialContextGen ProvideModeDialContextGenerator
     Mtu int
     ReadBufferByteCount int
+    // a datagram larger than the read buffer is truncated by the read.
+    // Truncated datagrams are dropped, and the read buffer grows up to this size for the following reads.
+    // Use `ReadBufferByteCount` to never grow
+    MaxReadBufferByteCount int
+    // the max packets from fragmenting a single read
+    // datagrams that need more fragments are dropped
+    MaxFragmentCount int
     SequenceBufferSize int
     // the number of open sockets per user
     // uses an lru cleanup where new sockets over the limit close old sockets
     UserLimit int
+    // the rate of new sequences per source, refilled continuously up to the burst size
+    // new sequences over the rate are dropped (the first packet), which keeps a single source from exhausting sockets
+    // 0 is no limit
+    NewConnectionsPerSecond float64
+    // 0 is the per second rate, rounded up
+    NewConnectionBurstSize int
+    // attempt to egress from the source port of the client, falling back to an ephemeral port
+    // see `dialWithSourcePort` for limitations
+    PreserveSourcePort bool
+}
+
+
+func (self *UdpBufferSettings) DestinationPortIdleTimeout(destinationPort int) time.Duration {
+    if idleTimeout, ok := self.DestinationPortIdleTimeouts[destinationPort]; ok {
+        return idleTimeout
+    }
+    return self.IdleTimeout
+}
+
+// the socket read timeout for a sequence to the destination port
+// a port with an idle timeout override does not close the sequence on read before the idle timeout.
+// other ports keep `ReadTimeout`
+func (self *UdpBufferSettings) DestinationPortReadTimeout(destinationPort int) time.Duration {
+    if idleTimeout, ok := self.DestinationPortIdleTimeouts[destinationPort]; ok {
+        return max(self.ReadTimeout, idleTimeout)
+    }
+    return self.ReadTimeout
 }
 
 
@@ -468,6 +1138,11 @@ type UdpBuffer[BufferId comparable] struct {
     ctx context.Context
     receiveCallback ReceivePacketFunction
     udpBufferSettings *UdpBufferSettings
+    sequenceGate *sequenceGate
+    // optional. Limits the rate of new sequences per source
+    sourceLimiter *sourceLimiter
+    // optional
+    receiveStats receiveStatsFunction
 
     mutex sync.Mutex
 
@@ -490,6 +1165,13 @@ func newUdpBuffer[BufferId comparable](
 }
 
 
+func (self *UdpBuffer[BufferId]) sequenceCount() int {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return len(self.sequences)
+}
+
 func (self *UdpBuffer[BufferId]) udpSend(
     bufferId BufferId,
     sourceIp net.IP,
@@ -518,6 +1200,16 @@ func (self *UdpBuffer[BufferId]) udpSend(
                 }
             }
         }
+
+        if self.sourceLimiter != nil && !self.sourceLimiter.allow(source, ipVersion, IpProtocolUdp, int(udp.DstPort)) {
+            glog.V(1).Infof("[lnr]udp drop throttled %s\n", source)
+            return nil
+        }
+
+        if !self.sequenceGate.open() {
+            glog.V(1).Infof("[lnr]udp drop quiesced %s\n", source)
+            return nil
+        }
         
         if 0 < self.udpBufferSettings.UserLimit {
             // limit the total connections per source to avoid blowing up the ulimit
@@ -540,6 +1232,7 @@ func (self *UdpBuffer[BufferId]) udpSend(
             self.ctx,
             self.receiveCallback,
             source,
+            provideMode,
             ipVersion,
             sourceIp,
             udp.SrcPort,
@@ -547,8 +1240,10 @@ func (self *UdpBuffer[BufferId]) udpSend(
             udp.DstPort,
             self.udpBufferSettings,
         )
+        sequence.receiveStats = self.receiveStats
         self.sequences[bufferId] = sequence
         go func() {
+            defer self.sequenceGate.close()
             sequence.Run()
 
             self.mutex.Lock()
@@ -572,11 +1267,18 @@ func (self *UdpBuffer[BufferId]) udpSend(
         udp: udp,
     } 
     sequence := initSequence(nil)
+    if sequence == nil {
+        // quiesced or throttled, drop
+        return false, nil
+    }
     if success, err := sequence.send(sendItem, timeout); err == nil {
         return success, nil
+    } else if sequence = initSequence(sequence); sequence == nil {
+        // sequence closed and quiesced or throttled, drop
+        return false, nil
     } else {
         // sequence closed
-        return initSequence(sequence).send(sendItem, timeout)
+        return sequence.send(sendItem, timeout)
     }
 }
 
@@ -586,17 +1288,25 @@ type UdpSequence struct {
     ctx context.Context
     cancel context.CancelFunc
     receiveCallback ReceivePacketFunction
+    // optional
+    receiveStats receiveStatsFunction
     udpBufferSettings *UdpBufferSettings
+    idleTimeout time.Duration
+    readTimeout time.Duration
 
     sendItems chan *UdpSendItem
 
     idleCondition *IdleCondition
 
+    statsLock sync.Mutex
+    truncatedDatagramCount int
+
     StreamState
 }
 
 func NewUdpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
         source Path, 
+        provideMode protocol.ProvideMode,
         ipVersion int,
         sourceIp net.IP, sourcePort layers.UDPPort,
         destinationIp net.IP, destinationPort layers.UDPPort,
@@ -604,6 +1314,7 @@ func NewUdpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
     cancelCtx, cancel := context.WithCancel(ctx)
     streamState := StreamState{
         source: source,
+        provideMode: provideMode,
         ipVersion: ipVersion,
         sourceIp: sourceIp,
         sourcePort: sourcePort,
@@ -617,6 +1328,8 @@ func NewUdpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
         receiveCallback: receiveCallback,
         sendItems: make(chan *UdpSendItem, udpBufferSettings.SequenceBufferSize),
         udpBufferSettings: udpBufferSettings,
+        idleTimeout: udpBufferSettings.DestinationPortIdleTimeout(int(destinationPort)),
+        readTimeout: udpBufferSettings.DestinationPortReadTimeout(int(destinationPort)),
         idleCondition: NewIdleCondition(),
         StreamState: streamState,
     }
@@ -662,18 +1375,51 @@ func (self *UdpSequence) send(sendItem *UdpSendItem, timeout time.Duration) (boo
     }
 }
 
+func (self *UdpSequence) truncatedDatagram() int {
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    self.truncatedDatagramCount += 1
+    return self.truncatedDatagramCount
+}
+
+// the number of received datagrams dropped because they were larger than the read buffer
+func (self *UdpSequence) TruncatedDatagramCount() int {
+    self.statsLock.Lock()
+    defer self.statsLock.Unlock()
+
+    return self.truncatedDatagramCount
+}
+
 func (self *UdpSequence) Run() {
     defer self.cancel()
 
     receive := func(packet []byte) {
+        if self.receiveStats != nil {
+            self.receiveStats(self.ipVersion, IpProtocolUdp, int(self.destinationPort), len(packet))
+        }
         self.receiveCallback(self.source, IpProtocolUdp, packet)
     }
 
     glog.V(2).Infof("[init]udp connect\n")
-    socket, err := net.Dial(
-        "udp",
-        self.DestinationAuthority(),
-    )
+    dialContext := self.udpBufferSettings.DialContextGen(self.provideMode)
+    var socket net.Conn
+    var err error
+    if self.udpBufferSettings.PreserveSourcePort {
+        socket, _, err = dialWithSourcePort(
+            self.ctx,
+            dialContext,
+            "udp",
+            self.DestinationAuthority(),
+            int(self.sourcePort),
+        )
+    } else {
+        socket, err = dialContext(
+            self.ctx,
+            "udp",
+            self.DestinationAuthority(),
+        )
+    }
     if err != nil {
         glog.Infof("[init]udp connect error = %s\n", err)
         return
@@ -685,7 +1431,17 @@ func (self *UdpSequence) Run() {
     go func() {
         defer self.cancel()
 
-        buffer := make([]byte, self.udpBufferSettings.ReadBufferByteCount)
+        // the read buffer has one extra byte to detect truncation
+        // a read that fills the extra byte was truncated.
+        // This works on all platforms, unlike reading the `MSG_TRUNC` flag
+        readBufferByteCount := self.udpBufferSettings.ReadBufferByteCount
+        buffer := make([]byte, readBufferByteCount + 1)
+        maxPayloadByteCount := maxFragmentPayloadByteCount(
+            self.ipVersion,
+            UdpHeaderSize,
+            self.udpBufferSettings.Mtu,
+            self.udpBufferSettings.MaxFragmentCount,
+        )
 
         for forwardIter := uint64(0); ; forwardIter += 1 {
             select {
@@ -695,15 +1451,27 @@ func (self *UdpSequence) Run() {
             }
 
 
-            readTimeout := time.Now().Add(self.udpBufferSettings.ReadTimeout)
-            socket.SetReadDeadline(readTimeout)
+            socket.SetReadDeadline(time.Now().Add(self.readTimeout))
             n, err := socket.Read(buffer)
 
             if err != nil {
                 glog.Infof("[f%d]udp receive err = %s\n", forwardIter, err)
             }
 
-            if 0 < n {
+            if readBufferByteCount < n {
+                // the datagram is larger than the buffer
+                // never forward a partial datagram
+                truncatedDatagramCount := self.truncatedDatagram()
+                glog.Infof("[f%d]udp receive drop truncated (%d total)\n", forwardIter, truncatedDatagramCount)
+                if readBufferByteCount < self.udpBufferSettings.MaxReadBufferByteCount {
+                    readBufferByteCount = self.udpBufferSettings.MaxReadBufferByteCount
+                    buffer = make([]byte, readBufferByteCount + 1)
+                    glog.V(1).Infof("[f%d]udp receive grow buffer %db\n", forwardIter, readBufferByteCount)
+                }
+            } else if maxPayloadByteCount < n {
+                // the datagram cannot be split across reads
+                glog.Infof("[f%d]udp receive drop %d fragment limit\n", forwardIter, n)
+            } else if 0 < n {
                 self.UpdateLastActivityTime()
 
                 packets, packetsErr := self.DataPackets(buffer, n, self.udpBufferSettings.Mtu)
@@ -781,7 +1549,7 @@ func (self *UdpSequence) Run() {
                         }
                     }
                 }
-            case <- time.After(self.udpBufferSettings.IdleTimeout):
+            case <- time.After(self.idleTimeout):
                 if self.idleCondition.Close(checkpointId) {
                     // close the sequence
                     return
@@ -816,6 +1584,7 @@ type UdpSendItem struct {
 
 type StreamState struct {
     source Path
+    provideMode protocol.ProvideMode
     ipVersion int
     sourceIp net.IP
     sourcePort layers.UDPPort
@@ -908,7 +1677,8 @@ func (self *StreamState) DataPackets(payload []byte, n int, mtu int) ([][]byte,
         // fragment
         buffer := gopacket.NewSerializeBufferExpectedSize(mtu, 0)
         packetSize := mtu - headerSize
-        packets := make([][]byte, 0, (n + packetSize) / packetSize)
+        packetCount := (n + packetSize - 1) / packetSize
+        packets := make([][]byte, 0, packetCount)
         for i := 0; i < n; {
             j := min(i + packetSize, n)
             err := gopacket.SerializeLayers(buffer, options,
@@ -920,6 +1690,8 @@ func (self *StreamState) DataPackets(payload []byte, n int, mtu int) ([][]byte,
                 return nil, err
             }
             packet := buffer.Bytes()
+            // each packet is a separate copy,
+            // so that a packet retained downstream does not retain the other packets
             packetCopy := make([]byte, len(packet))
             copy(packetCopy, packet)
             packets = append(packets, packetCopy)
@@ -938,16 +1710,47 @@ type TcpBufferSettings struct {
     // ReadPollTimeout time.Duration
     // WritePollTimeout time.Duration
     IdleTimeout time.Duration
+    // selects the egress dialer by the provide mode of the source
+    DialContextGen ProvideModeDialContextGenerator
+    // optional. Called after each upstream dial. On a failed dial, this is called after the RST is sent to the source
+    OnConnectResult TcpConnectResultFunction
     ReadBufferByteCount int
+    // the max packets from fragmenting a single read
+    // reads are limited to the payload of this many packets
+    MaxFragmentCount int
     SequenceBufferSize int
     Mtu int
     // the window size is the max amount of packet data in memory for each sequence
-    // TODO currently we do not enable window scale
+    // the window scale of the source is honored, but we do not scale our own window
     // TODO this value is max 2^16
     WindowSize int
+    // when the receive window of the source is closed, probe the source at this interval
+    // so that a lost window update does not stall the sequence until the idle timeout
+    WindowProbeTimeout time.Duration
+    // the upstream socket buffer sizes (SO_SNDBUF, SO_RCVBUF). 0 is the os default.
+    // Larger buffers help throughput on high bandwidth-delay egress paths,
+    // at the cost of kernel memory per socket (up to `UserLimit` sockets per user)
+    // and more data in flight that is lost when a sequence closes.
+    // The os may cap the size, e.g. `net.core.wmem_max` and `net.core.rmem_max` on linux
+    SocketWriteBufferByteCount int
+    SocketReadBufferByteCount int
     // the number of open sockets per user
     // uses an lru cleanup where new sockets over the limit close old sockets
     UserLimit int
+    // the rate of new connections per source, refilled continuously up to the burst size
+    // new connections over the rate are dropped (the SYN), which keeps a single source from exhausting sockets
+    // 0 is no limit
+    NewConnectionsPerSecond float64
+    // 0 is the per second rate, rounded up
+    NewConnectionBurstSize int
+    // the max upstream dials in progress per source
+    // new connections over the limit wait for a dial to complete, up to the `ConnectTimeout`.
+    // This smooths a burst of SYNs from a single source into upstream connections
+    // 0 is no limit
+    MaxConcurrentDialsPerSource int
+    // attempt to egress from the source port of the client, falling back to an ephemeral port
+    // see `dialWithSourcePort` for limitations
+    PreserveSourcePort bool
 }
 
 
@@ -1027,6 +1830,13 @@ type TcpBuffer[BufferId comparable] struct {
     ctx context.Context
     receiveCallback ReceivePacketFunction
     tcpBufferSettings *TcpBufferSettings
+    sequenceGate *sequenceGate
+    // optional. Limits the rate of new sequences per source
+    sourceLimiter *sourceLimiter
+    // optional. Limits the concurrent upstream dials per source
+    dialLimiter *sourceDialLimiter
+    // optional
+    receiveStats receiveStatsFunction
 
     mutex sync.Mutex
 
@@ -1045,10 +1855,18 @@ func newTcpBuffer[BufferId comparable](
         tcpBufferSettings: tcpBufferSettings,
         sequences: map[BufferId]*TcpSequence{},
         sourceSequences: map[Path]map[BufferId]*TcpSequence{},
+        dialLimiter: newSourceDialLimiter(tcpBufferSettings.MaxConcurrentDialsPerSource),
     }
 }
 
 
+func (self *TcpBuffer[BufferId]) sequenceCount() int {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return len(self.sequences)
+}
+
 func (self *TcpBuffer[BufferId]) tcpSend(
     bufferId BufferId,
     sourceIp net.IP,
@@ -1072,7 +1890,26 @@ func (self *TcpBuffer[BufferId]) tcpSend(
             return nil
         }
 
+        if sequence, ok := self.sequences[bufferId]; ok && sequence.duplicateSyn(tcp) {
+            // the source retransmitted the SYN while the sequence connects, e.g. while waiting for a dial
+            // keep the sequence in its place in the dial wait
+            glog.V(2).Infof("[lnr]tcp drop duplicate syn %s\n", source)
+            return nil
+        }
+
         // else new sequence
+        if self.sourceLimiter != nil && !self.sourceLimiter.allow(source, ipVersion, IpProtocolTcp, int(tcp.DstPort)) {
+            glog.V(1).Infof("[lnr]tcp drop throttled %s\n", source)
+            return nil
+        }
+
+        // check the gate before replacing an existing sequence,
+        // so that a retransmitted syn while quiesced does not close a live sequence
+        if !self.sequenceGate.open() {
+            glog.V(1).Infof("[lnr]tcp drop quiesced %s\n", source)
+            return nil
+        }
+
         if sequence, ok := self.sequences[bufferId]; ok {
             sequence.Cancel()
             delete(self.sequences, bufferId)
@@ -1104,6 +1941,7 @@ func (self *TcpBuffer[BufferId]) tcpSend(
             self.ctx,
             self.receiveCallback,
             source,
+            provideMode,
             ipVersion,
             sourceIp,
             tcp.SrcPort,
@@ -1111,8 +1949,12 @@ func (self *TcpBuffer[BufferId]) tcpSend(
             tcp.DstPort,
             self.tcpBufferSettings,
         )
+        sequence.dialLimiter = self.dialLimiter
+        sequence.receiveStats = self.receiveStats
+        sequence.synSeq = tcp.Seq
         self.sequences[bufferId] = sequence
         go func() {
+            defer self.sequenceGate.close()
             sequence.Run()
 
             self.mutex.Lock()
@@ -1135,7 +1977,7 @@ func (self *TcpBuffer[BufferId]) tcpSend(
         tcp: tcp,
     }
     if sequence := initSequence(); sequence == nil {
-        // sequence does not exist and not a syn packet, drop
+        // sequence does not exist and not a syn packet, or quiesced, drop
         return false, nil
     } else {
         return sequence.send(sendItem, timeout)
@@ -1156,18 +1998,26 @@ type TcpSequence struct {
     cancel context.CancelFunc
     
     receiveCallback ReceivePacketFunction
+    // optional
+    receiveStats receiveStatsFunction
 
     tcpBufferSettings *TcpBufferSettings
+    // optional. See `TcpBufferSettings.MaxConcurrentDialsPerSource`
+    dialLimiter *sourceDialLimiter
 
     sendItems chan *TcpSendItem
 
     idleCondition *IdleCondition
 
+    // the initial sequence number of the SYN that opened the sequence
+    synSeq uint32
+
     ConnectionState
 }
 
 func NewTcpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
         source Path,
+        provideMode protocol.ProvideMode,
         ipVersion int,
         sourceIp net.IP, sourcePort layers.TCPPort,
         destinationIp net.IP, destinationPort layers.TCPPort,
@@ -1183,6 +2033,7 @@ func NewTcpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
 
     connectionState := ConnectionState{
         source: source,
+        provideMode: provideMode,
         ipVersion: ipVersion,
         sourceIp: sourceIp,
         sourcePort: sourcePort,
@@ -1203,6 +2054,15 @@ func NewTcpSequence(ctx context.Context, receiveCallback ReceivePacketFunction,
     }
 }
 
+// true if the SYN is a retransmit of the SYN that opened the sequence,
+// and the sequence has not yet connected upstream
+func (self *TcpSequence) duplicateSyn(tcp *layers.TCP) bool {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    return !self.connected && tcp.Seq == self.synSeq
+}
+
 func (self *TcpSequence) send(sendItem *TcpSendItem, timeout time.Duration) (bool, error) {
     if !self.idleCondition.UpdateOpen() {
         return false, nil
@@ -1243,14 +2103,27 @@ func (self *TcpSequence) send(sendItem *TcpSendItem, timeout time.Duration) (boo
     }
 }
 
+func (self *TcpSequence) connectResult(latency time.Duration, err error) {
+    if onConnectResult := self.tcpBufferSettings.OnConnectResult; onConnectResult != nil {
+        HandleError(func() {
+            onConnectResult(NewTransferPath(self.source, Path{}), self.DestinationAuthority(), latency, err)
+        })
+    }
+}
+
 func (self *TcpSequence) Run() {
     defer self.cancel()
 
     receive := func(packet []byte) {
+        if self.receiveStats != nil {
+            self.receiveStats(self.ipVersion, IpProtocolTcp, int(self.destinationPort), len(packet))
+        }
         self.receiveCallback(self.source, IpProtocolTcp, packet)
     }
 
     closed := false
+    // set on a failed connect. The result is reported after the RST
+    var reportConnectError func()
     // send a final FIN+ACK
     defer func() {
         if closed {
@@ -1269,6 +2142,9 @@ func (self *TcpSequence) Run() {
                 receive(packet)
             }
         }
+        if reportConnectError != nil {
+            reportConnectError()
+        }
     }()
 
 
@@ -1295,7 +2171,9 @@ func (self *TcpSequence) Run() {
                     // this is arbitrary, and since there is no transport security risk back to sender is fine
                     self.receiveSeq = sendItem.tcp.Seq
                     self.receiveSeqAck = sendItem.tcp.Seq
-                    self.receiveWindowSize = sendItem.tcp.Window
+                    self.receiveWindowScaleEnabled, self.receiveWindowScale = tcpWindowScale(sendItem.tcp)
+                    // the window in the SYN is never scaled
+                    self.receiveWindowSize = uint32(sendItem.tcp.Window)
                     packet, err = self.SynAck()
                     self.receiveSeq += 1
                 }()
@@ -1313,20 +2191,54 @@ func (self *TcpSequence) Run() {
     }
 
     glog.V(2).Infof("[init]tcp connect\n")
-    socket, err := net.DialTimeout(
-        "tcp",
-        self.DestinationAuthority(),
-        self.tcpBufferSettings.ConnectTimeout,
-    )
+    dialContext := self.tcpBufferSettings.DialContextGen(self.provideMode)
+    connectCtx, connectCancel := context.WithTimeout(self.ctx, self.tcpBufferSettings.ConnectTimeout)
+    connectStartTime := time.Now()
+    var socket net.Conn
+    var err error
+    // the wait for a dial counts against the connect timeout
+    if self.dialLimiter.acquire(connectCtx, self.source) {
+        if self.tcpBufferSettings.PreserveSourcePort {
+            socket, _, err = dialWithSourcePort(
+                connectCtx,
+                dialContext,
+                "tcp",
+                self.DestinationAuthority(),
+                int(self.sourcePort),
+            )
+        } else {
+            socket, err = dialContext(
+                connectCtx,
+                "tcp",
+                self.DestinationAuthority(),
+            )
+        }
+        self.dialLimiter.release(self.source)
+    } else {
+        err = errors.New("Dial limit timeout.")
+    }
+    connectCancel()
+    connectLatency := time.Now().Sub(connectStartTime)
     if err != nil {
         glog.Infof("[init]tcp connect error = %s\n", err)
+        reportConnectError = func() {
+            self.connectResult(connectLatency, err)
+        }
         return
     }
+    self.connectResult(connectLatency, nil)
     defer socket.Close()
 
-    // tcpSocket := socket.(*net.TCPConn)
-    // tcpSocket.SetNoDelay(false)
+    if tcpSocket, ok := socket.(*net.TCPConn); ok {
+        setTcpSocketBuffers(tcpSocket, self.tcpBufferSettings)
+    }
     
+    func() {
+        self.mutex.Lock()
+        defer self.mutex.Unlock()
+
+        self.connected = true
+    }()
     self.UpdateLastActivityTime()
     glog.V(2).Infof("[init]connect success\n")
 
@@ -1341,7 +2253,16 @@ func (self *TcpSequence) Run() {
     go func() {
         defer self.cancel()
 
-        buffer := make([]byte, self.tcpBufferSettings.ReadBufferByteCount)
+        // limit each read to the max fragments
+        buffer := make([]byte, min(
+            self.tcpBufferSettings.ReadBufferByteCount,
+            maxFragmentPayloadByteCount(
+                self.ipVersion,
+                TcpHeaderSizeWithoutExtensions,
+                self.tcpBufferSettings.Mtu,
+                self.tcpBufferSettings.MaxFragmentCount,
+            ),
+        ))
         
         
         for forwardIter := uint64(0); ; forwardIter += 1 {
@@ -1365,47 +2286,80 @@ func (self *TcpSequence) Run() {
 
                 // since the transfer from local to remove is lossless and preserves order,
                 // do not worry about retransmits
-                var packets [][]byte
-                var packetsErr error
-                func() {
-                    self.mutex.Lock()
-                    defer self.mutex.Unlock()
+                // the read is sent in parts as the receive window opens,
+                // so that a receive window smaller than the read does not stall the sequence
+                for i := 0; i < n; {
+                    var packets [][]byte
+                    var packetsErr error
+                    var probePacket []byte
+                    func() {
+                        self.mutex.Lock()
+                        defer self.mutex.Unlock()
+
+                        var probeTimer *time.Timer
+                        defer func() {
+                            if probeTimer != nil {
+                                probeTimer.Stop()
+                            }
+                        }()
+
+                        for self.receiveWindowSize <= self.receiveSeq - self.receiveSeqAck {
+                            select {
+                            case <- self.ctx.Done():
+                                return
+                            default:
+                            }
+                            if probeTimer == nil {
+                                probeTimer = time.AfterFunc(self.tcpBufferSettings.WindowProbeTimeout, func() {
+                                    self.mutex.Lock()
+                                    defer self.mutex.Unlock()
+
+                                    receiveAckCond.Broadcast()
+                                })
+                            } else if !probeTimer.Stop() {
+                                // the probe timer fired
+                                // send the probe outside the lock and continue to wait
+                                glog.V(2).Infof("[f%d]tcp receive window probe\n", forwardIter)
+                                probePacket, packetsErr = self.WindowProbe()
+                                return
+                            } else {
+                                probeTimer.Reset(self.tcpBufferSettings.WindowProbeTimeout)
+                            }
+                            glog.V(2).Infof("[f%d]tcp receive window wait\n", forwardIter)
+                            receiveAckCond.Wait()
+                        }
+
+                        m := min(n - i, int(self.receiveWindowSize - (self.receiveSeq - self.receiveSeqAck)))
+                        packets, packetsErr = self.DataPackets(buffer[i:], m, self.tcpBufferSettings.Mtu)
+                        if packetsErr != nil {
+                            glog.Infof("[f%d]tcp receive packets error = %s\n", forwardIter, packetsErr)
+                            return
+                        }
 
-                    packets, packetsErr = self.DataPackets(buffer, n, self.tcpBufferSettings.Mtu)
+                        if 1 < len(packets) {
+                            glog.V(2).Infof("[f%d]tcp receive segmented packets %d\n", forwardIter, len(packets))
+                        }
+                        glog.V(2).Infof("[f%d]tcp receive %d/%d %d %d\n", forwardIter, m, n, len(packets), self.receiveSeq)
+
+                        self.receiveSeq += uint32(m)
+                        i += m
+                    }()
                     if packetsErr != nil {
-                        glog.Infof("[f%d]tcp receive packets error = %s\n", forwardIter, packetsErr)
                         return
                     }
 
-                    if 1 < len(packets) {
-                        glog.V(2).Infof("[f%d]tcp receive segmented packets %d\n", forwardIter, len(packets))
+                    select {
+                    case <- self.ctx.Done():
+                        return
+                    default:
                     }
-                    glog.V(2).Infof("[f%d]tcp receive %d %d %d\n", forwardIter, n, len(packets), self.receiveSeq)
 
-                    for uint32(self.receiveWindowSize) < self.receiveSeq - self.receiveSeqAck + uint32(n) {
-                        glog.V(2).Infof("[f%d]tcp receive window wait\n", forwardIter)
-                        receiveAckCond.Wait()
-                        select {
-                        case <- self.ctx.Done():
-                            return
-                        default:
-                        }
+                    if probePacket != nil {
+                        receive(probePacket)
+                    }
+                    for _, packet := range packets { 
+                        receive(packet)
                     }
-
-                    self.receiveSeq += uint32(n)
-                }()
-                if packetsErr != nil {
-                    return
-                }
-
-                select {
-                case <- self.ctx.Done():
-                    return
-                default:
-                }
-
-                for _, packet := range packets { 
-                    receive(packet)
                 }
             }
             
@@ -1472,7 +2426,7 @@ func (self *TcpSequence) Run() {
                         // note the window size can be be adjusted at any time for the same receive seq number, 
                         // e.g. ->0 then ->full on receiver full
                         if self.receiveSeqAck <= sendItem.tcp.Ack {
-                            self.receiveWindowSize = sendItem.tcp.Window
+                            self.receiveWindowSize = uint32(sendItem.tcp.Window) << self.receiveWindowScale
                             self.receiveSeqAck = sendItem.tcp.Ack
                             receiveAckCond.Broadcast()
                         }
@@ -1572,6 +2526,22 @@ func (self *TcpSequence) Run() {
     }
 }
 
+// failures to set the buffer sizes are logged and the socket continues with the os default
+func setTcpSocketBuffers(tcpSocket *net.TCPConn, tcpBufferSettings *TcpBufferSettings) {
+    if 0 < tcpBufferSettings.SocketWriteBufferByteCount {
+        err := tcpSocket.SetWriteBuffer(tcpBufferSettings.SocketWriteBufferByteCount)
+        if err != nil {
+            glog.Infof("[init]tcp set write buffer error = %s\n", err)
+        }
+    }
+    if 0 < tcpBufferSettings.SocketReadBufferByteCount {
+        err := tcpSocket.SetReadBuffer(tcpBufferSettings.SocketReadBufferByteCount)
+        if err != nil {
+            glog.Infof("[init]tcp set read buffer error = %s\n", err)
+        }
+    }
+}
+
 type TcpSendItem struct {
     provideMode protocol.ProvideMode
     tcp *layers.TCP
@@ -1579,6 +2549,7 @@ type TcpSendItem struct {
 
 type ConnectionState struct {
     source Path
+    provideMode protocol.ProvideMode
     ipVersion int
     sourceIp net.IP
     sourcePort layers.TCPPort
@@ -1590,8 +2561,15 @@ type ConnectionState struct {
     sendSeq uint32
     receiveSeq uint32
     receiveSeqAck uint32
-    receiveWindowSize uint16
+    // the receive window size is scaled by the source window scale
+    receiveWindowSize uint32
+    // the window scale is in effect only when the source sends the option in the SYN
+    // https://datatracker.ietf.org/doc/html/rfc7323#section-2.2
+    receiveWindowScaleEnabled bool
+    receiveWindowScale uint8
     windowSize uint16
+    // the upstream socket is connected
+    connected bool
 
     userLimited
 }
@@ -1642,11 +2620,21 @@ func (self *ConnectionState) SynAck() ([]byte, error) {
         ACK: true,
         SYN: true,
         Window: self.windowSize,
-        // TODO window scale
-        // https://datatracker.ietf.org/doc/html/rfc1323#page-8
     }
     tcp.SetNetworkLayerForChecksum(ip)
     headerSize += TcpHeaderSizeWithoutExtensions
+    if self.receiveWindowScaleEnabled {
+        // the source window scale is in effect only if the option is returned
+        // we do not scale our own window (shift count 0)
+        // https://datatracker.ietf.org/doc/html/rfc7323#section-2.2
+        tcp.Options = append(tcp.Options, layers.TCPOption{
+            OptionType: layers.TCPOptionKindWindowScale,
+            OptionLength: 3,
+            OptionData: []byte{0},
+        })
+        // padded to a multiple of 4
+        headerSize += 4
+    }
 
     options := gopacket.SerializeOptions{
         ComputeChecksums: true,
@@ -1721,6 +2709,63 @@ func (self *ConnectionState) PureAck() ([]byte, error) {
     return packet, nil
 }
 
+// a zero window probe is an ACK one before the receive seq,
+// which the source acknowledges with its current window
+// https://datatracker.ietf.org/doc/html/rfc9293#section-3.8.6.1
+func (self *ConnectionState) WindowProbe() ([]byte, error) {
+    headerSize := 0
+    var ip gopacket.NetworkLayer
+    switch self.ipVersion {
+    case 4:
+        ip = &layers.IPv4{
+            Version: 4,
+            TTL: 64,
+            SrcIP: self.destinationIp,
+            DstIP: self.sourceIp,
+            Protocol: layers.IPProtocolTCP,
+        }
+        headerSize += Ipv4HeaderSizeWithoutExtensions
+    case 6:
+        ip = &layers.IPv6{
+            Version: 6,
+            HopLimit: 64,
+            SrcIP: self.destinationIp,
+            DstIP: self.sourceIp,
+            NextHeader: layers.IPProtocolTCP,
+        }
+        headerSize += Ipv6HeaderSize
+    }
+
+    tcp := layers.TCP{
+        SrcPort: self.destinationPort,
+        DstPort: self.sourcePort,
+        Seq: self.receiveSeq - 1,
+        Ack: self.sendSeq,
+        ACK: true,
+        Window: self.windowSize,
+    }
+    tcp.SetNetworkLayerForChecksum(ip)
+    headerSize += TcpHeaderSizeWithoutExtensions
+
+    options := gopacket.SerializeOptions{
+        ComputeChecksums: true,
+        FixLengths: true,
+    }
+
+    buffer := gopacket.NewSerializeBufferExpectedSize(headerSize, 0)
+
+    err := gopacket.SerializeLayers(buffer, options,
+        ip.(gopacket.SerializableLayer),
+        &tcp,
+    )
+
+    if err != nil {
+        return nil, err
+    }
+    packet := buffer.Bytes()
+    return packet, nil
+}
+
 func (self *ConnectionState) FinAck() ([]byte, error) {
     headerSize := 0
     var ip gopacket.NetworkLayer
@@ -1902,7 +2947,8 @@ func (self *ConnectionState) DataPackets(payload []byte, n int, mtu int) ([][]by
         // fragment
         buffer := gopacket.NewSerializeBufferExpectedSize(mtu, 0)
         packetSize := mtu - headerSize
-        packets := [][]byte{}
+        packetCount := (n + packetSize - 1) / packetSize
+        packets := make([][]byte, 0, packetCount)
         for i := 0; i < n; {
             j := min(i + packetSize, n)
             tcp.Seq = self.receiveSeq + uint32(i)
@@ -1915,6 +2961,8 @@ func (self *ConnectionState) DataPackets(payload []byte, n int, mtu int) ([][]by
                 return nil, err
             }
             packet := buffer.Bytes()
+            // each packet is a separate copy,
+            // so that a packet retained downstream does not retain the other packets
             packetCopy := make([]byte, len(packet))
             copy(packetCopy, packet)
             packets = append(packets, packetCopy)
@@ -1958,16 +3006,32 @@ func tcpFlagsString(tcp *layers.TCP) string {
     return strings.Join(flags, ", ")
 }
 
+// returns whether the SYN has the window scale option, and the shift count
+func tcpWindowScale(tcp *layers.TCP) (bool, uint8) {
+    for _, option := range tcp.Options {
+        if option.OptionType == layers.TCPOptionKindWindowScale && 1 <= len(option.OptionData) {
+            // the max shift count is 14
+            // https://datatracker.ietf.org/doc/html/rfc7323#section-2.3
+            return true, min(option.OptionData[0], 14)
+        }
+    }
+    return false, 0
+}
+
 
 func DefaultRemoteUserNatProviderSettings() *RemoteUserNatProviderSettings {
     return &RemoteUserNatProviderSettings{
         WriteTimeout: 30 * time.Second,
+        DrainQuietTimeout: 1 * time.Second,
     }
 }
 
 
 type RemoteUserNatProviderSettings struct {
     WriteTimeout time.Duration
+    // a drain completes when there are no pending sends
+    // and no packets from the local nat for this timeout
+    DrainQuietTimeout time.Duration
 }
 
 
@@ -1978,6 +3042,13 @@ type RemoteUserNatProvider struct {
     settings *RemoteUserNatProviderSettings
     localUserNatUnsub func()
     clientUnsub func()
+
+    stateLock sync.Mutex
+    draining bool
+    // sends to clients that are not yet acked
+    pendingSendCount int
+    lastReceiveTime time.Time
+    pendingSendUpdate *Monitor
 }
 
 func NewRemoteUserNatProviderWithDefaults(
@@ -1997,6 +3068,7 @@ func NewRemoteUserNatProvider(
         localUserNat: localUserNat,
         securityPolicy: DefaultSecurityPolicy(),
         settings: settings,
+        pendingSendUpdate: NewMonitor(),
     }
 
     localUserNatUnsub := localUserNat.AddReceivePacketCallback(userNatProvider.Receive)
@@ -2034,13 +3106,19 @@ func (self *RemoteUserNatProvider) Receive(source Path, ipProtocol IpProtocol, p
         opts = append(opts, NoAck())
         c := func()(bool) {
             // ack := make(chan error)
+            self.openSend()
             sent := self.client.SendWithTimeout(
                 frame,
                 source.ClientId,
-                func(err error) {},
+                func(err error) {
+                    self.closeSend()
+                },
                 self.settings.WriteTimeout,
                 opts...,
             )
+            if !sent {
+                self.closeSend()
+            }
             return sent
         }
         if glog.V(2) {
@@ -2053,13 +3131,20 @@ func (self *RemoteUserNatProvider) Receive(source Path, ipProtocol IpProtocol, p
         }
     case IpProtocolTcp:
         c := func()(bool) {
-            return self.client.SendWithTimeout(
+            self.openSend()
+            sent := self.client.SendWithTimeout(
                 frame,
                 source.ClientId,
-                func(err error) {},
+                func(err error) {
+                    self.closeSend()
+                },
                 self.settings.WriteTimeout,
                 opts...,
             )
+            if !sent {
+                self.closeSend()
+            }
+            return sent
         }
         if glog.V(2) {
             TraceWithReturn(
@@ -2073,8 +3158,25 @@ func (self *RemoteUserNatProvider) Receive(source Path, ipProtocol IpProtocol, p
 
 }
 
+func (self *RemoteUserNatProvider) openSend() {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    self.pendingSendCount += 1
+    self.lastReceiveTime = time.Now()
+}
+
+func (self *RemoteUserNatProvider) closeSend() {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    self.pendingSendCount -= 1
+    self.pendingSendUpdate.NotifyAll()
+}
+
 // `connect.ReceiveFunction`
 func (self *RemoteUserNatProvider) ClientReceive(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+    // while draining, the local nat is quiesced and refuses packets that would open a new sequence
     for _, frame := range frames {
         switch frame.MessageType {
         case protocol.MessageType_IpIpPacketToProvider:
@@ -2090,7 +3192,11 @@ func (self *RemoteUserNatProvider) ClientReceive(sourceId Id, frames []*protocol
             case SecurityPolicyResultAllow:
                 source := Path{ClientId: sourceId}
                 c := func()(bool) {
-                    return self.localUserNat.SendPacketWithTimeout(source, provideMode, packet, self.settings.WriteTimeout)
+                    success, err := self.localUserNat.SendPacketDetailed(source, provideMode, packet, self.settings.WriteTimeout)
+                    if err != nil {
+                        glog.V(1).Infof("[unpr]drop %s<-%s = %s\n", self.client.ClientTag(), sourceId, err)
+                    }
+                    return success && err == nil
                 }
                 if glog.V(2) {
                     TraceWithReturn(
@@ -2107,6 +3213,89 @@ func (self *RemoteUserNatProvider) ClientReceive(sourceId Id, frames []*protocol
     }
 }
 
+func (self *RemoteUserNatProvider) IsDraining() bool {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    return self.draining
+}
+
+// refuses new sessions, see `Quiesce`, and waits for the active nat sequences to send their final packets
+// packets from clients for existing sequences, e.g. acks and fins, continue to be forwarded
+// call before closing the client so that in flight responses are not truncated
+// returns true if all sends were acked and either the existing sequences closed
+// or the local nat was quiet for `DrainQuietTimeout` before the timeout
+func (self *RemoteUserNatProvider) Drain(timeout time.Duration) bool {
+    func() {
+        self.stateLock.Lock()
+        defer self.stateLock.Unlock()
+
+        self.draining = true
+    }()
+    self.Quiesce()
+
+    endTime := time.Now().Add(timeout)
+    for {
+        notify := self.pendingSendUpdate.NotifyChannel()
+        pendingSendCount, quietTime := func()(int, time.Time) {
+            self.stateLock.Lock()
+            defer self.stateLock.Unlock()
+
+            return self.pendingSendCount, self.lastReceiveTime.Add(self.settings.DrainQuietTimeout)
+        }()
+
+        // nil once closed, so that the wait does not spin on pending sends
+        sequencesDrained := self.QuiescedAndDrained()
+        sequencesClosed := false
+        select {
+        case <- sequencesDrained:
+            sequencesClosed = true
+            sequencesDrained = nil
+        default:
+        }
+
+        now := time.Now()
+        if pendingSendCount == 0 && (sequencesClosed || !now.Before(quietTime)) {
+            return true
+        }
+
+        waitTimeout := endTime.Sub(now)
+        if waitTimeout <= 0 {
+            glog.Infof("[unp]drain timeout with %d pending sends\n", pendingSendCount)
+            return false
+        }
+        if pendingSendCount == 0 {
+            waitTimeout = min(waitTimeout, quietTime.Sub(now))
+        }
+
+        select {
+        case <- notify:
+        case <- sequencesDrained:
+        case <- time.After(waitTimeout):
+        }
+    }
+}
+
+// stops the local nat from opening new sequences for clients, for maintenance,
+// and refuses contracts from sources that do not already have an open contract
+// existing sequences continue until they close. See `QuiescedAndDrained`
+// note existing sources may still rotate to new contracts,
+// since existing sequences may need more transfer
+func (self *RemoteUserNatProvider) Quiesce() {
+    self.client.ContractManager().Quiesce()
+    self.localUserNat.Quiesce()
+}
+
+func (self *RemoteUserNatProvider) IsQuiesced() bool {
+    return self.localUserNat.IsQuiesced()
+}
+
+// closed when quiesced and all existing sequences have closed
+// it is then safe to `Drain` and close without interrupting sessions
+func (self *RemoteUserNatProvider) QuiescedAndDrained() <-chan struct{} {
+    return self.localUserNat.QuiescedAndDrained()
+}
+
 func (self *RemoteUserNatProvider) Close() {
     // self.client.RemoveReceiveCallback(self.clientCallbackId)
     // self.localUserNat.RemoveReceivePacketCallback(self.localUserNatCallbackId)
@@ -2291,6 +3480,78 @@ const (
 )
 
 
+// well known services, classified by destination port
+// the long tail of ports is bucketed into `NatServiceOther`
+type NatService int
+const (
+    NatServiceOther NatService = 0
+    NatServiceDns NatService = 1
+    NatServiceHttp NatService = 2
+    NatServiceHttps NatService = 3
+    NatServiceQuic NatService = 4
+)
+
+func (self NatService) String() string {
+    switch self {
+    case NatServiceDns:
+        return "dns"
+    case NatServiceHttp:
+        return "http"
+    case NatServiceHttps:
+        return "https"
+    case NatServiceQuic:
+        return "quic"
+    default:
+        return "other"
+    }
+}
+
+func ClassifyNatService(ipProtocol IpProtocol, destinationPort int) NatService {
+    switch {
+    case destinationPort == 53:
+        return NatServiceDns
+    case ipProtocol == IpProtocolTcp && destinationPort == 80:
+        return NatServiceHttp
+    case ipProtocol == IpProtocolTcp && destinationPort == 443:
+        return NatServiceHttps
+    case ipProtocol == IpProtocolUdp && destinationPort == 443:
+        return NatServiceQuic
+    default:
+        return NatServiceOther
+    }
+}
+
+
+// comparable
+type NatServiceKey struct {
+    IpVersion int
+    Protocol IpProtocol
+    Service NatService
+}
+
+
+type LocalUserNatStats struct {
+    // open sequences in the buffers
+    UdpSequenceCount int
+    TcpSequenceCount int
+    // totals of the service stats since the nat started
+    SendByteCount ByteCount
+    ReceiveByteCount ByteCount
+}
+
+
+type NatServiceStats struct {
+    SendPacketCount int64
+    SendByteCount ByteCount
+    ReceivePacketCount int64
+    ReceiveByteCount ByteCount
+    // packets dropped by the `LocalUserNatSettings.PacketFilter`
+    FilteredPacketCount int64
+    // new connections dropped by the `NewConnectionsPerSecond` limit of the source
+    ThrottledConnectionCount int64
+}
+
+
 type IpPath struct {
     Version int
     Protocol IpProtocol
@@ -2509,14 +3770,18 @@ func (self *SecurityPolicy) Inspect(provideMode protocol.ProvideMode, packet []b
         // back ip packet
         return ipPath, SecurityPolicyResultDrop
     }
+    return ipPath, self.InspectPath(provideMode, ipPath)
+}
 
+// inspects a packet that was already parsed
+func (self *SecurityPolicy) InspectPath(provideMode protocol.ProvideMode, ipPath *IpPath) SecurityPolicyResult {
     if protocol.ProvideMode_Public <= provideMode {
         // apply public rules:
         // - only public unicast network destinations
         // - block insecure or known unencrypted traffic
 
         if !isPublicUnicast(ipPath.DestinationIp) {
-            return ipPath, SecurityPolicyResultIncident 
+            return SecurityPolicyResultIncident
         }
 
         // block insecure or unencrypted traffic is implemented as a block list,
@@ -2538,11 +3803,11 @@ func (self *SecurityPolicy) Inspect(provideMode protocol.ProvideMode, packet []b
             }
         }
         if !allow() {
-            return ipPath, SecurityPolicyResultDrop
+            return SecurityPolicyResultDrop
         }
     }
 
-    return ipPath, SecurityPolicyResultAllow
+    return SecurityPolicyResultAllow
 }
 
 
@@ -2622,5 +3887,166 @@ func applyLruUserLimit[R UserLimited](resources []R, ulimit int, limitCallback f
 }
 
 
+// a token bucket per source that limits the rate of new connections
+type sourceLimiter struct {
+    connectionsPerSecond float64
+    burstSize float64
+    throttleCallback func(ipVersion int, ipProtocol IpProtocol, destinationPort int)
+
+    mutex sync.Mutex
+    buckets map[Path]*sourceBucket
+    pruneTime time.Time
+}
+
+type sourceBucket struct {
+    tokens float64
+    updateTime time.Time
+}
+
+// returns nil if there is no limit
+func newSourceLimiter(
+    connectionsPerSecond float64,
+    burstSize int,
+    throttleCallback func(ipVersion int, ipProtocol IpProtocol, destinationPort int),
+) *sourceLimiter {
+    if connectionsPerSecond <= 0 {
+        return nil
+    }
+    if burstSize <= 0 {
+        burstSize = int(math.Ceil(connectionsPerSecond))
+    }
+    return &sourceLimiter{
+        connectionsPerSecond: connectionsPerSecond,
+        burstSize: float64(burstSize),
+        throttleCallback: throttleCallback,
+        buckets: map[Path]*sourceBucket{},
+        pruneTime: time.Now(),
+    }
+}
+
+// takes a token for a new connection from the source
+// returns false if the connection is throttled
+func (self *sourceLimiter) allow(source Path, ipVersion int, ipProtocol IpProtocol, destinationPort int) bool {
+    allow := func()(bool) {
+        self.mutex.Lock()
+        defer self.mutex.Unlock()
+
+        now := time.Now()
+        self.prune(now)
+
+        bucket, ok := self.buckets[source]
+        if !ok {
+            bucket = &sourceBucket{
+                tokens: self.burstSize,
+                updateTime: now,
+            }
+            self.buckets[source] = bucket
+        } else {
+            bucket.tokens = self.refill(bucket, now)
+            bucket.updateTime = now
+        }
+        if bucket.tokens < 1 {
+            return false
+        }
+        bucket.tokens -= 1
+        return true
+    }()
+    if !allow && self.throttleCallback != nil {
+        self.throttleCallback(ipVersion, ipProtocol, destinationPort)
+    }
+    return allow
+}
+
+func (self *sourceLimiter) refill(bucket *sourceBucket, now time.Time) float64 {
+    elapsed := now.Sub(bucket.updateTime).Seconds()
+    return min(self.burstSize, bucket.tokens + elapsed * self.connectionsPerSecond)
+}
+
+// a full bucket is the same as no bucket
+// buckets are pruned at most once per the time to fill a bucket
+func (self *sourceLimiter) prune(now time.Time) {
+    fillTimeout := time.Duration(self.burstSize / self.connectionsPerSecond * float64(time.Second))
+    if now.Sub(self.pruneTime) < fillTimeout {
+        return
+    }
+    self.pruneTime = now
+    for source, bucket := range self.buckets {
+        if self.burstSize <= self.refill(bucket, now) {
+            delete(self.buckets, source)
+        }
+    }
+}
+
+
+// limits the upstream dials in progress per source
+// a nil limiter is no limit
+type sourceDialLimiter struct {
+    maxDials int
+
+    mutex sync.Mutex
+    // source -> dials in progress
+    dialCounts map[Path]int
+    // notified when a dial completes
+    monitor *Monitor
+}
+
+// returns nil if there is no limit
+func newSourceDialLimiter(maxDials int) *sourceDialLimiter {
+    if maxDials <= 0 {
+        return nil
+    }
+    return &sourceDialLimiter{
+        maxDials: maxDials,
+        dialCounts: map[Path]int{},
+        monitor: NewMonitor(),
+    }
+}
+
+// waits for a dial from the source to be allowed
+// returns false if the context is done first
+// each successful acquire must be followed by a release
+func (self *sourceDialLimiter) acquire(ctx context.Context, source Path) bool {
+    if self == nil {
+        return true
+    }
+
+    for {
+        notify := self.monitor.NotifyChannel()
+        acquired := func()(bool) {
+            self.mutex.Lock()
+            defer self.mutex.Unlock()
+
+            if self.maxDials <= self.dialCounts[source] {
+                return false
+            }
+            self.dialCounts[source] += 1
+            return true
+        }()
+        if acquired {
+            return true
+        }
+        select {
+        case <- ctx.Done():
+            return false
+        case <- notify:
+        }
+    }
+}
+
+func (self *sourceDialLimiter) release(source Path) {
+    if self == nil {
+        return
+    }
 
+    func() {
+        self.mutex.Lock()
+        defer self.mutex.Unlock()
 
+        if dialCount := self.dialCounts[source] - 1; 0 < dialCount {
+            self.dialCounts[source] = dialCount
+        } else {
+            delete(self.dialCounts, source)
+        }
+    }()
+    self.monitor.NotifyAll()
+}
@@ -0,0 +1,149 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestSetTcpSocketBuffers(t *testing.T) {
+	// the upstream socket buffers are set from the settings, and 0 keeps the os default
+	// linux reports double the set size to account for bookkeeping overhead
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	socketBuffers := func(tcpSocket *net.TCPConn) (writeBufferByteCount int, readBufferByteCount int) {
+		rawConn, err := tcpSocket.SyscallConn()
+		assert.Equal(t, nil, err)
+		var writeErr error
+		var readErr error
+		rawConn.Control(func(fd uintptr) {
+			writeBufferByteCount, writeErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+			readBufferByteCount, readErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		})
+		assert.Equal(t, nil, writeErr)
+		assert.Equal(t, nil, readErr)
+		return
+	}
+
+	dial := func() *net.TCPConn {
+		tcpSocket, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		assert.Equal(t, nil, err)
+		return tcpSocket
+	}
+
+	defaultSocket := dial()
+	defer defaultSocket.Close()
+	defaultWriteBufferByteCount, defaultReadBufferByteCount := socketBuffers(defaultSocket)
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	setTcpSocketBuffers(defaultSocket, tcpBufferSettings)
+	writeBufferByteCount, readBufferByteCount := socketBuffers(defaultSocket)
+	assert.Equal(t, defaultWriteBufferByteCount, writeBufferByteCount)
+	assert.Equal(t, defaultReadBufferByteCount, readBufferByteCount)
+
+	// under the default linux max of 208KiB
+	tcpBufferSettings.SocketWriteBufferByteCount = int(kib(48))
+	tcpBufferSettings.SocketReadBufferByteCount = int(kib(40))
+	tcpSocket := dial()
+	defer tcpSocket.Close()
+	setTcpSocketBuffers(tcpSocket, tcpBufferSettings)
+	writeBufferByteCount, readBufferByteCount = socketBuffers(tcpSocket)
+	assert.Equal(t, 2 * tcpBufferSettings.SocketWriteBufferByteCount, writeBufferByteCount)
+	assert.Equal(t, 2 * tcpBufferSettings.SocketReadBufferByteCount, readBufferByteCount)
+
+	// failures are non-fatal
+	tcpSocket.Close()
+	setTcpSocketBuffers(tcpSocket, tcpBufferSettings)
+}
+
+
+func TestUdpSequenceProvideModeSourceIp(t *testing.T) {
+	// binds the loopback aliases 127.0.0.2 and 127.0.0.3, which only exist by default on linux
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer listener.Close()
+	listenerAddr := listener.LocalAddr().(*net.UDPAddr)
+
+	provideModeSourceIps := map[protocol.ProvideMode]net.IP{
+		protocol.ProvideMode_Public: net.IPv4(127, 0, 0, 2).To4(),
+		protocol.ProvideMode_Network: net.IPv4(127, 0, 0, 3).To4(),
+	}
+
+	dialProvideModes := make(chan protocol.ProvideMode, len(provideModeSourceIps))
+	sourceIpDialContextGen := NewSourceIpDialContextGenerator(provideModeSourceIps)
+
+	udpBufferSettings := DefaultUdpBufferSettings()
+	udpBufferSettings.DialContextGen = func(provideMode protocol.ProvideMode)(DialContextFunc) {
+		dialProvideModes <- provideMode
+		return sourceIpDialContextGen(provideMode)
+	}
+
+	for provideMode, sourceIp := range provideModeSourceIps {
+		sequence := NewUdpSequence(
+			ctx,
+			func(source Path, ipProtocol IpProtocol, packet []byte) {},
+			Path{ClientId: NewId()},
+			provideMode,
+			4,
+			net.IPv4(72, 0, 0, 1), layers.UDPPort(40000),
+			listenerAddr.IP, layers.UDPPort(listenerAddr.Port),
+			udpBufferSettings,
+		)
+		go sequence.Run()
+
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(40000),
+			DstPort: layers.UDPPort(listenerAddr.Port),
+		}
+		udp.Payload = []byte(provideMode.String())
+		success, err := sequence.send(&UdpSendItem{
+			provideMode: provideMode,
+			udp: udp,
+		}, timeout)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+
+		select {
+		case dialProvideMode := <- dialProvideModes:
+			assert.Equal(t, provideMode, dialProvideMode)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+
+		buffer := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(timeout))
+		n, addr, err := listener.ReadFromUDP(buffer)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, provideMode.String(), string(buffer[:n]))
+		assert.Equal(t, sourceIp.String(), addr.IP.String())
+
+		sequence.Close()
+	}
+}
@@ -5,10 +5,15 @@ import (
     "testing"
     "time"
 	"encoding/binary"
+	"hash/maphash"
 	"net"
 	"reflect"
-	// "sync"
+	"sync"
 	"fmt"
+	"errors"
+	"math"
+	mathrand "math/rand"
+	"runtime"
 
 	"github.com/google/gopacket"
     "github.com/google/gopacket/layers"
@@ -150,466 +155,2666 @@ func TestTcp6Path(t *testing.T) {
 }
 
 
+func TestUdpSequenceDestinationPortIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-func udp4Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
-	payload = make([]byte, 4)
-    binary.LittleEndian.PutUint32(payload, uint32(s))
-
-	sourceIp := net.IPv4(72, 0, 0, 1)
-	sourcePort := layers.UDPPort(40000 + s)
-	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k))
-	destinationPort := layers.UDPPort(443)
+	udpBufferSettings := DefaultUdpBufferSettings()
+	udpBufferSettings.ReadTimeout = 100 * time.Millisecond
+	udpBufferSettings.IdleTimeout = 1 * time.Second
+	udpBufferSettings.DestinationPortIdleTimeouts = map[int]time.Duration{
+		53: 100 * time.Millisecond,
+		443: 2 * time.Second,
+	}
 
-    ip := &layers.IPv4{
-        Version: 4,
-        TTL: 64,
-        SrcIP: sourceIp,
-        DstIP: destinationIp,
-        Protocol: layers.IPProtocolUDP,
-    }
+	assert.Equal(t, 100 * time.Millisecond, udpBufferSettings.DestinationPortIdleTimeout(53))
+	assert.Equal(t, 2 * time.Second, udpBufferSettings.DestinationPortIdleTimeout(443))
+	assert.Equal(t, 1 * time.Second, udpBufferSettings.DestinationPortIdleTimeout(80))
+
+	runSequence := func(destinationPort layers.UDPPort)(chan time.Duration) {
+		sequence := NewUdpSequence(
+			ctx,
+			func(source Path, ipProtocol IpProtocol, packet []byte) {},
+			Path{ClientId: NewId()},
+			protocol.ProvideMode_Network,
+			4,
+			net.IPv4(127, 0, 0, 1), layers.UDPPort(40000),
+			net.IPv4(127, 0, 0, 1), destinationPort,
+			udpBufferSettings,
+		)
+		done := make(chan time.Duration, 1)
+		go func() {
+			startTime := time.Now()
+			sequence.Run()
+			done <- time.Since(startTime)
+		}()
+		return done
+	}
 
-    udp := layers.UDP{
-        SrcPort: sourcePort,
-        DstPort: destinationPort,
-    }
-    udp.SetNetworkLayerForChecksum(ip)
+	dnsDone := runSequence(53)
+	quicDone := runSequence(443)
 
-    options := gopacket.SerializeOptions{
-        ComputeChecksums: true,
-        FixLengths: true,
-    }
+	var dnsDuration time.Duration
+	select {
+	case dnsDuration = <- dnsDone:
+	case <- time.After(1 * time.Second):
+		t.FailNow()
+	}
 
-    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
-    err := gopacket.SerializeLayers(buffer, options,
-        gopacket.SerializableLayer(ip),
-        &udp,
-        gopacket.Payload(payload),
-    )
-    if err != nil {
-        panic(err)
-    }
-    packet = buffer.Bytes()
+	var quicDuration time.Duration
+	select {
+	case quicDuration = <- quicDone:
+	case <- time.After(4 * time.Second):
+		t.FailNow()
+	}
 
-    return
+	assert.Equal(t, true, dnsDuration < 1 * time.Second)
+	assert.Equal(t, true, 2 * time.Second <= quicDuration)
 }
 
 
-func tcp4Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
-	payload = make([]byte, 4)
-    binary.LittleEndian.PutUint32(payload, uint32(s))
+func TestUdpSequenceDefaultReadTimeout(t *testing.T) {
+	// only a destination port with an idle timeout override extends the read timeout
+	// sequences to other ports keep the read timeout
 
-	sourceIp := net.IPv4(72, 0, 0, 1)
-	sourcePort := layers.TCPPort(40000 + s)
-	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k))
-	destinationPort := layers.TCPPort(443)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-    ip := &layers.IPv4{
-        Version: 4,
-        TTL: 64,
-        SrcIP: sourceIp,
-        DstIP: destinationIp,
-        Protocol: layers.IPProtocolTCP,
-    }
+	udpBufferSettings := DefaultUdpBufferSettings()
+	udpBufferSettings.ReadTimeout = 100 * time.Millisecond
+	udpBufferSettings.IdleTimeout = 1 * time.Second
+	udpBufferSettings.DestinationPortIdleTimeouts = map[int]time.Duration{
+		53: 50 * time.Millisecond,
+		443: 2 * time.Second,
+	}
 
-    tcp := layers.TCP{
-        SrcPort: sourcePort,
-        DstPort: destinationPort,
-        Seq: 0,
-        Ack: 0,
-        Window: 1024,
-    }
-    tcp.SetNetworkLayerForChecksum(ip)
+	assert.Equal(t, 100 * time.Millisecond, udpBufferSettings.DestinationPortReadTimeout(53))
+	assert.Equal(t, 2 * time.Second, udpBufferSettings.DestinationPortReadTimeout(443))
+	assert.Equal(t, 100 * time.Millisecond, udpBufferSettings.DestinationPortReadTimeout(80))
+
+	for _, destinationPort := range []layers.UDPPort{53, 443, 80} {
+		sequence := NewUdpSequence(
+			ctx,
+			func(source Path, ipProtocol IpProtocol, packet []byte) {},
+			Path{ClientId: NewId()},
+			protocol.ProvideMode_Network,
+			4,
+			net.IPv4(127, 0, 0, 1), layers.UDPPort(40000),
+			net.IPv4(127, 0, 0, 1), destinationPort,
+			udpBufferSettings,
+		)
+		assert.Equal(t, udpBufferSettings.DestinationPortReadTimeout(int(destinationPort)), sequence.readTimeout)
+	}
 
-    options := gopacket.SerializeOptions{
-        ComputeChecksums: true,
-        FixLengths: true,
-    }
+	// the default settings have no overrides
+	defaultUdpBufferSettings := DefaultUdpBufferSettings()
+	for _, destinationPort := range []int{53, 443, 80} {
+		assert.Equal(t, defaultUdpBufferSettings.ReadTimeout, defaultUdpBufferSettings.DestinationPortReadTimeout(destinationPort))
+	}
+}
 
-    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
-    err := gopacket.SerializeLayers(buffer, options,
-        gopacket.SerializableLayer(ip),
-        &tcp,
-        gopacket.Payload(payload),
-    )
-    if err != nil {
-        panic(err)
-    }
-    packet = buffer.Bytes()
 
-    return
-}
+func TestSourceIpDialContextMixedFamily(t *testing.T) {
+	// a v4 source ip is not bound for v6 destinations, which would fail with no suitable address
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-func udp6Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
-	payload = make([]byte, 4)
-    binary.LittleEndian.PutUint32(payload, uint32(s))
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("ipv6 loopback not available")
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
 
-	sourceIp := net.IPv4(72, 0, 0, 1).To16()
-	sourcePort := layers.UDPPort(40000 + s)
-	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k)).To16()
-	destinationPort := layers.UDPPort(443)
+	dialContextGen := NewSourceIpDialContextGenerator(map[protocol.ProvideMode]net.IP{
+		protocol.ProvideMode_Public: net.IPv4(127, 0, 0, 1).To4(),
+	})
+	dialContext := dialContextGen(protocol.ProvideMode_Public)
 
-    ip := &layers.IPv6{
-        Version: 6,
-        HopLimit: 64,
-        SrcIP: sourceIp,
-        DstIP: destinationIp,        
-        NextHeader: layers.IPProtocolUDP,
-    }
+	conn, err := dialContext(ctx, "tcp", listener.Addr().String())
+	assert.Equal(t, nil, err)
+	if conn != nil {
+		conn.Close()
+	}
 
-    udp := layers.UDP{
-        SrcPort: sourcePort,
-        DstPort: destinationPort,
-    }
-    udp.SetNetworkLayerForChecksum(ip)
+	assert.Equal(t, true, sameIpFamily(net.IPv4(127, 0, 0, 1), "tcp", "127.0.0.2:80"))
+	assert.Equal(t, false, sameIpFamily(net.IPv4(127, 0, 0, 1), "tcp", "[::1]:80"))
+	assert.Equal(t, false, sameIpFamily(net.IPv4(127, 0, 0, 1), "udp6", "example.com:80"))
+	assert.Equal(t, true, sameIpFamily(net.IPv6loopback, "udp", "[::1]:80"))
+	assert.Equal(t, true, sameIpFamily(net.IPv6loopback, "tcp", "example.com:80"))
+}
 
-    options := gopacket.SerializeOptions{
-        ComputeChecksums: true,
-        FixLengths: true,
-    }
 
-    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
-    err := gopacket.SerializeLayers(buffer, options,
-        gopacket.SerializableLayer(ip),
-        &udp,
-        gopacket.Payload(payload),
-    )
-    if err != nil {
-        panic(err)
-    }
-    packet = buffer.Bytes()
+func TestSequencePreserveSourcePort(t *testing.T) {
+	// the udp and tcp sequences egress from the client source port
+	// when the source port is in use, the udp sequence falls back to an ephemeral port
 
-    return
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	timeout := 5 * time.Second
 
-func tcp6Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
-	payload = make([]byte, 4)
-    binary.LittleEndian.PutUint32(payload, uint32(s))
+	freePort := func()(int) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
 
-	sourceIp := net.IPv4(72, 0, 0, 1).To16()
-	sourcePort := layers.TCPPort(40000 + s)
-	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k)).To16()
-	destinationPort := layers.TCPPort(443)
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	udpBufferSettings := DefaultUdpBufferSettings()
+	udpBufferSettings.PreserveSourcePort = true
+
+	udpSourcePort := func(sourcePort int)(int) {
+		sequence := NewUdpSequence(
+			ctx,
+			func(source Path, ipProtocol IpProtocol, packet []byte) {},
+			Path{ClientId: NewId()},
+			protocol.ProvideMode_Network,
+			4,
+			net.IPv4(72, 0, 0, 1), layers.UDPPort(sourcePort),
+			udpListenerAddr.IP, layers.UDPPort(udpListenerAddr.Port),
+			udpBufferSettings,
+		)
+		go sequence.Run()
+		defer sequence.Close()
+
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(sourcePort),
+			DstPort: layers.UDPPort(udpListenerAddr.Port),
+		}
+		udp.Payload = []byte("hi")
+		success, err := sequence.send(&UdpSendItem{
+			provideMode: protocol.ProvideMode_Network,
+			udp: udp,
+		}, timeout)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+
+		buffer := make([]byte, 1024)
+		udpListener.SetReadDeadline(time.Now().Add(timeout))
+		n, addr, err := udpListener.ReadFromUDP(buffer)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "hi", string(buffer[:n]))
+		return addr.Port
+	}
 
-    ip := &layers.IPv6{
-        Version: 6,
-        HopLimit: 64,
-        SrcIP: sourceIp,
-        DstIP: destinationIp,
-        NextHeader: layers.IPProtocolTCP,
-    }
+	sourcePort := freePort()
+	assert.Equal(t, sourcePort, udpSourcePort(sourcePort))
 
-    tcp := layers.TCP{
-        SrcPort: sourcePort,
-        DstPort: destinationPort,
-        Seq: 0,
-        Ack: 0,
-        Window: 1024,
-    }
-    tcp.SetNetworkLayerForChecksum(ip)
+	// hold the source port so that the sequence cannot bind it
+	sourcePort = freePort()
+	conflict, err := net.ListenUDP("udp", &net.UDPAddr{Port: sourcePort})
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, sourcePort, udpSourcePort(sourcePort))
+	conflict.Close()
 
-    options := gopacket.SerializeOptions{
-        ComputeChecksums: true,
-        FixLengths: true,
-    }
 
-    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
-    err := gopacket.SerializeLayers(buffer, options,
-        gopacket.SerializableLayer(ip),
-        &tcp,
-        gopacket.Payload(payload),
-    )
-    if err != nil {
-        panic(err)
-    }
-    packet = buffer.Bytes()
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer tcpListener.Close()
+	tcpListenerAddr := tcpListener.Addr().(*net.TCPAddr)
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	tcpBufferSettings.PreserveSourcePort = true
+
+	tcpSourcePort := func()(int) {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Equal(t, nil, err)
+		defer listener.Close()
+		return listener.Addr().(*net.TCPAddr).Port
+	}()
+	sequence := NewTcpSequence(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {},
+		Path{ClientId: NewId()},
+		protocol.ProvideMode_Network,
+		4,
+		net.IPv4(72, 0, 0, 1), layers.TCPPort(tcpSourcePort),
+		tcpListenerAddr.IP, layers.TCPPort(tcpListenerAddr.Port),
+		tcpBufferSettings,
+	)
+	go sequence.Run()
+	defer sequence.Close()
+
+	success, err := sequence.send(&TcpSendItem{
+		provideMode: protocol.ProvideMode_Network,
+		tcp: &layers.TCP{
+			SrcPort: layers.TCPPort(tcpSourcePort),
+			DstPort: layers.TCPPort(tcpListenerAddr.Port),
+			SYN: true,
+			Seq: 1000,
+			Window: 1024,
+		},
+	}, timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
 
-    return
+	tcpListener.SetDeadline(time.Now().Add(timeout))
+	conn, err := tcpListener.Accept()
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Equal(t, tcpSourcePort, conn.RemoteAddr().(*net.TCPAddr).Port)
 }
 
+func TestUdpSequenceTruncatedDatagram(t *testing.T) {
+	// a datagram larger than the read buffer is dropped, not forwarded truncated
+	// the read buffer grows so that the next datagram of the same size is received
 
-func testingNewClient(ctx context.Context, providerClient *Client, receivePacketCallback ReceivePacketFunction) (UserNatClient, error) {
-	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	routesSend := []Route{
-		make(chan []byte),
+	timeout := 5 * time.Second
+	payloadByteCount := 4000
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	udpBufferSettings := DefaultUdpBufferSettings()
+	assert.Equal(t, true, udpBufferSettings.ReadBufferByteCount < payloadByteCount)
+
+	receivePayloads := make(chan []byte, 1024)
+	sequence := NewUdpSequence(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {
+			ipv4 := layers.IPv4{}
+			err := ipv4.DecodeFromBytes(packet, gopacket.NilDecodeFeedback)
+			assert.Equal(t, nil, err)
+			udp := layers.UDP{}
+			err = udp.DecodeFromBytes(ipv4.Payload, gopacket.NilDecodeFeedback)
+			assert.Equal(t, nil, err)
+			receivePayloads <- udp.Payload
+		},
+		Path{ClientId: NewId()},
+		protocol.ProvideMode_Network,
+		4,
+		net.IPv4(72, 0, 0, 1), layers.UDPPort(40000),
+		udpListenerAddr.IP, layers.UDPPort(udpListenerAddr.Port),
+		udpBufferSettings,
+	)
+	go sequence.Run()
+	defer sequence.Close()
+
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(40000),
+		DstPort: layers.UDPPort(udpListenerAddr.Port),
 	}
-	routesReceive := []Route{
-		make(chan []byte),
+	udp.Payload = []byte("hi")
+	success, err := sequence.send(&UdpSendItem{
+		provideMode: protocol.ProvideMode_Network,
+		udp: udp,
+	}, timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+
+	buffer := make([]byte, 1024)
+	udpListener.SetReadDeadline(time.Now().Add(timeout))
+	_, sequenceAddr, err := udpListener.ReadFromUDP(buffer)
+	assert.Equal(t, nil, err)
+
+	payload := make([]byte, payloadByteCount)
+	mathrand.Read(payload)
+
+	// truncated and dropped
+	_, err = udpListener.WriteToUDP(payload, sequenceAddr)
+	assert.Equal(t, nil, err)
+	endTime := time.Now().Add(timeout)
+	for sequence.TruncatedDatagramCount() == 0 && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, sequence.TruncatedDatagramCount())
+	select {
+	case <- receivePayloads:
+		t.FailNow()
+	default:
 	}
 
-	transportSend := NewSendGatewayTransport()
-	transportReceive := NewReceiveGatewayTransport()
-	client.RouteManager().UpdateTransport(transportSend, routesSend)
-	client.RouteManager().UpdateTransport(transportReceive, routesReceive)
+	// received whole in fragments
+	_, err = udpListener.WriteToUDP(payload, sequenceAddr)
+	assert.Equal(t, nil, err)
+	receivePayload := []byte{}
+	for len(receivePayload) < payloadByteCount {
+		select {
+		case fragment := <- receivePayloads:
+			receivePayload = append(receivePayload, fragment...)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	assert.Equal(t, payload, receivePayload)
+	assert.Equal(t, 1, sequence.TruncatedDatagramCount())
+}
 
-	client.ContractManager().AddNoContractPeer(providerClient.ClientId())
+func TestTcpSequenceConnectResult(t *testing.T) {
+	// dial an upstream that refuses the connection
+	// the connect result reports the error after the RST is sent to the source
 
-	providerTransportSend := NewSendClientTransport(client.ClientId())
-	providerTransportReceive := NewReceiveGatewayTransport()
-	providerClient.RouteManager().UpdateTransport(providerTransportReceive, routesSend)
-	providerClient.RouteManager().UpdateTransport(providerTransportSend, routesReceive)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	providerClient.ContractManager().AddNoContractPeer(client.ClientId())
+	timeout := 5 * time.Second
 
-	return NewRemoteUserNatClient(
-		client,
-		receivePacketCallback,
-		[]Path{
-			Path{ClientId: providerClient.ClientId()},
+	// reserve a port and close it so that the dial is refused
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	listenerAddr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	type connectResult struct {
+		source TransferPath
+		destination string
+		err error
+	}
+	// connect results and received tcp packets, in order
+	events := make(chan any, 16)
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	tcpBufferSettings.OnConnectResult = func(source TransferPath, destination string, latency time.Duration, err error) {
+		events <- &connectResult{
+			source: source,
+			destination: destination,
+			err: err,
+		}
+	}
+
+	source := Path{ClientId: NewId()}
+	sequence := NewTcpSequence(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {
+			ipPacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+			if tcp, ok := ipPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+				events <- tcp
+			}
 		},
+		source,
 		protocol.ProvideMode_Network,
+		4,
+		net.IPv4(72, 0, 0, 1), layers.TCPPort(40000),
+		listenerAddr.IP, layers.TCPPort(listenerAddr.Port),
+		tcpBufferSettings,
 	)
+	go sequence.Run()
+	defer sequence.Close()
+
+	success, err := sequence.send(&TcpSendItem{
+		provideMode: protocol.ProvideMode_Network,
+		tcp: &layers.TCP{
+			SrcPort: layers.TCPPort(40000),
+			DstPort: layers.TCPPort(listenerAddr.Port),
+			SYN: true,
+			Seq: 1000,
+			Window: 1024,
+		},
+	}, timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+
+	rst := false
+	for !rst {
+		select {
+		case event := <- events:
+			tcp, ok := event.(*layers.TCP)
+			// the connect result must not precede the RST
+			assert.Equal(t, true, ok)
+			rst = tcp.RST
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	select {
+	case event := <- events:
+		result, ok := event.(*connectResult)
+		assert.Equal(t, true, ok)
+		assert.Equal(t, NewTransferPath(source, Path{}), result.source)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", listenerAddr.Port), result.destination)
+		assert.NotEqual(t, nil, result.err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
 }
 
 
-// test with all sequence buffer sizes set to 0
-func testClient[P comparable](
-	t *testing.T,
-	userNatClientGenerator func(context.Context, *Client, ReceivePacketFunction)(UserNatClient, error),
-	packetGenerator PacketGeneratorFunction,
-	toComparableIpPath func(*IpPath)(P),
-) {
-	// runs a send-receive test on the `UserNatClient` produced by `userNatClientGenerator`
-	// this is a multi-threaded stress test that is meant to stress the buffers and routing
+func TestTcpMaxConcurrentDialsPerSource(t *testing.T) {
+	// many simultaneous SYNs from one source
+	// the upstream dials in progress stay within the limit, and the waiting dials run as dials complete
+	// SYN retransmits while the dials wait do not reset the waiting sequences
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+	maxDials := 4
+	n := 32
+
+	dialRelease := make(chan struct{})
+	dialCounts := make(chan int, 2 * n)
+	dialCount := 0
+	dialLock := sync.Mutex{}
+	updateDialCount := func(delta int) {
+		dialLock.Lock()
+		defer dialLock.Unlock()
+		dialCount += delta
+		if 0 < delta {
+			dialCounts <- dialCount
+		}
+	}
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	tcpBufferSettings.MaxConcurrentDialsPerSource = maxDials
+	tcpBufferSettings.DialContextGen = func(provideMode protocol.ProvideMode) DialContextFunc {
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			updateDialCount(1)
+			defer updateDialCount(-1)
+			select {
+			case <- dialRelease:
+			case <- ctx.Done():
+			}
+			return nil, errors.New("Test dial.")
+		}
+	}
+
+	rsts := make(chan *layers.TCP, 2 * n)
+	tcp4Buffer := NewTcp4Buffer(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {
+			ipPacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+			if tcp, ok := ipPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && tcp.RST {
+				rsts <- tcp
+			}
+		},
+		tcpBufferSettings,
+	)
+
+	source := Path{ClientId: NewId()}
+	sendSyn := func(i int) bool {
+		success, err := tcp4Buffer.send(
+			source,
+			protocol.ProvideMode_Network,
+			&layers.IPv4{
+				SrcIP: net.IPv4(72, 0, 0, 1),
+				DstIP: net.IPv4(10, 0, 0, 1),
+			},
+			&layers.TCP{
+				SrcPort: layers.TCPPort(40000 + i),
+				DstPort: layers.TCPPort(443),
+				SYN: true,
+				Seq: 1000,
+				Window: 1024,
+			},
+			timeout,
+		)
+		assert.Equal(t, nil, err)
+		return success
+	}
+	for i := 0; i < n; i += 1 {
+		assert.Equal(t, true, sendSyn(i))
+	}
+
+	nextDialCount := func()(int) {
+		select {
+		case c := <- dialCounts:
+			return c
+		case <- time.After(timeout):
+			t.FailNow()
+			return 0
+		}
+	}
+
+	for i := 0; i < maxDials; i += 1 {
+		assert.Equal(t, true, nextDialCount() <= maxDials)
+	}
+	// the other dials wait
+	select {
+	case <- dialCounts:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+
+	// the retransmits are dropped as duplicates of the waiting SYNs
+	for i := 0; i < n; i += 1 {
+		assert.Equal(t, false, sendSyn(i))
+	}
+	assert.Equal(t, n, tcp4Buffer.sequenceCount())
+	select {
+	case <- rsts:
+		t.Fatal("Waiting sequence was reset.")
+	case <- dialCounts:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+
+	close(dialRelease)
+	for i := maxDials; i < n; i += 1 {
+		assert.Equal(t, true, nextDialCount() <= maxDials)
+	}
+	// each sequence dials once
+	select {
+	case <- dialCounts:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+}
+
+
+func TestTcpSequenceWindow(t *testing.T) {
+	// the source opens with a scaled window of 0 and the sequence probes the source
+	// then the window opens in parts, and each part is sent as the window allows
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+	// the upstream writes more than the first window
+	upstreamData := make([]byte, 200)
+	for i := 0; i < len(upstreamData); i += 1 {
+		upstreamData[i] = byte(i)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer listener.Close()
+	listenerAddr := listener.Addr().(*net.TCPAddr)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(upstreamData)
+		<- ctx.Done()
+	}()
+
+	receiveTcps := make(chan *layers.TCP, 1024)
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	tcpBufferSettings.WindowProbeTimeout = 50 * time.Millisecond
+
+	sequence := NewTcpSequence(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {
+			ipPacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+			if tcp, ok := ipPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+				receiveTcps <- tcp
+			}
+		},
+		Path{ClientId: NewId()},
+		protocol.ProvideMode_Network,
+		4,
+		net.IPv4(72, 0, 0, 1), layers.TCPPort(40000),
+		listenerAddr.IP, layers.TCPPort(listenerAddr.Port),
+		tcpBufferSettings,
+	)
+	go sequence.Run()
+	defer sequence.Close()
+
+	send := func(tcp *layers.TCP) {
+		tcp.SrcPort = layers.TCPPort(40000)
+		tcp.DstPort = layers.TCPPort(listenerAddr.Port)
+		success, err := sequence.send(&TcpSendItem{
+			provideMode: protocol.ProvideMode_Network,
+			tcp: tcp,
+		}, timeout)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+	}
+
+	nextTcp := func() *layers.TCP {
+		select {
+		case tcp := <- receiveTcps:
+			return tcp
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	// waits for a probe, and requires no data before the probe
+	requireProbe := func(seq uint32) {
+		for {
+			tcp := nextTcp()
+			assert.Equal(t, 0, len(tcp.Payload))
+			if tcp.Seq == seq - 1 {
+				return
+			}
+		}
+	}
+
+	// skips probes and requires the next data
+	requireData := func(seq uint32, data []byte) {
+		receiveData := []byte{}
+		for len(receiveData) < len(data) {
+			tcp := nextTcp()
+			if 0 < len(tcp.Payload) {
+				assert.Equal(t, seq + uint32(len(receiveData)), tcp.Seq)
+				receiveData = append(receiveData, tcp.Payload...)
+			}
+		}
+		assert.Equal(t, data, receiveData)
+	}
+
+	// window scale 4, window 0
+	send(&layers.TCP{
+		SYN: true,
+		Seq: 1000,
+		Window: 0,
+		Options: []layers.TCPOption{
+			layers.TCPOption{
+				OptionType: layers.TCPOptionKindWindowScale,
+				OptionLength: 3,
+				OptionData: []byte{4},
+			},
+		},
+	})
+
+	synAck := nextTcp()
+	assert.Equal(t, true, synAck.SYN)
+	assert.Equal(t, true, synAck.ACK)
+	synAckWindowScale, synAckShift := tcpWindowScale(synAck)
+	assert.Equal(t, true, synAckWindowScale)
+	assert.Equal(t, uint8(0), synAckShift)
+	seq := synAck.Seq + 1
+
+	// the SYN+ACK is acked, but the window stays closed
+	send(&layers.TCP{
+		ACK: true,
+		Seq: 1001,
+		Ack: seq,
+		Window: 0,
+	})
+	requireProbe(seq)
+	requireProbe(seq)
+
+	// open the window to 8 << 4 = 128
+	send(&layers.TCP{
+		ACK: true,
+		Seq: 1001,
+		Ack: seq,
+		Window: 8,
+	})
+	requireData(seq, upstreamData[:128])
+	seq += 128
+
+	// the window closes on the ack
+	send(&layers.TCP{
+		ACK: true,
+		Seq: 1001,
+		Ack: seq,
+		Window: 0,
+	})
+	requireProbe(seq)
+
+	// full window
+	send(&layers.TCP{
+		ACK: true,
+		Seq: 1001,
+		Ack: seq,
+		Window: math.MaxUint16,
+	})
+	requireData(seq, upstreamData[128:])
+}
+
+
+func TestDataPacketsBoundedAllocation(t *testing.T) {
+	mtu := 1500
+	maxFragmentCount := 64
+
+	streamState := &StreamState{
+		ipVersion: 4,
+		sourceIp: net.IPv4(10, 0, 0, 1),
+		sourcePort: layers.UDPPort(40000),
+		destinationIp: net.IPv4(72, 0, 0, 1),
+		destinationPort: layers.UDPPort(443),
+	}
+	connectionState := &ConnectionState{
+		ipVersion: 4,
+		sourceIp: net.IPv4(10, 0, 0, 1),
+		sourcePort: layers.TCPPort(40000),
+		destinationIp: net.IPv4(72, 0, 0, 1),
+		destinationPort: layers.TCPPort(443),
+	}
+
+	type dataPacketsCase struct {
+		transportHeaderSize int
+		dataPackets func(payload []byte, n int, mtu int) ([][]byte, error)
+	}
+	for _, c := range []dataPacketsCase{
+		{UdpHeaderSize, streamState.DataPackets},
+		{TcpHeaderSizeWithoutExtensions, connectionState.DataPackets},
+	} {
+		headerSize := Ipv4HeaderSizeWithoutExtensions + c.transportHeaderSize
+
+		// the max payload fragments into exactly the max fragment count
+		n := maxFragmentPayloadByteCount(4, c.transportHeaderSize, mtu, maxFragmentCount)
+		payload := make([]byte, n)
+		mathrand.Read(payload)
+
+		var memStats0 runtime.MemStats
+		var memStats1 runtime.MemStats
+		runtime.ReadMemStats(&memStats0)
+		packets, err := c.dataPackets(payload, n, mtu)
+		runtime.ReadMemStats(&memStats1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, maxFragmentCount, len(packets))
+
+		packetByteCount := 0
+		reassembledPayload := []byte{}
+		for _, packet := range packets {
+			assert.Equal(t, true, len(packet) <= mtu)
+			// packets must not share capacity
+			assert.Equal(t, len(packet), cap(packet))
+			packetByteCount += len(packet)
+			reassembledPayload = append(reassembledPayload, packet[headerSize:]...)
+		}
+		assert.Equal(t, n + maxFragmentCount * headerSize, packetByteCount)
+		assert.Equal(t, payload, reassembledPayload)
+
+		// the packets plus serialization overhead
+		allocByteCount := int(memStats1.TotalAlloc - memStats0.TotalAlloc)
+		assert.Equal(t, true, allocByteCount <= 2 * packetByteCount)
+	}
+
+	// unlimited
+	assert.Equal(t, math.MaxInt, maxFragmentPayloadByteCount(4, UdpHeaderSize, mtu, 0))
+}
+
+
+func BenchmarkDataPackets(b *testing.B) {
+	connectionState := &ConnectionState{
+		ipVersion: 4,
+		sourceIp: net.IPv4(10, 0, 0, 1),
+		sourcePort: layers.TCPPort(40000),
+		destinationIp: net.IPv4(72, 0, 0, 1),
+		destinationPort: layers.TCPPort(443),
+	}
+	n := int(kib(64))
+	payload := make([]byte, n)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		connectionState.DataPackets(payload, n, DefaultMtu)
+	}
+}
+
+
+func BenchmarkBufferId6Map(b *testing.B) {
+	// compares the buffer map keyed by `BufferId6` with a map keyed by a 64-bit fingerprint
+	// of the tuple with collision chaining, at 100k flows.
+	// Each lookup constructs the id from the packet fields, as on the packet path,
+	// so the fingerprint is computed per lookup
+
+	flowCount := 100000
+
+	type flow struct {
+		source Path
+		sourceIp net.IP
+		sourcePort int
+		destinationIp net.IP
+		destinationPort int
+	}
+	flows := make([]flow, flowCount)
+	for i := 0; i < flowCount; i += 1 {
+		sourceIp := make(net.IP, 16)
+		mathrand.Read(sourceIp)
+		destinationIp := make(net.IP, 16)
+		mathrand.Read(destinationIp)
+		flows[i] = flow{
+			source: Path{ClientId: NewId()},
+			sourceIp: sourceIp,
+			sourcePort: mathrand.Intn(65536),
+			destinationIp: destinationIp,
+			destinationPort: 443,
+		}
+	}
+	newBufferId := func(f *flow) BufferId6 {
+		return NewBufferId6(f.source, f.sourceIp, f.sourcePort, f.destinationIp, f.destinationPort)
+	}
+
+	seed := maphash.MakeSeed()
+	fingerprint := func(bufferId *BufferId6) uint64 {
+		var h maphash.Hash
+		h.SetSeed(seed)
+		h.Write(bufferId.source.ClientId[:])
+		h.Write(bufferId.source.StreamId[:])
+		h.Write(bufferId.sourceIp[:])
+		h.Write(bufferId.destinationIp[:])
+		var ports [4]byte
+		binary.BigEndian.PutUint16(ports[0:2], uint16(bufferId.sourcePort))
+		binary.BigEndian.PutUint16(ports[2:4], uint16(bufferId.destinationPort))
+		h.Write(ports[:])
+		return h.Sum64()
+	}
+
+	b.Run("map", func(b *testing.B) {
+		sequences := map[BufferId6]*UdpSequence{}
+		for i := range flows {
+			sequences[newBufferId(&flows[i])] = &UdpSequence{}
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i += 1 {
+			if sequences[newBufferId(&flows[i % flowCount])] == nil {
+				b.FailNow()
+			}
+		}
+	})
+
+	b.Run("fingerprint", func(b *testing.B) {
+		type entry struct {
+			bufferId BufferId6
+			sequence *UdpSequence
+		}
+		sequences := map[uint64][]entry{}
+		for i := range flows {
+			bufferId := newBufferId(&flows[i])
+			h := fingerprint(&bufferId)
+			sequences[h] = append(sequences[h], entry{
+				bufferId: bufferId,
+				sequence: &UdpSequence{},
+			})
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i += 1 {
+			bufferId := newBufferId(&flows[i % flowCount])
+			var sequence *UdpSequence
+			for _, e := range sequences[fingerprint(&bufferId)] {
+				if e.bufferId == bufferId {
+					sequence = e.sequence
+					break
+				}
+			}
+			if sequence == nil {
+				b.FailNow()
+			}
+		}
+	})
+}
+
+
+func TestLocalUserNatSendPacketDetailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultLocalUserNatSettings()
+	settings.SecurityPolicy = DefaultSecurityPolicy()
+
+	// do not run the nat so that the buffer fills
+	localUserNat := &LocalUserNat{
+		ctx: ctx,
+		cancel: cancel,
+		clientTag: "test",
+		sendPackets: make(chan *SendPacket, 1),
+		settings: settings,
+		receiveCallbacks: NewCallbackList[ReceivePacketFunction](),
+	}
+
+	source := Path{ClientId: NewId()}
+
+	serialize := func(layers_ ...gopacket.SerializableLayer)([]byte) {
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, layers_...)
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	ip := &layers.IPv4{
+		Version: 4,
+		TTL: 64,
+		SrcIP: net.IPv4(72, 0, 0, 1),
+		DstIP: net.IPv4(72, 1, 1, 1),
+		Protocol: layers.IPProtocolICMPv4,
+	}
+	icmpPacket := serialize(
+		ip,
+		&layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0),
+		},
+		gopacket.Payload([]byte{0, 1, 2, 3}),
+	)
+
+	ip.Protocol = layers.IPProtocolUDP
+	httpUdp := &layers.UDP{
+		SrcPort: 40000,
+		DstPort: 80,
+	}
+	httpUdp.SetNetworkLayerForChecksum(ip)
+	httpPacket := serialize(ip, httpUdp, gopacket.Payload([]byte{0, 1, 2, 3}))
+
+	packet, _ := udp4Packet(1, 1, 1, 1)
+
+
+	success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, []byte{}, 0)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketDecode))
+
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, packet[:Ipv4HeaderSizeWithoutExtensions + 4], 0)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketDecode))
+
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, icmpPacket, 0)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketUnsupportedProtocol))
+
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, httpPacket, 0)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketFiltered))
+
+	// the network provide mode does not filter
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, httpPacket, 0)
+	assert.Equal(t, true, success)
+	assert.Equal(t, nil, err)
+
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, packet, 0)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketBufferFull))
+
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, packet, 10 * time.Millisecond)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrPacketBufferFull))
+
+	assert.Equal(t, false, localUserNat.SendPacket(source, protocol.ProvideMode_Public, packet, 0))
+
+	<- localUserNat.sendPackets
+
+	assert.Equal(t, true, localUserNat.SendPacket(source, protocol.ProvideMode_Public, packet, 0))
+
+	<- localUserNat.sendPackets
+
+	// the default settings do not inspect packets
+	localUserNat.settings = DefaultLocalUserNatSettings()
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, httpPacket, 0)
+	assert.Equal(t, true, success)
+	assert.Equal(t, nil, err)
+
+	// a closed nat is done
+	localUserNat.Close()
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Public, httpPacket, -1)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrDone))
+}
+
+
+func udp4Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
+	payload = make([]byte, 4)
+    binary.LittleEndian.PutUint32(payload, uint32(s))
+
+	sourceIp := net.IPv4(72, 0, 0, 1)
+	sourcePort := layers.UDPPort(40000 + s)
+	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k))
+	destinationPort := layers.UDPPort(443)
+
+    ip := &layers.IPv4{
+        Version: 4,
+        TTL: 64,
+        SrcIP: sourceIp,
+        DstIP: destinationIp,
+        Protocol: layers.IPProtocolUDP,
+    }
+
+    udp := layers.UDP{
+        SrcPort: sourcePort,
+        DstPort: destinationPort,
+    }
+    udp.SetNetworkLayerForChecksum(ip)
+
+    options := gopacket.SerializeOptions{
+        ComputeChecksums: true,
+        FixLengths: true,
+    }
+
+    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
+    err := gopacket.SerializeLayers(buffer, options,
+        gopacket.SerializableLayer(ip),
+        &udp,
+        gopacket.Payload(payload),
+    )
+    if err != nil {
+        panic(err)
+    }
+    packet = buffer.Bytes()
+
+    return
+}
+
+
+func tcp4Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
+	payload = make([]byte, 4)
+    binary.LittleEndian.PutUint32(payload, uint32(s))
+
+	sourceIp := net.IPv4(72, 0, 0, 1)
+	sourcePort := layers.TCPPort(40000 + s)
+	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k))
+	destinationPort := layers.TCPPort(443)
+
+    ip := &layers.IPv4{
+        Version: 4,
+        TTL: 64,
+        SrcIP: sourceIp,
+        DstIP: destinationIp,
+        Protocol: layers.IPProtocolTCP,
+    }
+
+    tcp := layers.TCP{
+        SrcPort: sourcePort,
+        DstPort: destinationPort,
+        Seq: 0,
+        Ack: 0,
+        Window: 1024,
+    }
+    tcp.SetNetworkLayerForChecksum(ip)
+
+    options := gopacket.SerializeOptions{
+        ComputeChecksums: true,
+        FixLengths: true,
+    }
+
+    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
+    err := gopacket.SerializeLayers(buffer, options,
+        gopacket.SerializableLayer(ip),
+        &tcp,
+        gopacket.Payload(payload),
+    )
+    if err != nil {
+        panic(err)
+    }
+    packet = buffer.Bytes()
+
+    return
+}
+
+
+func udp6Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
+	payload = make([]byte, 4)
+    binary.LittleEndian.PutUint32(payload, uint32(s))
+
+	sourceIp := net.IPv4(72, 0, 0, 1).To16()
+	sourcePort := layers.UDPPort(40000 + s)
+	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k)).To16()
+	destinationPort := layers.UDPPort(443)
+
+    ip := &layers.IPv6{
+        Version: 6,
+        HopLimit: 64,
+        SrcIP: sourceIp,
+        DstIP: destinationIp,        
+        NextHeader: layers.IPProtocolUDP,
+    }
+
+    udp := layers.UDP{
+        SrcPort: sourcePort,
+        DstPort: destinationPort,
+    }
+    udp.SetNetworkLayerForChecksum(ip)
+
+    options := gopacket.SerializeOptions{
+        ComputeChecksums: true,
+        FixLengths: true,
+    }
+
+    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
+    err := gopacket.SerializeLayers(buffer, options,
+        gopacket.SerializableLayer(ip),
+        &udp,
+        gopacket.Payload(payload),
+    )
+    if err != nil {
+        panic(err)
+    }
+    packet = buffer.Bytes()
+
+    return
+}
+
+
+func tcp6Packet(s int, i int, j int, k int)(packet []byte, payload []byte) {
+	payload = make([]byte, 4)
+    binary.LittleEndian.PutUint32(payload, uint32(s))
+
+	sourceIp := net.IPv4(72, 0, 0, 1).To16()
+	sourcePort := layers.TCPPort(40000 + s)
+	destinationIp := net.IPv4(byte(72), byte(1 + i), byte(1 + j), byte(1 + k)).To16()
+	destinationPort := layers.TCPPort(443)
+
+    ip := &layers.IPv6{
+        Version: 6,
+        HopLimit: 64,
+        SrcIP: sourceIp,
+        DstIP: destinationIp,
+        NextHeader: layers.IPProtocolTCP,
+    }
+
+    tcp := layers.TCP{
+        SrcPort: sourcePort,
+        DstPort: destinationPort,
+        Seq: 0,
+        Ack: 0,
+        Window: 1024,
+    }
+    tcp.SetNetworkLayerForChecksum(ip)
+
+    options := gopacket.SerializeOptions{
+        ComputeChecksums: true,
+        FixLengths: true,
+    }
+
+    buffer := gopacket.NewSerializeBufferExpectedSize(1024, 0)
+    err := gopacket.SerializeLayers(buffer, options,
+        gopacket.SerializableLayer(ip),
+        &tcp,
+        gopacket.Payload(payload),
+    )
+    if err != nil {
+        panic(err)
+    }
+    packet = buffer.Bytes()
+
+    return
+}
+
+
+func testingNewClient(ctx context.Context, providerClient *Client, receivePacketCallback ReceivePacketFunction) (UserNatClient, error) {
+	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+
+	routesSend := []Route{
+		make(chan []byte),
+	}
+	routesReceive := []Route{
+		make(chan []byte),
+	}
+
+	transportSend := NewSendGatewayTransport()
+	transportReceive := NewReceiveGatewayTransport()
+	client.RouteManager().UpdateTransport(transportSend, routesSend)
+	client.RouteManager().UpdateTransport(transportReceive, routesReceive)
+
+	client.ContractManager().AddNoContractPeer(providerClient.ClientId())
+
+	providerTransportSend := NewSendClientTransport(client.ClientId())
+	providerTransportReceive := NewReceiveGatewayTransport()
+	providerClient.RouteManager().UpdateTransport(providerTransportReceive, routesSend)
+	providerClient.RouteManager().UpdateTransport(providerTransportSend, routesReceive)
+
+	providerClient.ContractManager().AddNoContractPeer(client.ClientId())
+
+	return NewRemoteUserNatClient(
+		client,
+		receivePacketCallback,
+		[]Path{
+			Path{ClientId: providerClient.ClientId()},
+		},
+		protocol.ProvideMode_Network,
+	)
+}
+
+
+// test with all sequence buffer sizes set to 0
+func testClient[P comparable](
+	t *testing.T,
+	userNatClientGenerator func(context.Context, *Client, ReceivePacketFunction)(UserNatClient, error),
+	packetGenerator PacketGeneratorFunction,
+	toComparableIpPath func(*IpPath)(P),
+) {
+	// runs a send-receive test on the `UserNatClient` produced by `userNatClientGenerator`
+	// this is a multi-threaded stress test that is meant to stress the buffers and routing
+
+
+	// n destinations
+	// all have the same receiver callback, put into a channel of messages
+	// echo the received packet
+
+	// create fake packets for all iterations of i,j,k in a range
+	// retransmit some packets by increasing source port s
+	// make sure all packets are received
+	// make sure all packets are echoed back
+
+
+	timeout := 30 * time.Second
+
+	m := 6
+	n := 6
+	repeatCount := 6
+	parallelCount := 6
+	echoCount := 2
+
+
+	// each packet gets echoed back
+	totalCount := parallelCount * m * n * n * n * repeatCount * (1 + echoCount)
+
+	// cMutex := sync.Mutex{}
+	// cSendCount := 0
+	// cReceiveCount := 0
+
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientId := NewId()
+	providerClientId := NewId()
+
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.SequenceBufferSize = 0
+	settings.SendBufferSettings.AckBufferSize = 0
+	settings.ReceiveBufferSettings.SequenceBufferSize = 0
+	// settings.ReceiveBufferSettings.AckBufferSize = 0
+	settings.ForwardBufferSettings.SequenceBufferSize = 0
+	providerClient := NewClient(ctx, providerClientId, NewNoContractClientOob(), settings)
+	defer providerClient.Cancel()
+
+
+	type receivePacket struct {
+		sourceId Id
+		packet []byte
+	}
+
+	receivePackets := make(chan *receivePacket)
+
+
+	receivePacketCallback := func(source Path, ipProtocol IpProtocol, packet []byte) {
+		// record the echo packet
+
+		// cMutex.Lock()
+		// cReceiveCount += 1
+		// // fmt.Printf("C Receive %d/%d (%.2f%%)\n", cReceiveCount, totalCount, 100.0 * float32(cReceiveCount) / float32(totalCount))
+		// cMutex.Unlock()
+
+        receivePacket := &receivePacket{
+        	sourceId: source.ClientId,
+        	packet: packet,
+        }
+
+        receivePackets <- receivePacket
+	}
+
+
+	natClient, err := userNatClientGenerator(ctx, providerClient, receivePacketCallback)
+	assert.Equal(t, err, nil)
+
+
+	providerClient.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		// cMutex.Lock()
+		// cReceiveCount += 1
+		// // fmt.Printf("C Receive %d/%d (%.2f%%)\n", cReceiveCount, totalCount, 100.0 * float32(cReceiveCount) / float32(totalCount))
+		// cMutex.Unlock()
+
+		echo := func(packet []byte) {
+            ipPacketFromProvider := &protocol.IpPacketFromProvider{
+		        IpPacket: &protocol.IpPacket{
+		            PacketBytes: packet,
+		        },
+		    }
+		    frame, err := ToFrame(ipPacketFromProvider)
+		    if err != nil {
+		        panic(err)
+		    }
+
+		    success := providerClient.SendWithTimeout(frame, sourceId, func(err error) {}, -1)
+		    assert.Equal(t, true, success)
+
+		    // cMutex.Lock()
+			// cSendCount += 1
+			// // fmt.Printf("C Send %d/%d (%.2f%%)\n", cSendCount, totalCount, 100.0 * float32(cSendCount) / float32(totalCount))
+			// cMutex.Unlock()
+		}
+		for _, frame := range frames {
+            if ipPacketToProvider_, err := FromFrame(frame); err == nil {
+            	if ipPacketToProvider, ok := ipPacketToProvider_.(*protocol.IpPacketToProvider); ok {
+		            packet := ipPacketToProvider.IpPacket.PacketBytes
+
+		            receivePacket := &receivePacket{
+		            	sourceId: sourceId,
+		            	packet: packet,
+		            }
+
+		            receivePackets <- receivePacket
+
+		            for i := 0; i < echoCount; i += 1 {
+		            	// do not make a blocking call back into the client from the receiver
+		            	// this could deadlock the client depending on whether other messages are
+		            	// queued to this receiver
+			            go echo(packet)
+			        }
+			    }
+	        }
+
+        }
+	})
+
+
+	for p := 0; p < parallelCount; p += 1 {
+		go func() {
+			source := Path{ClientId:clientId}
+			for s := 0; s < m; s += 1 {
+				for i := 0; i < n; i += 1 {
+					for j := 0; j < n; j += 1 {
+						for k := 0; k < n; k += 1 {
+							for a := 0; a < repeatCount; a += 1 {
+								packet, _ := packetGenerator(s, i, j, k)
+								success := natClient.SendPacket(source, protocol.ProvideMode_Network, packet, -1)
+								if !success {
+									fmt.Printf("[TIMEOUT]%T\n", natClient)
+								}
+								assert.Equal(t, true, success)
+
+								// cMutex.Lock()
+								// cSendCount += 1
+								// // fmt.Printf("C Send %d/%d (%.2f%%)\n", cSendCount, totalCount, 100.0 * float32(cSendCount) / float32(totalCount))
+								// cMutex.Unlock()
+							}
+						}
+					}
+				}
+			}
+		}()
+	}
+
+
+	comparableIpPathPayloads := map[P][][]byte{}
+	comparableIpPathSources := map[P]map[Id]bool{}
+
+	for i := 0; i < totalCount; i += 1 {
+		fmt.Printf("[testr]%d/%d (%.2f%%)\n", i, totalCount, 100 * float32(i) / float32(totalCount))
+		select {
+		case receivePacket := <- receivePackets:
+			// fmt.Printf("Receive %d/%d (%.2f%%)\n", i + 1, totalCount, 100.0 * float32(i + 1) / float32(totalCount))
+
+			ipPath, err := ParseIpPath(receivePacket.packet)
+			assert.Equal(t, err, nil)
+
+			var payload []byte
+			switch ipPath.Version {
+			case 4:
+				ipv4 := layers.IPv4{}
+	            ipv4.DecodeFromBytes(receivePacket.packet, gopacket.NilDecodeFeedback)
+	            payload = ipv4.Payload
+			case 6:
+				ipv6 := layers.IPv6{}
+		        ipv6.DecodeFromBytes(receivePacket.packet, gopacket.NilDecodeFeedback)
+		        payload = ipv6.Payload
+		    }
+
+			switch ipPath.Protocol {
+			case IpProtocolUdp:
+				udp := layers.UDP{}
+	            udp.DecodeFromBytes(payload, gopacket.NilDecodeFeedback)
+	            payload = udp.Payload
+			case IpProtocolTcp:
+				tcp := layers.TCP{}
+	            tcp.DecodeFromBytes(payload, gopacket.NilDecodeFeedback)
+	            payload = tcp.Payload
+			}
+
+			comparableIpPath := toComparableIpPath(ipPath)
+			comparableIpPathPayloads[comparableIpPath] = append(comparableIpPathPayloads[comparableIpPath], payload)
+
+			sources, ok := comparableIpPathSources[comparableIpPath]
+			if !ok {
+				sources = map[Id]bool{}
+				comparableIpPathSources[comparableIpPath] = sources
+			}
+			sources[receivePacket.sourceId] = true
+		case <- time.After(timeout):
+			t.Fail()
+		}
+	}
+
+	// make sure all messages were received
+	// make sure each path has just one source
+	for s := 0; s < m; s += 1 {
+		for i := 0; i < n; i += 1 {
+			for j := 0; j < n; j += 1 {
+				for k := 0; k < n; k += 1 {
+
+					packet, payload := packetGenerator(s, i, j, k)
+					ipPath, err := ParseIpPath(packet)
+					assert.Equal(t, err, nil)
+					comparableIpPath := toComparableIpPath(ipPath)
+
+					payloads := comparableIpPathPayloads[comparableIpPath]
+
+					count := 0
+					for _, b := range payloads {
+						e := reflect.DeepEqual(b, payload)
+						if e {
+							count += 1
+						}
+					}
+
+					assert.Equal(t, parallelCount * repeatCount * (1 + echoCount), count)
+
+					sources := comparableIpPathSources[comparableIpPath]
+
+					if 0 < echoCount {
+						assert.Equal(t, 2, len(sources))
+					} else {
+						assert.Equal(t, 1, len(sources))
+					}
+				}
+			}
+		}
+	}
+}
+
+
+
+
+func TestRemoteUserNatProviderDrain(t *testing.T) {
+	// the provider drains while the upstream servers are still sending final packets
+	// the final udp and tcp packets are delivered to the user before the drain returns
+	// while draining, packets for existing sequences are forwarded and new sequences are refused
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer tcpListener.Close()
+	tcpListenerAddr := tcpListener.Addr().(*net.TCPAddr)
+
+	drainStart := make(chan struct{})
+	udpActive := make(chan struct{})
+	udpDrainPayloads := make(chan string, 16)
+	tcpActive := make(chan struct{})
+
+	go func() {
+		buffer := make([]byte, 1024)
+		_, addr, err := udpListener.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		close(udpActive)
+		<- drainStart
+		for i := 0; ; i += 1 {
+			n, _, err := udpListener.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			udpDrainPayloads <- string(buffer[:n])
+			if i == 0 {
+				udpListener.WriteToUDP([]byte("udp bye"), addr)
+			}
+		}
+	}()
+
+	go func() {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		close(tcpActive)
+		<- drainStart
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte("tcp bye"))
+	}()
+
+	settings := DefaultClientSettings()
+
+	provider := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer provider.Cancel()
+	user := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer user.Cancel()
+
+	providerToUser := make(chan []byte)
+	userToProvider := make(chan []byte)
+	provider.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{providerToUser})
+	provider.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{userToProvider})
+	user.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{userToProvider})
+	user.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{providerToUser})
+
+	provider.ContractManager().AddNoContractPeer(user.ClientId())
+	user.ContractManager().AddNoContractPeer(provider.ClientId())
+
+	localUserNat := NewLocalUserNatWithDefaults(ctx, "test")
+	defer localUserNat.Close()
+
+	remoteUserNatProviderSettings := DefaultRemoteUserNatProviderSettings()
+	remoteUserNatProviderSettings.DrainQuietTimeout = 500 * time.Millisecond
+	remoteUserNatProvider := NewRemoteUserNatProvider(provider, localUserNat, remoteUserNatProviderSettings)
+	defer remoteUserNatProvider.Close()
+
+	udpPayloads := make(chan string, 16)
+	tcpPayloads := make(chan string, 16)
+	tcpFins := make(chan struct{}, 16)
+	user.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.IpPacketFromProvider:
+				ipPacket := gopacket.NewPacket(v.IpPacket.PacketBytes, layers.LayerTypeIPv4, gopacket.Default)
+				if udp, ok := ipPacket.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+					udpPayloads <- string(udp.Payload)
+				}
+				if tcp, ok := ipPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+					if 0 < len(tcp.Payload) {
+						tcpPayloads <- string(tcp.Payload)
+					}
+					if tcp.FIN {
+						tcpFins <- struct{}{}
+					}
+				}
+			}
+		}
+	})
+
+	serialize := func(layers_ ...gopacket.SerializableLayer)([]byte) {
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, layers_...)
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	sendToProvider := func(packet []byte) {
+		success := user.SendWithTimeout(
+			RequireToFrame(&protocol.IpPacketToProvider{
+				IpPacket: &protocol.IpPacket{
+					PacketBytes: packet,
+				},
+			}),
+			provider.ClientId(),
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	udpIp := &layers.IPv4{
+		Version: 4,
+		TTL: 64,
+		SrcIP: net.IPv4(10, 0, 0, 1),
+		DstIP: udpListenerAddr.IP,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: 40000,
+		DstPort: layers.UDPPort(udpListenerAddr.Port),
+	}
+	udp.SetNetworkLayerForChecksum(udpIp)
+	sendToProvider(serialize(udpIp, udp, gopacket.Payload([]byte("udp hi"))))
+
+	tcpIp := &layers.IPv4{
+		Version: 4,
+		TTL: 64,
+		SrcIP: net.IPv4(10, 0, 0, 1),
+		DstIP: tcpListenerAddr.IP,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: layers.TCPPort(tcpListenerAddr.Port),
+		SYN: true,
+		Seq: 1000,
+		Window: 1024,
+	}
+	tcp.SetNetworkLayerForChecksum(tcpIp)
+	sendToProvider(serialize(tcpIp, tcp))
+
+	for _, active := range []chan struct{}{udpActive, tcpActive} {
+		select {
+		case <- active:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	drained := make(chan bool)
+	go func() {
+		drained <- remoteUserNatProvider.Drain(timeout)
+	}()
+	for !remoteUserNatProvider.IsDraining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(drainStart)
+
+	// a new sequence is refused, and the existing sequence is forwarded
+	newUdp := &layers.UDP{
+		SrcPort: 40001,
+		DstPort: layers.UDPPort(udpListenerAddr.Port),
+	}
+	newUdp.SetNetworkLayerForChecksum(udpIp)
+	sendToProvider(serialize(udpIp, newUdp, gopacket.Payload([]byte("udp new"))))
+	sendToProvider(serialize(udpIp, udp, gopacket.Payload([]byte("udp again"))))
+
+	var drainSuccess bool
+	select {
+	case drainSuccess = <- drained:
+	case <- time.After(2 * timeout):
+		t.FailNow()
+	}
+	assert.Equal(t, true, drainSuccess)
+
+	drainPayloads := []string{}
+	for done := false; !done; {
+		select {
+		case payload := <- udpDrainPayloads:
+			drainPayloads = append(drainPayloads, payload)
+		default:
+			done = true
+		}
+	}
+	assert.Equal(t, []string{"udp again"}, drainPayloads)
+
+	// the final packets were delivered during the drain
+	select {
+	case payload := <- udpPayloads:
+		assert.Equal(t, "udp bye", payload)
+	default:
+		t.Fatal("Missing udp final packet.")
+	}
+	select {
+	case payload := <- tcpPayloads:
+		assert.Equal(t, "tcp bye", payload)
+	default:
+		t.Fatal("Missing tcp final packet.")
+	}
+	select {
+	case <- tcpFins:
+	default:
+		t.Fatal("Missing tcp FIN.")
+	}
+}
+
+
+func TestRemoteUserNatProviderQuiesce(t *testing.T) {
+	// while quiesced, new sequences are refused and existing sequences continue
+	// the provider is drained once the existing sequences idle out
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+	idleTimeout := 1 * time.Second
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := udpListener.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			udpListener.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+
+	settings := DefaultClientSettings()
+
+	provider := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer provider.Cancel()
+	user := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer user.Cancel()
+
+	providerToUser := make(chan []byte)
+	userToProvider := make(chan []byte)
+	provider.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{providerToUser})
+	provider.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{userToProvider})
+	user.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{userToProvider})
+	user.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{providerToUser})
+
+	provider.ContractManager().AddNoContractPeer(user.ClientId())
+	user.ContractManager().AddNoContractPeer(provider.ClientId())
+
+	localUserNatSettings := DefaultLocalUserNatSettings()
+	localUserNatSettings.UdpBufferSettings.IdleTimeout = idleTimeout
+	localUserNat := NewLocalUserNat(ctx, "test", localUserNatSettings)
+	defer localUserNat.Close()
+
+	remoteUserNatProvider := NewRemoteUserNatProviderWithDefaults(provider, localUserNat)
+	defer remoteUserNatProvider.Close()
+
+	udpPayloads := make(chan string, 16)
+	user.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.IpPacketFromProvider:
+				ipPacket := gopacket.NewPacket(v.IpPacket.PacketBytes, layers.LayerTypeIPv4, gopacket.Default)
+				if udp, ok := ipPacket.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+					udpPayloads <- string(udp.Payload)
+				}
+			}
+		}
+	})
+
+	sendUdp := func(sourcePort int, payload string) {
+		udpIp := &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: udpListenerAddr.IP,
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(sourcePort),
+			DstPort: layers.UDPPort(udpListenerAddr.Port),
+		}
+		udp.SetNetworkLayerForChecksum(udpIp)
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(
+			buffer,
+			gopacket.SerializeOptions{
+				ComputeChecksums: true,
+				FixLengths: true,
+			},
+			udpIp,
+			udp,
+			gopacket.Payload([]byte(payload)),
+		)
+		assert.Equal(t, nil, err)
+
+		success := user.SendWithTimeout(
+			RequireToFrame(&protocol.IpPacketToProvider{
+				IpPacket: &protocol.IpPacket{
+					PacketBytes: buffer.Bytes(),
+				},
+			}),
+			provider.ClientId(),
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	requireEcho := func(payload string) {
+		select {
+		case echoPayload := <- udpPayloads:
+			assert.Equal(t, payload, echoPayload)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	requireNoEcho := func() {
+		select {
+		case echoPayload := <- udpPayloads:
+			t.Fatalf("Unexpected echo %s.", echoPayload)
+		case <- time.After(idleTimeout / 4):
+		}
+	}
+
+	sendUdp(40000, "a")
+	requireEcho("a")
+	assert.Equal(t, 1, localUserNat.SequenceCount())
+
+	remoteUserNatProvider.Quiesce()
+	assert.Equal(t, true, remoteUserNatProvider.IsQuiesced())
+
+	// the existing session continues
+	sendUdp(40000, "b")
+	requireEcho("b")
+
+	// a new session is refused
+	sendUdp(40001, "c")
+	requireNoEcho()
+	assert.Equal(t, 1, localUserNat.SequenceCount())
+
+	select {
+	case <- remoteUserNatProvider.QuiescedAndDrained():
+		t.Fatal("Drained with an active session.")
+	default:
+	}
+
+	select {
+	case <- remoteUserNatProvider.QuiescedAndDrained():
+	case <- time.After(idleTimeout + timeout):
+		t.FailNow()
+	}
+	assert.Equal(t, 0, localUserNat.SequenceCount())
+
+	// the closed session is not reopened
+	sendUdp(40000, "d")
+	requireNoEcho()
+}
+
+
+func TestTcpQuiesceSyn(t *testing.T) {
+	// while quiesced, a syn for an existing sequence is refused
+	// and does not close the existing sequence
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	tcpBufferSettings := DefaultTcpBufferSettings()
+	// hold the dial so that the sequence stays open
+	tcpBufferSettings.DialContextGen = func(provideMode protocol.ProvideMode) DialContextFunc {
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			<- ctx.Done()
+			return nil, errors.New("Test dial.")
+		}
+	}
+
+	rsts := make(chan *layers.TCP, 16)
+	tcp4Buffer := NewTcp4Buffer(
+		ctx,
+		func(source Path, ipProtocol IpProtocol, packet []byte) {
+			ipPacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+			if tcp, ok := ipPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && tcp.RST {
+				rsts <- tcp
+			}
+		},
+		tcpBufferSettings,
+	)
+	sequenceGate := newSequenceGate()
+	tcp4Buffer.sequenceGate = sequenceGate
+
+	source := Path{ClientId: NewId()}
+	sendSyn := func(seq uint32) bool {
+		success, err := tcp4Buffer.send(
+			source,
+			protocol.ProvideMode_Network,
+			&layers.IPv4{
+				SrcIP: net.IPv4(72, 0, 0, 1),
+				DstIP: net.IPv4(10, 0, 0, 1),
+			},
+			&layers.TCP{
+				SrcPort: layers.TCPPort(40000),
+				DstPort: layers.TCPPort(443),
+				SYN: true,
+				Seq: seq,
+				Window: 1024,
+			},
+			timeout,
+		)
+		assert.Equal(t, nil, err)
+		return success
+	}
+
+	assert.Equal(t, true, sendSyn(1000))
+	assert.Equal(t, 1, tcp4Buffer.sequenceCount())
+
+	sequenceGate.quiesce()
+	assert.Equal(t, false, sendSyn(2000))
+	assert.Equal(t, 1, tcp4Buffer.sequenceCount())
+	assert.Equal(t, 1, sequenceGate.openCount())
+	select {
+	case <- rsts:
+		t.Fatal("Existing sequence was reset.")
+	case <- time.After(200 * time.Millisecond):
+	}
+}
+
+
+func TestLocalUserNatServiceStats(t *testing.T) {
+	// packets to well known ports are classified by service
+	// and the long tail is bucketed into other
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := udpListener.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			udpListener.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+
+	localUserNat := NewLocalUserNatWithDefaults(ctx, "test")
+	defer localUserNat.Close()
+
+	receives := make(chan []byte, 16)
+	localUserNat.AddReceivePacketCallback(func(source Path, ipProtocol IpProtocol, packet []byte) {
+		// the tcp sequences may respond with a reset
+		if ipProtocol == IpProtocolUdp {
+			receives <- packet
+		}
+	})
+
+	serialize := func(layers_ ...gopacket.SerializableLayer)([]byte) {
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, layers_...)
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	udpPacket := func(ipVersion int, destinationPort int)([]byte) {
+		udp := &layers.UDP{
+			SrcPort: 40000,
+			DstPort: layers.UDPPort(destinationPort),
+		}
+		if ipVersion == 6 {
+			ip := &layers.IPv6{
+				Version: 6,
+				HopLimit: 64,
+				SrcIP: net.ParseIP("fd00::1"),
+				DstIP: net.IPv6loopback,
+				NextHeader: layers.IPProtocolUDP,
+			}
+			udp.SetNetworkLayerForChecksum(ip)
+			return serialize(ip, udp, gopacket.Payload([]byte("hi")))
+		}
+		ip := &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: net.IPv4(127, 0, 0, 1),
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, udp, gopacket.Payload([]byte("hi")))
+	}
+
+	tcpPacket := func(destinationPort int)([]byte) {
+		ip := &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: net.IPv4(127, 0, 0, 1),
+			Protocol: layers.IPProtocolTCP,
+		}
+		tcp := &layers.TCP{
+			SrcPort: 40000,
+			DstPort: layers.TCPPort(destinationPort),
+			SYN: true,
+			Seq: 1000,
+			Window: 1024,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, tcp)
+	}
+
+	source := Path{ClientId: NewId()}
+	expectedSendStats := map[NatServiceKey]NatServiceStats{}
+	send := func(key NatServiceKey, packet []byte) {
+		success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, packet, timeout)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+		stats := expectedSendStats[key]
+		stats.SendPacketCount += 1
+		stats.SendByteCount += ByteCount(len(packet))
+		expectedSendStats[key] = stats
+	}
+
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolUdp, Service: NatServiceDns}, udpPacket(4, 53))
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolUdp, Service: NatServiceDns}, udpPacket(4, 53))
+	send(NatServiceKey{IpVersion: 6, Protocol: IpProtocolUdp, Service: NatServiceDns}, udpPacket(6, 53))
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolUdp, Service: NatServiceQuic}, udpPacket(4, 443))
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolTcp, Service: NatServiceHttps}, tcpPacket(443))
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolTcp, Service: NatServiceHttp}, tcpPacket(80))
+	echoPacket := udpPacket(4, udpListenerAddr.Port)
+	send(NatServiceKey{IpVersion: 4, Protocol: IpProtocolUdp, Service: NatServiceOther}, echoPacket)
+
+	var echoReceivePacket []byte
+	select {
+	case echoReceivePacket = <- receives:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	sendStats := func()(map[NatServiceKey]NatServiceStats) {
+		sendStats := map[NatServiceKey]NatServiceStats{}
+		for key, stats := range localUserNat.ServiceStats() {
+			if 0 < stats.SendPacketCount {
+				sendStats[key] = NatServiceStats{
+					SendPacketCount: stats.SendPacketCount,
+					SendByteCount: stats.SendByteCount,
+				}
+			}
+		}
+		return sendStats
+	}
+	assert.Equal(t, expectedSendStats, sendStats())
+
+	// the echo is counted against the service of the original destination port
+	otherStats := localUserNat.ServiceStats()[NatServiceKey{IpVersion: 4, Protocol: IpProtocolUdp, Service: NatServiceOther}]
+	assert.Equal(t, int64(1), otherStats.ReceivePacketCount)
+	assert.Equal(t, ByteCount(len(echoReceivePacket)), otherStats.ReceiveByteCount)
+
+	assert.Equal(t, NatServiceOther, ClassifyNatService(IpProtocolTcp, 8443))
+	assert.Equal(t, NatServiceDns, ClassifyNatService(IpProtocolTcp, 53))
+	assert.Equal(t, "quic", NatServiceQuic.String())
+}
+
+
+func TestLocalUserNatStats(t *testing.T) {
+	// the stats count the open sequences and the total bytes
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	defer udpListener.Close()
+	udpListenerAddr := udpListener.LocalAddr().(*net.UDPAddr)
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, addr, err := udpListener.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			udpListener.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+
+	localUserNat := NewLocalUserNatWithDefaults(ctx, "test")
+	defer localUserNat.Close()
+
+	receives := make(chan []byte, 16)
+	localUserNat.AddReceivePacketCallback(func(source Path, ipProtocol IpProtocol, packet []byte) {
+		receives <- packet
+	})
+
+	// each source port is a new sequence
+	udpPacket := func(sourcePort int)([]byte) {
+		ip := &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: net.IPv4(127, 0, 0, 1),
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(sourcePort),
+			DstPort: layers.UDPPort(udpListenerAddr.Port),
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload([]byte("hi")))
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	assert.Equal(t, LocalUserNatStats{}, localUserNat.Stats())
+
+	source := Path{ClientId: NewId()}
+	expectedStats := LocalUserNatStats{}
+	for i := 0; i < 3; i += 1 {
+		packet := udpPacket(40000 + i)
+		success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, packet, timeout)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+		expectedStats.UdpSequenceCount += 1
+		expectedStats.SendByteCount += ByteCount(len(packet))
+
+		select {
+		case receivePacket := <- receives:
+			expectedStats.ReceiveByteCount += ByteCount(len(receivePacket))
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	assert.Equal(t, expectedStats, localUserNat.Stats())
+
+	// the sequences close with the nat
+	localUserNat.Close()
+	endTime := time.Now().Add(timeout)
+	for 0 < localUserNat.Stats().UdpSequenceCount {
+		if endTime.Before(time.Now()) {
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+
+func TestLocalUserNatPortFilter(t *testing.T) {
+	// packets to allowed ports pass the filter and packets to denied ports are dropped and counted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serialize := func(layers_ ...gopacket.SerializableLayer)([]byte) {
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, layers_...)
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
+	}
+
+	ipv4 := func(ipProtocol layers.IPProtocol)(*layers.IPv4) {
+		return &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: net.IPv4(127, 0, 0, 1),
+			Protocol: ipProtocol,
+		}
+	}
 
+	udpPacket := func(destinationPort int)([]byte) {
+		ip := ipv4(layers.IPProtocolUDP)
+		udp := &layers.UDP{
+			SrcPort: 40000,
+			DstPort: layers.UDPPort(destinationPort),
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, udp, gopacket.Payload([]byte("hi")))
+	}
 
-	// n destinations
-	// all have the same receiver callback, put into a channel of messages
-	// echo the received packet
+	tcpPacket := func(destinationPort int)([]byte) {
+		ip := ipv4(layers.IPProtocolTCP)
+		tcp := &layers.TCP{
+			SrcPort: 40000,
+			DstPort: layers.TCPPort(destinationPort),
+			SYN: true,
+			Seq: 1000,
+			Window: 1024,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, tcp)
+	}
 
-	// create fake packets for all iterations of i,j,k in a range
-	// retransmit some packets by increasing source port s
-	// make sure all packets are received
-	// make sure all packets are echoed back
+	source := Path{ClientId: NewId()}
 
+	testPorts := func(packetFilter PacketFilter, allowedPorts []int, deniedPorts []int) {
+		settings := DefaultLocalUserNatSettings()
+		settings.PacketFilter = packetFilter
+		localUserNat := NewLocalUserNat(ctx, "test", settings)
+		defer localUserNat.Close()
 
-	timeout := 30 * time.Second
+		for _, port := range allowedPorts {
+			for _, packet := range [][]byte{udpPacket(port), tcpPacket(port)} {
+				success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, packet, 0)
+				assert.Equal(t, nil, err)
+				assert.Equal(t, true, success)
+			}
+		}
+		for _, port := range deniedPorts {
+			for _, packet := range [][]byte{udpPacket(port), tcpPacket(port)} {
+				success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, packet, 0)
+				assert.Equal(t, true, errors.Is(err, ErrPacketFiltered))
+				assert.Equal(t, false, success)
+			}
+		}
 
-	m := 6
-	n := 6
-	repeatCount := 6
-	parallelCount := 6
-	echoCount := 2
+		filteredCounts := map[IpProtocol]int64{}
+		for key, stats := range localUserNat.ServiceStats() {
+			filteredCounts[key.Protocol] += stats.FilteredPacketCount
+		}
+		assert.Equal(t, int64(len(deniedPorts)), filteredCounts[IpProtocolUdp])
+		assert.Equal(t, int64(len(deniedPorts)), filteredCounts[IpProtocolTcp])
+	}
 
+	testPorts(NewPortPacketFilter([]int{53, 80, 443}, nil), []int{53, 80, 443}, []int{22, 8443})
+	testPorts(NewPortPacketFilter(nil, []int{22, 25}), []int{53, 8443}, []int{22, 25})
+	testPorts(NewPortPacketFilter([]int{53, 443}, []int{443}), []int{53}, []int{443, 80})
+	testPorts(nil, []int{22, 443}, nil)
+}
 
-	// each packet gets echoed back
-	totalCount := parallelCount * m * n * n * n * repeatCount * (1 + echoCount)
 
-	// cMutex := sync.Mutex{}
-	// cSendCount := 0
-	// cReceiveCount := 0
+func TestSourceLimiter(t *testing.T) {
+	// each source has a burst of new connections, then is limited to the rate
 
+	throttleCount := 0
+	limiter := newSourceLimiter(20, 3, func(ipVersion int, ipProtocol IpProtocol, destinationPort int) {
+		throttleCount += 1
+	})
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	sourceA := Path{ClientId: NewId()}
+	sourceB := Path{ClientId: NewId()}
 
-	clientId := NewId()
-	providerClientId := NewId()
+	for i := 0; i < 3; i += 1 {
+		assert.Equal(t, true, limiter.allow(sourceA, 4, IpProtocolTcp, 443))
+	}
+	assert.Equal(t, false, limiter.allow(sourceA, 4, IpProtocolTcp, 443))
+	assert.Equal(t, 1, throttleCount)
+	// sources are independent
+	assert.Equal(t, true, limiter.allow(sourceB, 4, IpProtocolTcp, 443))
+
+	// one token refills in 50ms
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, true, limiter.allow(sourceA, 4, IpProtocolTcp, 443))
+
+	// full buckets are pruned
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, true, limiter.allow(sourceB, 4, IpProtocolTcp, 443))
+	assert.Equal(t, 1, len(limiter.buckets))
+
+	// no rate is no limit
+	assert.Equal(t, (*sourceLimiter)(nil), newSourceLimiter(0, 3, nil))
+}
 
 
-	settings := DefaultClientSettings()
-	settings.SendBufferSettings.SequenceBufferSize = 0
-	settings.SendBufferSettings.AckBufferSize = 0
-	settings.ReceiveBufferSettings.SequenceBufferSize = 0
-	// settings.ReceiveBufferSettings.AckBufferSize = 0
-	settings.ForwardBufferSettings.SequenceBufferSize = 0
-	providerClient := NewClient(ctx, providerClientId, NewNoContractClientOob(), settings)
-	defer providerClient.Cancel()
+func TestLocalUserNatConnectionThrottle(t *testing.T) {
+	// new sequences over the burst for a source are dropped and counted
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	type receivePacket struct {
-		sourceId Id
-		packet []byte
+	serialize := func(layers_ ...gopacket.SerializableLayer)([]byte) {
+		options := gopacket.SerializeOptions{
+			ComputeChecksums: true,
+			FixLengths: true,
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buffer, options, layers_...)
+		if err != nil {
+			panic(err)
+		}
+		return buffer.Bytes()
 	}
 
-	receivePackets := make(chan *receivePacket)
+	ipv4 := func(ipProtocol layers.IPProtocol)(*layers.IPv4) {
+		return &layers.IPv4{
+			Version: 4,
+			TTL: 64,
+			SrcIP: net.IPv4(10, 0, 0, 1),
+			DstIP: net.IPv4(127, 0, 0, 1),
+			Protocol: ipProtocol,
+		}
+	}
 
+	// each source port is a new sequence
+	udpPacket := func(sourcePort int)([]byte) {
+		ip := ipv4(layers.IPProtocolUDP)
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(sourcePort),
+			DstPort: 53,
+		}
+		udp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, udp, gopacket.Payload([]byte("hi")))
+	}
 
-	receivePacketCallback := func(source Path, ipProtocol IpProtocol, packet []byte) {
-		// record the echo packet
+	tcpPacket := func(sourcePort int)([]byte) {
+		ip := ipv4(layers.IPProtocolTCP)
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(sourcePort),
+			DstPort: 443,
+			SYN: true,
+			Seq: 1000,
+			Window: 1024,
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		return serialize(ip, tcp)
+	}
 
-		// cMutex.Lock()
-		// cReceiveCount += 1
-		// // fmt.Printf("C Receive %d/%d (%.2f%%)\n", cReceiveCount, totalCount, 100.0 * float32(cReceiveCount) / float32(totalCount))
-		// cMutex.Unlock()
+	settings := DefaultLocalUserNatSettings()
+	// effectively no refill during the test
+	settings.UdpBufferSettings.NewConnectionsPerSecond = 0.001
+	settings.UdpBufferSettings.NewConnectionBurstSize = 2
+	settings.TcpBufferSettings.NewConnectionsPerSecond = 0.001
+	settings.TcpBufferSettings.NewConnectionBurstSize = 3
+	localUserNat := NewLocalUserNat(ctx, "test", settings)
+	defer localUserNat.Close()
+
+	sourceA := Path{ClientId: NewId()}
+	sourceB := Path{ClientId: NewId()}
+
+	for i := 0; i < 5; i += 1 {
+		for _, packet := range [][]byte{udpPacket(40000 + i), tcpPacket(40000 + i)} {
+			success, err := localUserNat.SendPacketDetailed(sourceA, protocol.ProvideMode_Network, packet, -1)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, success)
+		}
+	}
+	// another source is not throttled
+	for _, packet := range [][]byte{udpPacket(40000), tcpPacket(40000)} {
+		success, err := localUserNat.SendPacketDetailed(sourceB, protocol.ProvideMode_Network, packet, -1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+	}
 
-        receivePacket := &receivePacket{
-        	sourceId: source.ClientId,
-        	packet: packet,
-        }
+	throttledCounts := func()(map[IpProtocol]int64) {
+		throttledCounts := map[IpProtocol]int64{}
+		for key, stats := range localUserNat.ServiceStats() {
+			throttledCounts[key.Protocol] += stats.ThrottledConnectionCount
+		}
+		return throttledCounts
+	}
 
-        receivePackets <- receivePacket
+	expectedThrottledCounts := map[IpProtocol]int64{
+		IpProtocolUdp: 3,
+		IpProtocolTcp: 2,
+	}
+	endTime := time.Now().Add(5 * time.Second)
+	for {
+		if counts := throttledCounts(); reflect.DeepEqual(expectedThrottledCounts, counts) {
+			break
+		} else if endTime.Before(time.Now()) {
+			assert.Equal(t, expectedThrottledCounts, counts)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+}
 
 
-	natClient, err := userNatClientGenerator(ctx, providerClient, receivePacketCallback)
-	assert.Equal(t, err, nil)
+func TestLocalUserNatDnsInterceptor(t *testing.T) {
+	// dns queries answered by the interceptor are replied to without forwarding
+	// other queries and other ports are forwarded
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	providerClient.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
-		// cMutex.Lock()
-		// cReceiveCount += 1
-		// // fmt.Printf("C Receive %d/%d (%.2f%%)\n", cReceiveCount, totalCount, 100.0 * float32(cReceiveCount) / float32(totalCount))
-		// cMutex.Unlock()
+	timeout := 5 * time.Second
+
+	// records the forwarded destinations
+	dials := make(chan string, 16)
+	defaultDialContextGen := NewSourceIpDialContextGenerator(map[protocol.ProvideMode]net.IP{})
+	settings := DefaultLocalUserNatSettings()
+	settings.UdpBufferSettings.DialContextGen = func(provideMode protocol.ProvideMode)(DialContextFunc) {
+		dialContext := defaultDialContextGen(provideMode)
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			dials <- address
+			return dialContext(ctx, network, address)
+		}
+	}
+	localUserNat := NewLocalUserNat(ctx, "test", settings)
+	defer localUserNat.Close()
 
-		echo := func(packet []byte) {
-            ipPacketFromProvider := &protocol.IpPacketFromProvider{
-		        IpPacket: &protocol.IpPacket{
-		            PacketBytes: packet,
-		        },
-		    }
-		    frame, err := ToFrame(ipPacketFromProvider)
-		    if err != nil {
-		        panic(err)
-		    }
+	nextDial := func() string {
+		select {
+		case address := <- dials:
+			return address
+		case <- time.After(timeout):
+			t.FailNow()
+			return ""
+		}
+	}
 
-		    success := providerClient.SendWithTimeout(frame, sourceId, func(err error) {}, -1)
-		    assert.Equal(t, true, success)
+	receives := make(chan []byte, 16)
+	localUserNat.AddReceivePacketCallback(func(source Path, ipProtocol IpProtocol, packet []byte) {
+		receives <- packet
+	})
 
-		    // cMutex.Lock()
-			// cSendCount += 1
-			// // fmt.Printf("C Send %d/%d (%.2f%%)\n", cSendCount, totalCount, 100.0 * float32(cSendCount) / float32(totalCount))
-			// cMutex.Unlock()
+	steerIp := net.IPv4(10, 1, 2, 3).To4()
+	queries := make(chan string, 16)
+	localUserNat.SetDnsInterceptor(func(query *layers.DNS) (*layers.DNS, bool) {
+		name := string(query.Questions[0].Name)
+		queries <- name
+		if name != "steer.test" {
+			return nil, false
 		}
-		for _, frame := range frames {
-            if ipPacketToProvider_, err := FromFrame(frame); err == nil {
-            	if ipPacketToProvider, ok := ipPacketToProvider_.(*protocol.IpPacketToProvider); ok {
-		            packet := ipPacketToProvider.IpPacket.PacketBytes
+		return &layers.DNS{
+			ID: query.ID,
+			QR: true,
+			OpCode: query.OpCode,
+			RD: query.RD,
+			RA: true,
+			ResponseCode: layers.DNSResponseCodeNoErr,
+			Questions: query.Questions,
+			Answers: []layers.DNSResourceRecord{
+				layers.DNSResourceRecord{
+					Name: query.Questions[0].Name,
+					Type: layers.DNSTypeA,
+					Class: layers.DNSClassIN,
+					TTL: 60,
+					IP: steerIp,
+				},
+			},
+		}, true
+	})
 
-		            receivePacket := &receivePacket{
-		            	sourceId: sourceId,
-		            	packet: packet,
-		            }
+	sourceIp := net.IPv4(10, 0, 0, 1).To4()
+	destinationIp := net.IPv4(127, 0, 0, 1).To4()
 
-		            receivePackets <- receivePacket
+	dnsPacket := func(sourcePort int, destinationPort int, name string)([]byte) {
+		return dnsQueryPacket(sourceIp, destinationIp, sourcePort, destinationPort, name)
+	}
 
-		            for i := 0; i < echoCount; i += 1 {
-		            	// do not make a blocking call back into the client from the receiver
-		            	// this could deadlock the client depending on whether other messages are
-		            	// queued to this receiver
-			            go echo(packet)
-			        }
-			    }
-	        }
+	source := Path{ClientId: NewId()}
 
-        }
-	})
+	// answered by the interceptor
+	success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsPacket(40000, 53, "steer.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	select {
+	case name := <- queries:
+		assert.Equal(t, "steer.test", name)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	select {
+	case packet := <- receives:
+		responsePacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+		ip := responsePacket.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		assert.Equal(t, destinationIp, ip.SrcIP)
+		assert.Equal(t, sourceIp, ip.DstIP)
+		udp := responsePacket.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		assert.Equal(t, layers.UDPPort(53), udp.SrcPort)
+		assert.Equal(t, layers.UDPPort(40000), udp.DstPort)
+		dns := responsePacket.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		assert.Equal(t, uint16(1234), dns.ID)
+		assert.Equal(t, true, dns.QR)
+		assert.Equal(t, 1, len(dns.Answers))
+		assert.Equal(t, steerIp, dns.Answers[0].IP.To4())
+	case <- time.After(timeout):
+		t.FailNow()
+	}
 
+	// not answered, forwarded upstream
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsPacket(40001, 53, "other.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	select {
+	case name := <- queries:
+		assert.Equal(t, "other.test", name)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	assert.Equal(t, "127.0.0.1:53", nextDial())
 
-	for p := 0; p < parallelCount; p += 1 {
-		go func() {
-			source := Path{ClientId:clientId}
-			for s := 0; s < m; s += 1 {
-				for i := 0; i < n; i += 1 {
-					for j := 0; j < n; j += 1 {
-						for k := 0; k < n; k += 1 {
-							for a := 0; a < repeatCount; a += 1 {
-								packet, _ := packetGenerator(s, i, j, k)
-								success := natClient.SendPacket(source, protocol.ProvideMode_Network, packet, -1)
-								if !success {
-									fmt.Printf("[TIMEOUT]%T\n", natClient)
-								}
-								assert.Equal(t, true, success)
+	// other ports are not intercepted
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsPacket(40002, 5353, "steer.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
 
-								// cMutex.Lock()
-								// cSendCount += 1
-								// // fmt.Printf("C Send %d/%d (%.2f%%)\n", cSendCount, totalCount, 100.0 * float32(cSendCount) / float32(totalCount))
-								// cMutex.Unlock()
-							}
-						}
-					}
-				}
-			}
-		}()
+	assert.Equal(t, "127.0.0.1:5353", nextDial())
+	select {
+	case <- queries:
+		t.FailNow()
+	default:
 	}
 
+	// no interceptor forwards all queries
+	localUserNat.SetDnsInterceptor(nil)
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsPacket(40003, 53, "steer.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	assert.Equal(t, "127.0.0.1:53", nextDial())
+
+	// the answered query was not forwarded
+	select {
+	case <- dials:
+		t.FailNow()
+	default:
+	}
+}
 
-	comparableIpPathPayloads := map[P][][]byte{}
-	comparableIpPathSources := map[P]map[Id]bool{}
 
-	for i := 0; i < totalCount; i += 1 {
-		fmt.Printf("[testr]%d/%d (%.2f%%)\n", i, totalCount, 100 * float32(i) / float32(totalCount))
-		select {
-		case receivePacket := <- receivePackets:
-			// fmt.Printf("Receive %d/%d (%.2f%%)\n", i + 1, totalCount, 100.0 * float32(i + 1) / float32(totalCount))
+func dnsQueryPacket(sourceIp net.IP, destinationIp net.IP, sourcePort int, destinationPort int, name string) []byte {
+	ip := &layers.IPv4{
+		Version: 4,
+		TTL: 64,
+		SrcIP: sourceIp,
+		DstIP: destinationIp,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(sourcePort),
+		DstPort: layers.UDPPort(destinationPort),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+	dns := &layers.DNS{
+		ID: 1234,
+		RD: true,
+		Questions: []layers.DNSQuestion{
+			layers.DNSQuestion{
+				Name: []byte(name),
+				Type: layers.DNSTypeA,
+				Class: layers.DNSClassIN,
+			},
+		},
+	}
+	options := gopacket.SerializeOptions{
+		ComputeChecksums: true,
+		FixLengths: true,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, options, ip, udp, dns)
+	if err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
 
-			ipPath, err := ParseIpPath(receivePacket.packet)
-			assert.Equal(t, err, nil)
 
-			var payload []byte
-			switch ipPath.Version {
-			case 4:
-				ipv4 := layers.IPv4{}
-	            ipv4.DecodeFromBytes(receivePacket.packet, gopacket.NilDecodeFeedback)
-	            payload = ipv4.Payload
-			case 6:
-				ipv6 := layers.IPv6{}
-		        ipv6.DecodeFromBytes(receivePacket.packet, gopacket.NilDecodeFeedback)
-		        payload = ipv6.Payload
-		    }
+func TestLocalUserNatDnsInterceptorBlocking(t *testing.T) {
+	// a dns interceptor that blocks does not block other traffic through the nat
+	// the reply is sent when the interceptor returns
 
-			switch ipPath.Protocol {
-			case IpProtocolUdp:
-				udp := layers.UDP{}
-	            udp.DecodeFromBytes(payload, gopacket.NilDecodeFeedback)
-	            payload = udp.Payload
-			case IpProtocolTcp:
-				tcp := layers.TCP{}
-	            tcp.DecodeFromBytes(payload, gopacket.NilDecodeFeedback)
-	            payload = tcp.Payload
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			comparableIpPath := toComparableIpPath(ipPath)
-			comparableIpPathPayloads[comparableIpPath] = append(comparableIpPathPayloads[comparableIpPath], payload)
+	timeout := 5 * time.Second
 
-			sources, ok := comparableIpPathSources[comparableIpPath]
-			if !ok {
-				sources = map[Id]bool{}
-				comparableIpPathSources[comparableIpPath] = sources
-			}
-			sources[receivePacket.sourceId] = true
-		case <- time.After(timeout):
-			t.Fail()
+	dials := make(chan string, 16)
+	defaultDialContextGen := NewSourceIpDialContextGenerator(map[protocol.ProvideMode]net.IP{})
+	settings := DefaultLocalUserNatSettings()
+	settings.UdpBufferSettings.DialContextGen = func(provideMode protocol.ProvideMode)(DialContextFunc) {
+		dialContext := defaultDialContextGen(provideMode)
+		return func(ctx context.Context, network string, address string) (net.Conn, error) {
+			dials <- address
+			return dialContext(ctx, network, address)
 		}
 	}
+	localUserNat := NewLocalUserNat(ctx, "test", settings)
+	defer localUserNat.Close()
 
-	// make sure all messages were received
-	// make sure each path has just one source
-	for s := 0; s < m; s += 1 {
-		for i := 0; i < n; i += 1 {
-			for j := 0; j < n; j += 1 {
-				for k := 0; k < n; k += 1 {
-
-					packet, payload := packetGenerator(s, i, j, k)
-					ipPath, err := ParseIpPath(packet)
-					assert.Equal(t, err, nil)
-					comparableIpPath := toComparableIpPath(ipPath)
+	receives := make(chan []byte, 16)
+	localUserNat.AddReceivePacketCallback(func(source Path, ipProtocol IpProtocol, packet []byte) {
+		receives <- packet
+	})
 
-					payloads := comparableIpPathPayloads[comparableIpPath]
+	queries := make(chan string, 16)
+	release := make(chan struct{})
+	localUserNat.SetDnsInterceptor(func(query *layers.DNS) (*layers.DNS, bool) {
+		name := string(query.Questions[0].Name)
+		queries <- name
+		if name == "slow.test" {
+			select {
+			case <- release:
+			case <- ctx.Done():
+			}
+		}
+		return &layers.DNS{
+			ID: query.ID,
+			QR: true,
+			OpCode: query.OpCode,
+			RD: query.RD,
+			RA: true,
+			ResponseCode: layers.DNSResponseCodeNoErr,
+			Questions: query.Questions,
+		}, true
+	})
 
-					count := 0
-					for _, b := range payloads {
-						e := reflect.DeepEqual(b, payload)
-						if e {
-							count += 1
-						}
-					}
+	sourceIp := net.IPv4(10, 0, 0, 1).To4()
+	destinationIp := net.IPv4(127, 0, 0, 1).To4()
+	source := Path{ClientId: NewId()}
 
-					assert.Equal(t, parallelCount * repeatCount * (1 + echoCount), count)
+	requireResponse := func(destinationPort int) {
+		select {
+		case packet := <- receives:
+			responsePacket := gopacket.NewPacket(packet, layers.LayerTypeIPv4, gopacket.Default)
+			udp := responsePacket.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			assert.Equal(t, layers.UDPPort(destinationPort), udp.DstPort)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
 
-					sources := comparableIpPathSources[comparableIpPath]
+	success, err := localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsQueryPacket(sourceIp, destinationIp, 40000, 53, "slow.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	select {
+	case name := <- queries:
+		assert.Equal(t, "slow.test", name)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
 
-					if 0 < echoCount {
-						assert.Equal(t, 2, len(sources))
-					} else {
-						assert.Equal(t, 1, len(sources))
-					}
-				}
-			}
-		}
+	// other traffic is forwarded while the interceptor blocks
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsQueryPacket(sourceIp, destinationIp, 40001, 5353, "other.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	select {
+	case address := <- dials:
+		assert.Equal(t, "127.0.0.1:5353", address)
+	case <- time.After(timeout):
+		t.FailNow()
 	}
-}
 
+	// other queries are answered while the interceptor blocks
+	success, err = localUserNat.SendPacketDetailed(source, protocol.ProvideMode_Network, dnsQueryPacket(sourceIp, destinationIp, 40002, 53, "fast.test"), timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	requireResponse(40002)
 
+	close(release)
+	requireResponse(40000)
+}
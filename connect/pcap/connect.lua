@@ -0,0 +1,26 @@
+-- Wireshark dissector for pcap files written by `connect.PcapWriter`
+--
+-- Each packet is a `bringyour.TransferFrame` protobuf with link type DLT_USER0 (147).
+-- To use:
+-- 1. In Preferences > Protocols > ProtoBuf, add the `protocol` directory of this repo
+--    to the search paths, and enable "Load .proto files on startup".
+-- 2. Copy this file to the Wireshark personal Lua plugins directory
+--    (Help > About Wireshark > Folders > Personal Lua Plugins), or run
+--    `wireshark -X lua_script:connect.lua capture.pcap`
+--
+-- The nested `Frame.message_bytes` are shown as bytes. The type of the bytes is `Frame.message_type`,
+-- e.g. `TransferPack` is a `bringyour.Pack` and `TransferAck` is a `bringyour.Ack`.
+
+local connect_proto = Proto("connect", "BringYour Connect Transfer Frame")
+
+local protobuf_dissector = Dissector.get("protobuf")
+
+function connect_proto.dissector(tvb, pinfo, tree)
+    pinfo.cols.protocol = "CONNECT"
+    local subtree = tree:add(connect_proto, tvb())
+    pinfo.private["pb_msg_type"] = "message,bringyour.TransferFrame"
+    pcall(Dissector.call, protobuf_dissector, tvb, pinfo, subtree)
+end
+
+local wtap_encap_table = DissectorTable.get("wtap_encap")
+wtap_encap_table:add(wtap.USER0, connect_proto)
@@ -0,0 +1,55 @@
+package connect
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+
+// Certificate pinning for the platform api and transports.
+// A pin is the base64 encoded sha256 of a certificate SubjectPublicKeyInfo,
+// the same as the HPKP `pin-sha256`. This can be computed with
+// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`
+// A connection is accepted when any certificate in a verified chain matches any pin.
+// Extra certificates that the server sends outside of the verified chain are never matched.
+// Pinning is in addition to the normal certificate verification, not a replacement.
+
+
+var ErrTlsPinMismatch = errors.New("TLS certificate does not match a pin.")
+
+
+func TlsPin(cert *x509.Certificate) string {
+	spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(spkiHash[:])
+}
+
+
+// returns nil if there are no pins, which is the default tls config
+func newTlsPinConfig(tlsPins []string) *tls.Config {
+	if len(tlsPins) == 0 {
+		return nil
+	}
+
+	pins := map[string]bool{}
+	for _, tlsPin := range tlsPins {
+		pins[tlsPin] = true
+	}
+
+	return &tls.Config{
+		// called after the normal verification
+		VerifyConnection: func(state tls.ConnectionState) error {
+			// only the verified chains. `PeerCertificates` includes unverified extras from the server
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pins[TlsPin(cert)] {
+						return nil
+					}
+				}
+			}
+			return ErrTlsPinMismatch
+		},
+	}
+}
@@ -0,0 +1,210 @@
+package connect
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/go-playground/assert/v2"
+)
+
+
+// trust the in-process server certificate so that only the pin decides
+func testingTrustServer(tlsConfig *tls.Config, server *httptest.Server) {
+	rootCas := x509.NewCertPool()
+	rootCas.AddCert(server.Certificate())
+	tlsConfig.RootCAs = rootCas
+}
+
+
+func testingOtherTlsPin() string {
+	otherHash := sha256.Sum256([]byte("other"))
+	return base64.StdEncoding.EncodeToString(otherHash[:])
+}
+
+
+func TestTlsPinApi(t *testing.T) {
+	// the api client connects with a matching pin and fails with a distinct error for a mismatched pin
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"by_jwt\": \"test\"}")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	// the httptest servers all use the same certificate, so use a pin that matches no certificate
+	otherTlsPin := testingOtherTlsPin()
+
+	for _, tlsPins := range [][]string{
+		[]string{TlsPin(server.Certificate())},
+		[]string{otherTlsPin, TlsPin(server.Certificate())},
+	} {
+		client := newHttpClient(tlsPins)
+		testingTrustServer(client.Transport.(*http.Transport).TLSClientConfig, server)
+
+		result, err := post(ctx, client, server.URL, nil, "", &AuthLoginResultNetwork{}, NewNoopApiCallback[*AuthLoginResultNetwork]())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "test", result.ByJwt)
+	}
+
+	client := newHttpClient([]string{otherTlsPin})
+	testingTrustServer(client.Transport.(*http.Transport).TLSClientConfig, server)
+
+	_, err := post(ctx, client, server.URL, nil, "", &AuthLoginResultNetwork{}, NewNoopApiCallback[*AuthLoginResultNetwork]())
+	assert.Equal(t, true, errors.Is(err, ErrTlsPinMismatch))
+
+	// no pins is the default tls config
+	assert.Equal(t, nil, newHttpClient(nil).Transport.(*http.Transport).TLSClientConfig)
+}
+
+
+func TestTlsPinTransport(t *testing.T) {
+	// the platform transport websocket dialer connects with a matching pin
+	// and fails with a distinct error for a mismatched pin
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.Close()
+	}))
+	defer server.Close()
+
+	// the httptest servers all use the same certificate, so use a pin that matches no certificate
+	otherTlsPin := testingOtherTlsPin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	wsUrl := strings.Replace(server.URL, "https://", "wss://", 1)
+
+	dial := func(tlsPins []string) error {
+		settings := DefaultPlatformTransportSettings()
+		settings.TlsPins = tlsPins
+		tlsConfig := newTlsPinConfig(settings.TlsPins)
+		testingTrustServer(tlsConfig, server)
+		wsDialer := &websocket.Dialer{
+			HandshakeTimeout: settings.WsHandshakeTimeout,
+			TLSClientConfig: tlsConfig,
+		}
+		ws, _, err := wsDialer.DialContext(ctx, wsUrl, nil)
+		if err == nil {
+			ws.Close()
+		}
+		return err
+	}
+
+	assert.Equal(t, nil, dial([]string{TlsPin(server.Certificate())}))
+	err := dial([]string{otherTlsPin})
+	assert.Equal(t, true, errors.Is(err, ErrTlsPinMismatch))
+}
+
+
+func testingCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(certDer)
+	if err != nil {
+		panic(err)
+	}
+	return cert, key
+}
+
+
+func TestTlsPinExtraCertificate(t *testing.T) {
+	// a server that sends a non-pinned leaf plus the pinned certificate as an extra does not match the pin
+	// only certificates in the verified chain are matched
+
+	notBefore := time.Now().Add(-1 * time.Hour)
+	notAfter := time.Now().Add(1 * time.Hour)
+
+	caCert, caKey := testingCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	leafCert, leafKey := testingCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, caCert, caKey)
+	// the public pinned certificate, which the attacker does not hold the key for
+	pinnedCert, _ := testingCertificate(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		NotBefore: notBefore,
+		NotAfter: notAfter,
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"by_jwt\": \"test\"}")
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{
+			tls.Certificate{
+				Certificate: [][]byte{leafCert.Raw, pinnedCert.Raw},
+				PrivateKey: leafKey,
+			},
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	post_ := func(tlsPins []string) error {
+		client := newHttpClient(tlsPins)
+		tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+		rootCas := x509.NewCertPool()
+		rootCas.AddCert(caCert)
+		tlsConfig.RootCAs = rootCas
+		_, err := post(ctx, client, server.URL, nil, "", &AuthLoginResultNetwork{}, NewNoopApiCallback[*AuthLoginResultNetwork]())
+		return err
+	}
+
+	err := post_([]string{TlsPin(pinnedCert)})
+	assert.Equal(t, true, errors.Is(err, ErrTlsPinMismatch))
+
+	// pins in the verified chain match
+	assert.Equal(t, nil, post_([]string{TlsPin(leafCert)}))
+	assert.Equal(t, nil, post_([]string{TlsPin(caCert)}))
+}
@@ -9,6 +9,7 @@ import (
     // "os/signal"
     // "syscall"
     "fmt"
+    "errors"
     "runtime/debug"
     "strings"
     "encoding/json"
@@ -31,7 +32,7 @@ func IsDoneError(r any) bool {
     }
     switch v := r.(type) {
     case error:
-        return isDoneMessage(v.Error())
+        return errors.Is(v, ErrDone) || isDoneMessage(v.Error())
     case string:
         return isDoneMessage(v)
     default:
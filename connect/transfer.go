@@ -1,11 +1,14 @@
 package connect
 
 import (
+	"container/list"
 	"context"
 	"time"
 	"sync"
 	"errors"
+	"io"
 	"math"
+	mathrand "math/rand"
 	"fmt"
 	// "runtime/debug"
 	// "runtime"
@@ -57,11 +60,44 @@ const DefaultTransferBufferSize = 32
 const VerifyForwardMessages = false
 
 
+// how often `Client.Drain` checks for pending sends
+const drainPollInterval = 10 * time.Millisecond
+
+
 type AckFunction = func(err error)
 // provideMode is the mode of where these frames are from: network, friends and family, public
 // provideMode nil means no contract
 type ReceiveFunction = func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode)
+// returns an error if any receive callback panicked
+type ReceiveDetailedFunction = func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) error
 type ForwardFunction = func(sourceId Id, destinationId Id, transferFrameBytes []byte)
+// called before the first frames received with the new provide mode,
+// when the contract changes the provide mode mid-sequence
+type ProvideModeChangeFunction = func(sourceId Id, previousProvideMode protocol.ProvideMode, provideMode protocol.ProvideMode)
+// called when a receive sequence exits. Data that was not yet delivered is dropped
+// reason is one of the `ReceiveSequenceExit*` values
+type SequenceErrorFunction = func(source TransferPath, sequenceId Id, reason string)
+
+
+// receive sequence exit reasons. See `SequenceErrorFunction`
+const (
+	// a preceding message did not arrive within `ReceiveBufferSettings.GapTimeout`
+	ReceiveSequenceExitGapTimeout = "gap-timeout"
+	// no messages within `ReceiveBufferSettings.IdleTimeout`
+	ReceiveSequenceExitIdleTimeout = "idle-timeout"
+	// a message could not be received
+	ReceiveSequenceExitBadMessage = "bad-message"
+	// the head message did not have a valid contract
+	ReceiveSequenceExitNoContract = "no-contract"
+	// the contract accounting of a message did not match, see `BadAccountingError`
+	ReceiveSequenceExitBadAccounting = "bad-accounting"
+	// the source exceeded `ReceiveBufferSettings.BadMessageAbuseLimit`
+	ReceiveSequenceExitAbuse = "abuse"
+	// the sequence or client was closed
+	ReceiveSequenceExitClosed = "closed"
+	// the sender closed its sequence gracefully, see `SendBufferSettings.GracefulClose`
+	ReceiveSequenceExitSenderClose = "sender-close"
+)
 
 
 // destination id for control messages
@@ -73,17 +109,43 @@ var ControlId = Id{}
 var DirectStreamId = Id{}
 
 
+// a companion contract send failed because the destination has no open contract to this client,
+// e.g. the contract from the destination expired or closed.
+// The application can retry the send without `CompanionContract`
+var ErrNoCompanionContract = errors.New("No companion contract.")
+
+
+// a send failed because the client or local nat is done, e.g. it was cancelled or closed
+var ErrDone = errors.New("Done.")
+
+
 func DefaultClientSettings() *ClientSettings {
 	return &ClientSettings{
 		SendBufferSize: DefaultTransferBufferSize,
 		ForwardBufferSize: DefaultTransferBufferSize,
 		ReadTimeout: 30 * time.Second,
+		ReadBatchSize: 32,
 		BufferTimeout: 30 * time.Second,
 		ControlWriteTimeout: 30 * time.Second,
 		SendBufferSettings: DefaultSendBufferSettings(),
 		ReceiveBufferSettings: DefaultReceiveBufferSettings(),
 		ForwardBufferSettings: DefaultForwardBufferSettings(),
 		ContractManagerSettings: DefaultContractManagerSettings(),
+		RouteManagerSettings: DefaultRouteManagerSettings(),
+		PeerAuditLabel: "",
+		// smaller messages are not worth the compression overhead
+		CompressMinByteCount: ByteCount(256),
+		// larger compressed packs are dropped as bad messages
+		MaxDecompressedByteCount: mib(64),
+		// test-only
+		WatchdogSettings: nil,
+		MaxOpenContracts: 0,
+		TransportMtu: DefaultMtu,
+		LoopbackRateLimit: 0,
+		DisableLoopback: false,
+		Clock: RealClock,
+		// much longer than a scheduling or gc delay
+		SuspendThreshold: 10 * time.Second,
 	}
 }
 
@@ -99,11 +161,18 @@ func DefaultSendBufferSettings() *SendBufferSettings {
 	return &SendBufferSettings{
 		CreateContractTimeout: 30 * time.Second,
 		CreateContractRetryInterval: 5 * time.Second,
+		// no backoff
+		CreateContractRetryBackoffScale: 0,
+		// +-10% so that sequences retrying together do not request together
+		CreateContractRetryJitterFraction: 0.1,
+		CreateContractErrorRetryCount: 0,
 		// this should be greater than the rtt under load
 		// TODO use an rtt estimator based on the ack times
 		ResendInterval: 1 * time.Second,
 		// no backoff
 		ResendBackoffScale: 0,
+		// +-10% so that items queued together do not resend together
+		ResendJitterFraction: 0.1,
 		AckTimeout: 60 * time.Second,
 		IdleTimeout: 60 * time.Second,
 		// pause on resend for selectively acked messaged
@@ -114,7 +183,19 @@ func DefaultSendBufferSettings() *SendBufferSettings {
 		// this includes transport reconnections
 		WriteTimeout: 30 * time.Second,
 		ResendQueueMaxByteCount: mib(1),
+		// fixed window of `ResendQueueMaxByteCount`
+		CongestionControllerGenerator: DefaultCongestionControllerGenerator,
 		ContractFillFraction: 0.5,
+		NackAccountingPolicy: NackAccountingMinMessage,
+		// duplicate acks of resent messages are also invalid,
+		// so this should be above the expected resend rate
+		InvalidAckLimit: 1024,
+		InvalidAckWindow: 1 * time.Second,
+		RttWindowSize: 128,
+		// off, so that the stats are the plain distribution of the window
+		RttWindowHalfLife: 0,
+		// off for receivers that do not understand the close marker
+		GracefulClose: false,
 	}
 }
 
@@ -131,9 +212,14 @@ func DefaultReceiveBufferSettings() *ReceiveBufferSettings {
 		ResendAbuseThreshold: 4,
 		ResendAbuseMultiple: 0.5,
 		MaxPeerAuditDuration: 60 * time.Second,
+		// the bad message limit is opt-in
+		BadMessageAbuseLimit: 0,
+		BadMessageAbuseWindow: 60 * time.Second,
+		AbuseBlockTimeout: 60 * time.Second,
 		// this includes transport reconnections
 		WriteTimeout: 30 * time.Second,
 		ReceiveQueueMaxByteCount: mib(2),
+		ReceivePanicPolicy: ReceivePanicPolicyAck,
 	}
 }
 
@@ -143,6 +229,14 @@ func DefaultForwardBufferSettings() *ForwardBufferSettings {
 		IdleTimeout: 300 * time.Second,
 		SequenceBufferSize: DefaultTransferBufferSize,
 		WriteTimeout: 1 * time.Second,
+		TotalMaxByteCount: mib(32),
+		DropLogInterval: 5 * time.Second,
+		WorkerCount: 0,
+		WorkerSweepInterval: 1 * time.Second,
+		MaxSequences: 8192,
+		WriteRetryCount: 0,
+		WriteRetryBackoff: 10 * time.Millisecond,
+		MaxConsecutiveDrops: 8,
 	}
 }
 
@@ -153,6 +247,105 @@ type TransferPath struct {
 	destination Path
 }
 
+func NewTransferPath(source Path, destination Path) TransferPath {
+	return TransferPath{
+		source: source,
+		destination: destination,
+	}
+}
+
+func (self TransferPath) Source() Path {
+	return self.source
+}
+
+func (self TransferPath) Destination() Path {
+	return self.destination
+}
+
+// a path to the stream, for sending into the stream
+func StreamDestination(streamId Id) TransferPath {
+	return TransferPath{
+		destination: Path{StreamId: streamId},
+	}
+}
+
+// a path from the stream, for receiving from the stream
+func StreamSource(streamId Id) TransferPath {
+	return TransferPath{
+		source: Path{StreamId: streamId},
+	}
+}
+
+func (self TransferPath) IsStream() bool {
+	return self.source.IsStream() || self.destination.IsStream()
+}
+
+// the path with only the source, for matching any destination
+func (self TransferPath) SourceMask() TransferPath {
+	return TransferPath{
+		source: self.source,
+	}
+}
+
+// the path with only the destination, for matching any source
+func (self TransferPath) DestinationMask() TransferPath {
+	return TransferPath{
+		destination: self.destination,
+	}
+}
+
+// a stream path addresses only the stream. It must not have client ids,
+// and the source and destination must be the same stream when both are set
+func (self TransferPath) Validate() error {
+	if !self.IsStream() {
+		return nil
+	}
+	if self.source.ClientId != (Id{}) || self.destination.ClientId != (Id{}) {
+		return errors.New("Stream path must not have a client id.")
+	}
+	if self.source.IsStream() && self.destination.IsStream() && self.source.StreamId != self.destination.StreamId {
+		return errors.New("Stream path must have one stream id.")
+	}
+	return nil
+}
+
+func (self TransferPath) ToProtobuf() *protocol.TransferPath {
+	streamId := self.destination.StreamId
+	if self.source.IsStream() {
+		streamId = self.source.StreamId
+	}
+	return &protocol.TransferPath{
+		DestinationId: self.destination.ClientId.Bytes(),
+		SourceId: self.source.ClientId.Bytes(),
+		StreamId: streamId.Bytes(),
+	}
+}
+
+// the protobuf has one stream id, which is set on both the source and destination
+// use `SourceMask` or `DestinationMask` to compare to a stream source or destination
+func TransferPathFromProtobuf(protoPath *protocol.TransferPath) (TransferPath, error) {
+	sourceId, err := IdFromBytes(protoPath.SourceId)
+	if err != nil {
+		return TransferPath{}, err
+	}
+	destinationId, err := IdFromBytes(protoPath.DestinationId)
+	if err != nil {
+		return TransferPath{}, err
+	}
+	streamId, err := IdFromBytes(protoPath.StreamId)
+	if err != nil {
+		return TransferPath{}, err
+	}
+	path := TransferPath{
+		source: Path{ClientId: sourceId, StreamId: streamId},
+		destination: Path{ClientId: destinationId, StreamId: streamId},
+	}
+	if err := path.Validate(); err != nil {
+		return TransferPath{}, err
+	}
+	return path, nil
+}
+
 
 // comparable
 type Path struct {
@@ -160,6 +353,10 @@ type Path struct {
 	StreamId Id
 }
 
+func (self Path) IsStream() bool {
+	return self.StreamId != DirectStreamId
+}
+
 
 type SendPack struct {
 	TransferOptions
@@ -171,6 +368,8 @@ type SendPack struct {
 	// called (true) when the pack is ack'd, or (false) if not ack'd (closed before ack)
 	AckCallback AckFunction
 	MessageByteCount ByteCount
+	// the frame message bytes are compressed
+	Compressed bool
 }
 
 
@@ -178,7 +377,7 @@ type ReceivePack struct {
 	SourceId Id
 	SequenceId Id
 	Pack *protocol.Pack
-	ReceiveCallback ReceiveFunction
+	ReceiveCallback ReceiveDetailedFunction
 	MessageByteCount ByteCount
 }
 
@@ -199,12 +398,21 @@ type TransferOptions struct {
 	// a companion contract replies to an existing contract
 	// using this option limits the destination to clients that have an active contract to the sender
 	CompanionContract bool
+	// compress the frame message bytes end to end
+	// small or incompressible messages are sent uncompressed
+	Compress bool
+	// the provide mode the receive callback sees for sends to this client
+	// this can be used to simulate delivery from other provide modes
+	// `ProvideMode_None` (the zero value) is delivered as `ProvideMode_Network`
+	LoopbackProvideMode protocol.ProvideMode
 }
 
 func DefaultTransferOpts() TransferOptions {
 	return TransferOptions{
 		Ack: true,
 		CompanionContract: false,
+		Compress: false,
+		LoopbackProvideMode: protocol.ProvideMode_Network,
 	}
 }
 
@@ -231,11 +439,36 @@ func CompanionContract() transferOptionsSetCompanionContract {
 }
 
 
+type transferOptionsSetCompress struct {
+	Compress bool
+}
+
+func Compress() transferOptionsSetCompress {
+	return transferOptionsSetCompress{
+		Compress: true,
+	}
+}
+
+
+type transferOptionsSetLoopbackProvideMode struct {
+	LoopbackProvideMode protocol.ProvideMode
+}
+
+func LoopbackProvideMode(provideMode protocol.ProvideMode) transferOptionsSetLoopbackProvideMode {
+	return transferOptionsSetLoopbackProvideMode{
+		LoopbackProvideMode: provideMode,
+	}
+}
+
+
 
 type ClientSettings struct {
 	SendBufferSize int
 	ForwardBufferSize int
 	ReadTimeout time.Duration
+	// the max frames processed per read of the routes
+	// 1 reads a single frame at a time
+	ReadBatchSize int
 	BufferTimeout time.Duration
 	ControlWriteTimeout time.Duration
 
@@ -243,6 +476,47 @@ type ClientSettings struct {
 	ReceiveBufferSettings *ReceiveBufferSettings
 	ForwardBufferSettings *ForwardBufferSettings
 	ContractManagerSettings *ContractManagerSettings
+	RouteManagerSettings *RouteManagerSettings
+
+	CompressMinByteCount ByteCount
+	// the max byte count of the frames of a pack after decompression
+	MaxDecompressedByteCount ByteCount
+
+	// test-only. nil disables the sequence watchdog
+	WatchdogSettings *WatchdogSettings
+
+	// the max open send and receive contracts across all sequences. 0 is no limit
+	// see `openContractLimit`
+	MaxOpenContracts int
+
+	// the max transfer frame size that a transport carries without fragmentation,
+	// after the transport framing (e.g. the websocket or tunnel header)
+	// see `EffectivePayloadSize`
+	TransportMtu int
+
+	// attached to all peer audits sent by the client, e.g. the tenant of a multi-tenant provider
+	// per peer labels override this. See `Client.SetPeerAuditLabel`
+	// "" is no label
+	PeerAuditLabel string
+
+	// the max loopback sends per second. Sends over the limit are delayed up to the send timeout
+	// see `loopbackLimit`
+	// 0 is no limit
+	LoopbackRateLimit float64
+	// send to self through the send buffer and transports instead of delivering in process.
+	// This is for testing end-to-end paths to self. The transports must route the client back to itself,
+	// and the contract manager must allow contracts to self
+	// see `isLoopback`
+	DisableLoopback bool
+
+	// the time source of the send and receive sequences. nil is `RealClock`
+	// see `FakeClock`
+	Clock Clock
+	// a sequence wait that returns this far past its timeout is a suspend of the process,
+	// which restarts the ack and gap timeouts as `OnResume`
+	// see `detectSuspend`
+	// 0 disables detection
+	SuspendThreshold time.Duration
 }
 
 
@@ -259,8 +533,14 @@ type Client struct {
 
 	receiveCallbacks *CallbackList[ReceiveFunction]
 	forwardCallbacks *CallbackList[ForwardFunction]
+	provideModeChangeCallbacks *CallbackList[ProvideModeChangeFunction]
+	contractEvictCallbacks *CallbackList[ContractEvictFunction]
+	sequenceErrorCallbacks *CallbackList[SequenceErrorFunction]
+
+	openContractLimit *openContractLimit
 
 	loopback chan *SendPack
+	loopbackLimit *loopbackLimit
 
 	routeManager *RouteManager
 	contractManager *ContractManager
@@ -269,6 +549,19 @@ type Client struct {
 	forwardBuffer *ForwardBuffer
 
 	contractManagerUnsub func()
+
+	stateLock sync.Mutex
+	groupResolver GroupResolver
+	// peer id -> label
+	peerAuditLabels map[Id]string
+	// see `Drain`
+	draining bool
+	// loopback sends accepted but not yet delivered
+	loopbackPendingCount int
+	// see `OnResume`
+	resumeTime time.Time
+
+	clock Clock
 }
 
 func NewClientWithDefaults(
@@ -302,6 +595,11 @@ func NewClientWithTag(
 	settings *ClientSettings,
 ) *Client {
 	cancelCtx, cancel := context.WithCancel(ctx)
+	contractEvictCallbacks := NewCallbackList[ContractEvictFunction]()
+	clock := settings.Clock
+	if clock == nil {
+		clock = RealClock
+	}
 	client := &Client{
 		ctx: cancelCtx,
 		cancel: cancel,
@@ -311,10 +609,17 @@ func NewClientWithTag(
 		settings: settings,
 		receiveCallbacks: NewCallbackList[ReceiveFunction](),
 		forwardCallbacks: NewCallbackList[ForwardFunction](),
+		provideModeChangeCallbacks: NewCallbackList[ProvideModeChangeFunction](),
+		contractEvictCallbacks: contractEvictCallbacks,
+		sequenceErrorCallbacks: NewCallbackList[SequenceErrorFunction](),
+		openContractLimit: newOpenContractLimit(clientTag, settings.MaxOpenContracts, contractEvictCallbacks),
 		loopback: make(chan *SendPack),
+		loopbackLimit: newLoopbackLimit(settings.LoopbackRateLimit),
+		peerAuditLabels: map[Id]string{},
+		clock: clock,
 	}
 
-	routeManager := NewRouteManager(ctx, clientTag)
+	routeManager := NewRouteManager(ctx, clientTag, settings.RouteManagerSettings)
 	contractManager := NewContractManager(ctx, client, settings.ContractManagerSettings)
 
 	client.contractManagerUnsub = client.AddReceiveCallback(contractManager.Receive)
@@ -346,6 +651,24 @@ func (self *Client) ClientId() Id {
 	return self.clientId
 }
 
+func (self *Client) Stats() ClientStats {
+	return self.loopbackLimit.Stats()
+}
+
+func (self *Client) ResourceStats() ResourceStats {
+	resourceStats := ResourceStats{}
+	var sendGoroutineCount int
+	var receiveGoroutineCount int
+	var forwardGoroutineCount int
+	resourceStats.SendSequenceCount, sendGoroutineCount = self.sendBuffer.resourceCounts()
+	resourceStats.ReceiveSequenceCount, receiveGoroutineCount = self.receiveBuffer.resourceCounts()
+	resourceStats.ForwardSequenceCount, forwardGoroutineCount = self.forwardBuffer.resourceCounts()
+	resourceStats.BufferGoroutineCount = sendGoroutineCount + receiveGoroutineCount + forwardGoroutineCount
+	resourceStats.ForwardSequenceEvictCount = self.forwardBuffer.sequenceEvictCount()
+	resourceStats.SequenceCreateCount, resourceStats.SequenceCloseCount = globalSequenceCounts.counts()
+	return resourceStats
+}
+
 func (self *Client) ClientTag() string {
 	return self.clientTag
 }
@@ -354,6 +677,29 @@ func (self *Client) ClientOob() OutOfBandControl {
 	return self.clientOob
 }
 
+// overrides `ClientSettings.PeerAuditLabel` for audits of the peer
+// "" removes the override
+func (self *Client) SetPeerAuditLabel(peerId Id, label string) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if label == "" {
+		delete(self.peerAuditLabels, peerId)
+	} else {
+		self.peerAuditLabels[peerId] = label
+	}
+}
+
+func (self *Client) PeerAuditLabel(peerId Id) string {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if label, ok := self.peerAuditLabels[peerId]; ok {
+		return label
+	}
+	return self.settings.PeerAuditLabel
+}
+
 func (self *Client) ReportAbuse(sourceId Id) {
 	peerAudit := NewSequencePeerAudit(self, sourceId, 0)
 	peerAudit.Update(func (peerAudit *PeerAudit) {
@@ -370,7 +716,7 @@ func (self *Client) ForwardWithTimeout(transferFrameBytes []byte, timeout time.D
 func (self *Client) ForwardWithTimeoutDetailed(transferFrameBytes []byte, timeout time.Duration) (bool, error) {
 	select {
 	case <- self.ctx.Done():
-		return false, errors.New("Done")
+		return false, ErrDone
 	default:
 	}
 
@@ -397,6 +743,110 @@ func (self *Client) Forward(transferFrameBytes []byte) bool {
 	return self.ForwardWithTimeout(transferFrameBytes, -1)
 }
 
+// the max message bytes of a frame sent on the path
+// such that the transfer frame fits in `ClientSettings.TransportMtu`.
+// Assumptions:
+// - one frame per pack. Packs that combine frames have additional overhead per frame
+// - the pack may carry a contract frame, which is included in the overhead
+// - the transport mtu is net of any transport and tunnel framing
+// - compression never expands the message bytes
+// Returns 0 if the mtu cannot fit the overhead.
+func (self *Client) EffectivePayloadSize(path TransferPath) int {
+	mtu := self.settings.TransportMtu
+
+	sourceId := path.Source().ClientId
+	if sourceId == (Id{}) {
+		sourceId = self.clientId
+	}
+
+	// the largest encoding of each field
+	storedContractBytes, _ := proto.Marshal(&protocol.StoredContract{
+		ContractId: Id{}.Bytes(),
+		TransferByteCount: math.MaxUint64,
+		SourceId: sourceId.Bytes(),
+		DestinationId: path.Destination().ClientId.Bytes(),
+	})
+	contractBytes, _ := proto.Marshal(&protocol.Contract{
+		StoredContractBytes: storedContractBytes,
+		// sha256 hmac
+		StoredContractHmac: make([]byte, 32),
+		ProvideMode: protocol.ProvideMode(math.MaxInt32),
+	})
+	pack := &protocol.Pack{
+		MessageId: Id{}.Bytes(),
+		SequenceId: Id{}.Bytes(),
+		SequenceNumber: math.MaxUint64,
+		Head: true,
+		Frames: []*protocol.Frame{
+			&protocol.Frame{
+				MessageType: protocol.MessageType(math.MaxInt32),
+				// the payload length is at most the mtu, which bounds the length prefix
+				MessageBytes: make([]byte, mtu),
+			},
+		},
+		Nack: true,
+		ContractFrame: &protocol.Frame{
+			MessageType: protocol.MessageType_TransferContract,
+			MessageBytes: contractBytes,
+		},
+		Compressed: true,
+	}
+	packBytes, _ := proto.Marshal(pack)
+	transferFrame := &protocol.TransferFrame{
+		TransferPath: NewTransferPath(
+			Path{ClientId: sourceId, StreamId: path.Source().StreamId},
+			path.Destination(),
+		).ToProtobuf(),
+		Frame: &protocol.Frame{
+			MessageType: protocol.MessageType_TransferPack,
+			MessageBytes: packBytes,
+		},
+	}
+	transferFrameBytes, _ := proto.Marshal(transferFrame)
+
+	overhead := len(transferFrameBytes) - mtu
+	return max(0, mtu - overhead)
+}
+
+// pins the destination of the path to the route. A route is identified by its `Route` value
+// see `RouteManager.PinDestination`
+func (self *Client) PinDestination(destination TransferPath, route Route) error {
+	destinationId, err := self.destinationId(destination)
+	if err != nil {
+		return err
+	}
+	self.routeManager.PinDestination(destinationId, route)
+	return nil
+}
+
+func (self *Client) UnpinDestination(destination TransferPath) error {
+	destinationId, err := self.destinationId(destination)
+	if err != nil {
+		return err
+	}
+	self.routeManager.UnpinDestination(destinationId)
+	return nil
+}
+
+// sends to the destination prefer routes that carry the ip version,
+// e.g. 4 for a destination resolved from a dns A record and 6 for AAAA
+// see `RouteManager.SetDestinationIpVersion`
+func (self *Client) SetDestinationIpVersion(destinationId Id, ipVersion int) {
+	self.routeManager.SetDestinationIpVersion(destinationId, ipVersion)
+}
+
+// see `RouteManager.ForceIpVersion`
+func (self *Client) ForceIpVersion(ipVersion int) {
+	self.routeManager.ForceIpVersion(ipVersion)
+}
+
+// overrides `ForwardBufferSettings.IdleTimeout` for the destination
+// until the forward sequence of the destination closes
+// a timeout <= 0 falls back to the default
+func (self *Client) SetForwardIdleTimeout(destinationId Id, idleTimeout time.Duration) {
+	self.forwardBuffer.SetIdleTimeout(destinationId, idleTimeout)
+}
+
 func (self *Client) SendWithTimeout(
 	frame *protocol.Frame,
 	destinationId Id,
@@ -414,13 +864,33 @@ func (self *Client) SendWithTimeoutDetailed(
 	ackCallback AckFunction,
 	timeout time.Duration,
 	opts ...any,
+) (bool, error) {
+	if groupResolver := self.GroupResolver(); groupResolver != nil {
+		if memberIds, ok := groupResolver.ResolveGroup(destinationId); ok {
+			return self.sendGroupWithTimeoutDetailed(frame, destinationId, memberIds, ackCallback, timeout, opts...)
+		}
+	}
+	return self.sendWithTimeoutDetailed(frame, destinationId, ackCallback, timeout, opts...)
+}
+
+func (self *Client) sendWithTimeoutDetailed(
+	frame *protocol.Frame,
+	destinationId Id,
+	ackCallback AckFunction,
+	timeout time.Duration,
+	opts ...any,
 ) (bool, error) {
 	select {
 	case <- self.ctx.Done():
-		return false, errors.New("Done")
+		return false, ErrDone
 	default:
 	}
 
+	// control sends are still needed to create contracts for the pending sends
+	if destinationId != ControlId && self.isDraining() {
+		return false, errors.New("Draining")
+	}
+
 	safeAckCallback := func(err error) {
 		if ackCallback != nil {
 			HandleError(func() {
@@ -438,6 +908,10 @@ func (self *Client) SendWithTimeoutDetailed(
 			transferOpts.Ack = v.Ack
 		case transferOptionsSetCompanionContract:
 			transferOpts.CompanionContract = v.CompanionContract
+		case transferOptionsSetCompress:
+			transferOpts.Compress = v.Compress
+		case transferOptionsSetLoopbackProvideMode:
+			transferOpts.LoopbackProvideMode = v.LoopbackProvideMode
 		}
 	}
 
@@ -450,39 +924,90 @@ func (self *Client) SendWithTimeoutDetailed(
 		MessageByteCount: messageByteCount,
 	}
 
-	if sendPack.DestinationId == self.clientId {
+	if self.isLoopback(sendPack.DestinationId) {
 		// loopback
+		// count the send as pending until it is delivered, so that `Drain` waits for it
+		self.addLoopbackPending(1)
+		sent := false
+		defer func() {
+			if !sent {
+				self.addLoopbackPending(-1)
+			}
+		}()
+		timeout, ok := self.loopbackLimit.wait(self.ctx, timeout)
+		if !ok {
+			select {
+			case <- self.ctx.Done():
+				return false, ErrDone
+			default:
+				return false, nil
+			}
+		}
 		if timeout < 0 {
 			select {
 			case <- self.ctx.Done():
-				return false, errors.New("Done")
+				return false, ErrDone
 			case self.loopback <- sendPack:
+				sent = true
+				self.loopbackLimit.send(messageByteCount)
 				return true, nil
 			}
 		} else if timeout == 0 {
 			select {
 			case <- self.ctx.Done():
-				return false, errors.New("Done")
+				return false, ErrDone
 			case self.loopback <- sendPack:
+				sent = true
+				self.loopbackLimit.send(messageByteCount)
 				return true, nil
 			default:
+				self.loopbackLimit.drop()
 				return false, nil
 			}
 		} else {
 			select {
 			case <- self.ctx.Done():
-				return false, errors.New("Done")
+				return false, ErrDone
 			case self.loopback <- sendPack:
+				sent = true
+				self.loopbackLimit.send(messageByteCount)
 				return true, nil
 			case <- time.After(timeout):
+				self.loopbackLimit.drop()
 				return false, nil
 			}
 		}
 	} else {
+		// loopback frames are never compressed since they are not serialized
+		if transferOpts.Compress {
+			if compressedFrame, compressed := compressFrame(frame, self.settings.CompressMinByteCount); compressed {
+				sendPack.Frame = compressedFrame
+				sendPack.MessageByteCount = ByteCount(len(compressedFrame.MessageBytes))
+				sendPack.Compressed = true
+			}
+		}
 		return self.sendBuffer.Pack(sendPack, timeout)
 	}
 }
 
+// sends to self are delivered in process, unless `ClientSettings.DisableLoopback`
+// group sends resolve to member ids before this check, so a group that contains self loops back for self
+func (self *Client) isLoopback(destinationId Id) bool {
+	return !self.settings.DisableLoopback && destinationId == self.clientId
+}
+
+// the client id a transfer path sends to
+// stream destinations are addressed only by the stream, and are never self
+func (self *Client) destinationId(destination TransferPath) (Id, error) {
+	if err := destination.Validate(); err != nil {
+		return Id{}, err
+	}
+	if destination.Destination().IsStream() {
+		return Id{}, errors.New("Stream destinations are not supported.")
+	}
+	return destination.Destination().ClientId, nil
+}
+
 func (self *Client) SendControlWithTimeout(frame *protocol.Frame, ackCallback AckFunction, timeout time.Duration) bool {
 	return self.SendWithTimeout(frame, ControlId, ackCallback, timeout)
 }
@@ -495,12 +1020,188 @@ func (self *Client) SendControl(frame *protocol.Frame, ackCallback AckFunction)
 	return self.Send(frame, ControlId, ackCallback)
 }
 
+// Sends the bytes of the reader to the destination as one message of `protocol.StreamChunk` frames.
+// Each chunk has at most `chunkSize` bytes, reduced to fit the transport mtu and the standard contract.
+// `chunkSize <= 0` uses the largest chunk that fits. See `StreamChunkSize`.
+// The chunks are sent in order with ack, and each send blocks until the send buffer accepts it,
+// so a slow destination slows the read of the stream.
+// The ack callback is called once, after all chunks are acked or on the first error.
+// Returns false if the stream could not be read or sent to the end.
+func (self *Client) SendStream(
+	reader io.Reader,
+	destination TransferPath,
+	chunkSize int,
+	ackCallback AckFunction,
+) bool {
+	streamAck := newStreamAck(ackCallback)
+
+	destinationId, err := self.destinationId(destination)
+	if err != nil {
+		streamAck.close(err)
+		return false
+	}
+
+	maxChunkSize := self.StreamChunkSize(destination)
+	if chunkSize <= 0 || maxChunkSize < chunkSize {
+		chunkSize = maxChunkSize
+	}
+	if chunkSize <= 0 {
+		streamAck.close(errors.New("Destination cannot fit a chunk."))
+		return false
+	}
+
+	readChunk := func() ([]byte, error) {
+		chunkBytes := make([]byte, chunkSize)
+		n, err := io.ReadFull(reader, chunkBytes)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return chunkBytes[:n], err
+	}
+
+	messageId := NewId()
+	chunkBytes, readErr := readChunk()
+	for chunkIndex := uint32(0); ; chunkIndex += 1 {
+		if readErr != nil && readErr != io.EOF {
+			streamAck.close(readErr)
+			return false
+		}
+		// read ahead to mark the last chunk
+		last := readErr == io.EOF
+		var nextChunkBytes []byte
+		var nextReadErr error
+		if !last {
+			nextChunkBytes, nextReadErr = readChunk()
+			last = nextReadErr == io.EOF && len(nextChunkBytes) == 0
+		}
+
+		if streamAck.isDone() {
+			// a previous chunk failed
+			return false
+		}
+		frame := RequireToFrame(&protocol.StreamChunk{
+			MessageId: messageId.Bytes(),
+			ChunkIndex: chunkIndex,
+			Last: last,
+			ChunkBytes: chunkBytes,
+		})
+		if !self.SendWithTimeout(frame, destinationId, streamAck.ack, -1) {
+			streamAck.close(errors.New("Send failed."))
+			return false
+		}
+		streamAck.add()
+
+		if last {
+			streamAck.close(nil)
+			return true
+		}
+		chunkBytes, readErr = nextChunkBytes, nextReadErr
+	}
+}
+
+// the max chunk bytes of a `protocol.StreamChunk` sent on the path,
+// such that the chunk frame fits in `EffectivePayloadSize` and the standard contract.
+// Returns 0 if the chunk overhead does not fit.
+func (self *Client) StreamChunkSize(destination TransferPath) int {
+	payloadSize := min(
+		self.EffectivePayloadSize(destination),
+		int(self.contractManager.StandardContractTransferByteCount()),
+	)
+
+	// the largest encoding of each field
+	chunkBytes, _ := proto.Marshal(&protocol.StreamChunk{
+		MessageId: Id{}.Bytes(),
+		ChunkIndex: math.MaxUint32,
+		Last: true,
+		// the chunk length is at most the payload size, which bounds the length prefix
+		ChunkBytes: make([]byte, payloadSize),
+	})
+	overhead := len(chunkBytes) - payloadSize
+	return max(0, payloadSize - overhead)
+}
+
+
+// calls the stream ack callback once,
+// on the first error or after the stream is closed and all chunks are acked
+type streamAck struct {
+	ackCallback AckFunction
+
+	stateLock sync.Mutex
+	unackedCount int
+	closed bool
+	done bool
+}
+
+func newStreamAck(ackCallback AckFunction) *streamAck {
+	return &streamAck{
+		ackCallback: ackCallback,
+	}
+}
+
+func (self *streamAck) add() {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.unackedCount += 1
+}
+
+// AckFunction
+// note an ack can arrive before the chunk is added
+func (self *streamAck) ack(err error) {
+	self.complete(err, func() {
+		self.unackedCount -= 1
+	})
+}
+
+func (self *streamAck) close(err error) {
+	self.complete(err, func() {
+		self.closed = true
+	})
+}
+
+func (self *streamAck) complete(err error, update func()) {
+	done := func()(bool) {
+		self.stateLock.Lock()
+		defer self.stateLock.Unlock()
+
+		update()
+		if self.done {
+			return false
+		}
+		if err != nil || self.closed && self.unackedCount == 0 {
+			self.done = true
+			return true
+		}
+		return false
+	}()
+	if done && self.ackCallback != nil {
+		HandleError(func() {
+			self.ackCallback(err)
+		})
+	}
+}
+
+func (self *streamAck) isDone() bool {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return self.done
+}
+
 // ReceiveFunction
 func (self *Client) receive(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+	self.receiveDetailed(sourceId, frames, provideMode)
+}
+
+// ReceiveDetailedFunction
+func (self *Client) receiveDetailed(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) error {
+	var errs []error
 	for _, receiveCallback := range self.receiveCallbacks.Get() {
 		c := func()(any) {
 			return HandleError(func() {
 				receiveCallback(sourceId, frames, provideMode)
+			}, func(err error) {
+				errs = append(errs, err)
 			})
 		}
 		if glog.V(2) {
@@ -512,6 +1213,7 @@ func (self *Client) receive(sourceId Id, frames []*protocol.Frame, provideMode p
 			c()
 		}
 	}
+	return errors.Join(errs...)
 }
 
 // ForwardFunction
@@ -533,6 +1235,37 @@ func (self *Client) forward(sourceId Id, destinationId Id, transferFrameBytes []
 	}
 }
 
+// ProvideModeChangeFunction
+func (self *Client) provideModeChange(sourceId Id, previousProvideMode protocol.ProvideMode, provideMode protocol.ProvideMode) {
+	for _, provideModeChangeCallback := range self.provideModeChangeCallbacks.Get() {
+		HandleError(func() {
+			provideModeChangeCallback(sourceId, previousProvideMode, provideMode)
+		})
+	}
+}
+
+func (self *Client) sequenceError(source TransferPath, sequenceId Id, reason string) {
+	for _, sequenceErrorCallback := range self.sequenceErrorCallbacks.Get() {
+		HandleError(func() {
+			sequenceErrorCallback(source, sequenceId, reason)
+		})
+	}
+}
+
+func (self *Client) AddSequenceErrorCallback(sequenceErrorCallback SequenceErrorFunction) func() {
+	callbackId := self.sequenceErrorCallbacks.Add(sequenceErrorCallback)
+	return func() {
+		self.sequenceErrorCallbacks.Remove(callbackId)
+	}
+}
+
+func (self *Client) AddContractEvictCallback(contractEvictCallback ContractEvictFunction) func() {
+	callbackId := self.contractEvictCallbacks.Add(contractEvictCallback)
+	return func() {
+		self.contractEvictCallbacks.Remove(callbackId)
+	}
+}
+
 func (self *Client) AddReceiveCallback(receiveCallback ReceiveFunction) func() {
 	callbackId := self.receiveCallbacks.Add(receiveCallback)
 	return func() {
@@ -547,6 +1280,13 @@ func (self *Client) AddForwardCallback(forwardCallback ForwardFunction) func() {
 	}
 }
 
+func (self *Client) AddProvideModeChangeCallback(provideModeChangeCallback ProvideModeChangeFunction) func() {
+	callbackId := self.provideModeChangeCallbacks.Add(provideModeChangeCallback)
+	return func() {
+		self.provideModeChangeCallbacks.Remove(callbackId)
+	}
+}
+
 func (self *Client) run() {
 	defer self.cancel()
 	
@@ -560,6 +1300,15 @@ func (self *Client) run() {
 		peerAudit.Update(callback)
 		peerAudit.Complete()
 	}
+	auditBadMessage := func(sourceId Id, byteCount ByteCount) {
+		abuse := self.receiveBuffer.badMessage(sourceId)
+		updatePeerAudit(sourceId, func(a *PeerAudit) {
+			a.badMessage(byteCount)
+			if abuse {
+				a.Abuse = true
+			}
+		})
+	}
 
 	// loopback messages must be serialized
 	go func() {
@@ -568,16 +1317,21 @@ func (self *Client) run() {
 			case <- self.ctx.Done():
 				return
 			case sendPack := <- self.loopback:
+				provideMode := sendPack.LoopbackProvideMode
+				if provideMode == protocol.ProvideMode_None {
+					provideMode = protocol.ProvideMode_Network
+				}
 				HandleError(func() {
 					self.receive(
 						self.clientId,
 						[]*protocol.Frame{sendPack.Frame},
-						protocol.ProvideMode_Network,
+						provideMode,
 					)
 					sendPack.AckCallback(nil)
 				}, func(err error) {
 					sendPack.AckCallback(err)
 				})
+				self.addLoopbackPending(-1)
 			}
 		}
 	}()
@@ -589,10 +1343,14 @@ func (self *Client) run() {
 		default:
 		}
 
-		var transferFrameBytes []byte
+		var transferFramesBytes [][]byte
 		var err error
 		c := func()(error) {
-			transferFrameBytes, err = multiRouteReader.Read(self.ctx, self.settings.ReadTimeout)
+			transferFramesBytes, err = multiRouteReader.ReadBatch(
+				self.ctx,
+				self.settings.ReadTimeout,
+				max(1, self.settings.ReadBatchSize),
+			)
 			return err
 		}
 		if glog.V(2) {
@@ -607,114 +1365,40 @@ func (self *Client) run() {
 			continue
 		}
 
-		// at this point, the route is expected to have already parsed the transfer frame
-		// and applied basic validation and source/destination checks
-		// because of this, errors in parsing the `FilteredTransferFrame` are not expected
-		// decode a minimal subset of the full message needed to make a routing decision
-		filteredTransferFrame := &protocol.FilteredTransferFrame{}
-		if err := proto.Unmarshal(transferFrameBytes, filteredTransferFrame); err != nil {
-			// bad protobuf (unexpected, see route note above)
-			continue
-		}
-		if filteredTransferFrame.TransferPath == nil {
-			// bad protobuf (unexpected, see route note above)
-			continue
-		}
-		sourceId, err := IdFromBytes(filteredTransferFrame.TransferPath.SourceId)
-		if err != nil {
-			// bad protobuf (unexpected, see route note above)
-			continue
-		}
-		destinationId, err := IdFromBytes(filteredTransferFrame.TransferPath.DestinationId)
-		if err != nil {
-			// bad protobuf (unexpected, see route note above)
-			continue
-		}
-
-		glog.V(1).Infof("[cr] %s %s<-%s\n", self.clientTag, destinationId, sourceId)
-
-		if destinationId == self.clientId {
-			// the transports have typically not parsed the full `TransferFrame`
-			// on error, discard the message and report the peer
-			transferFrame := &protocol.TransferFrame{}
-			if err := proto.Unmarshal(transferFrameBytes, transferFrame); err != nil {
-				// bad protobuf
-				updatePeerAudit(sourceId, func(a *PeerAudit) {
-					a.badMessage(ByteCount(len(transferFrameBytes)))
-				})
+		for _, transferFrameBytes := range transferFramesBytes {
+			// at this point, the route is expected to have already parsed the transfer frame
+			// and applied basic validation and source/destination checks
+			// because of this, errors in parsing the `FilteredTransferFrame` are not expected
+			// decode a minimal subset of the full message needed to make a routing decision
+			filteredTransferFrame := &protocol.FilteredTransferFrame{}
+			if err := proto.Unmarshal(transferFrameBytes, filteredTransferFrame); err != nil {
+				// bad protobuf (unexpected, see route note above)
+				continue
+			}
+			if filteredTransferFrame.TransferPath == nil {
+				// bad protobuf (unexpected, see route note above)
+				continue
+			}
+			sourceId, err := IdFromBytes(filteredTransferFrame.TransferPath.SourceId)
+			if err != nil {
+				// bad protobuf (unexpected, see route note above)
+				continue
+			}
+			destinationId, err := IdFromBytes(filteredTransferFrame.TransferPath.DestinationId)
+			if err != nil {
+				// bad protobuf (unexpected, see route note above)
 				continue
 			}
-			frame := transferFrame.GetFrame()
 
-			// TODO apply source verification+decryption with pke
+			glog.V(1).Infof("[cr] %s %s<-%s\n", self.clientTag, destinationId, sourceId)
 
-			switch frame.GetMessageType() {
-			case protocol.MessageType_TransferAck:
-				ack := &protocol.Ack{}
-				if err := proto.Unmarshal(frame.GetMessageBytes(), ack); err != nil {
-					// bad protobuf
-					updatePeerAudit(sourceId, func(a *PeerAudit) {
-						a.badMessage(ByteCount(len(transferFrameBytes)))
-					})
-					continue
-				}
-				c := func()(bool) {
-					return self.sendBuffer.Ack(sourceId, ack, self.settings.BufferTimeout)
-				}
-				if glog.V(2) {
-					TraceWithReturn(
-						fmt.Sprintf("[cr]ack %s %s<-%s", self.clientTag, destinationId, sourceId),
-						c,
-					)
-				} else {
-					c()
-				}
-			case protocol.MessageType_TransferPack:
-				pack := &protocol.Pack{}
-				if err := proto.Unmarshal(frame.GetMessageBytes(), pack); err != nil {
-					// bad protobuf
-					updatePeerAudit(sourceId, func(a *PeerAudit) {
-						a.badMessage(ByteCount(len(transferFrameBytes)))
-					})
-					continue
-				}
-				sequenceId, err := IdFromBytes(pack.SequenceId)
-				if err != nil {
-					// bad protobuf
-					continue
-				}
-				messageByteCount := MessageByteCount(pack.Frames)
-				c := func()(bool) {
-					success, err := self.receiveBuffer.Pack(&ReceivePack{
-						SourceId: sourceId,
-						SequenceId: sequenceId,
-						Pack: pack,
-						ReceiveCallback: self.receive,
-						MessageByteCount: messageByteCount,
-					}, self.settings.BufferTimeout)
-					return success && err == nil
-				}
-				if glog.V(2) {
-					TraceWithReturn(
-						fmt.Sprintf("[cr]pack %s %s<-%s", self.clientTag, destinationId, sourceId),
-						c,
-					)
-				} else {
-					c()
-				}
-			default:
-				updatePeerAudit(sourceId, func(a *PeerAudit) {
-					a.badMessage(ByteCount(len(transferFrameBytes)))
-				})
-			}
-		} else {
-			if VerifyForwardMessages {
+			if destinationId == self.clientId {
+				// the transports have typically not parsed the full `TransferFrame`
+				// on error, discard the message and report the peer
 				transferFrame := &protocol.TransferFrame{}
 				if err := proto.Unmarshal(transferFrameBytes, transferFrame); err != nil {
 					// bad protobuf
-					updatePeerAudit(sourceId, func(a *PeerAudit) {
-						a.badMessage(ByteCount(len(transferFrameBytes)))
-					})
+					auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
 					continue
 				}
 				frame := transferFrame.GetFrame()
@@ -726,35 +1410,108 @@ func (self *Client) run() {
 					ack := &protocol.Ack{}
 					if err := proto.Unmarshal(frame.GetMessageBytes(), ack); err != nil {
 						// bad protobuf
-						updatePeerAudit(sourceId, func(a *PeerAudit) {
-							a.badMessage(ByteCount(len(transferFrameBytes)))
-						})
+						auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
 						continue
 					}
+					c := func()(bool) {
+						return self.sendBuffer.Ack(sourceId, ack, self.settings.BufferTimeout)
+					}
+					if glog.V(2) {
+						TraceWithReturn(
+							fmt.Sprintf("[cr]ack %s %s<-%s", self.clientTag, destinationId, sourceId),
+							c,
+						)
+					} else {
+						c()
+					}
 				case protocol.MessageType_TransferPack:
 					pack := &protocol.Pack{}
 					if err := proto.Unmarshal(frame.GetMessageBytes(), pack); err != nil {
 						// bad protobuf
-						updatePeerAudit(sourceId, func(a *PeerAudit) {
-							a.badMessage(ByteCount(len(transferFrameBytes)))
-						})
+						auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
+						continue
+					}
+					sequenceId, err := IdFromBytes(pack.SequenceId)
+					if err != nil {
+						// bad protobuf
 						continue
 					}
+					// the byte count is the compressed byte count, which matches the sender accounting
+					messageByteCount := MessageByteCount(pack.Frames)
+					if pack.Compressed {
+						frames, err := decompressFrames(pack.Frames, self.settings.MaxDecompressedByteCount)
+						if err != nil {
+							// bad compression
+							auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
+							continue
+						}
+						pack.Frames = frames
+						pack.Compressed = false
+					}
+					c := func()(bool) {
+						success, err := self.receiveBuffer.Pack(&ReceivePack{
+							SourceId: sourceId,
+							SequenceId: sequenceId,
+							Pack: pack,
+							ReceiveCallback: self.receiveDetailed,
+							MessageByteCount: messageByteCount,
+						}, self.settings.BufferTimeout)
+						return success && err == nil
+					}
+					if glog.V(2) {
+						TraceWithReturn(
+							fmt.Sprintf("[cr]pack %s %s<-%s", self.clientTag, destinationId, sourceId),
+							c,
+						)
+					} else {
+						c()
+					}
 				default:
-					// unknown message, ignore
+					auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
 				}
-			}
-
-			c := func() {
-				self.forward(sourceId, destinationId, transferFrameBytes)
-			}
-			if glog.V(1) {
-				Trace(
-					fmt.Sprintf("[cr]forward %s %s<-%s", self.clientTag, destinationId, sourceId),
-					c,
-				)
 			} else {
-				c()
+				if VerifyForwardMessages {
+					transferFrame := &protocol.TransferFrame{}
+					if err := proto.Unmarshal(transferFrameBytes, transferFrame); err != nil {
+						// bad protobuf
+						auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
+						continue
+					}
+					frame := transferFrame.GetFrame()
+
+					// TODO apply source verification+decryption with pke
+
+					switch frame.GetMessageType() {
+					case protocol.MessageType_TransferAck:
+						ack := &protocol.Ack{}
+						if err := proto.Unmarshal(frame.GetMessageBytes(), ack); err != nil {
+							// bad protobuf
+							auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
+							continue
+						}
+					case protocol.MessageType_TransferPack:
+						pack := &protocol.Pack{}
+						if err := proto.Unmarshal(frame.GetMessageBytes(), pack); err != nil {
+							// bad protobuf
+							auditBadMessage(sourceId, ByteCount(len(transferFrameBytes)))
+							continue
+						}
+					default:
+						// unknown message, ignore
+					}
+				}
+
+				c := func() {
+					self.forward(sourceId, destinationId, transferFrameBytes)
+				}
+				if glog.V(1) {
+					Trace(
+						fmt.Sprintf("[cr]forward %s %s<-%s", self.clientTag, destinationId, sourceId),
+						c,
+					)
+				} else {
+					c()
+				}
 			}
 		}
 	}
@@ -768,6 +1525,50 @@ func (self *Client) ResendQueueSize(destinationId Id, companionContract bool) (i
 	}
 }
 
+// send throughput by destination path, for the open send sequences
+func (self *Client) TransferStats() map[TransferPath]*TransferStats {
+	return self.sendBuffer.TransferStats()
+}
+
+// requests a contract for the destination into the contract queue,
+// so that the first send to the destination takes the queued contract instead of waiting for a new one.
+// Apps that know their destinations ahead of time can call this on connect.
+// This does nothing when a contract is already queued, a previous prewarm request is outstanding,
+// or the destination does not need a contract.
+// Multi-hop prewarm is not supported. Contracts are keyed only by the destination client id,
+// so there are no intermediary contracts to prewarm.
+// The request is async
+func (self *Client) PrewarmContract(destination TransferPath) error {
+	destinationId, err := self.destinationId(destination)
+	if err != nil {
+		return err
+	}
+	if self.isLoopback(destinationId) {
+		return nil
+	}
+	if self.contractManager.SendNoContract(destinationId, false) {
+		return nil
+	}
+	if self.contractManager.PrewarmContract(destinationId, self.settings.ControlWriteTimeout) {
+		glog.V(1).Infof("[c]%s->%s prewarm contract\n", self.clientTag, destinationId)
+	}
+	return nil
+}
+
+// rtt distribution by destination path, over the last `SendBufferSettings.RttWindowSize` samples
+// of the open send sequences
+func (self *Client) RttStats() map[TransferPath]*RttStats {
+	return self.sendBuffer.RttStats()
+}
+
+func (self *Client) TotalResendQueueSize() (int, ByteCount) {
+	if self.sendBuffer == nil {
+		return 0, 0
+	} else {
+		return self.sendBuffer.TotalResendQueueSize()
+	}
+}
+
 func (self *Client) ReceiveQueueSize(sourceId Id, sequenceId Id) (int, ByteCount) {
 	if self.receiveBuffer == nil {
 		return 0, 0
@@ -804,6 +1605,109 @@ func (self *Client) Close() {
 	self.contractManagerUnsub()
 }
 
+// stops accepting new sends, except control sends, and waits up to `timeout` for the pending sends
+// to be acked or fail, then closes the client.
+// A send is pending while it is in a send sequence queue or resend queue,
+// or for loopback, until it is delivered.
+// returns true if all pending sends completed before the timeout
+func (self *Client) Drain(timeout time.Duration) bool {
+	func() {
+		self.stateLock.Lock()
+		defer self.stateLock.Unlock()
+		self.draining = true
+	}()
+	defer self.Close()
+
+	endTime := time.Now().Add(timeout)
+	for {
+		if self.sendBuffer.Drained() && self.loopbackDrained() {
+			return true
+		}
+		remainingTimeout := endTime.Sub(time.Now())
+		if remainingTimeout <= 0 {
+			glog.Infof("[c]%s drain timeout\n", self.clientTag)
+			return false
+		}
+		select {
+		case <- self.ctx.Done():
+			return false
+		case <- time.After(min(drainPollInterval, remainingTimeout)):
+		}
+	}
+}
+
+func (self *Client) isDraining() bool {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.draining
+}
+
+func (self *Client) addLoopbackPending(delta int) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	self.loopbackPendingCount += delta
+}
+
+func (self *Client) loopbackDrained() bool {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.loopbackPendingCount == 0
+}
+
+// Call after the process resumes from a suspend, e.g. when a mobile device wakes from sleep.
+// Timeouts are measured with the monotonic clock, so a wall clock step does not affect them.
+// However a suspend can elapse the ack and gap timeouts without a chance for the peer to respond,
+// which closes the open sequences at once on wake.
+// After resume, the ack timeouts of pending sends and the gap timeouts of pending receives
+// restart from the resume time. Pending sends past their resend time are resent.
+// Sequences also detect a suspend on their own, see `detectSuspend`.
+func (self *Client) OnResume() {
+	self.resume(self.clock.Now())
+}
+
+func (self *Client) resume(resumeTime time.Time) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	if self.resumeTime.Before(resumeTime) {
+		self.resumeTime = resumeTime
+	}
+	glog.V(1).Infof("[c]%s resume\n", self.clientTag)
+}
+
+// call when a sequence wait of `timeout` that started at `waitTime` returns
+// The timers of a wait fire at once on wake from a suspend, so a wait that returns
+// far past its timeout means the process was suspended, and resumes the client.
+// The monotonic clock does not advance during a suspend on some platforms,
+// so the wall clock gap is also considered.
+func (self *Client) detectSuspend(waitTime time.Time, timeout time.Duration) {
+	if self.settings.SuspendThreshold <= 0 {
+		return
+	}
+	now := self.clock.Now()
+	elapsed := max(now.Sub(waitTime), now.Round(0).Sub(waitTime.Round(0)))
+	if self.settings.SuspendThreshold <= elapsed - timeout {
+		glog.Infof("[c]%s detected suspend (%s)\n", self.clientTag, elapsed - timeout)
+		self.resume(now)
+	}
+}
+
+// the time of the last `OnResume`
+// sequences read this once per timeout check rather than per item, see `timeoutStartTime`
+func (self *Client) lastResumeTime() time.Time {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	return self.resumeTime
+}
+
+// the start of a timeout for an item that started at `startTime`
+// items that started before the last resume restart their timeout from the resume
+func timeoutStartTime(startTime time.Time, resumeTime time.Time) time.Time {
+	if startTime.Before(resumeTime) {
+		return resumeTime
+	}
+	return startTime
+}
+
 func (self *Client) Cancel() {
 	self.cancel()
 
@@ -823,12 +1727,25 @@ func (self *Client) Flush() {
 
 type SendBufferSettings struct {
 	CreateContractTimeout time.Duration
+	// the initial time between contract requests. Does linear backoff with `CreateContractRetryBackoffScale`
+	// the retries are bounded by `CreateContractTimeout`
 	CreateContractRetryInterval time.Duration
+	CreateContractRetryBackoffScale float64
+	// each retry interval is randomly scaled by up to +-`CreateContractRetryJitterFraction`
+	// 0 disables jitter
+	CreateContractRetryJitterFraction float64
+	// the number of definitive contract errors (e.g. insufficient balance) to retry before failing fast
+	// transient errors are retried until `CreateContractTimeout`
+	CreateContractErrorRetryCount int
 
 	// TODO replace this with round trip time estimation
 	// resend timeout is the initial time between successive send attempts. Does linear backoff
 	ResendInterval time.Duration
 	ResendBackoffScale float64
+	// each resend timeout is randomly scaled by up to +-`ResendJitterFraction`
+	// this spreads out the retransmits of items that were queued at the same time
+	// 0 disables jitter
+	ResendJitterFraction float64
 
 	// on ack timeout, no longer attempt to retransmit and notify of ack failure
 	AckTimeout time.Duration
@@ -844,10 +1761,51 @@ type SendBufferSettings struct {
 	WriteTimeout time.Duration
 
 	ResendQueueMaxByteCount ByteCount
+	// creates the congestion controller for each send sequence, which sets the resend queue window.
+	// See `CongestionController`
+	CongestionControllerGenerator CongestionControllerGenerator
 
 	// as this ->1, there is more risk that noack messages will get dropped due to out of sync contracts
 	ContractFillFraction float32
-}
+
+	// how no-ack messages are counted against the contract. See `NackAccountingPolicy`
+	NackAccountingPolicy NackAccountingPolicy
+
+	// acks that do not match a pending message of the sequence are invalid and dropped
+	// a peer that sends more than `InvalidAckLimit` invalid acks in `InvalidAckWindow` is audited
+	// 0 disables the audit
+	InvalidAckLimit int
+	InvalidAckWindow time.Duration
+
+	// the number of recent rtt samples kept per sequence for `Client.RttStats`
+	// 0 disables the window
+	RttWindowSize int
+	// samples in the window are weighted by 1/2 for every half life of their age,
+	// so that the rtt stats follow a change of the path latency
+	// 0 weights all samples in the window equally
+	RttWindowHalfLife time.Duration
+
+	// when true, a sequence that closes idle with all messages acked sends a close marker,
+	// so that the receiver closes its sequence without waiting for its idle timeout
+	GracefulClose bool
+}
+
+
+// The receiver counts every message as at least its `MinMessageByteCount`.
+// Policies other than `NackAccountingMinMessage` count tiny no-ack messages as less than the receiver does,
+// so the receiver contract fills before the sender contract.
+// The sender relies on the headroom of `ContractFillFraction` to switch contracts before the receiver
+// starts dropping no-ack messages for lack of contract.
+type NackAccountingPolicy int
+const (
+	// each no-ack message is counted as at least `MinMessageByteCount`. This matches the receiver
+	NackAccountingMinMessage NackAccountingPolicy = 0
+	// each no-ack message is counted as its actual byte count
+	NackAccountingBytes NackAccountingPolicy = 1
+	// no-ack messages are counted in batches of at least `MinMessageByteCount`,
+	// and the unused remainder of a batch is used by the following no-ack messages
+	NackAccountingBatch NackAccountingPolicy = 2
+)
 
 
 type sendSequenceId struct {
@@ -865,6 +1823,8 @@ type SendBuffer struct {
 
 	mutex sync.Mutex
 	sendSequences map[sendSequenceId]*SendSequence
+	// sequence goroutines that have not returned, including replaced sequences
+	goroutineCount int
 }
 
 func NewSendBuffer(ctx context.Context,
@@ -911,12 +1871,16 @@ func (self *SendBuffer) Pack(sendPack *SendPack, timeout time.Duration) (bool, e
 			self.sendBufferSettings,
 		)
 		self.sendSequences[sendSequenceId] = sendSequence
+		self.goroutineCount += 1
+		globalSequenceCounts.created()
 		go func() {
 			HandleError(sendSequence.Run)
 
 			self.mutex.Lock()
 			defer self.mutex.Unlock()
 			sendSequence.Close()
+			self.goroutineCount -= 1
+			globalSequenceCounts.closed()
 			// clean up
 			if sendSequence == self.sendSequences[sendSequenceId] {
 				delete(self.sendSequences, sendSequenceId)
@@ -931,7 +1895,7 @@ func (self *SendBuffer) Pack(sendPack *SendPack, timeout time.Duration) (bool, e
 	for i := 0; i < 2; i += 1 {
 		select {
 		case <- self.ctx.Done():
-			return false, errors.New("Done.")
+			return false, ErrDone
 		default:
 		}
 		sendSequence = initSendSequence(sendSequence)
@@ -953,22 +1917,32 @@ func (self *SendBuffer) Ack(sourceId Id, ack *protocol.Ack, timeout time.Duratio
 		}]
 	}
 	
-	anyFound := false
-	anySuccess := false
+	seqs := []*SendSequence{}
 	if seq := sendSequence(false); seq != nil {
-		anyFound = true
-		if success, err := seq.Ack(ack, timeout); success && err == nil {
-			anySuccess = true
-		}
+		seqs = append(seqs, seq)
 	}
 	if seq := sendSequence(true); seq != nil {
-		anyFound = true
+		seqs = append(seqs, seq)
+	}
+	if len(seqs) == 0 {
+		glog.Infof("[sb]ack miss sequence does not exist\n")
+		return false
+	}
+
+	anySuccess := false
+	anyMatch := false
+	for _, seq := range seqs {
+		if !seq.matchesSequenceId(ack) {
+			continue
+		}
+		anyMatch = true
 		if success, err := seq.Ack(ack, timeout); success && err == nil {
 			anySuccess = true
 		}
 	}
-	if !anyFound {
-		glog.Infof("[sb]ack miss sequence does not exist\n")
+	if !anyMatch {
+		// the ack is for a sequence that no longer exists
+		seqs[0].invalidAck(ack)
 	}
 	return anySuccess
 }
@@ -989,6 +1963,113 @@ func (self *SendBuffer) ResendQueueSize(destinationId Id, companionContract bool
 	return 0, 0, Id{}
 }
 
+// the resend queue size summed over all open sequences
+func (self *SendBuffer) TotalResendQueueSize() (int, ByteCount) {
+	sendSequences := func()([]*SendSequence) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		return maps.Values(self.sendSequences)
+	}
+
+	netCount := 0
+	netByteCount := ByteCount(0)
+	for _, sendSequence := range sendSequences() {
+		count, byteCount, _ := sendSequence.ResendQueueSize()
+		netCount += count
+		netByteCount += byteCount
+	}
+	return netCount, netByteCount
+}
+
+// a consistent snapshot of the open sequences, taken under the buffer lock.
+// Sequences with the same path (e.g. the companion sequence) are summed,
+// and the rtt is the max of the sequences
+func (self *SendBuffer) TransferStats() map[TransferPath]*TransferStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pathStats := map[TransferPath]*TransferStats{}
+	for sendSequenceId, sendSequence := range self.sendSequences {
+		select {
+		case <- sendSequence.ctx.Done():
+			// closed
+			continue
+		default:
+		}
+		path := NewTransferPath(
+			Path{ClientId: self.client.ClientId()},
+			Path{ClientId: sendSequenceId.DestinationId},
+		)
+		stats := sendSequence.TransferStats()
+		if netStats, ok := pathStats[path]; ok {
+			netStats.add(stats)
+		} else {
+			pathStats[path] = stats
+		}
+	}
+	return pathStats
+}
+
+// the rtt distribution by destination path, for the open sequences.
+// Sequences with the same path (e.g. the companion sequence) share one distribution
+func (self *SendBuffer) RttStats() map[TransferPath]*RttStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pathSamples := map[TransferPath][]time.Duration{}
+	// all sequences share the half life, so either every path has weights or none do
+	pathWeights := map[TransferPath][]float64{}
+	for sendSequenceId, sendSequence := range self.sendSequences {
+		select {
+		case <- sendSequence.ctx.Done():
+			// closed
+			continue
+		default:
+		}
+		path := NewTransferPath(
+			Path{ClientId: self.client.ClientId()},
+			Path{ClientId: sendSequenceId.DestinationId},
+		)
+		samples, weights := sendSequence.rttSamples()
+		pathSamples[path] = append(pathSamples[path], samples...)
+		if weights != nil {
+			pathWeights[path] = append(pathWeights[path], weights...)
+		}
+	}
+
+	pathStats := map[TransferPath]*RttStats{}
+	for path, samples := range pathSamples {
+		pathStats[path] = newWeightedRttStats(samples, pathWeights[path])
+	}
+	return pathStats
+}
+
+// true when no open sequence has pending sends
+func (self *SendBuffer) Drained() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, sendSequence := range self.sendSequences {
+		select {
+		case <- sendSequence.ctx.Done():
+			// closed. The pending sends were failed
+			continue
+		default:
+		}
+		if !sendSequence.Drained() {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *SendBuffer) resourceCounts() (sequenceCount int, goroutineCount int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.sendSequences), self.goroutineCount
+}
+
 func (self *SendBuffer) Close() {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -1028,6 +2109,7 @@ type SendSequence struct {
 	cancel context.CancelFunc
 
 	client *Client
+	clock Clock
 	clientId Id
 	clientTag string
 	routeManager *RouteManager
@@ -1052,9 +2134,27 @@ type SendSequence struct {
 	sendItems []*sendItem
 	nextSequenceNumber uint64
 
+	congestionController CongestionController
+
 	idleCondition *IdleCondition
 
 	multiRouteWriter MultiRouteWriter
+
+	invalidAckLock sync.Mutex
+	invalidAckWindowStartTime time.Time
+	invalidAckCount int
+	invalidAckByteCount ByteCount
+
+	statsLock sync.Mutex
+	ackedByteCount ByteCount
+	resendCount int
+	// smoothed rtt of items acked on the first send. 0 if no sample yet
+	rtt time.Duration
+	// the samples behind `rtt`
+	rttWindow *RttWindow
+	// packs accepted by `Pack` that have not been sent or failed
+	// this covers the time a pack waits for a contract after it leaves the channel
+	pendingPackCount int
 }
 
 func NewSendSequence(
@@ -1071,6 +2171,7 @@ func NewSendSequence(
 		ctx: cancelCtx,
 		cancel: cancel,
 		client: client,
+		clock: client.clock,
 		clientId: client.ClientId(),
 		clientTag: client.ClientTag(),
 		routeManager: routeManager,
@@ -1086,7 +2187,13 @@ func NewSendSequence(
 		resendQueue: newResendQueue(),
 		sendItems: []*sendItem{},
 		nextSequenceNumber: 0,
+		congestionController: sendBufferSettings.CongestionControllerGenerator(sendBufferSettings),
 		idleCondition: NewIdleCondition(),
+		rttWindow: NewRttWindowWithHalfLife(
+			sendBufferSettings.RttWindowSize,
+			sendBufferSettings.RttWindowHalfLife,
+			client.clock,
+		),
 	}
 }
 
@@ -1095,11 +2202,45 @@ func (self *SendSequence) ResendQueueSize() (int, ByteCount, Id) {
 	return count, byteSize, self.sequenceId
 }
 
+// true when there are no pending packs and the resend queue is empty
+func (self *SendSequence) Drained() bool {
+	self.statsLock.Lock()
+	pendingPackCount := self.pendingPackCount
+	self.statsLock.Unlock()
+
+	// the pending count is decremented after the item is added to the resend queue,
+	// so check the pending count first
+	if 0 < pendingPackCount {
+		return false
+	}
+	count, _ := self.resendQueue.QueueSize()
+	return count == 0
+}
+
+func (self *SendSequence) addPendingPack(delta int) {
+	self.statsLock.Lock()
+	defer self.statsLock.Unlock()
+	self.pendingPackCount += delta
+}
+
+func (self *SendSequence) TransferStats() *TransferStats {
+	self.statsLock.Lock()
+	defer self.statsLock.Unlock()
+
+	_, unackedByteCount := self.resendQueue.QueueSize()
+	return &TransferStats{
+		AckedByteCount: self.ackedByteCount,
+		UnackedByteCount: unackedByteCount,
+		ResendCount: self.resendCount,
+		Rtt: self.rtt,
+	}
+}
+
 // success, error
 func (self *SendSequence) Pack(sendPack *SendPack, timeout time.Duration) (bool, error) {
 	select {
 	case <- self.ctx.Done():
-		return false, errors.New("Done.")
+		return false, ErrDone
 	default:
 	}
 
@@ -1108,17 +2249,26 @@ func (self *SendSequence) Pack(sendPack *SendPack, timeout time.Duration) (bool,
 	}
 	defer self.idleCondition.UpdateClose()
 
+	self.addPendingPack(1)
+	success, err := self.pack(sendPack, timeout)
+	if !success || err != nil {
+		self.addPendingPack(-1)
+	}
+	return success, err
+}
+
+func (self *SendSequence) pack(sendPack *SendPack, timeout time.Duration) (bool, error) {
 	if timeout < 0 {
 		select {
 		case <- self.ctx.Done():
-			return false, errors.New("Done.")
+			return false, ErrDone
 		case self.packs <- sendPack:
 			return true, nil
 		}
 	} else if timeout == 0 {
 		select {
 		case <- self.ctx.Done():
-			return false, errors.New("Done.")
+			return false, ErrDone
 		case self.packs <- sendPack:
 			return true, nil
 		default:
@@ -1127,10 +2277,10 @@ func (self *SendSequence) Pack(sendPack *SendPack, timeout time.Duration) (bool,
 	} else {
 		select {
 		case <- self.ctx.Done():
-			return false, errors.New("Done.")
+			return false, ErrDone
 		case self.packs <- sendPack:
 			return true, nil
-		case <- time.After(timeout):
+		case <- self.clock.After(timeout):
 			return false, nil
 		}
 	}
@@ -1139,6 +2289,7 @@ func (self *SendSequence) Pack(sendPack *SendPack, timeout time.Duration) (bool,
 func (self *SendSequence) Ack(ack *protocol.Ack, timeout time.Duration) (bool, error) {
 	sequenceId, err := IdFromBytes(ack.SequenceId)
 	if err != nil {
+		self.invalidAck(ack)
 		return false, err
 	}
 	if self.sequenceId != sequenceId {
@@ -1152,6 +2303,18 @@ func (self *SendSequence) Ack(ack *protocol.Ack, timeout time.Duration) (bool, e
 	default:
 	}
 
+	// drop acks for messages that are not pending before they reach the ack channel,
+	// so that an ack flood cannot block the sequence
+	messageId, err := IdFromBytes(ack.MessageId)
+	if err != nil {
+		self.invalidAck(ack)
+		return false, err
+	}
+	if _, ok := self.resendQueue.ContainsMessageId(messageId); !ok {
+		self.invalidAck(ack)
+		return false, nil
+	}
+
 	if timeout < 0 {
 		select {
 		case <- self.ctx.Done():
@@ -1174,12 +2337,59 @@ func (self *SendSequence) Ack(ack *protocol.Ack, timeout time.Duration) (bool, e
 			return false, errors.New("Done.")
 		case self.acks <- ack:
 			return true, nil
-		case <- time.After(timeout):
+		case <- self.clock.After(timeout):
 			return false, nil
 		}
 	}
 }
 
+func (self *SendSequence) matchesSequenceId(ack *protocol.Ack) bool {
+	sequenceId, err := IdFromBytes(ack.SequenceId)
+	return err == nil && self.sequenceId == sequenceId
+}
+
+// counts an invalid ack from the destination
+// the destination is audited for the invalid acks of each window that exceeds `InvalidAckLimit`
+func (self *SendSequence) invalidAck(ack *protocol.Ack) {
+	if self.sendBufferSettings.InvalidAckLimit <= 0 {
+		return
+	}
+
+	auditCount, auditByteCount := func()(int, ByteCount) {
+		self.invalidAckLock.Lock()
+		defer self.invalidAckLock.Unlock()
+
+		now := self.clock.Now()
+		if self.sendBufferSettings.InvalidAckWindow <= now.Sub(self.invalidAckWindowStartTime) {
+			self.invalidAckWindowStartTime = now
+			self.invalidAckCount = 0
+			self.invalidAckByteCount = 0
+		}
+		self.invalidAckCount += 1
+		self.invalidAckByteCount += ByteCount(proto.Size(ack))
+
+		if self.invalidAckCount <= self.sendBufferSettings.InvalidAckLimit {
+			return 0, 0
+		}
+		// a sustained flood is audited in batches of the limit
+		auditCount := self.invalidAckCount
+		auditByteCount := self.invalidAckByteCount
+		self.invalidAckCount = 0
+		self.invalidAckByteCount = 0
+		return auditCount, auditByteCount
+	}()
+
+	if 0 < auditCount {
+		glog.Infof("[s]%s->%s %d invalid acks\n", self.clientTag, self.destinationId, auditCount)
+		peerAudit := NewSequencePeerAudit(self.client, self.destinationId, 0)
+		peerAudit.Update(func(a *PeerAudit) {
+			a.BadMessageCount += auditCount
+			a.BadMessageByteCount += auditByteCount
+		})
+		peerAudit.Complete()
+	}
+}
+
 func (self *SendSequence) Run() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -1205,6 +2415,7 @@ func (self *SendSequence) Run() {
 		}
 
 		// drain the channel
+		// packs queued after this are drained in `Close`
 		func() {
 			for {
 				select {
@@ -1213,6 +2424,8 @@ func (self *SendSequence) Run() {
 						return
 					}
 					sendPack.AckCallback(errors.New("Send sequence closed."))
+				default:
+					return
 				}
 			}
 		}()
@@ -1251,18 +2464,47 @@ func (self *SendSequence) Run() {
 		}
 	}()
 
+	watchdog := newSequenceWatchdog(
+		self.ctx,
+		self.client.settings.WatchdogSettings,
+		"send",
+		self.clientTag,
+		self.destinationId,
+		self.sequenceId,
+	)
+	watchdogState := func()(string) {
+		resendCount, resendByteCount := self.resendQueue.QueueSize()
+		return fmt.Sprintf(
+			"next_sequence_number=%d send_items=%d resend_queue=%d(%db) packs=%d pending_acks=%d",
+			self.nextSequenceNumber,
+			len(self.sendItems),
+			resendCount,
+			resendByteCount,
+			len(self.packs),
+			ackWindow.PendingCount(),
+		)
+	}
+
 	for {
+		watchdog.Work(watchdogState)
+
 		// apply the acks
 		ackSnapshot := ackWindow.Snapshot(true)
 		if 0 < ackSnapshot.ackUpdateCount {
-			self.receiveAck(ackSnapshot.headAck.messageId, false)
+			if err := self.receiveAck(ackSnapshot.headAck.messageId, false); err != nil {
+				self.exitBadAccounting(err)
+				return
+			}
 		}
 		for messageId, _ := range ackSnapshot.selectiveAcks {
-			self.receiveAck(messageId, true)
+			if err := self.receiveAck(messageId, true); err != nil {
+				self.exitBadAccounting(err)
+				return
+			}
 		}
 
 
-		sendTime := time.Now()
+		sendTime := self.clock.Now()
 		var timeout time.Duration
 
 		if self.resendQueue.Len() == 0 { 
@@ -1270,13 +2512,14 @@ func (self *SendSequence) Run() {
 		} else {
 			timeout = self.sendBufferSettings.AckTimeout
 
+			resumeTime := self.client.lastResumeTime()
 			for {
 				item := self.resendQueue.PeekFirst()
 				if item == nil {
 					break
 				}
 
-				itemAckTimeout := item.sendTime.Add(self.sendBufferSettings.AckTimeout).Sub(sendTime)
+				itemAckTimeout := timeoutStartTime(item.sendTime, resumeTime).Add(self.sendBufferSettings.AckTimeout).Sub(sendTime)
 
 				if itemAckTimeout <= 0 {
 					// message took too long to ack
@@ -1337,9 +2580,13 @@ func (self *SendSequence) Run() {
 				}
 
 				item.sendCount += 1
+				self.statsLock.Lock()
+				self.resendCount += 1
+				self.statsLock.Unlock()
+				self.congestionController.OnLoss()
 				// linear backoff
 				// itemResendTimeout := self.sendBufferSettings.ResendInterval
-				itemResendTimeout := time.Duration(float64(self.sendBufferSettings.ResendInterval) * (1 + self.sendBufferSettings.ResendBackoffScale * float64(item.sendCount)))
+				itemResendTimeout := self.jitterResendTimeout(time.Duration(float64(self.sendBufferSettings.ResendInterval) * (1 + self.sendBufferSettings.ResendBackoffScale * float64(item.sendCount))))
 				if itemResendTimeout < itemAckTimeout {
 					item.resendTime = sendTime.Add(itemResendTimeout)
 				} else {
@@ -1349,7 +2596,10 @@ func (self *SendSequence) Run() {
 			}
 		}
 
+		watchdog.Wait()
+
 		checkpointId := self.idleCondition.Checkpoint()
+		waitTime := self.clock.Now()
 		
 		// approximate since this cannot consider the next message byte size
 		canQueue := func()(bool) {
@@ -1358,7 +2608,7 @@ func (self *SendSequence) Run() {
 	        if 0 == queueSize {
 	            return true
 	        }
-	        return queueByteCount < self.sendBufferSettings.ResendQueueMaxByteCount
+	        return queueByteCount < self.congestionController.WindowByteCount()
 		}
 		if !canQueue() {
 			// wait for acks
@@ -1366,11 +2616,14 @@ func (self *SendSequence) Run() {
 			case <- self.ctx.Done():
 			    return
 			case <- ackSnapshot.ackNotify:
-			case <- time.After(timeout):
+				self.client.detectSuspend(waitTime, timeout)
+			case <- self.clock.After(timeout):
+				self.client.detectSuspend(waitTime, timeout)
 				if 0 == self.resendQueue.Len() {
 					// idle timeout
 					if self.idleCondition.Close(checkpointId) {
 						// close the sequence
+						self.sendClose()
 					    return
 					}
 					// else there are pending updates
@@ -1381,27 +2634,34 @@ func (self *SendSequence) Run() {
 			case <- self.ctx.Done():
 				return
 			case <- ackSnapshot.ackNotify:
+				self.client.detectSuspend(waitTime, timeout)
 			case sendPack, ok := <- self.packs:
 				if !ok {
 					return
 				}
+				self.client.detectSuspend(waitTime, timeout)
+				watchdog.Work(watchdogState)
 
 				// note messages of `size < MinMessageByteCount` get counted as `MinMessageByteCount` against the contract
-				if self.updateContract(sendPack.MessageByteCount) {
-					self.send(sendPack.Frame, sendPack.AckCallback, sendPack.Ack)
+				if contractByteCount, err := self.updateContract(sendPack.MessageByteCount, sendPack.Ack); err == nil {
+					self.send(sendPack.Frame, sendPack.AckCallback, sendPack.Ack, sendPack.Compressed, contractByteCount)
 					// ignore the error since there will be a retry
+					self.addPendingPack(-1)
 				} else {
 					// no contract
 					// close the sequence
-					glog.Infof("[s]%s->%s exit could not create contract.\n", self.clientTag, self.destinationId)
-					sendPack.AckCallback(errors.New("No contract"))
+					glog.Infof("[s]%s->%s exit could not create contract = %s\n", self.clientTag, self.destinationId, err)
+					sendPack.AckCallback(err)
+					self.addPendingPack(-1)
 					return
 				}
-			case <- time.After(timeout):
+			case <- self.clock.After(timeout):
+				self.client.detectSuspend(waitTime, timeout)
 				if 0 == self.resendQueue.Len() {
 					// idle timeout
 					if self.idleCondition.Close(checkpointId) {
 						// close the sequence
+						self.sendClose()
 						return
 					}
 					// else there are pending updates
@@ -1411,26 +2671,66 @@ func (self *SendSequence) Run() {
 	}
 }
 
-func (self *SendSequence) updateContract(messageByteCount ByteCount) bool {
+// returns the byte count debited from the contract
+// the error is a `*DefinitiveContractError` when the contract request failed definitively
+// for a companion sequence, the error is or wraps `ErrNoCompanionContract` when the destination has no open contract
+func (self *SendSequence) updateContract(messageByteCount ByteCount, ack bool) (ByteCount, error) {
 	// `sendNoContract` is a mutual configuration 
 	// both sides must configure themselves to require no contract from each other
 	if self.contractManager.SendNoContract(self.destinationId, self.companionContract) {
-		return true
+		return 0, nil
 	}
-	if self.sendContract != nil && self.sendContract.update(messageByteCount) {
-		return true
+
+	nackAccountingPolicy := NackAccountingMinMessage
+	if !ack {
+		nackAccountingPolicy = self.sendBufferSettings.NackAccountingPolicy
+	}
+
+	if self.sendContract != nil {
+		if contractByteCount, ok := self.sendContract.updateWithPolicy(messageByteCount, nackAccountingPolicy); ok {
+			self.client.openContractLimit.touch(self.sendContract.contractId)
+			return contractByteCount, nil
+		}
 	}
 
+	var contractByteCount ByteCount
+	var contractErr error
 	createContract := func()(bool) {
 		// the max overhead of the pack frame
 		// this is needed because the size of the contract pack is counted against the contract
 		// maxContractMessageByteCount := ByteCount(256)
 
+		// 0 takes any contract and requests a standard contract
+		sizedContractTransferByteCount := ByteCount(0)
 		effectiveContractTransferByteCount := ByteCount(float32(self.contractManager.StandardContractTransferByteCount()) * self.sendBufferSettings.ContractFillFraction)
 		if effectiveContractTransferByteCount < messageByteCount + self.sendBufferSettings.MinMessageByteCount /*+ maxContractMessageByteCount*/ {
 			// this pack does not fit into a standard contract
-			// TODO allow requesting larger contracts
-			panic("Message too large for contract. It can never be sent.")
+			// request a contract sized to fit the pack
+			sizedContractTransferByteCount = contractTransferByteCountForEffective(
+				messageByteCount + self.sendBufferSettings.MinMessageByteCount,
+				self.sendBufferSettings.ContractFillFraction,
+			)
+			if self.contractManager.MaxContractTransferByteCount() < sizedContractTransferByteCount {
+				glog.Infof("[s]%s->%s message too large for contract (%d/%d)\n", self.clientTag, self.destinationId, sizedContractTransferByteCount, self.contractManager.MaxContractTransferByteCount())
+				contractErr = errors.New("Message too large for contract.")
+				return false
+			}
+		}
+		createNextContract := func() {
+			if 0 < sizedContractTransferByteCount {
+				self.contractManager.CreateContractWithSize(
+					self.destinationId,
+					self.companionContract,
+					sizedContractTransferByteCount,
+					self.client.settings.ControlWriteTimeout,
+				)
+			} else {
+				self.contractManager.CreateContract(
+					self.destinationId,
+					self.companionContract,
+					self.client.settings.ControlWriteTimeout,
+				)
+			}
 		}
 
 
@@ -1449,12 +2749,18 @@ func (self *SendSequence) updateContract(messageByteCount ByteCount) bool {
 
 			// note `update(0)` will use `MinMessageByteCount` byte count
 			// the min message byte count is used to avoid spam
-			if nextSendContract.update(0) && nextSendContract.update(messageByteCount) {
+			if !nextSendContract.update(0) {
+				glog.Infof("[s]%s->%s contract too small %s\n", self.clientTag, self.destinationId, nextSendContract.contractId)
+				self.contractManager.CompleteContract(nextSendContract.contractId, 0, 0)
+				return false
+			}
+			if nextContractByteCount, ok := nextSendContract.updateWithPolicy(messageByteCount, nackAccountingPolicy); ok {
 				self.setContract(nextSendContract)
 
 				// append the contract to the sequence
-				self.sendWithSetContract(nil, func(error){}, true, true)
+				self.sendWithSetContract(nil, func(error){}, true, false, nextSendContract.minUpdateByteCount, true)
 
+				contractByteCount = nextContractByteCount
 				return true
 			} else {
 				// this contract doesn't fit the message
@@ -1467,8 +2773,14 @@ func (self *SendSequence) updateContract(messageByteCount ByteCount) bool {
 		}
 
 		nextContract := func(timeout time.Duration)(bool) {
-			if contract := self.contractManager.TakeContract(self.ctx, self.destinationId, timeout); contract != nil && setNextContract(contract) {
+			contract, err := self.contractManager.TakeContractWithSize(self.ctx, self.destinationId, sizedContractTransferByteCount, timeout)
+			if err != nil {
+				contractErr = err
+				return false
+			}
+			if contract != nil && setNextContract(contract) {
 				// async queue up the next contract
+				// following messages are expected to fit a standard contract
 				self.contractManager.CreateContract(
 					self.destinationId,
 					self.companionContract,
@@ -1496,8 +2808,12 @@ func (self *SendSequence) updateContract(messageByteCount ByteCount) bool {
 		if traceNextContract(0) {
 			return true
 		}
+		// an error here is from a previous request
+		contractErr = nil
 
-		endTime := time.Now().Add(self.sendBufferSettings.CreateContractTimeout)
+		contractErrorCount := 0
+		retryCount := 0
+		endTime := self.clock.Now().Add(self.sendBufferSettings.CreateContractTimeout)
 		for {
 			select {
 			case <- self.ctx.Done():
@@ -1505,32 +2821,72 @@ func (self *SendSequence) updateContract(messageByteCount ByteCount) bool {
 			default:
 			}
 
-			timeout := endTime.Sub(time.Now())
+			timeout := endTime.Sub(self.clock.Now())
 			if timeout <= 0 {
 				return false
 			}
 
 			// async queue up the next contract
-			self.contractManager.CreateContract(
-				self.destinationId,
-				self.companionContract,
-				self.client.settings.ControlWriteTimeout,
-			)
+			createNextContract()
 
-			if traceNextContract(min(timeout, self.sendBufferSettings.CreateContractRetryInterval)) {
+			// linear backoff
+			retryInterval := jitterDuration(
+				time.Duration(float64(self.sendBufferSettings.CreateContractRetryInterval) * (1 + self.sendBufferSettings.CreateContractRetryBackoffScale * float64(retryCount))),
+				self.sendBufferSettings.CreateContractRetryJitterFraction,
+			)
+			retryCount += 1
+			if traceNextContract(min(timeout, retryInterval)) {
 				return true
 			}
+			if contractErr != nil {
+				contractErrorCount += 1
+				if self.sendBufferSettings.CreateContractErrorRetryCount < contractErrorCount {
+					// fail fast
+					return false
+				}
+				glog.Infof("[s]%s->%s retry contract error (%d) = %s\n", self.clientTag, self.destinationId, contractErrorCount, contractErr)
+				contractErr = nil
+			}
 		}
 	}
 
+	var success bool
 	if glog.V(2) {
-		return TraceWithReturn(
+		success = TraceWithReturn(
 			fmt.Sprintf("[s]create contract c=%t %s->%s", self.companionContract, self.clientTag, self.destinationId),
 			createContract,
 		)
 	} else {
-		return createContract()
+		success = createContract()
+	}
+	if !success {
+		if self.companionContract && !self.contractManager.HasSourceContract(self.destinationId) {
+			// a companion contract can only be created for an open contract from the destination
+			var definitiveContractErr *DefinitiveContractError
+			if contractErr == nil {
+				glog.Infof("[s]%s->%s no companion contract\n", self.clientTag, self.destinationId)
+				return 0, ErrNoCompanionContract
+			} else if errors.As(contractErr, &definitiveContractErr) {
+				glog.Infof("[s]%s->%s no companion contract = %s\n", self.clientTag, self.destinationId, contractErr)
+				return 0, fmt.Errorf("%w %w", ErrNoCompanionContract, contractErr)
+			}
+		}
+		if contractErr != nil {
+			return 0, contractErr
+		}
+		return 0, errors.New("No contract")
+	}
+	return contractByteCount, nil
+}
+
+// the smallest contract transfer byte count with an effective byte count of at least `effectiveByteCount`
+func contractTransferByteCountForEffective(effectiveByteCount ByteCount, contractFillFraction float32) ByteCount {
+	transferByteCount := ByteCount(math.Ceil(float64(effectiveByteCount) / float64(contractFillFraction)))
+	// match the float32 rounding of `newSequenceContract`
+	for ByteCount(float32(transferByteCount) * contractFillFraction) < effectiveByteCount {
+		transferByteCount += 1
 	}
+	return transferByteCount
 }
 
 func (self *SendSequence) setContract(nextSendContract *sequenceContract) {
@@ -1550,23 +2906,29 @@ func (self *SendSequence) setContract(nextSendContract *sequenceContract) {
 	}
 	self.openSendContracts[nextSendContract.contractId] = nextSendContract
 	self.sendContract = nextSendContract
+	self.client.openContractLimit.open(nextSendContract.contractId, self.destinationId, true, self, self.cancel)
 }
 
 func (self *SendSequence) send(
 	frame *protocol.Frame,
 	ackCallback AckFunction,
 	ack bool,
+	compressed bool,
+	contractByteCount ByteCount,
 ) {
-	self.sendWithSetContract(frame, ackCallback, ack, false)
+	self.sendWithSetContract(frame, ackCallback, ack, compressed, contractByteCount, false)
 }
 
 func (self *SendSequence) sendWithSetContract(
 	frame *protocol.Frame,
 	ackCallback AckFunction,
 	ack bool,
+	compressed bool,
+	// the byte count debited from the current contract for this message
+	contractByteCount ByteCount,
 	setContract bool,
 ) {
-	sendTime := time.Now()
+	sendTime := self.clock.Now()
 	messageId := NewId()
 	
 	var contractId *Id
@@ -1607,6 +2969,7 @@ func (self *SendSequence) sendWithSetContract(
 		Frames: frames,
 		ContractFrame: contractFrame,
 		Nack: !ack,
+		Compressed: compressed,
 	}
 
 	packBytes, _ := proto.Marshal(pack)
@@ -1634,8 +2997,9 @@ func (self *SendSequence) sendWithSetContract(
 			messageByteCount: messageByteCount,
 		},
 		contractId: contractId,
+		contractByteCount: contractByteCount,
 		sendTime: sendTime,
-		resendTime: sendTime.Add(self.sendBufferSettings.ResendInterval),
+		resendTime: sendTime.Add(self.jitterResendTimeout(self.sendBufferSettings.ResendInterval)),
 		sendCount: 1,
 		head: head,
 		hasContractFrame: (contractFrame != nil),
@@ -1643,6 +3007,12 @@ func (self *SendSequence) sendWithSetContract(
 		ackCallback: ackCallback,
 	}
 
+	if ack {
+		// add before the write so that the item is pending when the ack arrives
+		self.sendItems = append(self.sendItems, item)
+		self.resendQueue.Add(item)
+	}
+
 	var err error
 	c := func()(error) {
 		err = self.multiRouteWriter.Write(
@@ -1664,11 +3034,8 @@ func (self *SendSequence) sendWithSetContract(
 		}
 	}
 
-	if ack {
-		self.sendItems = append(self.sendItems, item)
-		self.resendQueue.Add(item)
-		// ignore the write error since the item will be resent
-	} else {
+	// for ack items, ignore the write error since the item will be resent
+	if !ack {
 		// immediately ack
 		if err == nil {
 			self.ackItem(item)
@@ -1678,6 +3045,49 @@ func (self *SendSequence) sendWithSetContract(
 	}
 }
 
+// sends the close marker when `GracefulClose`
+// the marker is sent once and not acked. A lost marker leaves the receiver to its idle timeout
+func (self *SendSequence) sendClose() {
+	if !self.sendBufferSettings.GracefulClose {
+		return
+	}
+
+	pack := &protocol.Pack{
+		MessageId: NewId().Bytes(),
+		SequenceId: self.sequenceId.Bytes(),
+		SequenceNumber: self.nextSequenceNumber,
+		Frames: []*protocol.Frame{},
+		Close: true,
+	}
+
+	packBytes, _ := proto.Marshal(pack)
+
+	transferFrame := &protocol.TransferFrame{
+		TransferPath: &protocol.TransferPath{
+			DestinationId: self.destinationId.Bytes(),
+			SourceId: self.clientId.Bytes(),
+			StreamId: DirectStreamId.Bytes(),
+		},
+		Frame: &protocol.Frame{
+			MessageType: protocol.MessageType_TransferPack,
+			MessageBytes: packBytes,
+		},
+	}
+
+	transferFrameBytes, _ := proto.Marshal(transferFrame)
+
+	err := self.multiRouteWriter.Write(
+		self.ctx,
+		transferFrameBytes,
+		self.sendBufferSettings.WriteTimeout,
+	)
+	if err != nil {
+		glog.Infof("[s]close drop = %s", err)
+	} else {
+		glog.V(1).Infof("[s]%s->%s close %d\n", self.clientTag, self.destinationId, self.nextSequenceNumber)
+	}
+}
+
 func (self *SendSequence) setHead(item *sendItem) ([]byte, error) {
 	glog.V(1).Infof("[s]set head %s->%s\n", self.clientTag, self.destinationId)
 
@@ -1718,12 +3128,32 @@ func (self *SendSequence) setHead(item *sendItem) ([]byte, error) {
 	return transferFrameBytesWithHead, nil
 }
 
-func (self *SendSequence) receiveAck(messageId Id, selective bool) {
+// audits the destination and logs the accounting state for diagnosis
+// the sequence must exit after this
+func (self *SendSequence) exitBadAccounting(err error) {
+	glog.Errorf(
+		"[s]%s->%s exit %s next_sequence_number=%d send_items=%d = %s\n",
+		self.clientTag,
+		self.destinationId,
+		self.sequenceId,
+		self.nextSequenceNumber,
+		len(self.sendItems),
+		err,
+	)
+	peerAudit := NewSequencePeerAudit(self.client, self.destinationId, 0)
+	peerAudit.Update(func(a *PeerAudit) {
+		a.badContract()
+	})
+	peerAudit.Complete()
+}
+
+// returns a `BadAccountingError` if the ack does not match the contract accounting
+func (self *SendSequence) receiveAck(messageId Id, selective bool) error {
 	item := self.resendQueue.GetByMessageId(messageId)
 	if item == nil {
 		glog.V(1).Infof("[s]ack miss %s->%s\n", self.clientTag, self.destinationId)
 		// message not pending ack
-		return
+		return nil
 	}
 
 	if selective {
@@ -1732,13 +3162,22 @@ func (self *SendSequence) receiveAck(messageId Id, selective bool) {
 		if removed == nil {
 			panic(errors.New("Missing item"))
 		}
-		item.resendTime = time.Now().Add(self.sendBufferSettings.SelectiveAckTimeout)
+		item.resendTime = self.clock.Now().Add(self.sendBufferSettings.SelectiveAckTimeout)
 		self.resendQueue.Add(item)
-		return
+		return nil
 	}
 
 	glog.V(1).Infof("[s]ack %d %s->%s\n", item.sequenceNumber, self.clientTag, self.destinationId)
 
+	// only items acked on the first send are an unambiguous rtt sample
+	if item.sendCount == 1 {
+		rtt := self.clock.Now().Sub(item.sendTime)
+		self.updateRtt(rtt)
+		self.congestionController.OnAck(rtt)
+	} else {
+		self.congestionController.OnAck(0)
+	}
+
 	// acks are cumulative
 	// implicitly ack all earlier items in the sequence
 	i := 0
@@ -1761,7 +3200,10 @@ func (self *SendSequence) receiveAck(messageId Id, selective bool) {
 			panic(errors.New("Missing item"))
 		}
 
-		self.ackItem(implicitItem)
+		if err := self.ackItem(implicitItem); err != nil {
+			self.sendItems = self.sendItems[i + 1:]
+			return err
+		}
 		self.sendItems[i] = nil
 
 		if glog.V(2) {
@@ -1774,12 +3216,42 @@ func (self *SendSequence) receiveAck(messageId Id, selective bool) {
 		a, b := self.resendQueue.QueueSize()
 		glog.Infof("[s]ack %d/%d (stop %d %dB %d) %s->%s\n", item.sequenceNumber, self.nextSequenceNumber - 1, a, b, len(self.sendItems), self.clientTag, self.destinationId)
 	}
+	return nil
+}
+
+func (self *SendSequence) updateRtt(rttSample time.Duration) {
+	self.statsLock.Lock()
+	defer self.statsLock.Unlock()
+
+	if self.rtt == 0 {
+		self.rtt = rttSample
+	} else {
+		// ewma with the tcp smoothing factor 1/8
+		self.rtt = (7 * self.rtt + rttSample) / 8
+	}
+	self.rttWindow.Add(rttSample)
+}
+
+// the samples and their weights. See `RttWindow.Weights`
+func (self *SendSequence) rttSamples() ([]time.Duration, []float64) {
+	self.statsLock.Lock()
+	defer self.statsLock.Unlock()
+
+	return self.rttWindow.Samples(), self.rttWindow.Weights()
 }
 
-func (self *SendSequence) ackItem(item *sendItem) {
+func (self *SendSequence) ackItem(item *sendItem) error {
 	if item.contractId != nil {
 		itemSendContract := self.openSendContracts[*item.contractId]
-		itemSendContract.ack(item.messageByteCount)
+		if err := itemSendContract.settle(item.contractByteCount); err != nil {
+			item.ackCallback(err)
+			return err
+		}
+		self.contractManager.updateContractUsage(
+			itemSendContract.contractId,
+			itemSendContract.ackedByteCount,
+			itemSendContract.unackedByteCount,
+		)
 		// not current and closed
 		if self.sendContract != itemSendContract && itemSendContract.unackedByteCount == 0 {
 			self.contractManager.CompleteContract(
@@ -1790,7 +3262,25 @@ func (self *SendSequence) ackItem(item *sendItem) {
 			delete(self.openSendContracts, itemSendContract.contractId)
 		}
 	}
+
+	self.statsLock.Lock()
+	self.ackedByteCount += item.messageByteCount
+	self.statsLock.Unlock()
+
 	item.ackCallback(nil)
+	return nil
+}
+
+// scales the duration by a random factor in [1 - jitterFraction, 1 + jitterFraction)
+func jitterDuration(duration time.Duration, jitterFraction float64) time.Duration {
+	if jitterFraction <= 0 {
+		return duration
+	}
+	return time.Duration(float64(duration) * (1 + jitterFraction * (2 * mathrand.Float64() - 1)))
+}
+
+func (self *SendSequence) jitterResendTimeout(resendTimeout time.Duration) time.Duration {
+	return jitterDuration(resendTimeout, self.sendBufferSettings.ResendJitterFraction)
 }
 
 func (self *SendSequence) Close() {
@@ -1798,16 +3288,38 @@ func (self *SendSequence) Close() {
 	self.idleCondition.WaitForClose()
 	close(self.packs)
 	close(self.acks)
+
+	for sendPack := range self.packs {
+		sendPack.AckCallback(errors.New("Send sequence closed."))
+	}
 }
 
 func (self *SendSequence) Cancel() {
 	self.cancel()
 }
 
+type TransferStats struct {
+	AckedByteCount ByteCount
+	// the byte count in the resend queue
+	UnackedByteCount ByteCount
+	ResendCount int
+	// 0 if no sample yet
+	Rtt time.Duration
+}
+
+func (self *TransferStats) add(stats *TransferStats) {
+	self.AckedByteCount += stats.AckedByteCount
+	self.UnackedByteCount += stats.UnackedByteCount
+	self.ResendCount += stats.ResendCount
+	self.Rtt = max(self.Rtt, stats.Rtt)
+}
+
+
 type sendItem struct {
 	transferItem
 
 	contractId *Id
+	contractByteCount ByteCount
 	head bool
 	hasContractFrame bool
 	sendTime time.Time
@@ -1856,9 +3368,61 @@ type ReceiveBufferSettings struct {
 
 	MaxPeerAuditDuration time.Duration
 
+	// a source that sends more than `BadMessageAbuseLimit` bad messages in `BadMessageAbuseWindow`,
+	// across all of its sequences, is audited as abuse.
+	// Its receive sequences are closed and new packs from the source are dropped for `AbuseBlockTimeout`,
+	// so that the source cannot keep reopening sequences
+	// 0, the default, disables the limit
+	BadMessageAbuseLimit int
+	BadMessageAbuseWindow time.Duration
+	AbuseBlockTimeout time.Duration
+	// optional. Called when a source is audited as abuse
+	AbuseCallback AbuseFunction
+
 	WriteTimeout time.Duration
 
 	ReceiveQueueMaxByteCount ByteCount
+
+	// what to do with a message when a receive callback panics
+	ReceivePanicPolicy ReceivePanicPolicy
+	// optional. Called when a receive callback panics
+	ReceivePanicCallback ReceivePanicFunction
+}
+
+
+type ReceivePanicPolicy int
+
+const (
+	// ack the message. The message is not delivered again
+	ReceivePanicPolicyAck ReceivePanicPolicy = 0
+	// do not ack the message, so that the sender retransmits it
+	// the sequence does not advance past the message until it is received without a panic,
+	// or the sender gives up at its ack timeout
+	// this only applies to messages sent with ack
+	// the retransmit is delivered again to every receive callback, including the callbacks that did not panic,
+	// so receive callbacks must handle at-least-once delivery with this policy
+	ReceivePanicPolicyNoAck ReceivePanicPolicy = 1
+)
+
+
+type ReceivePanicFunction = func(receivePanic *ReceivePanic)
+
+
+type AbuseFunction = func(sourceId Id)
+
+
+type ReceivePanic struct {
+	SourceId Id
+	SequenceId Id
+	MessageId Id
+	SequenceNumber uint64
+	// true if the message was sent with ack
+	Ack bool
+	// true if the message was acked per the `ReceivePanicPolicy`
+	Acked bool
+	ProvideMode protocol.ProvideMode
+	Frames []*protocol.Frame
+	Err error
 }
 
 
@@ -1879,6 +3443,14 @@ type ReceiveBuffer struct {
 	mutex sync.Mutex
 	// source id -> receive sequence
 	receiveSequences map[receiveSequenceId]*ReceiveSequence
+	// source id -> receive sequences of the source
+	sourceReceiveSequences map[Id]map[receiveSequenceId]*ReceiveSequence
+	// sequence goroutines that have not returned, including replaced sequences
+	goroutineCount int
+	// source id -> element in `sourceAbuseOrder`, for `BadMessageAbuseLimit`
+	sourceAbuses map[Id]*list.Element
+	// `*receiveSourceAbuse` in order of window start time, oldest first
+	sourceAbuseOrder *list.List
 }
 
 func NewReceiveBuffer(ctx context.Context,
@@ -1893,6 +3465,9 @@ func NewReceiveBuffer(ctx context.Context,
 		contractManager: contractManager,
 		receiveBufferSettings: receiveBufferSettings,
 		receiveSequences: map[receiveSequenceId]*ReceiveSequence{},
+		sourceReceiveSequences: map[Id]map[receiveSequenceId]*ReceiveSequence{},
+		sourceAbuses: map[Id]*list.Element{},
+		sourceAbuseOrder: list.New(),
 	}
 }
 
@@ -1912,7 +3487,7 @@ func (self *ReceiveBuffer) Pack(receivePack *ReceivePack, timeout time.Duration)
 				return receiveSequence
 			} else {
 				receiveSequence.Cancel()
-				delete(self.receiveSequences, receiveSequenceId)
+				self.removeReceiveSequence(receiveSequenceId)
 			}
 		}
 		receiveSequence = NewReceiveSequence(
@@ -1924,21 +3499,44 @@ func (self *ReceiveBuffer) Pack(receivePack *ReceivePack, timeout time.Duration)
 			receivePack.SequenceId,
 			self.receiveBufferSettings,
 		)
-		self.receiveSequences[receiveSequenceId] = receiveSequence
+		self.addReceiveSequence(receiveSequenceId, receiveSequence)
+		self.goroutineCount += 1
+		globalSequenceCounts.created()
 		go func() {
 			HandleError(receiveSequence.Run)
 
 			self.mutex.Lock()
 			defer self.mutex.Unlock()
 			receiveSequence.Close()
+			self.goroutineCount -= 1
+			globalSequenceCounts.closed()
 			// clean up
 			if receiveSequence == self.receiveSequences[receiveSequenceId] {
-				delete(self.receiveSequences, receiveSequenceId)
+				self.removeReceiveSequence(receiveSequenceId)
 			}
 		}()
 		return receiveSequence
 	}
 
+	if self.blocked(receivePack.SourceId) {
+		glog.V(1).Infof("[rb]drop blocked %s<-%s\n", self.client.ClientTag(), receivePack.SourceId)
+		return false, errors.New("Blocked.")
+	}
+
+	if receivePack.Pack.Close {
+		// a close marker does not open a sequence
+		// a marker for a sequence that already closed is ignored
+		receiveSequence := func()(*ReceiveSequence) {
+			self.mutex.Lock()
+			defer self.mutex.Unlock()
+			return self.receiveSequences[receiveSequenceId]
+		}()
+		if receiveSequence == nil {
+			return true, nil
+		}
+		return receiveSequence.Pack(receivePack, timeout)
+	}
+
 	var receiveSequence *ReceiveSequence
 	var success bool
 	var err error
@@ -1957,6 +3555,107 @@ func (self *ReceiveBuffer) Pack(receivePack *ReceivePack, timeout time.Duration)
 	return success, err
 }
 
+// counts a bad message from the source towards `BadMessageAbuseLimit`
+// returns true if the source is audited as abuse. The sequences of the source are canceled,
+// and the source is blocked for `AbuseBlockTimeout`
+func (self *ReceiveBuffer) badMessage(sourceId Id) bool {
+	if self.receiveBufferSettings.BadMessageAbuseLimit <= 0 {
+		return false
+	}
+
+	abuse := func()(bool) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		now := self.client.clock.Now()
+		// the order is by window start, so only the oldest entries need to be checked
+		// an entry behind an entry that is still blocked waits until that entry expires
+		for element := self.sourceAbuseOrder.Front(); element != nil; element = self.sourceAbuseOrder.Front() {
+			sourceAbuse := element.Value.(*receiveSourceAbuse)
+			if !sourceAbuse.expired(now, self.receiveBufferSettings.BadMessageAbuseWindow) {
+				break
+			}
+			self.sourceAbuseOrder.Remove(element)
+			delete(self.sourceAbuses, sourceAbuse.sourceId)
+		}
+
+		var sourceAbuse *receiveSourceAbuse
+		if element, ok := self.sourceAbuses[sourceId]; ok {
+			sourceAbuse = element.Value.(*receiveSourceAbuse)
+			if self.receiveBufferSettings.BadMessageAbuseWindow <= now.Sub(sourceAbuse.windowStartTime) {
+				sourceAbuse.windowStartTime = now
+				sourceAbuse.badMessageCount = 0
+				self.sourceAbuseOrder.MoveToBack(element)
+			}
+		} else {
+			sourceAbuse = &receiveSourceAbuse{
+				sourceId: sourceId,
+				windowStartTime: now,
+			}
+			self.sourceAbuses[sourceId] = self.sourceAbuseOrder.PushBack(sourceAbuse)
+		}
+		sourceAbuse.badMessageCount += 1
+
+		if sourceAbuse.badMessageCount <= self.receiveBufferSettings.BadMessageAbuseLimit {
+			return false
+		}
+		// the count starts over after the block
+		sourceAbuse.windowStartTime = now
+		sourceAbuse.badMessageCount = 0
+		sourceAbuse.blockEndTime = now.Add(self.receiveBufferSettings.AbuseBlockTimeout)
+		self.sourceAbuseOrder.MoveToBack(self.sourceAbuses[sourceId])
+
+		for _, receiveSequence := range self.sourceReceiveSequences[sourceId] {
+			receiveSequence.Cancel()
+		}
+		return true
+	}()
+
+	if abuse {
+		glog.Infof("[rb]%s<-%s abuse, block for %s\n", self.client.ClientTag(), sourceId, self.receiveBufferSettings.AbuseBlockTimeout)
+		if abuseCallback := self.receiveBufferSettings.AbuseCallback; abuseCallback != nil {
+			HandleError(func() {
+				abuseCallback(sourceId)
+			})
+		}
+	}
+	return abuse
+}
+
+func (self *ReceiveBuffer) blocked(sourceId Id) bool {
+	if self.receiveBufferSettings.BadMessageAbuseLimit <= 0 {
+		return false
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	element, ok := self.sourceAbuses[sourceId]
+	return ok && self.client.clock.Now().Before(element.Value.(*receiveSourceAbuse).blockEndTime)
+}
+
+// must be called with the mutex
+func (self *ReceiveBuffer) addReceiveSequence(sequenceKey receiveSequenceId, receiveSequence *ReceiveSequence) {
+	self.receiveSequences[sequenceKey] = receiveSequence
+	sourceReceiveSequences, ok := self.sourceReceiveSequences[sequenceKey.SourceId]
+	if !ok {
+		sourceReceiveSequences = map[receiveSequenceId]*ReceiveSequence{}
+		self.sourceReceiveSequences[sequenceKey.SourceId] = sourceReceiveSequences
+	}
+	sourceReceiveSequences[sequenceKey] = receiveSequence
+}
+
+// must be called with the mutex
+func (self *ReceiveBuffer) removeReceiveSequence(sequenceKey receiveSequenceId) {
+	delete(self.receiveSequences, sequenceKey)
+	if sourceReceiveSequences, ok := self.sourceReceiveSequences[sequenceKey.SourceId]; ok {
+		delete(sourceReceiveSequences, sequenceKey)
+		if len(sourceReceiveSequences) == 0 {
+			delete(self.sourceReceiveSequences, sequenceKey.SourceId)
+		}
+	}
+}
+
 func (self *ReceiveBuffer) ReceiveQueueSize(sourceId Id, sequenceId Id) (int, ByteCount) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -1971,6 +3670,13 @@ func (self *ReceiveBuffer) ReceiveQueueSize(sourceId Id, sequenceId Id) (int, By
 	return 0, 0
 }
 
+func (self *ReceiveBuffer) resourceCounts() (sequenceCount int, goroutineCount int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.receiveSequences), self.goroutineCount
+}
+
 func (self *ReceiveBuffer) Close() {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -2005,11 +3711,24 @@ func (self *ReceiveBuffer) Flush() {
 }
 
 
+type receiveSourceAbuse struct {
+	sourceId Id
+	windowStartTime time.Time
+	badMessageCount int
+	blockEndTime time.Time
+}
+
+func (self *receiveSourceAbuse) expired(now time.Time, window time.Duration) bool {
+	return window <= now.Sub(self.windowStartTime) && !now.Before(self.blockEndTime)
+}
+
+
 type ReceiveSequence struct {
 	ctx context.Context
 	cancel context.CancelFunc
 
 	client *Client
+	clock Clock
 	clientId Id
 	clientTag string
 	routeManager *RouteManager
@@ -2021,6 +3740,9 @@ type ReceiveSequence struct {
 	receiveBufferSettings *ReceiveBufferSettings
 
 	receiveContract *sequenceContract
+	// the provide mode of the last frames delivered
+	headProvideMode protocol.ProvideMode
+	headProvideModeSet bool
 
 	packs chan *ReceivePack
 
@@ -2047,6 +3769,7 @@ func NewReceiveSequence(
 		ctx: cancelCtx,
 		cancel: cancel,
 		client: client,
+		clock: client.clock,
 		clientId: client.ClientId(),
 		clientTag: client.ClientTag(),
 		routeManager: routeManager,
@@ -2102,13 +3825,14 @@ func (self *ReceiveSequence) Pack(receivePack *ReceivePack, timeout time.Duratio
 			return false, errors.New("Done.")
 		case self.packs <- receivePack:
 			return true, nil
-		case <- time.After(timeout):
+		case <- self.clock.After(timeout):
 			return false, nil
 		}
 	}
 }
 
 func (self *ReceiveSequence) Run() {
+	exitReason := ReceiveSequenceExitClosed
 	defer func() {
 		if r := recover(); r != nil {
 			glog.Errorf("[r]%s<-%s abnormal exit =  %s\n", self.clientTag, self.sourceId, r)
@@ -2127,6 +3851,14 @@ func (self *ReceiveSequence) Run() {
 				self.receiveContract.ackedByteCount,
 				self.receiveContract.unackedByteCount,
 			)
+			// the sender may also resume the sequence with a new receive sequence
+			self.contractManager.checkpointReceiveContract(&ReceiveContractCheckpoint{
+				SourceId: self.sourceId,
+				SequenceId: self.sequenceId,
+				NextSequenceNumber: self.nextSequenceNumber,
+				Contract: self.receiveContract.contract,
+				AckedByteCount: self.receiveContract.ackedByteCount,
+			})
 		}
 
 		// drain the buffer
@@ -2139,6 +3871,12 @@ func (self *ReceiveSequence) Run() {
 		self.contractManager.CloseSourceContract(self.sourceId)
 
 		self.peerAudit.Complete()
+
+		self.client.sequenceError(
+			NewTransferPath(Path{ClientId: self.sourceId}, Path{ClientId: self.clientId}),
+			self.sequenceId,
+			exitReason,
+		)
 	}()
 
 	self.peerAudit = NewSequencePeerAudit(
@@ -2147,6 +3885,8 @@ func (self *ReceiveSequence) Run() {
 		self.receiveBufferSettings.MaxPeerAuditDuration,
 	)
 
+	self.resumeContract()
+
 	// compress and send acks
 	go func() {
 		defer self.cancel()
@@ -2223,7 +3963,7 @@ func (self *ReceiveSequence) Run() {
 				select {
 				case <- self.ctx.Done():
 					return
-				case <- time.After(self.receiveBufferSettings.AckCompressTimeout):
+				case <- self.clock.After(self.receiveBufferSettings.AckCompressTimeout):
 				}
 			}
 
@@ -2241,24 +3981,48 @@ func (self *ReceiveSequence) Run() {
 		}
 	}()
 
+	watchdog := newSequenceWatchdog(
+		self.ctx,
+		self.client.settings.WatchdogSettings,
+		"receive",
+		self.clientTag,
+		self.sourceId,
+		self.sequenceId,
+	)
+	watchdogState := func()(string) {
+		receiveCount, receiveByteCount := self.receiveQueue.QueueSize()
+		return fmt.Sprintf(
+			"next_sequence_number=%d receive_queue=%d(%db) packs=%d pending_acks=%d",
+			self.nextSequenceNumber,
+			receiveCount,
+			receiveByteCount,
+			len(self.packs),
+			self.ackWindow.PendingCount(),
+		)
+	}
+
 	for {
-		receiveTime := time.Now()
+		watchdog.Work(watchdogState)
+
+		receiveTime := self.clock.Now()
 		var timeout time.Duration
 		
 		if queueSize, _ := self.receiveQueue.QueueSize(); 0 == queueSize {
 			timeout = self.receiveBufferSettings.IdleTimeout
 		} else {
 			timeout = self.receiveBufferSettings.GapTimeout
+			resumeTime := self.client.lastResumeTime()
 			for {
 				item := self.receiveQueue.PeekFirst()
 				if item == nil {
 					break
 				}
 
-				itemGapTimeout := item.receiveTime.Add(self.receiveBufferSettings.GapTimeout).Sub(receiveTime)
+				itemGapTimeout := timeoutStartTime(item.receiveTime, resumeTime).Add(self.receiveBufferSettings.GapTimeout).Sub(receiveTime)
 				if itemGapTimeout < 0 {
 					glog.Infof("[r]%s<-%s exit gap timeout\n", self.clientTag, self.sourceId)
 					// did not receive a preceding message in time
+					exitReason = ReceiveSequenceExitGapTimeout
 					return
 				}
 
@@ -2277,15 +4041,20 @@ func (self *ReceiveSequence) Run() {
 					// this item is the head of sequence
 					if err := self.registerContracts(item); err != nil {
 						glog.Infof("[r]%s<-%s exit could not register contracts = %s\n", self.clientTag, self.sourceId, err)
+						exitReason = ReceiveSequenceExitNoContract
 						return
 					}
 					if self.updateContract(item) {
 						glog.V(1).Infof("[r]seq+ %d->%d (queue) %s<-%s\n", self.nextSequenceNumber, self.nextSequenceNumber + 1, self.clientTag, self.sourceId)
 						self.nextSequenceNumber = self.nextSequenceNumber + 1
-						self.receiveHead(item)
+						if err := self.receiveHead(item); err != nil {
+							exitReason = self.auditReceiveError(err, item.messageByteCount)
+							return
+						}
 					} else {
 						// no valid contract. it should have been attached to the head
 						glog.Infof("[r]drop head no contract %s<-%s\n", self.clientTag, self.sourceId)
+						exitReason = ReceiveSequenceExitNoContract
 						return
 					}
 				} else {
@@ -2297,7 +4066,10 @@ func (self *ReceiveSequence) Run() {
 			}
 		}
 
+		watchdog.Wait()
+
 		checkpointId := self.idleCondition.Checkpoint()
+		waitTime := self.clock.Now()
 		select {
 		case <- self.ctx.Done():
 			return
@@ -2305,17 +4077,27 @@ func (self *ReceiveSequence) Run() {
 			if !ok {
 				return
 			}
-
-			if receivePack.Pack.Nack {
-				received, err := self.receiveNack(receivePack)
+			self.client.detectSuspend(waitTime, timeout)
+			watchdog.Work(watchdogState)
+
+			if receivePack.Pack.Close {
+				// the sender closed the sequence after all messages were acked
+				// a marker that does not match the receive state is ignored,
+				// and the sequence closes on its own timeouts
+				if self.nextSequenceNumber == receivePack.Pack.SequenceNumber && 0 == self.receiveQueue.Len() {
+					glog.V(1).Infof("[r]%s<-%s exit sender close\n", self.clientTag, self.sourceId)
+					exitReason = ReceiveSequenceExitSenderClose
+					return
+				}
+				glog.V(1).Infof("[r]drop close %d %s<-%s\n", receivePack.Pack.SequenceNumber, self.clientTag, self.sourceId)
+			} else if receivePack.Pack.Nack {
+				received, err := self.recoverReceive(self.receiveNack, receivePack)
 				if err != nil {
 					// bad message
 					// close the sequence
 					glog.Infof("[r]%s<-%s exit could not receive nack = %s\n", self.clientTag, self.sourceId, err)
-					self.peerAudit.Update(func(a *PeerAudit) {
-						a.badMessage(receivePack.MessageByteCount)
-					})
-					return	
+					exitReason = self.auditReceiveError(err, receivePack.MessageByteCount)
+					return
 				} else if !received {
 					glog.V(1).Infof("[r]drop nack %s<-%s\n", self.clientTag, self.sourceId)
 					// drop the message
@@ -2326,15 +4108,13 @@ func (self *ReceiveSequence) Run() {
 
 			// note messages of `size < MinMessageByteCount` get counted as `MinMessageByteCount` against the contract
 			} else {
-				received, err := self.receive(receivePack)
+				received, err := self.recoverReceive(self.receive, receivePack)
 				if err != nil {
 					// bad message
 					// close the sequence
 					glog.Infof("[r]%s<-%s exit could not receive ack = %s\n", self.clientTag, self.sourceId, err)
-					self.peerAudit.Update(func(a *PeerAudit) {
-						a.badMessage(receivePack.MessageByteCount)
-					})
-					return	
+					exitReason = self.auditReceiveError(err, receivePack.MessageByteCount)
+					return
 				} else if !received {
 					glog.V(1).Infof("[r]drop ack %s<-%s\n", self.clientTag, self.sourceId)
 					// drop the message
@@ -2343,11 +4123,13 @@ func (self *ReceiveSequence) Run() {
 					})
 				}
 			}
-		case <- time.After(timeout):
+		case <- self.clock.After(timeout):
+			self.client.detectSuspend(waitTime, timeout)
 			if 0 == self.receiveQueue.Len() {
 				// idle timeout
 				if self.idleCondition.Close(checkpointId) {
 					// close the sequence
+					exitReason = ReceiveSequenceExitIdleTimeout
 					return
 				}
 				// else there are pending updates
@@ -2385,8 +4167,57 @@ func (self *ReceiveSequence) sendAck(sequenceNumber uint64, messageId Id, select
 	self.ackWindow.Update(ack)
 }
 
+// audits the source for an error that closes the sequence, and returns the exit reason
+func (self *ReceiveSequence) auditReceiveError(err error, messageByteCount ByteCount) string {
+	var badAccountingError *BadAccountingError
+	if errors.As(err, &badAccountingError) {
+		glog.Errorf(
+			"[r]%s<-%s exit %s next_sequence_number=%d = %s\n",
+			self.clientTag,
+			self.sourceId,
+			self.sequenceId,
+			self.nextSequenceNumber,
+			err,
+		)
+		self.peerAudit.Update(func(a *PeerAudit) {
+			a.badContract()
+		})
+		return ReceiveSequenceExitBadAccounting
+	}
+	abuse := self.client.receiveBuffer.badMessage(self.sourceId)
+	self.peerAudit.Update(func(a *PeerAudit) {
+		a.badMessage(messageByteCount)
+		if abuse {
+			a.Abuse = true
+		}
+	})
+	if abuse {
+		return ReceiveSequenceExitAbuse
+	}
+	return ReceiveSequenceExitBadMessage
+}
+
+// a panic while receiving a pack is returned as an error,
+// so that input from the peer closes the sequence and is audited rather than crashing the run loop
+func (self *ReceiveSequence) recoverReceive(
+	receive func(*ReceivePack)(bool, error),
+	receivePack *ReceivePack,
+) (received bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if IsDoneError(r) {
+				panic(r)
+			}
+			glog.Errorf("[r]%s<-%s receive panic = %s\n", self.clientTag, self.sourceId, r)
+			received = false
+			err = fmt.Errorf("Receive panic: %s", r)
+		}
+	}()
+	return receive(receivePack)
+}
+
 func (self *ReceiveSequence) receive(receivePack *ReceivePack) (bool, error) {
-	receiveTime := time.Now()
+	receiveTime := self.clock.Now()
 
 	sequenceNumber := receivePack.Pack.SequenceNumber
 	var contractId *Id
@@ -2449,7 +4280,9 @@ func (self *ReceiveSequence) receive(receivePack *ReceivePack) (bool, error) {
 				return false, err
 			}
 			if self.updateContract(item) {
-				self.receiveHead(item)
+				if err := self.receiveHead(item); err != nil {
+					return false, err
+				}
 				return true, nil
 			} else {
 				// no valid contract. it should have been attached to the head
@@ -2498,7 +4331,7 @@ func (self *ReceiveSequence) receive(receivePack *ReceivePack) (bool, error) {
 
 func (self *ReceiveSequence) receiveNack(receivePack *ReceivePack) (bool, error) {
 
-	receiveTime := time.Now()
+	receiveTime := self.clock.Now()
 
 	sequenceNumber := receivePack.Pack.SequenceNumber
 	var contractId *Id
@@ -2529,7 +4362,9 @@ func (self *ReceiveSequence) receiveNack(receivePack *ReceivePack) (bool, error)
 		return false, err
 	}
 	if self.updateContract(item) {
-		self.receiveHead(item)
+		if err := self.receiveHead(item); err != nil {
+			return false, err
+		}
 		return true, nil
 	} else {
 		// no valid contract
@@ -2539,7 +4374,8 @@ func (self *ReceiveSequence) receiveNack(receivePack *ReceivePack) (bool, error)
 	}
 }
 
-func (self *ReceiveSequence) receiveHead(item *receiveItem) {
+// returns a `BadAccountingError` if the message does not match the contract accounting
+func (self *ReceiveSequence) receiveHead(item *receiveItem) error {
 	frameMessageTypes := []string{}
 	for _, frame := range item.frames {
 		frameMessageTypes = append(frameMessageTypes, fmt.Sprintf("%v", frame.MessageType))
@@ -2555,20 +4391,75 @@ func (self *ReceiveSequence) receiveHead(item *receiveItem) {
 	})
 	var provideMode protocol.ProvideMode
 	if self.receiveContract != nil {
-		self.receiveContract.ack(item.messageByteCount)
 		provideMode = self.receiveContract.provideMode
 	} else {
 		// no contract peers are considered in network
 		provideMode = protocol.ProvideMode_Network
 	}
-	item.receiveCallback(
+	if self.headProvideModeSet && self.headProvideMode != provideMode {
+		glog.V(1).Infof("[r]%s<-%s provide mode %s -> %s\n", self.clientTag, self.sourceId, self.headProvideMode, provideMode)
+		self.client.provideModeChange(self.sourceId, self.headProvideMode, provideMode)
+	}
+	self.headProvideMode = provideMode
+	self.headProvideModeSet = true
+	err := item.receiveCallback(
 		self.sourceId,
 		item.frames,
 		provideMode,
 	)
+	if err != nil {
+		retry := item.ack && self.receiveBufferSettings.ReceivePanicPolicy == ReceivePanicPolicyNoAck
+		self.receivePanic(item, provideMode, !retry, err)
+		if retry {
+			glog.Infof("[r]%s<-%s receive panic, retry %d\n", self.clientTag, self.sourceId, item.sequenceNumber)
+			// the retransmit is debited again
+			if item.debitContract != nil {
+				if err := item.debitContract.refund(item.messageByteCount); err != nil {
+					return err
+				}
+			}
+			// rewind so that the retransmit is received as the head
+			self.nextSequenceNumber = item.sequenceNumber
+			return nil
+		}
+	}
+	// a peer allowed to send with no contract may still attach a contract that does not fit the message
+	// only ack the contract that was debited
+	if item.debitContract != nil {
+		if err := item.debitContract.ack(item.messageByteCount); err != nil {
+			return err
+		}
+		self.contractManager.updateContractUsage(
+			item.debitContract.contractId,
+			item.debitContract.ackedByteCount,
+			item.debitContract.unackedByteCount,
+		)
+	}
 	if item.ack {
 		self.sendAck(item.sequenceNumber, item.messageId, false)
 	}
+	return nil
+}
+
+// ReceivePanicFunction
+func (self *ReceiveSequence) receivePanic(item *receiveItem, provideMode protocol.ProvideMode, acked bool, err error) {
+	receivePanicCallback := self.receiveBufferSettings.ReceivePanicCallback
+	if receivePanicCallback == nil {
+		return
+	}
+	HandleError(func() {
+		receivePanicCallback(&ReceivePanic{
+			SourceId: self.sourceId,
+			SequenceId: self.sequenceId,
+			MessageId: item.messageId,
+			SequenceNumber: item.sequenceNumber,
+			Ack: item.ack,
+			Acked: acked,
+			ProvideMode: provideMode,
+			Frames: item.frames,
+			Err: err,
+		})
+	})
 }
 
 func (self *ReceiveSequence) registerContracts(item *receiveItem) error {
@@ -2593,6 +4484,13 @@ func (self *ReceiveSequence) registerContracts(item *receiveItem) error {
 			contract.StoredContractBytes,
 			contract.ProvideMode) {
 		glog.Infof("[r]%s<-%s exit contract verification failed (%s)\n", self.clientTag, self.sourceId, contract.ProvideMode)
+		self.contractManager.verifyFailure(
+			TransferPath{
+				source: Path{ClientId: self.sourceId, StreamId: DirectStreamId},
+				destination: Path{ClientId: self.clientId, StreamId: DirectStreamId},
+			},
+			contract.ProvideMode,
+		)
 		// bad contract
 		// close sequence
 		self.peerAudit.Update(func(a *PeerAudit) {
@@ -2601,6 +4499,13 @@ func (self *ReceiveSequence) registerContracts(item *receiveItem) error {
 		return nil
 	}
 
+	if self.receiveContract == nil && !self.contractManager.allowSourceContract(self.sourceId) {
+		// refused, but not a bad contract, so the source is not audited
+		// the message has no contract and is dropped
+		glog.Infof("[r]%s<-%s exit contract refused quiesced\n", self.clientTag, self.sourceId)
+		return nil
+	}
+
 	nextReceiveContract, err := newSequenceContract(
 		"r",
 		&contract,
@@ -2629,6 +4534,40 @@ func (self *ReceiveSequence) registerContracts(item *receiveItem) error {
 	return nil
 }
 
+// resume a contract checkpointed by a previous receive sequence for the same sequence id,
+// e.g. before a client restart (see `ContractManager.ImportState`)
+func (self *ReceiveSequence) resumeContract() {
+	receiveContractCheckpoint, ok := self.contractManager.takeReceiveContractCheckpoint(self.sourceId, self.sequenceId)
+	if !ok {
+		return
+	}
+
+	contract := receiveContractCheckpoint.Contract
+	if !self.contractManager.Verify(
+			contract.StoredContractHmac,
+			contract.StoredContractBytes,
+			contract.ProvideMode) {
+		glog.Infof("[r]%s<-%s resume contract verification failed (%s)\n", self.clientTag, self.sourceId, contract.ProvideMode)
+		return
+	}
+
+	receiveContract, err := newSequenceContract(
+		"r",
+		contract,
+		self.receiveBufferSettings.MinMessageByteCount,
+		1.0,
+	)
+	if err != nil {
+		glog.Infof("[r]%s<-%s resume contract error = %s\n", self.clientTag, self.sourceId, err)
+		return
+	}
+	receiveContract.ackedByteCount = receiveContractCheckpoint.AckedByteCount
+
+	glog.V(1).Infof("[r]%s<-%s resume contract %s seq=%d\n", self.clientTag, self.sourceId, receiveContract.contractId, receiveContractCheckpoint.NextSequenceNumber)
+	self.setContract(receiveContract)
+	self.nextSequenceNumber = receiveContractCheckpoint.NextSequenceNumber
+}
+
 func (self *ReceiveSequence) setContract(nextReceiveContract *sequenceContract) error {
 	// contract already set
 	if self.receiveContract != nil && self.receiveContract.contractId == nextReceiveContract.contractId {
@@ -2646,6 +4585,7 @@ func (self *ReceiveSequence) setContract(nextReceiveContract *sequenceContract)
 	// FIXME some kind of async verification to the control to make sure the contract is valid
 	self.receiveContract = nextReceiveContract
 	self.contractManager.OpenSourceContract(self.sourceId)
+	self.client.openContractLimit.open(nextReceiveContract.contractId, self.sourceId, false, self, self.cancel)
 	return nil
 }
 
@@ -2653,6 +4593,8 @@ func (self *ReceiveSequence) updateContract(item *receiveItem) bool {
 	// always use a contract if present
 	// the sender may send contracts even if `receiveNoContract` is set locally
 	if self.receiveContract != nil && self.receiveContract.update(item.messageByteCount) {
+		item.debitContract = self.receiveContract
+		self.client.openContractLimit.touch(self.receiveContract.contractId)
 		return true
 	}
 	// `receiveNoContract` is a mutual configuration 
@@ -2682,8 +4624,10 @@ type receiveItem struct {
 	receiveTime time.Time
 	frames []*protocol.Frame
 	contractFrame *protocol.Frame
-	receiveCallback ReceiveFunction
+	receiveCallback ReceiveDetailedFunction
 	ack bool
+	// the contract debited for this item, or nil if received with no contract
+	debitContract *sequenceContract
 }
 
 
@@ -2733,6 +4677,13 @@ func newSequenceAckWindow() *sequenceAckWindow {
 	}
 }
 
+func (self *sequenceAckWindow) PendingCount() int {
+	self.ackLock.Lock()
+	defer self.ackLock.Unlock()
+
+	return self.ackUpdateCount + len(self.selectiveAcks)
+}
+
 func (self *sequenceAckWindow) Update(ack *sequenceAck) {
 	self.ackLock.Lock()
 	defer self.ackLock.Unlock()
@@ -2803,6 +4754,8 @@ type sequenceContract struct {
 	
 	ackedByteCount ByteCount
 	unackedByteCount ByteCount
+	// the remainder of the last no-ack batch, already debited
+	nackBatchByteCount ByteCount
 }
 
 func newSequenceContract(tag string, contract *protocol.Contract, minUpdateByteCount ByteCount, contractFillFraction float32) (*sequenceContract, error) {
@@ -2843,8 +4796,38 @@ func newSequenceContract(tag string, contract *protocol.Contract, minUpdateByteC
 }
 
 func (self *sequenceContract) update(byteCount ByteCount) bool {
-	effectiveByteCount := max(self.minUpdateByteCount, byteCount)
+	return self.debit(max(self.minUpdateByteCount, byteCount))
+}
+
+// returns the byte count debited from the contract
+func (self *sequenceContract) updateWithPolicy(byteCount ByteCount, nackAccountingPolicy NackAccountingPolicy) (ByteCount, bool) {
+	switch nackAccountingPolicy {
+	case NackAccountingBytes:
+		if self.debit(byteCount) {
+			return byteCount, true
+		}
+		return 0, false
+	case NackAccountingBatch:
+		if byteCount <= self.nackBatchByteCount {
+			self.nackBatchByteCount -= byteCount
+			return 0, true
+		}
+		effectiveByteCount := max(self.minUpdateByteCount, byteCount - self.nackBatchByteCount)
+		if self.debit(effectiveByteCount) {
+			self.nackBatchByteCount = effectiveByteCount - (byteCount - self.nackBatchByteCount)
+			return effectiveByteCount, true
+		}
+		return 0, false
+	default:
+		effectiveByteCount := max(self.minUpdateByteCount, byteCount)
+		if self.debit(effectiveByteCount) {
+			return effectiveByteCount, true
+		}
+		return 0, false
+	}
+}
 
+func (self *sequenceContract) debit(effectiveByteCount ByteCount) bool {
 	if self.effectiveTransferByteCount < self.ackedByteCount + self.unackedByteCount + effectiveByteCount {
 		// doesn't fit in contract
 		if glog.V(1) {
@@ -2877,15 +4860,69 @@ func (self *sequenceContract) update(byteCount ByteCount) bool {
 	return true
 }
 
-func (self *sequenceContract) ack(byteCount ByteCount) {
+func (self *sequenceContract) ack(byteCount ByteCount) error {
+	return self.settle(max(self.minUpdateByteCount, byteCount))
+}
+
+// reverses `update` for a message that will be received again
+func (self *sequenceContract) refund(byteCount ByteCount) error {
 	effectiveByteCount := max(self.minUpdateByteCount, byteCount)
+	if self.unackedByteCount < effectiveByteCount {
+		return self.badAccounting(effectiveByteCount)
+	}
+	self.unackedByteCount -= effectiveByteCount
+	return nil
+}
 
+// settles a byte count returned by `updateWithPolicy`
+func (self *sequenceContract) settle(effectiveByteCount ByteCount) error {
 	if self.unackedByteCount < effectiveByteCount {
-		// debug.PrintStack()
-		panic(fmt.Errorf("Bad accounting %d <> %d", self.unackedByteCount, effectiveByteCount))
+		return self.badAccounting(effectiveByteCount)
 	}
 	self.unackedByteCount -= effectiveByteCount
 	self.ackedByteCount += effectiveByteCount
+	return nil
+}
+
+func (self *sequenceContract) badAccounting(effectiveByteCount ByteCount) *BadAccountingError {
+	return &BadAccountingError{
+		ContractId: self.contractId,
+		SourceId: self.sourceId,
+		DestinationId: self.destinationId,
+		TransferByteCount: self.transferByteCount,
+		AckedByteCount: self.ackedByteCount,
+		UnackedByteCount: self.unackedByteCount,
+		EffectiveByteCount: effectiveByteCount,
+	}
+}
+
+
+// a settle or refund of more than the unacked byte count of the contract,
+// e.g. from duplicate or malformed acks from the peer.
+// The contract is left unchanged. The sequence closes and the peer is audited.
+type BadAccountingError struct {
+	ContractId Id
+	SourceId Id
+	DestinationId Id
+	TransferByteCount ByteCount
+	AckedByteCount ByteCount
+	UnackedByteCount ByteCount
+	// the byte count to settle or refund
+	EffectiveByteCount ByteCount
+}
+
+func (self *BadAccountingError) Error() string {
+	return fmt.Sprintf(
+		"Bad accounting %d <> %d (contract %s %s->%s acked=%d unacked=%d transfer=%d)",
+		self.UnackedByteCount,
+		self.EffectiveByteCount,
+		self.ContractId,
+		self.SourceId,
+		self.DestinationId,
+		self.AckedByteCount,
+		self.UnackedByteCount,
+		self.TransferByteCount,
+	)
 }
 
 
@@ -2895,6 +4932,32 @@ type ForwardBufferSettings struct {
 	SequenceBufferSize int
 
 	WriteTimeout time.Duration
+
+	// the max bytes buffered across all forward sequences
+	// forwards over this limit are dropped
+	TotalMaxByteCount ByteCount
+	// drops are logged in aggregate at most once per interval
+	DropLogInterval time.Duration
+
+	// when > 0, forward sequences run on a shared pool of this many workers
+	// instead of a goroutine per sequence. See `forwardWorkerPool`
+	WorkerCount int
+	// pooled sequences are checked for idle and close at this interval
+	WorkerSweepInterval time.Duration
+
+	// the max number of open forward sequences
+	// a new destination over this limit evicts the least recently used sequence,
+	// which drops the packs it has not written
+	// 0 is no limit
+	MaxSequences int
+
+	// a failed write of a pack is retried up to this many times before the pack is dropped
+	WriteRetryCount int
+	// the wait before the first retry of a failed write. Each retry doubles the wait, up to `WriteTimeout`
+	WriteRetryBackoff time.Duration
+	// after this many consecutive dropped packs, the sequence reopens its writer for the destination,
+	// which fails over to the current route set. 0 never reopens
+	MaxConsecutiveDrops int
 }
 
 
@@ -2906,9 +4969,32 @@ type ForwardBuffer struct {
 
 	forwardBufferSettings *ForwardBufferSettings
 
+	// nil when each sequence runs in its own goroutine
+	workerPool *forwardWorkerPool
+
 	mutex sync.Mutex
 	// destination id -> forward sequence
 	forwardSequences map[Id]*ForwardSequence
+	// destination id -> element in `forwardSequenceUseOrder`, for `MaxSequences`
+	forwardSequenceUses map[Id]*list.Element
+	// destination ids in order of last use, least recently used first
+	forwardSequenceUseOrder *list.List
+	// sequences evicted for `MaxSequences`
+	evictCount uint64
+	// destination id -> idle timeout
+	// overrides `IdleTimeout` for the destination
+	destinationIdleTimeouts map[Id]time.Duration
+	// sequence goroutines that have not returned, including replaced sequences
+	// sequences in the worker pool do not have their own goroutine
+	goroutineCount int
+
+	byteCountLock sync.Mutex
+	// bytes queued in all forward sequences
+	byteCount ByteCount
+	// drops since the last drop log
+	dropCount int
+	dropByteCount ByteCount
+	dropLogTime time.Time
 }
 
 func NewForwardBuffer(ctx context.Context,
@@ -2916,13 +5002,21 @@ func NewForwardBuffer(ctx context.Context,
 		routeManager *RouteManager,
 		contractManager *ContractManager,
 		forwardBufferSettings *ForwardBufferSettings) *ForwardBuffer {
+	var workerPool *forwardWorkerPool
+	if 0 < forwardBufferSettings.WorkerCount {
+		workerPool = newForwardWorkerPool(ctx, forwardBufferSettings)
+	}
 	return &ForwardBuffer{
 		ctx: ctx,
 		client: client,
 		routeManager: routeManager,
 		contractManager: contractManager,
 		forwardBufferSettings: forwardBufferSettings,
+		workerPool: workerPool,
 		forwardSequences: map[Id]*ForwardSequence{},
+		forwardSequenceUses: map[Id]*list.Element{},
+		forwardSequenceUseOrder: list.New(),
+		destinationIdleTimeouts: map[Id]time.Duration{},
 	}
 }
 
@@ -2934,10 +5028,17 @@ func (self *ForwardBuffer) Pack(forwardPack *ForwardPack, timeout time.Duration)
 		forwardSequence, ok := self.forwardSequences[forwardPack.DestinationId]
 		if ok {
 			if skip == nil || skip != forwardSequence {
+				self.useForwardSequence(forwardPack.DestinationId)
 				return forwardSequence
 			} else {
 				forwardSequence.Cancel()
 				delete(self.forwardSequences, forwardPack.DestinationId)
+				self.removeForwardSequenceUse(forwardPack.DestinationId)
+			}
+		}
+		if 0 < self.forwardBufferSettings.MaxSequences {
+			for self.forwardBufferSettings.MaxSequences <= len(self.forwardSequences) {
+				self.evictLeastRecentlyUsed()
 			}
 		}
 		forwardSequence = NewForwardSequence(
@@ -2947,40 +5048,188 @@ func (self *ForwardBuffer) Pack(forwardPack *ForwardPack, timeout time.Duration)
 			self.contractManager,
 			forwardPack.DestinationId,
 			self.forwardBufferSettings,
+			self.releaseByteCount,
 		)
+		if idleTimeout, ok := self.destinationIdleTimeouts[forwardPack.DestinationId]; ok {
+			forwardSequence.SetIdleTimeout(idleTimeout)
+		}
 		self.forwardSequences[forwardPack.DestinationId] = forwardSequence
-		go func() {
-			HandleError(forwardSequence.Run)
-
+		self.useForwardSequence(forwardPack.DestinationId)
+		globalSequenceCounts.created()
+		onClose := func() {
 			self.mutex.Lock()
 			defer self.mutex.Unlock()
 			forwardSequence.Close()
+			if self.workerPool == nil {
+				self.goroutineCount -= 1
+			}
+			globalSequenceCounts.closed()
 			// clean up
 			if forwardSequence == self.forwardSequences[forwardPack.DestinationId] {
 				delete(self.forwardSequences, forwardPack.DestinationId)
+				self.removeForwardSequenceUse(forwardPack.DestinationId)
+				delete(self.destinationIdleTimeouts, forwardPack.DestinationId)
 			}
-		}()
+		}
+		if self.workerPool != nil {
+			self.workerPool.add(forwardSequence, onClose)
+		} else {
+			self.goroutineCount += 1
+			go func() {
+				HandleError(forwardSequence.Run)
+				onClose()
+			}()
+		}
 		return forwardSequence
 	}
 
+	byteCount := ByteCount(len(forwardPack.TransferFrameBytes))
+	if !self.reserveByteCount(byteCount) {
+		// drop
+		return false, nil
+	}
+
 	var forwardSequence *ForwardSequence
 	var success bool
 	var err error
 	for i := 0; i < 2; i += 1 {
 		select {
 		case <- self.ctx.Done():
+			self.releaseByteCount(byteCount)
 			return false, errors.New("Done.")
 		default:
 		}
 		forwardSequence = initForwardSequence(forwardSequence)
 		if success, err = forwardSequence.Pack(forwardPack, timeout); err == nil {
+			if !success {
+				self.releaseByteCount(byteCount)
+			}
 			return success, nil
 		}
 		// sequence closed
 	}
+	self.releaseByteCount(byteCount)
 	return success, err
 }
 
+// cancels the least recently used sequence and removes it from the open sequences
+// the sequence releases its unwritten packs when it closes
+// must be called with the mutex
+func (self *ForwardBuffer) evictLeastRecentlyUsed() {
+	element := self.forwardSequenceUseOrder.Front()
+	if element == nil {
+		return
+	}
+	evictDestinationId := element.Value.(Id)
+
+	glog.V(1).Infof("[fb]evict %s->%s\n", self.client.ClientTag(), evictDestinationId)
+	if forwardSequence, ok := self.forwardSequences[evictDestinationId]; ok {
+		forwardSequence.Cancel()
+	}
+	delete(self.forwardSequences, evictDestinationId)
+	self.removeForwardSequenceUse(evictDestinationId)
+	delete(self.destinationIdleTimeouts, evictDestinationId)
+	self.evictCount += 1
+}
+
+// moves the destination to the most recently used
+// must be called with the mutex
+func (self *ForwardBuffer) useForwardSequence(destinationId Id) {
+	if element, ok := self.forwardSequenceUses[destinationId]; ok {
+		self.forwardSequenceUseOrder.MoveToBack(element)
+	} else {
+		self.forwardSequenceUses[destinationId] = self.forwardSequenceUseOrder.PushBack(destinationId)
+	}
+}
+
+// must be called with the mutex
+func (self *ForwardBuffer) removeForwardSequenceUse(destinationId Id) {
+	if element, ok := self.forwardSequenceUses[destinationId]; ok {
+		self.forwardSequenceUseOrder.Remove(element)
+		delete(self.forwardSequenceUses, destinationId)
+	}
+}
+
+// a timeout <= 0 removes the override for the destination
+// the override is removed when the forward sequence of the destination closes,
+// so that overrides do not accumulate for every destination ever forwarded
+func (self *ForwardBuffer) SetIdleTimeout(destinationId Id, idleTimeout time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if idleTimeout <= 0 {
+		delete(self.destinationIdleTimeouts, destinationId)
+		idleTimeout = self.forwardBufferSettings.IdleTimeout
+	} else {
+		self.destinationIdleTimeouts[destinationId] = idleTimeout
+	}
+	if forwardSequence, ok := self.forwardSequences[destinationId]; ok {
+		forwardSequence.SetIdleTimeout(idleTimeout)
+	}
+}
+
+// returns false if the byte count would exceed the total max byte count
+func (self *ForwardBuffer) reserveByteCount(byteCount ByteCount) bool {
+	self.byteCountLock.Lock()
+	defer self.byteCountLock.Unlock()
+
+	if self.forwardBufferSettings.TotalMaxByteCount <= 0 ||
+			self.byteCount + byteCount <= self.forwardBufferSettings.TotalMaxByteCount {
+		self.byteCount += byteCount
+		return true
+	}
+
+	self.dropCount += 1
+	self.dropByteCount += byteCount
+	now := time.Now()
+	if self.forwardBufferSettings.DropLogInterval <= now.Sub(self.dropLogTime) {
+		glog.Infof(
+			"[fb]drop %d forwards (%db) over total max byte count %db\n",
+			self.dropCount,
+			self.dropByteCount,
+			self.forwardBufferSettings.TotalMaxByteCount,
+		)
+		self.dropCount = 0
+		self.dropByteCount = 0
+		self.dropLogTime = now
+	}
+	return false
+}
+
+func (self *ForwardBuffer) releaseByteCount(byteCount ByteCount) {
+	self.byteCountLock.Lock()
+	defer self.byteCountLock.Unlock()
+
+	self.byteCount -= byteCount
+}
+
+// the bytes currently queued in all forward sequences
+func (self *ForwardBuffer) TotalByteCount() ByteCount {
+	self.byteCountLock.Lock()
+	defer self.byteCountLock.Unlock()
+
+	return self.byteCount
+}
+
+func (self *ForwardBuffer) resourceCounts() (sequenceCount int, goroutineCount int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	goroutineCount = self.goroutineCount
+	if self.workerPool != nil {
+		// the workers and the sweep
+		goroutineCount += self.forwardBufferSettings.WorkerCount + 1
+	}
+	return len(self.forwardSequences), goroutineCount
+}
+
+func (self *ForwardBuffer) sequenceEvictCount() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.evictCount
+}
+
 func (self *ForwardBuffer) Close() {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -3028,12 +5277,34 @@ type ForwardSequence struct {
 	destinationId Id
 
 	forwardBufferSettings *ForwardBufferSettings
+	// called with the size of each pack that leaves the sequence
+	releaseByteCount func(ByteCount)
 
 	packs chan *ForwardPack
 
 	idleCondition *IdleCondition
 
+	// replaced in tests
+	openMultiRouteWriter func(destinationId Id) MultiRouteWriter
+	closeMultiRouteWriter func(multiRouteWriter MultiRouteWriter)
+
+	writerLock sync.Mutex
 	multiRouteWriter MultiRouteWriter
+	// dropped packs since the last successful write
+	consecutiveDropCount int
+
+	clock Clock
+
+	// set when the sequence runs on a worker pool
+	workerPool *forwardWorkerPool
+
+	stateLock sync.Mutex
+	idleTimeout time.Duration
+	// pooled state
+	// true while the sequence is queued or running on a worker
+	scheduled bool
+	idleCheckpointId uint64
+	idleCheckpointTime time.Time
 }
 
 func NewForwardSequence(
@@ -3042,7 +5313,8 @@ func NewForwardSequence(
 		routeManager *RouteManager,
 		contractManager *ContractManager,
 		destinationId Id,
-		forwardBufferSettings *ForwardBufferSettings) *ForwardSequence {
+		forwardBufferSettings *ForwardBufferSettings,
+		releaseByteCount func(ByteCount)) *ForwardSequence {
 	cancelCtx, cancel := context.WithCancel(ctx)
 	return &ForwardSequence{
 		ctx: cancelCtx,
@@ -3054,13 +5326,41 @@ func NewForwardSequence(
 		contractManager: contractManager,
 		destinationId: destinationId,
 		forwardBufferSettings: forwardBufferSettings,
+		releaseByteCount: releaseByteCount,
+		openMultiRouteWriter: routeManager.OpenMultiRouteWriter,
+		closeMultiRouteWriter: routeManager.CloseMultiRouteWriter,
 		packs: make(chan *ForwardPack, forwardBufferSettings.SequenceBufferSize),
 		idleCondition: NewIdleCondition(),
+		idleTimeout: forwardBufferSettings.IdleTimeout,
+		clock: client.clock,
 	}
 }
 
+// takes effect on the next wait of the sequence
+func (self *ForwardSequence) SetIdleTimeout(idleTimeout time.Duration) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.idleTimeout = idleTimeout
+}
+
+func (self *ForwardSequence) IdleTimeout() time.Duration {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return self.idleTimeout
+}
+
 // success, error
 func (self *ForwardSequence) Pack(forwardPack *ForwardPack, timeout time.Duration) (bool, error) {
+	success, err := self.push(forwardPack, timeout)
+	if success && self.workerPool != nil {
+		self.schedule()
+	}
+	return success, err
+}
+
+func (self *ForwardSequence) push(forwardPack *ForwardPack, timeout time.Duration) (bool, error) {
 	select {
 	case <- self.ctx.Done():
 		return false, errors.New("Done.")
@@ -3103,10 +5403,24 @@ func (self *ForwardSequence) Pack(forwardPack *ForwardPack, timeout time.Duratio
 func (self *ForwardSequence) Run() {
 	defer self.cancel()
 
-	self.multiRouteWriter = self.routeManager.OpenMultiRouteWriter(self.destinationId)
-	defer self.routeManager.CloseMultiRouteWriter(self.multiRouteWriter)
+	self.openWriter()
+	defer self.closeWriter()
+
+	watchdog := newSequenceWatchdog(
+		self.ctx,
+		self.client.settings.WatchdogSettings,
+		"forward",
+		self.clientTag,
+		self.destinationId,
+		Id{},
+	)
+	watchdogState := func()(string) {
+		return fmt.Sprintf("packs=%d", len(self.packs))
+	}
 
 	for {
+		watchdog.Wait()
+
 		checkpointId := self.idleCondition.Checkpoint()
 		select {
 		case <- self.ctx.Done():
@@ -3115,21 +5429,10 @@ func (self *ForwardSequence) Run() {
 			if !ok {
 				return
 			}
-			c := func()(error) {
-				return self.multiRouteWriter.Write(self.ctx, forwardPack.TransferFrameBytes, self.forwardBufferSettings.WriteTimeout)
-			}
-			if glog.V(2) {
-				TraceWithReturn(
-					fmt.Sprintf("[f]multi route write %s->%s", self.clientTag, self.destinationId),
-					c,
-				)
-			} else {
-				err := c()
-				if err != nil {
-					glog.Infof("[f]drop = %s", err)
-				}
-			}
-		case <- time.After(self.forwardBufferSettings.IdleTimeout):
+			watchdog.Work(watchdogState)
+			self.write(forwardPack)
+			self.release(forwardPack)
+		case <- time.After(self.IdleTimeout()):
 			if self.idleCondition.Close(checkpointId) {
 				// close the sequence
 				return
@@ -3139,10 +5442,179 @@ func (self *ForwardSequence) Run() {
 	}
 }
 
+func (self *ForwardSequence) openWriter() {
+	self.writerLock.Lock()
+	defer self.writerLock.Unlock()
+
+	self.multiRouteWriter = self.openMultiRouteWriter(self.destinationId)
+}
+
+func (self *ForwardSequence) closeWriter() {
+	self.writerLock.Lock()
+	defer self.writerLock.Unlock()
+
+	if self.multiRouteWriter != nil {
+		self.closeMultiRouteWriter(self.multiRouteWriter)
+		self.multiRouteWriter = nil
+	}
+}
+
+// replaces the writer with a new writer for the destination
+// a closed writer is not reopened
+func (self *ForwardSequence) reopenWriter() {
+	self.writerLock.Lock()
+	defer self.writerLock.Unlock()
+
+	if self.multiRouteWriter == nil {
+		return
+	}
+	select {
+	case <- self.ctx.Done():
+		return
+	default:
+	}
+	self.closeMultiRouteWriter(self.multiRouteWriter)
+	self.multiRouteWriter = self.openMultiRouteWriter(self.destinationId)
+}
+
+func (self *ForwardSequence) writer() MultiRouteWriter {
+	self.writerLock.Lock()
+	defer self.writerLock.Unlock()
+
+	return self.multiRouteWriter
+}
+
+// retries the write up to `WriteRetryCount` times with a backoff between tries,
+// and reopens the writer after `MaxConsecutiveDrops` consecutive dropped packs
+func (self *ForwardSequence) write(forwardPack *ForwardPack) {
+	retryBackoff := self.forwardBufferSettings.WriteRetryBackoff
+	for i := 0; ; i += 1 {
+		c := func()(error) {
+			multiRouteWriter := self.writer()
+			if multiRouteWriter == nil {
+				return errors.New("Done.")
+			}
+			return multiRouteWriter.Write(self.ctx, forwardPack.TransferFrameBytes, self.forwardBufferSettings.WriteTimeout)
+		}
+		var err error
+		if glog.V(2) {
+			err = TraceWithReturn(
+				fmt.Sprintf("[f]multi route write %s->%s", self.clientTag, self.destinationId),
+				c,
+			)
+		} else {
+			err = c()
+		}
+		if err == nil {
+			self.consecutiveDropCount = 0
+			return
+		}
+
+		if self.forwardBufferSettings.WriteRetryCount <= i {
+			glog.Infof("[f]drop = %s", err)
+			self.consecutiveDropCount += 1
+			if 0 < self.forwardBufferSettings.MaxConsecutiveDrops && self.forwardBufferSettings.MaxConsecutiveDrops <= self.consecutiveDropCount {
+				glog.Infof("[f]%s->%s reopen writer after %d drops\n", self.clientTag, self.destinationId, self.consecutiveDropCount)
+				self.reopenWriter()
+				self.consecutiveDropCount = 0
+			}
+			return
+		}
+
+		retryTimer := self.clock.NewTimer(retryBackoff)
+		select {
+		case <- self.ctx.Done():
+			retryTimer.Stop()
+			return
+		case <- retryTimer.C():
+		}
+		retryBackoff = min(2 * retryBackoff, self.forwardBufferSettings.WriteTimeout)
+	}
+}
+
+// queues the sequence on the worker pool if it is not already queued or running
+func (self *ForwardSequence) schedule() {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if !self.scheduled {
+		self.scheduled = true
+		self.workerPool.ready(self)
+	}
+}
+
+// runs on a pool worker
+// writes up to `batchSize` packs, then yields the worker
+func (self *ForwardSequence) work(batchSize int) {
+	for i := 0; i < batchSize; i += 1 {
+		var forwardPack *ForwardPack
+		select {
+		case <- self.ctx.Done():
+		case forwardPack = <- self.packs:
+		default:
+		}
+		if forwardPack == nil {
+			break
+		}
+		self.write(forwardPack)
+		self.release(forwardPack)
+	}
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	select {
+	case <- self.ctx.Done():
+		self.scheduled = false
+		return
+	default:
+	}
+	if 0 < len(self.packs) {
+		self.workerPool.ready(self)
+	} else {
+		self.scheduled = false
+	}
+}
+
+// runs on the pool sweep
+// returns true if the pool should close the sequence
+func (self *ForwardSequence) sweep(now time.Time) bool {
+	select {
+	case <- self.ctx.Done():
+		return true
+	default:
+	}
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	checkpointId := self.idleCondition.Checkpoint()
+	if self.scheduled || self.idleCheckpointTime.IsZero() || checkpointId != self.idleCheckpointId {
+		self.idleCheckpointId = checkpointId
+		self.idleCheckpointTime = now
+		return false
+	}
+	if self.idleTimeout <= now.Sub(self.idleCheckpointTime) {
+		// else there are pending updates
+		return self.idleCondition.Close(checkpointId)
+	}
+	return false
+}
+
+func (self *ForwardSequence) release(forwardPack *ForwardPack) {
+	if self.releaseByteCount != nil {
+		self.releaseByteCount(ByteCount(len(forwardPack.TransferFrameBytes)))
+	}
+}
+
 func (self *ForwardSequence) Close() {
 	self.cancel()
 	self.idleCondition.WaitForClose()
 	close(self.packs)
+	// release packs that were never written
+	for forwardPack := range self.packs {
+		self.release(forwardPack)
+	}
 }
 
 func (self *ForwardSequence) Cancel() {
@@ -3257,6 +5729,9 @@ func (self *SequencePeerAudit) Complete() {
 	    ResendByteCount: uint64(self.peerAudit.ResendByteCount),
 	    ResendCount: uint64(self.peerAudit.ResendCount),
 	}
+	if label := self.client.PeerAuditLabel(self.peerId); label != "" {
+		peerAudit.Label = &label
+	}
 	self.client.ClientOob().SendControl(
 		[]*protocol.Frame{RequireToFrame(peerAudit)},
 		func(resultFrames []*protocol.Frame, err error){},
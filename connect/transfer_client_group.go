@@ -0,0 +1,124 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+
+// tracks a set of clients so that they can be closed together,
+// e.g. on shutdown of a process that creates many clients
+// clients are removed from the group when they are done
+
+
+type ClientGroup struct {
+	mutex sync.Mutex
+	clients map[*Client]bool
+}
+
+func NewClientGroup() *ClientGroup {
+	return &ClientGroup{
+		clients: map[*Client]bool{},
+	}
+}
+
+func (self *ClientGroup) NewClientWithDefaults(
+	ctx context.Context,
+	clientId Id,
+	clientOob OutOfBandControl,
+) *Client {
+	client := NewClientWithDefaults(ctx, clientId, clientOob)
+	self.Add(client)
+	return client
+}
+
+func (self *ClientGroup) NewClient(
+	ctx context.Context,
+	clientId Id,
+	clientOob OutOfBandControl,
+	settings *ClientSettings,
+) *Client {
+	client := NewClient(ctx, clientId, clientOob, settings)
+	self.Add(client)
+	return client
+}
+
+func (self *ClientGroup) Add(client *Client) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.clients[client] = true
+}
+
+func (self *ClientGroup) Remove(client *Client) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.clients, client)
+}
+
+// the active clients in the group
+func (self *ClientGroup) Clients() []*Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.removeDone()
+	return maps.Keys(self.clients)
+}
+
+func (self *ClientGroup) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.removeDone()
+	return len(self.clients)
+}
+
+// must be called with `mutex`
+func (self *ClientGroup) removeDone() {
+	for client, _ := range self.clients {
+		if client.IsDone() {
+			delete(self.clients, client)
+		}
+	}
+}
+
+func (self *ClientGroup) CloseAll() {
+	for _, client := range self.removeAll() {
+		client.Close()
+	}
+}
+
+// drains the clients in parallel with `Client.Drain`,
+// so that all clients stop accepting new sends at once and share the `timeout`
+// returns true if all clients drained before the timeout
+func (self *ClientGroup) DrainAll(timeout time.Duration) bool {
+	clients := self.removeAll()
+
+	drained := make(chan bool, len(clients))
+	for _, client := range clients {
+		go func() {
+			drained <- client.Drain(timeout)
+		}()
+	}
+
+	allDrained := true
+	for range clients {
+		if !<- drained {
+			allDrained = false
+		}
+	}
+	return allDrained
+}
+
+func (self *ClientGroup) removeAll() []*Client {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	clients := maps.Keys(self.clients)
+	clear(self.clients)
+	return clients
+}
@@ -0,0 +1,88 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+	"runtime"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestClientGroupCloseAll(t *testing.T) {
+	timeout := 5 * time.Second
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	startGoroutineCount := runtime.NumGoroutine()
+
+	clientGroup := NewClientGroup()
+	for i := 0; i < n; i += 1 {
+		client := clientGroup.NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+		sendTransport := NewSendGatewayTransport()
+		receiveTransport := NewReceiveGatewayTransport()
+		client.RouteManager().UpdateTransport(sendTransport, []Route{make(chan []byte)})
+		client.RouteManager().UpdateTransport(receiveTransport, []Route{make(chan []byte)})
+	}
+	assert.Equal(t, n, clientGroup.Len())
+	assert.Equal(t, true, startGoroutineCount + n <= runtime.NumGoroutine())
+
+	clients := clientGroup.Clients()
+	assert.Equal(t, n, len(clients))
+
+	clientGroup.CloseAll()
+	assert.Equal(t, 0, clientGroup.Len())
+
+	for _, client := range clients {
+		assert.Equal(t, true, client.IsDone())
+	}
+
+	endTime := time.Now().Add(timeout)
+	for startGoroutineCount < runtime.NumGoroutine() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, true, runtime.NumGoroutine() <= startGoroutineCount)
+}
+
+
+func TestClientGroupDrainAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientGroup := NewClientGroup()
+	a := clientGroup.NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	b := clientGroup.NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	assert.Equal(t, 2, clientGroup.Len())
+
+	// clients that are done are removed
+	b.Cancel()
+	assert.Equal(t, 1, clientGroup.Len())
+
+	// no pending sends so the drain does not wait for the timeout
+	startTime := time.Now()
+	assert.Equal(t, true, clientGroup.DrainAll(30 * time.Second))
+	assert.Equal(t, true, time.Since(startTime) < 5 * time.Second)
+	assert.Equal(t, true, a.IsDone())
+	assert.Equal(t, 0, clientGroup.Len())
+
+	// a send that is never acked is pending until the timeout
+	c := clientGroup.NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	destinationId := NewId()
+	c.ContractManager().AddNoContractPeer(destinationId)
+	success := c.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		destinationId,
+		func(err error) {},
+		-1,
+	)
+	assert.Equal(t, true, success)
+	assert.Equal(t, false, clientGroup.DrainAll(200 * time.Millisecond))
+	assert.Equal(t, true, c.IsDone())
+}
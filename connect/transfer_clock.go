@@ -0,0 +1,157 @@
+package connect
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+
+// The time source of the send and receive sequences.
+// Tests set `ClientSettings.Clock` to a `FakeClock` to advance time deterministically
+// through ack timeouts, resends, gap timeouts, and idle closure.
+// Other parts of the client (the contract manager, route manager, watchdog) use the real time.
+
+
+type Clock interface {
+	Now() time.Time
+	// the channel receives the time once `d` has elapsed
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+
+type ClockTimer interface {
+	C() <-chan time.Time
+	// returns false if the timer already fired or was stopped
+	Stop() bool
+}
+
+
+// the default clock
+var RealClock Clock = &realClock{}
+
+
+type realClock struct {
+}
+
+func (self *realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (self *realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (self *realClock) NewTimer(d time.Duration) ClockTimer {
+	return &realTimer{
+		timer: time.NewTimer(d),
+	}
+}
+
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (self *realTimer) C() <-chan time.Time {
+	return self.timer.C
+}
+
+func (self *realTimer) Stop() bool {
+	return self.timer.Stop()
+}
+
+
+// a clock that only moves with `Advance`
+// timers fire when an advance reaches their deadline
+type FakeClock struct {
+	mutex sync.Mutex
+	now time.Time
+	timers []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+		timers: []*fakeTimer{},
+	}
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.now
+}
+
+func (self *FakeClock) After(d time.Duration) <-chan time.Time {
+	return self.NewTimer(d).C()
+}
+
+func (self *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	timer := &fakeTimer{
+		clock: self,
+		deadline: self.now.Add(d),
+		c: make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		timer.c <- self.now
+	} else {
+		self.timers = append(self.timers, timer)
+	}
+	return timer
+}
+
+// moves the time forward and fires the timers with a deadline at or before the new time
+func (self *FakeClock) Advance(d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.now = self.now.Add(d)
+	self.timers = slices.DeleteFunc(self.timers, func(timer *fakeTimer)(bool) {
+		if self.now.Before(timer.deadline) {
+			return false
+		}
+		timer.c <- self.now
+		return true
+	})
+}
+
+// the number of timers that have not fired or stopped
+func (self *FakeClock) TimerCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.timers)
+}
+
+func (self *FakeClock) stop(timer *fakeTimer) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	n := len(self.timers)
+	self.timers = slices.DeleteFunc(self.timers, func(t *fakeTimer)(bool) {
+		return t == timer
+	})
+	return len(self.timers) < n
+}
+
+
+type fakeTimer struct {
+	clock *FakeClock
+	deadline time.Time
+	// buffered so that an advance does not block
+	c chan time.Time
+}
+
+func (self *fakeTimer) C() <-chan time.Time {
+	return self.c
+}
+
+func (self *fakeTimer) Stop() bool {
+	return self.clock.stop(self)
+}
@@ -0,0 +1,239 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestFakeClock(t *testing.T) {
+	startTime := time.Now()
+	clock := NewFakeClock(startTime)
+	assert.Equal(t, startTime, clock.Now())
+
+	after := clock.After(2 * time.Second)
+	timer := clock.NewTimer(3 * time.Second)
+	stoppedTimer := clock.NewTimer(time.Second)
+	assert.Equal(t, 3, clock.TimerCount())
+	assert.Equal(t, true, stoppedTimer.Stop())
+	assert.Equal(t, false, stoppedTimer.Stop())
+
+	// a non-positive duration fires immediately
+	select {
+	case <- clock.After(0):
+	default:
+		t.FailNow()
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <- after:
+		t.FailNow()
+	case <- stoppedTimer.C():
+		t.FailNow()
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case fireTime := <- after:
+		assert.Equal(t, startTime.Add(2 * time.Second), fireTime)
+	default:
+		t.FailNow()
+	}
+	assert.Equal(t, 1, clock.TimerCount())
+
+	clock.Advance(time.Minute)
+	select {
+	case <- timer.C():
+	default:
+		t.FailNow()
+	}
+	assert.Equal(t, false, timer.Stop())
+	assert.Equal(t, 0, clock.TimerCount())
+	assert.Equal(t, startTime.Add(2 * time.Second + time.Minute), clock.Now())
+}
+
+
+func TestClientFakeClockResend(t *testing.T) {
+	// with a fake clock, an unacked message is resent only when the clock advances past the resend interval
+
+	timeout := 5 * time.Second
+	resendInterval := time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := NewFakeClock(time.Now())
+
+	settings := DefaultClientSettings()
+	settings.Clock = clock
+	settings.SendBufferSettings.ResendInterval = resendInterval
+	settings.SendBufferSettings.ResendJitterFraction = 0
+	settings.SendBufferSettings.AckTimeout = 10 * resendInterval
+	settings.SendBufferSettings.IdleTimeout = 10 * resendInterval
+
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	// nothing acks on the other end
+	bReceive := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	bId := NewId()
+	a.ContractManager().AddNoContractPeer(bId)
+
+	acks := make(chan error, 1)
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		bId,
+		func(err error) {
+			acks <- err
+		},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	select {
+	case <- bReceive:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// real time passing does not resend
+	select {
+	case <- bReceive:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+
+	// advance in steps until the sequence has waited out the resend interval
+	// the sequence may not have started its wait when the first step is taken
+	resent := false
+	for i := 0; i < 100 && !resent; i += 1 {
+		clock.Advance(resendInterval / 10)
+		select {
+		case <- bReceive:
+			resent = true
+		case <- time.After(50 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, true, resent)
+
+	// the ack timeout closes the sequence, which fails the message
+	ackError := false
+	for i := 0; i < 200 && !ackError; i += 1 {
+		clock.Advance(resendInterval)
+		select {
+		case err := <- acks:
+			assert.NotEqual(t, nil, err)
+			ackError = true
+		case <- time.After(50 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, true, ackError)
+}
+
+
+func TestClientFakeClockSuspend(t *testing.T) {
+	// a jump of the clock far past the ack timeout, as on wake from a suspend,
+	// restarts the ack timeout instead of closing the sequence
+
+	testClientFakeClockSuspend(t, true)
+	testClientFakeClockSuspend(t, false)
+}
+
+func testClientFakeClockSuspend(t *testing.T, detectSuspend bool) {
+	timeout := 5 * time.Second
+	ackTimeout := 10 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := NewFakeClock(time.Now())
+
+	settings := DefaultClientSettings()
+	settings.Clock = clock
+	if detectSuspend {
+		settings.SuspendThreshold = time.Minute
+	} else {
+		settings.SuspendThreshold = 0
+	}
+	settings.SendBufferSettings.ResendInterval = time.Second
+	settings.SendBufferSettings.ResendJitterFraction = 0
+	settings.SendBufferSettings.AckTimeout = ackTimeout
+	settings.SendBufferSettings.IdleTimeout = 10 * ackTimeout
+
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	// nothing acks on the other end
+	bReceive := make(chan []byte, 1024)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	bId := NewId()
+	a.ContractManager().AddNoContractPeer(bId)
+
+	acks := make(chan error, 1)
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		bId,
+		func(err error) {
+			acks <- err
+		},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	select {
+	case <- bReceive:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// let the sequence start its wait
+	select {
+	case <- acks:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+
+	// suspend
+	clock.Advance(time.Hour)
+
+	select {
+	case err := <- acks:
+		assert.NotEqual(t, nil, err)
+		if detectSuspend {
+			t.FailNow()
+		}
+		return
+	case <- time.After(200 * time.Millisecond):
+		if !detectSuspend {
+			t.FailNow()
+		}
+	}
+
+	// the ack timeout restarted from the wake
+	steps := 0
+	ackError := false
+	for i := 0; i < 100 && !ackError; i += 1 {
+		clock.Advance(ackTimeout / 10)
+		steps += 1
+		select {
+		case err := <- acks:
+			assert.NotEqual(t, nil, err)
+			ackError = true
+		case <- time.After(50 * time.Millisecond):
+		}
+	}
+	assert.Equal(t, true, ackError)
+	assert.Equal(t, true, 5 <= steps)
+}
@@ -0,0 +1,75 @@
+package connect
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"bringyour.com/protocol"
+)
+
+
+// frame payload compression, negotiated end to end with the `Pack.compressed` flag
+// the message bytes of each frame in the pack are compressed independently,
+// and the receiver decompresses before the receive callback
+
+
+// compresses the message bytes of the frame
+// returns the original frame and false if the message is smaller than `minByteCount`,
+// or if compression would not reduce the size
+func compressFrame(frame *protocol.Frame, minByteCount ByteCount) (*protocol.Frame, bool) {
+	if ByteCount(len(frame.MessageBytes)) < minByteCount {
+		return frame, false
+	}
+
+	b := &bytes.Buffer{}
+	w, err := flate.NewWriter(b, flate.BestSpeed)
+	if err != nil {
+		return frame, false
+	}
+	if _, err := w.Write(frame.MessageBytes); err != nil {
+		return frame, false
+	}
+	if err := w.Close(); err != nil {
+		return frame, false
+	}
+
+	if len(frame.MessageBytes) <= b.Len() {
+		// incompressible
+		return frame, false
+	}
+
+	compressedFrame := &protocol.Frame{
+		MessageType: frame.MessageType,
+		MessageBytes: b.Bytes(),
+	}
+	return compressedFrame, true
+}
+
+
+// decompresses the message bytes of each frame
+// returns an error if the total decompressed size exceeds `maxByteCount`,
+// so that a small compressed pack cannot expand without bound
+func decompressFrames(frames []*protocol.Frame, maxByteCount ByteCount) ([]*protocol.Frame, error) {
+	decompressedFrames := make([]*protocol.Frame, 0, len(frames))
+	remainingByteCount := maxByteCount
+	for _, frame := range frames {
+		r := flate.NewReader(bytes.NewReader(frame.MessageBytes))
+		// read one byte past the limit to detect overflow
+		messageBytes, err := io.ReadAll(io.LimitReader(r, int64(remainingByteCount) + 1))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if remainingByteCount < ByteCount(len(messageBytes)) {
+			return nil, errors.New("Decompressed size exceeds the limit.")
+		}
+		remainingByteCount -= ByteCount(len(messageBytes))
+		decompressedFrames = append(decompressedFrames, &protocol.Frame{
+			MessageType: frame.MessageType,
+			MessageBytes: messageBytes,
+		})
+	}
+	return decompressedFrames, nil
+}
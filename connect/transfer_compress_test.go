@@ -0,0 +1,187 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+	"strings"
+	"bytes"
+	mathrand "math/rand"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestCompressFrameRoundTrip(t *testing.T) {
+	minByteCount := ByteCount(256)
+
+	content := strings.Repeat(`{"message": "hello", "count": 1234}`, 1024)
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: content,
+	})
+
+	compressedFrame, compressed := compressFrame(frame, minByteCount)
+	assert.Equal(t, true, compressed)
+	assert.Equal(t, frame.MessageType, compressedFrame.MessageType)
+	assert.Equal(t, true, len(compressedFrame.MessageBytes) < len(frame.MessageBytes))
+
+	frames, err := decompressFrames([]*protocol.Frame{compressedFrame}, mib(1))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, frame.MessageType, frames[0].MessageType)
+	assert.Equal(t, true, bytes.Equal(frame.MessageBytes, frames[0].MessageBytes))
+
+	message := RequireFromFrame(frames[0]).(*protocol.SimpleMessage)
+	assert.Equal(t, content, message.Content)
+}
+
+
+func TestCompressFrameSkip(t *testing.T) {
+	minByteCount := ByteCount(256)
+
+	// small
+	smallFrame := &protocol.Frame{
+		MessageType: protocol.MessageType_TestSimpleMessage,
+		MessageBytes: bytes.Repeat([]byte{0}, int(minByteCount) - 1),
+	}
+	frame, compressed := compressFrame(smallFrame, minByteCount)
+	assert.Equal(t, false, compressed)
+	assert.Equal(t, smallFrame, frame)
+
+	// incompressible
+	for i := 0; i < 16; i += 1 {
+		messageBytes := make([]byte, 1024 * (i + 1))
+		mathrand.Read(messageBytes)
+		randomFrame := &protocol.Frame{
+			MessageType: protocol.MessageType_TestSimpleMessage,
+			MessageBytes: messageBytes,
+		}
+		frame, compressed := compressFrame(randomFrame, minByteCount)
+		assert.Equal(t, false, compressed)
+		assert.Equal(t, randomFrame, frame)
+		assert.Equal(t, len(messageBytes), len(frame.MessageBytes))
+	}
+}
+
+
+func TestDecompressFramesLimit(t *testing.T) {
+	minByteCount := ByteCount(256)
+
+	frame := &protocol.Frame{
+		MessageType: protocol.MessageType_TestSimpleMessage,
+		MessageBytes: bytes.Repeat([]byte{0}, int(kib(64))),
+	}
+	compressedFrame, compressed := compressFrame(frame, minByteCount)
+	assert.Equal(t, true, compressed)
+
+	// exactly at the limit
+	frames, err := decompressFrames([]*protocol.Frame{compressedFrame}, kib(64))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, true, bytes.Equal(frame.MessageBytes, frames[0].MessageBytes))
+
+	// one byte over the limit
+	_, err = decompressFrames([]*protocol.Frame{compressedFrame}, kib(64) - 1)
+	assert.NotEqual(t, nil, err)
+
+	// the limit applies to the total of all frames in the pack
+	_, err = decompressFrames([]*protocol.Frame{compressedFrame, compressedFrame}, kib(127))
+	assert.NotEqual(t, nil, err)
+	frames, err = decompressFrames([]*protocol.Frame{compressedFrame, compressedFrame}, kib(128))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(frames))
+}
+
+
+func TestCompressedPackOverLimit(t *testing.T) {
+	// a compressed pack that decompresses past the limit is dropped and the peer is audited
+	// a compressed pack within the limit on the same route is still received
+
+	timeout := 5 * time.Second
+	maxByteCount := kib(64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &peerAuditOob{
+		peerAudits: make(chan *protocol.PeerAudit, 16),
+	}
+
+	settings := DefaultClientSettings()
+	settings.MaxDecompressedByteCount = maxByteCount
+	b := NewClient(ctx, bClientId, oob, settings)
+	defer b.Cancel()
+
+	b.ContractManager().AddNoContractPeer(aClientId)
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+
+	receives := make(chan string, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			if message, ok := RequireFromFrame(frame).(*protocol.SimpleMessage); ok {
+				receives <- message.Content
+			}
+		}
+	})
+
+	sequenceId := NewId()
+	sendPack := func(sequenceNumber uint64, content string) {
+		frame, compressed := compressFrame(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: content,
+			}),
+			settings.CompressMinByteCount,
+		)
+		assert.Equal(t, true, compressed)
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: sequenceNumber,
+			Head: (sequenceNumber == 0),
+			Frames: []*protocol.Frame{frame},
+			Compressed: true,
+		}
+		select {
+		case bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// a few kib on the wire that expands to 4mib
+	sendPack(0, strings.Repeat("a", int(mib(4))))
+
+	select {
+	case peerAudit := <- oob.peerAudits:
+		auditPeerId, err := IdFromBytes(peerAudit.PeerId)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, aClientId, auditPeerId)
+		assert.Equal(t, uint64(1), peerAudit.BadMessageCount)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	content := strings.Repeat("b", int(kib(4)))
+	sendPack(0, content)
+
+	select {
+	case receiveContent := <- receives:
+		assert.Equal(t, content, receiveContent)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case <- receives:
+		// the over limit pack must not be received
+		t.FailNow()
+	default:
+	}
+}
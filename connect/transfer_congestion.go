@@ -0,0 +1,54 @@
+package connect
+
+import (
+	"time"
+)
+
+
+// Controls the byte budget of the resend queue of a send sequence.
+// A send sequence does not queue new messages while the resend queue is at or over the window,
+// except that one item is always allowed.
+// Each send sequence has its own controller, created with `SendBufferSettings.CongestionControllerGenerator`.
+// The controller is only called from the send sequence goroutine.
+
+
+type CongestionController interface {
+	// a cumulative ack was received
+	// rtt is the round trip time of the acked item, or 0 if the item was resent
+	// since the sample is ambiguous
+	OnAck(rtt time.Duration)
+	// an item was resent after its resend timeout
+	OnLoss()
+	// the max byte count of the resend queue
+	WindowByteCount() ByteCount
+}
+
+
+type CongestionControllerGenerator func(sendBufferSettings *SendBufferSettings) CongestionController
+
+
+func DefaultCongestionControllerGenerator(sendBufferSettings *SendBufferSettings) CongestionController {
+	return NewFixedWindowController(sendBufferSettings.ResendQueueMaxByteCount)
+}
+
+
+// a constant window that ignores acks and loss
+type FixedWindowController struct {
+	windowByteCount ByteCount
+}
+
+func NewFixedWindowController(windowByteCount ByteCount) *FixedWindowController {
+	return &FixedWindowController{
+		windowByteCount: windowByteCount,
+	}
+}
+
+func (self *FixedWindowController) OnAck(rtt time.Duration) {
+}
+
+func (self *FixedWindowController) OnLoss() {
+}
+
+func (self *FixedWindowController) WindowByteCount() ByteCount {
+	return self.windowByteCount
+}
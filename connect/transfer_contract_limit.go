@@ -0,0 +1,178 @@
+package connect
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+
+// Limits the open send and receive contracts across all sequences of a client.
+// When the limit is exceeded, the sequence holding the least recently used contract is closed,
+// which closes its contracts. Closed receive sequences checkpoint their contract,
+// so the sender can resume with a new receive sequence.
+// Enable by setting `ClientSettings.MaxOpenContracts`.
+
+
+// send is true for send contracts, where the peer is the destination
+type ContractEvictFunction = func(contractId Id, peerId Id, send bool)
+
+
+type openContract struct {
+	contractId Id
+	peerId Id
+	send bool
+	// the sequence that holds the contract
+	owner any
+	evict func()
+}
+
+
+type openContractLimit struct {
+	clientTag string
+	maxOpenContracts int
+	evictCallbacks *CallbackList[ContractEvictFunction]
+
+	mutex sync.Mutex
+	// contract id -> element in `openContractOrder`
+	openContracts map[Id]*list.Element
+	// `*openContract` in order of last use, least recently used first
+	openContractOrder *list.List
+	// owner -> contract ids of the owner, so that all contracts of the owner evict together
+	ownerContractIds map[any]map[Id]bool
+}
+
+func newOpenContractLimit(
+	clientTag string,
+	maxOpenContracts int,
+	evictCallbacks *CallbackList[ContractEvictFunction],
+) *openContractLimit {
+	return &openContractLimit{
+		clientTag: clientTag,
+		maxOpenContracts: maxOpenContracts,
+		evictCallbacks: evictCallbacks,
+		openContracts: map[Id]*list.Element{},
+		openContractOrder: list.New(),
+		ownerContractIds: map[any]map[Id]bool{},
+	}
+}
+
+func (self *openContractLimit) enabled() bool {
+	return 0 < self.maxOpenContracts
+}
+
+// `evict` must close the owner without blocking
+func (self *openContractLimit) open(contractId Id, peerId Id, send bool, owner any, evict func()) {
+	if !self.enabled() {
+		return
+	}
+
+	evictContracts := func()([]*openContract) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		if _, ok := self.openContracts[contractId]; ok {
+			return nil
+		}
+		self.openContracts[contractId] = self.openContractOrder.PushBack(&openContract{
+			contractId: contractId,
+			peerId: peerId,
+			send: send,
+			owner: owner,
+			evict: evict,
+		})
+		contractIds, ok := self.ownerContractIds[owner]
+		if !ok {
+			contractIds = map[Id]bool{}
+			self.ownerContractIds[owner] = contractIds
+		}
+		contractIds[contractId] = true
+
+		evictContracts := []*openContract{}
+		for self.maxOpenContracts < len(self.openContracts) {
+			// least recently used, not held by the owner of the new contract
+			var evictContract *openContract
+			for element := self.openContractOrder.Front(); element != nil; element = element.Next() {
+				if openContract := element.Value.(*openContract); openContract.owner != owner {
+					evictContract = openContract
+					break
+				}
+			}
+			if evictContract == nil {
+				glog.Infof("[c]%s open contracts over limit %d/%d, nothing to evict\n", self.clientTag, len(self.openContracts), self.maxOpenContracts)
+				break
+			}
+			// all contracts of the owner close together
+			// the evicted contracts are removed now, and the later close of each contract does nothing
+			for evictContractId, _ := range self.ownerContractIds[evictContract.owner] {
+				if element, ok := self.openContracts[evictContractId]; ok {
+					evictContracts = append(evictContracts, element.Value.(*openContract))
+				}
+				self.remove(evictContractId)
+			}
+		}
+		return evictContracts
+	}()
+
+	evictedOwners := map[any]bool{}
+	for _, evictContract := range evictContracts {
+		glog.V(1).Infof("[c]%s evict contract %s (send=%t peer=%s)\n", self.clientTag, evictContract.contractId, evictContract.send, evictContract.peerId)
+		if !evictedOwners[evictContract.owner] {
+			evictedOwners[evictContract.owner] = true
+			evictContract.evict()
+		}
+		for _, evictCallback := range self.evictCallbacks.Get() {
+			HandleError(func() {
+				evictCallback(evictContract.contractId, evictContract.peerId, evictContract.send)
+			})
+		}
+	}
+}
+
+func (self *openContractLimit) touch(contractId Id) {
+	if !self.enabled() {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if element, ok := self.openContracts[contractId]; ok {
+		self.openContractOrder.MoveToBack(element)
+	}
+}
+
+func (self *openContractLimit) close(contractId Id) {
+	if !self.enabled() {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.remove(contractId)
+}
+
+// must be called with the mutex
+func (self *openContractLimit) remove(contractId Id) {
+	element, ok := self.openContracts[contractId]
+	if !ok {
+		return
+	}
+	openContract := self.openContractOrder.Remove(element).(*openContract)
+	delete(self.openContracts, contractId)
+	if contractIds, ok := self.ownerContractIds[openContract.owner]; ok {
+		delete(contractIds, contractId)
+		if len(contractIds) == 0 {
+			delete(self.ownerContractIds, openContract.owner)
+		}
+	}
+}
+
+func (self *openContractLimit) OpenContractCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.openContracts)
+}
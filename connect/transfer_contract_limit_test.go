@@ -0,0 +1,251 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+type contractEviction struct {
+	contractId Id
+	peerId Id
+	send bool
+}
+
+
+// responds to each contract request with a new contract
+type contractClientOob struct {
+	clientId Id
+}
+
+func (self *contractClientOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	resultFrames := []*protocol.Frame{}
+	for _, frame := range frames {
+		if createContract, ok := RequireFromFrame(frame).(*protocol.CreateContract); ok {
+			destinationId, err := IdFromBytes(createContract.DestinationId)
+			if err != nil {
+				panic(err)
+			}
+			resultFrames = append(resultFrames, RequireToFrame(&protocol.CreateContractResult{
+				Contract: requireContract(
+					protocol.ProvideMode_Network,
+					[]byte("test"),
+					self.clientId,
+					destinationId,
+				),
+			}))
+		}
+	}
+	go callback(resultFrames, nil)
+}
+
+
+func TestMaxOpenReceiveContracts(t *testing.T) {
+	// receive contracts from more sources than the limit
+	// the least recently used receive sequences are evicted and their contracts checkpointed
+
+	timeout := 5 * time.Second
+	maxOpenContracts := 2
+	n := 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.MaxOpenContracts = maxOpenContracts
+
+	bClientId := NewId()
+	b := NewClient(ctx, bClientId, NewNoContractClientOob(), settings)
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+	})
+	provideSecretKey, ok := b.ContractManager().GetProvideSecretKey(protocol.ProvideMode_Network)
+	assert.Equal(t, true, ok)
+
+	evictions := make(chan *contractEviction, 16)
+	b.AddContractEvictCallback(func(contractId Id, peerId Id, send bool) {
+		evictions <- &contractEviction{
+			contractId: contractId,
+			peerId: peerId,
+			send: send,
+		}
+	})
+
+	receives := make(chan Id, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		receives <- sourceId
+	})
+
+	sourceIds := []Id{}
+	for i := 0; i < n; i += 1 {
+		sourceId := NewId()
+		sourceIds = append(sourceIds, sourceId)
+
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: NewId().Bytes(),
+			SequenceNumber: 0,
+			Head: true,
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: "hi",
+				}),
+			},
+			ContractFrame: RequireToFrame(requireContract(
+				protocol.ProvideMode_Network,
+				provideSecretKey,
+				sourceId,
+				bClientId,
+			)),
+		}
+		bReceive <- requireTransferFrameBytes(RequireToFrame(pack), sourceId, bClientId)
+
+		select {
+		case receiveSourceId := <- receives:
+			assert.Equal(t, sourceId, receiveSourceId)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	for i := 0; i < n - maxOpenContracts; i += 1 {
+		select {
+		case eviction := <- evictions:
+			assert.Equal(t, sourceIds[i], eviction.peerId)
+			assert.Equal(t, false, eviction.send)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	select {
+	case <- evictions:
+		t.FailNow()
+	default:
+	}
+
+	// the evicted contracts are removed from the limit at once
+	assert.Equal(t, maxOpenContracts, b.openContractLimit.OpenContractCount())
+
+	// the evicted receive sequences checkpoint their contracts as they close
+	endTime := time.Now().Add(timeout)
+	for len(b.ContractManager().ExportState().ReceiveContractCheckpoints) < n - maxOpenContracts && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state := b.ContractManager().ExportState()
+	checkpointSourceIds := map[Id]bool{}
+	for _, receiveContractCheckpoint := range state.ReceiveContractCheckpoints {
+		checkpointSourceIds[receiveContractCheckpoint.SourceId] = true
+	}
+	assert.Equal(t, map[Id]bool{
+		sourceIds[0]: true,
+		sourceIds[1]: true,
+	}, checkpointSourceIds)
+}
+
+
+func TestMaxOpenSendContracts(t *testing.T) {
+	// send to more destinations than the limit
+	// the least recently used send sequences are evicted and their pending sends fail
+
+	timeout := 5 * time.Second
+	maxOpenContracts := 2
+	n := 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.MaxOpenContracts = maxOpenContracts
+
+	aClientId := NewId()
+	a := NewClient(ctx, aClientId, &contractClientOob{clientId: aClientId}, settings)
+	defer a.Cancel()
+
+	evictions := make(chan *contractEviction, 16)
+	a.AddContractEvictCallback(func(contractId Id, peerId Id, send bool) {
+		evictions <- &contractEviction{
+			contractId: contractId,
+			peerId: peerId,
+			send: send,
+		}
+	})
+
+	destinationIds := []Id{}
+	acks := map[Id]chan error{}
+	for i := 0; i < n; i += 1 {
+		destinationId := NewId()
+		destinationIds = append(destinationIds, destinationId)
+		ack := make(chan error, 1)
+		acks[destinationId] = ack
+
+		// there is no route, so the message is not acked
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+			destinationId,
+			func(err error) {
+				ack <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+
+		// wait for the contract to open
+		endTime := time.Now().Add(timeout)
+		for b := false; !b; {
+			if time.Now().After(endTime) {
+				t.FailNow()
+			}
+			func() {
+				a.openContractLimit.mutex.Lock()
+				defer a.openContractLimit.mutex.Unlock()
+				for _, element := range a.openContractLimit.openContracts {
+					if element.Value.(*openContract).peerId == destinationId {
+						b = true
+					}
+				}
+			}()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	select {
+	case eviction := <- evictions:
+		assert.Equal(t, destinationIds[0], eviction.peerId)
+		assert.Equal(t, true, eviction.send)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case err := <- acks[destinationIds[0]]:
+		assert.NotEqual(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	endTime := time.Now().Add(timeout)
+	for maxOpenContracts < a.openContractLimit.OpenContractCount() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, maxOpenContracts, a.openContractLimit.OpenContractCount())
+
+	for _, destinationId := range destinationIds[1:] {
+		select {
+		case <- acks[destinationId]:
+			t.FailNow()
+		default:
+		}
+	}
+}
@@ -2,6 +2,7 @@ package connect
 
 import (
 	"context"
+	"container/list"
 	"time"
 	"sync"
 	// "errors"
@@ -9,7 +10,7 @@ import (
 	"crypto/sha256"
 	"crypto/rand"
 	"fmt"
-	// "slices"
+	"slices"
 	// "runtime/debug"
 
 	"golang.org/x/exp/maps"
@@ -28,6 +29,75 @@ import (
 type ContractErrorFunction = func(contractError protocol.ContractError)
 
 
+// a contract error that will not be resolved by retrying the request,
+// e.g. the account has insufficient balance
+type DefinitiveContractError struct {
+	ContractError protocol.ContractError
+}
+
+func (self *DefinitiveContractError) Error() string {
+	return fmt.Sprintf("Contract error: %s", self.ContractError)
+}
+
+
+func IsDefinitiveContractError(contractError protocol.ContractError) bool {
+	switch contractError {
+	case protocol.ContractError_NoPermission, protocol.ContractError_InsufficientBalance:
+		return true
+	default:
+		// `Setup` is a transient platform error
+		return false
+	}
+}
+
+// contract lifecycle events, for observability of contract churn and utilization
+// utilization of a send contract is `AckedByteCount / TransferByteCount` on close
+// note acked byte counts include the `MinMessageByteCount` rounding of small messages
+const (
+	// a contract was taken for a send sequence
+	ContractEventTake = "take"
+	// a contract was requested from the platform. There is no contract id yet
+	ContractEventCreate = "create"
+	ContractEventClose = "close"
+	ContractEventCheckpoint = "checkpoint"
+)
+
+type ContractEvent struct {
+	EventType string
+	// zero for `ContractEventCreate`
+	ContractId Id
+	// zero for a close or checkpoint of a contract not opened by this contract manager,
+	// e.g. a receive contract
+	DestinationId Id
+	// the contract size, or the requested size for `ContractEventCreate`
+	// zero when the destination is zero
+	TransferByteCount ByteCount
+	// set for `ContractEventClose` and `ContractEventCheckpoint`
+	AckedByteCount ByteCount
+	UnackedByteCount ByteCount
+}
+
+type ContractEventFunction = func(contractEvent *ContractEvent)
+
+// the requested and granted size of a contract, reported when the contract is taken for a send sequence
+// the platform may grant a smaller contract than requested, which rotates contracts more often.
+// Granted sizes that are consistently smaller than requested indicate a plan or policy limit
+type ContractSizeResult struct {
+	ContractId Id
+	DestinationId Id
+	RequestedTransferByteCount ByteCount
+	// the granted size
+	TransferByteCount ByteCount
+}
+
+type ContractSizeResultFunction = func(contractSizeResult *ContractSizeResult)
+
+
+// called when a received contract fails verification
+// a spike in failures may be a misconfigured provide secret or an attack
+type VerifyFailureFunction = func(source TransferPath, provideMode protocol.ProvideMode)
+
+
 type ContractManagerStats struct {
 	ContractOpenCount int64
 	ContractCloseCount int64
@@ -68,8 +138,17 @@ func DefaultContractManagerSettings() *ContractManagerSettings {
 	}
 	return &ContractManagerSettings{
 		StandardContractTransferByteCount: mib(32),
+		// only standard contracts
+		MaxContractTransferByteCount: 0,
 
 		NetworkEventTimeEnableContracts: networkEventTimeEnableContracts,
+
+		// report only on close
+		UsageReportInterval: 0,
+
+		// a sender resumes soon after a receive sequence closes, e.g. after a reconnect
+		ReceiveContractCheckpointTimeout: 30 * time.Minute,
+		MaxReceiveContractCheckpoints: 1024,
 	}
 }
 
@@ -82,10 +161,25 @@ func DefaultContractManagerSettingsNoNetworkEvents() *ContractManagerSettings {
 
 type ContractManagerSettings struct {
 	StandardContractTransferByteCount ByteCount
+	// a message that does not fit in a standard contract requests a contract sized to fit the message,
+	// up to this byte count. Larger messages fail the send.
+	// 0 or less than the standard byte count allows only standard contracts
+	MaxContractTransferByteCount ByteCount
 
 	// enable contracts on the network
 	// this can be removed after wide adoption
 	NetworkEventTimeEnableContracts time.Time
+
+	// when set, the acked byte counts of open contracts are checkpointed to the platform on this interval,
+	// in addition to the report when the contract closes. Each report is cumulative for the contract.
+	// Only contracts with new acked bytes since the last report are reported.
+	// 0 disables periodic reports
+	UsageReportInterval time.Duration
+
+	// receive contract checkpoints older than this are dropped, and the sender starts a new contract
+	ReceiveContractCheckpointTimeout time.Duration
+	// the oldest receive contract checkpoints are dropped over this count
+	MaxReceiveContractCheckpoints int
 }
 
 func (self *ContractManagerSettings) ContractsEnabled() bool {
@@ -105,11 +199,34 @@ type ContractManager struct {
 
 	destinationContracts map[Id]*contractQueue
 	sourceContracts map[Id]bool
+	// when quiesced, contracts are refused from sources without an open contract
+	quiesced bool
 	
 	receiveNoContractClientIds map[Id]bool
 	sendNoContractClientIds map[Id]bool
 
 	contractErrorCallbacks *CallbackList[ContractErrorFunction]
+	contractEventCallbacks *CallbackList[ContractEventFunction]
+	contractSizeResultCallbacks *CallbackList[ContractSizeResultFunction]
+
+	verifyFailureCallback VerifyFailureFunction
+
+	// the last checkpointed receive contract per source
+	// source id -> element of `receiveContractCheckpointOrder`
+	receiveContractCheckpoints map[Id]*list.Element
+	// `*ReceiveContractCheckpoint` ordered by checkpoint time, oldest first
+	receiveContractCheckpointOrder *list.List
+
+	// contract id -> usage since open, for periodic usage reports
+	contractUsages map[Id]*contractUsage
+
+	// contract id -> requested transfer byte count, until the contract is taken or completed
+	// see `ContractSizeResult`
+	contractRequestedByteCounts map[Id]ByteCount
+
+	// destination ids with an outstanding prewarm contract request
+	// see `PrewarmContract`
+	prewarmDestinationIds map[Id]bool
 
 	localStats *ContractManagerStats
 }
@@ -146,9 +263,20 @@ func NewContractManager(
 		receiveNoContractClientIds: receiveNoContractClientIds,
 		sendNoContractClientIds: sendNoContractClientIds,
 		contractErrorCallbacks: NewCallbackList[ContractErrorFunction](),
+		contractEventCallbacks: NewCallbackList[ContractEventFunction](),
+		contractSizeResultCallbacks: NewCallbackList[ContractSizeResultFunction](),
+		receiveContractCheckpoints: map[Id]*list.Element{},
+		receiveContractCheckpointOrder: list.New(),
+		contractUsages: map[Id]*contractUsage{},
+		contractRequestedByteCounts: map[Id]ByteCount{},
+		prewarmDestinationIds: map[Id]bool{},
 		localStats: NewContractManagerStats(),
 	}
 
+	if 0 < settings.UsageReportInterval {
+		go HandleError(contractManager.runUsageReport)
+	}
+
 	return contractManager
 }
 
@@ -156,6 +284,10 @@ func (self *ContractManager) StandardContractTransferByteCount() ByteCount {
 	return self.settings.StandardContractTransferByteCount
 }
 
+func (self *ContractManager) MaxContractTransferByteCount() ByteCount {
+	return max(self.settings.StandardContractTransferByteCount, self.settings.MaxContractTransferByteCount)
+}
+
 func (self *ContractManager) addContractErrorCallback(contractErrorCallback ContractErrorFunction) func() {
 	callbackId := self.contractErrorCallbacks.Add(contractErrorCallback)
 	return func() {
@@ -163,6 +295,63 @@ func (self *ContractManager) addContractErrorCallback(contractErrorCallback Cont
 	}
 }
 
+func (self *ContractManager) AddContractEventCallback(contractEventCallback ContractEventFunction) func() {
+	callbackId := self.contractEventCallbacks.Add(contractEventCallback)
+	return func() {
+		self.contractEventCallbacks.Remove(callbackId)
+	}
+}
+
+// ContractEventFunction
+func (self *ContractManager) contractEvent(contractEvent *ContractEvent) {
+	for _, contractEventCallback := range self.contractEventCallbacks.Get() {
+		HandleError(func() {
+			contractEventCallback(contractEvent)
+		})
+	}
+}
+
+func (self *ContractManager) AddContractSizeResultCallback(contractSizeResultCallback ContractSizeResultFunction) func() {
+	callbackId := self.contractSizeResultCallbacks.Add(contractSizeResultCallback)
+	return func() {
+		self.contractSizeResultCallbacks.Remove(callbackId)
+	}
+}
+
+// ContractSizeResultFunction
+func (self *ContractManager) contractSizeResult(contractSizeResult *ContractSizeResult) {
+	for _, contractSizeResultCallback := range self.contractSizeResultCallbacks.Get() {
+		HandleError(func() {
+			contractSizeResultCallback(contractSizeResult)
+		})
+	}
+}
+
+// remembers the requested size of contracts returned for a contract request
+func (self *ContractManager) setContractRequestedByteCounts(contracts []*protocol.Contract, requestedByteCount ByteCount) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, contract := range contracts {
+		var storedContract protocol.StoredContract
+		if err := proto.Unmarshal(contract.StoredContractBytes, &storedContract); err != nil {
+			continue
+		}
+		if contractId, err := IdFromBytes(storedContract.ContractId); err == nil {
+			self.contractRequestedByteCounts[contractId] = requestedByteCount
+		}
+	}
+}
+
+func (self *ContractManager) removeContractRequestedByteCount(contractId Id) (ByteCount, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	requestedByteCount, ok := self.contractRequestedByteCounts[contractId]
+	delete(self.contractRequestedByteCounts, contractId)
+	return requestedByteCount, ok
+}
+
 // ReceiveFunction
 func (self *ContractManager) Receive(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
 	switch sourceId {
@@ -309,6 +498,26 @@ func (self *ContractManager) Verify(storedContractHmac []byte, storedContractByt
 	return hmac.Equal(storedContractHmac, expectedHmac)
 }
 
+func (self *ContractManager) SetVerifyFailureCallback(verifyFailureCallback VerifyFailureFunction) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.verifyFailureCallback = verifyFailureCallback
+}
+
+// VerifyFailureFunction
+func (self *ContractManager) verifyFailure(source TransferPath, provideMode protocol.ProvideMode) {
+	self.mutex.Lock()
+	verifyFailureCallback := self.verifyFailureCallback
+	self.mutex.Unlock()
+
+	if verifyFailureCallback != nil {
+		HandleError(func() {
+			verifyFailureCallback(source, provideMode)
+		})
+	}
+}
+
 func (self *ContractManager) GetProvideSecretKey(provideMode protocol.ProvideMode) ([]byte, bool) {
 	provideSecretKey, ok := self.provideSecretKeys[provideMode]
 	return provideSecretKey, ok
@@ -381,47 +590,135 @@ func (self *ContractManager) CloseSourceContract(sourceId Id) {
 	delete(self.sourceContracts, sourceId)
 }
 
+// refuses contracts from new sources, for maintenance
+// sources with an open contract may continue to rotate contracts
+func (self *ContractManager) Quiesce() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.quiesced = true
+}
+
+func (self *ContractManager) IsQuiesced() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.quiesced
+}
+
+// false if quiesced and the source does not have an open contract
+func (self *ContractManager) allowSourceContract(sourceId Id) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return !self.quiesced || self.sourceContracts[sourceId]
+}
+
+// true if a receive sequence from the source has an open contract
+// a companion contract to the source requires this
+func (self *ContractManager) HasSourceContract(sourceId Id) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.sourceContracts[sourceId]
+}
+
 func (self *ContractManager) TakeContract(ctx context.Context, destinationId Id, timeout time.Duration) *protocol.Contract {
+	contract, _ := self.TakeContractDetailed(ctx, destinationId, timeout)
+	return contract
+}
+
+// returns a `*DefinitiveContractError` if the last contract request for the destination failed definitively
+func (self *ContractManager) TakeContractDetailed(ctx context.Context, destinationId Id, timeout time.Duration) (*protocol.Contract, error) {
+	return self.TakeContractWithSize(ctx, destinationId, 0, timeout)
+}
+
+// takes a contract with at least `minTransferByteCount`. Smaller contracts are left in the queue
+// see `CreateContractWithSize`
+func (self *ContractManager) TakeContractWithSize(
+	ctx context.Context,
+	destinationId Id,
+	minTransferByteCount ByteCount,
+	timeout time.Duration,
+) (*protocol.Contract, error) {
 	contractQueue := self.openContractQueue(destinationId)
 	defer self.closeContractQueue(destinationId)
 
 	enterTime := time.Now()
 	for {
 		notify := contractQueue.updateMonitor.NotifyChannel()
-		contract := contractQueue.Poll()
+		contract := contractQueue.PollWithMinByteCount(minTransferByteCount)
 
 		if contract != nil {
-			return contract
+			var storedContract protocol.StoredContract
+			if err := proto.Unmarshal(contract.StoredContractBytes, &storedContract); err == nil {
+				if contractId, err := IdFromBytes(storedContract.ContractId); err == nil {
+					self.contractEvent(&ContractEvent{
+						EventType: ContractEventTake,
+						ContractId: contractId,
+						DestinationId: destinationId,
+						TransferByteCount: ByteCount(storedContract.TransferByteCount),
+					})
+					// contracts not requested by this contract manager have no requested size
+					if requestedByteCount, ok := self.removeContractRequestedByteCount(contractId); ok {
+						self.contractSizeResult(&ContractSizeResult{
+							ContractId: contractId,
+							DestinationId: destinationId,
+							RequestedTransferByteCount: requestedByteCount,
+							TransferByteCount: ByteCount(storedContract.TransferByteCount),
+						})
+					}
+				}
+			}
+			return contract, nil
+		}
+
+		if contractError, ok := contractQueue.ContractError(); ok {
+			return nil, &DefinitiveContractError{
+				ContractError: contractError,
+			}
 		}
 
 		if timeout < 0 {
 			select {
 			case <- self.ctx.Done():
-				return nil
+				return nil, nil
 			case <- ctx.Done():
-				return nil
+				return nil, nil
 			case <- notify:
 			}
 		} else if timeout == 0 {
-			return nil
+			return nil, nil
 		} else {
 			remainingTimeout := enterTime.Add(timeout).Sub(time.Now())
 			if remainingTimeout <= 0 {
-				return nil
+				return nil, nil
 			}
 			select {
 			case <- self.ctx.Done():
-				return nil
+				return nil, nil
 			case <- ctx.Done():
-				return nil
+				return nil, nil
 			case <- notify:
 			case <- time.After(remainingTimeout):
-				return nil
+				return nil, nil
 			}
 		}
 	}	
 }
 
+// the number of contracts queued for the destination that have not been taken
+func (self *ContractManager) QueuedContractCount(destinationId Id) int {
+	self.mutex.Lock()
+	contractQueue, ok := self.destinationContracts[destinationId]
+	self.mutex.Unlock()
+
+	if !ok {
+		return 0
+	}
+	return contractQueue.Len()
+}
+
 func (self *ContractManager) addContract(contract *protocol.Contract) error {
 	var storedContract protocol.StoredContract
 	err := proto.Unmarshal(contract.StoredContractBytes, &storedContract)
@@ -496,25 +793,114 @@ func (self *ContractManager) closeContractQueue(destinationId Id) {
 }
 
 func (self *ContractManager) CreateContract(destinationId Id, companionContract bool, timeout time.Duration) {
-	
+	self.CreateContractWithSize(
+		destinationId,
+		companionContract,
+		self.settings.StandardContractTransferByteCount,
+		timeout,
+	)
+}
+
+func (self *ContractManager) CreateContractWithSize(
+	destinationId Id,
+	companionContract bool,
+	transferByteCount ByteCount,
+	timeout time.Duration,
+) {
+	self.createContractWithSize(destinationId, companionContract, transferByteCount, timeout, nil)
+}
+
+// requests a contract for the destination into the contract queue,
+// unless a contract is already queued or a previous prewarm request is outstanding,
+// so that repeated calls before the first contract arrives do not each reserve balance
+// returns true if a contract was requested
+func (self *ContractManager) PrewarmContract(destinationId Id, timeout time.Duration) bool {
+	if 0 < self.QueuedContractCount(destinationId) {
+		return false
+	}
+
+	prewarm := func()(bool) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		if self.prewarmDestinationIds[destinationId] {
+			return false
+		}
+		self.prewarmDestinationIds[destinationId] = true
+		return true
+	}()
+	if !prewarm {
+		return false
+	}
+
+	self.createContractWithSize(
+		destinationId,
+		false,
+		self.settings.StandardContractTransferByteCount,
+		timeout,
+		func() {
+			self.mutex.Lock()
+			defer self.mutex.Unlock()
+
+			delete(self.prewarmDestinationIds, destinationId)
+		},
+	)
+	return true
+}
+
+// `resultCallback` is optional, and is called after the result contracts are queued
+func (self *ContractManager) createContractWithSize(
+	destinationId Id,
+	companionContract bool,
+	transferByteCount ByteCount,
+	timeout time.Duration,
+	resultCallback func(),
+) {
 	// look at destinationContracts and last contract to get previous contract id
 	contractQueue := self.openContractQueue(destinationId)
 	defer self.closeContractQueue(destinationId)
 
+	// a new request replaces the result of the previous request
+	contractQueue.ClearContractError()
+
 	createContract := &protocol.CreateContract{
 		DestinationId: destinationId.Bytes(),
-		TransferByteCount: uint64(self.settings.StandardContractTransferByteCount),
+		TransferByteCount: uint64(transferByteCount),
 		Companion: companionContract,
 		UsedContractIds: contractQueue.UsedContractIdBytes(),
 	}
+	self.contractEvent(&ContractEvent{
+		EventType: ContractEventCreate,
+		DestinationId: destinationId,
+		TransferByteCount: transferByteCount,
+	})
 	self.client.ClientOob().SendControl(
 		[]*protocol.Frame{RequireToFrame(createContract)},
 		func(resultFrames []*protocol.Frame, err error) {
 			if err == nil {
+				// set before the contracts are queued so that a take sees the requested size
+				contracts, contractErrors := parseControlContractFrames(resultFrames)
+				self.setContractRequestedByteCounts(contracts, transferByteCount)
+
 				self.Receive(ControlId, resultFrames, protocol.ProvideMode_Network)
+
+				// associate definitive errors with the destination so that waiting sends can fail fast
+				for _, contractError := range contractErrors {
+					if IsDefinitiveContractError(contractError) {
+						func() {
+							contractQueue := self.openContractQueue(destinationId)
+							defer self.closeContractQueue(destinationId)
+
+							contractQueue.SetContractError(contractError)
+						}()
+					}
+				}
 			} else {
 				glog.Warningf("[contract]oob err = %s\n", err)
 			}
+			if resultCallback != nil {
+				resultCallback()
+			}
 		},
 	)
 }
@@ -541,17 +927,25 @@ func (self *ContractManager) CompleteContractWithCheckpoint(
 	unackedByteCount ByteCount,
 	checkpoint bool,
 ) {
+	self.client.openContractLimit.close(contractId)
+
 	opened := false
 	var destinationId Id
+	var transferByteCount ByteCount
 
 	func() {
 		self.mutex.Lock()
 		defer self.mutex.Unlock()
 
-		if _, ok := self.localStats.ContractOpenByteCounts[contractId]; ok {
+		// the close report supersedes periodic usage reports
+		delete(self.contractUsages, contractId)
+		delete(self.contractRequestedByteCounts, contractId)
+
+		if contractOpenByteCount, ok := self.localStats.ContractOpenByteCounts[contractId]; ok {
 			// opened via the contract manager
 			opened = true
 			destinationId = self.localStats.ContractOpenDestinationIds[contractId]
+			transferByteCount = contractOpenByteCount
 			self.localStats.ContractCloseCount += 1
 			delete(self.localStats.ContractOpenByteCounts, contractId)
 			delete(self.localStats.ContractOpenDestinationIds, contractId)
@@ -561,6 +955,21 @@ func (self *ContractManager) CompleteContractWithCheckpoint(
 		}
 	}()
 
+	var eventType string
+	if checkpoint {
+		eventType = ContractEventCheckpoint
+	} else {
+		eventType = ContractEventClose
+	}
+	self.contractEvent(&ContractEvent{
+		EventType: eventType,
+		ContractId: contractId,
+		DestinationId: destinationId,
+		TransferByteCount: transferByteCount,
+		AckedByteCount: ackedByteCount,
+		UnackedByteCount: unackedByteCount,
+	})
+
 	closeContract := &protocol.CloseContract{
 		ContractId: contractId.Bytes(),
 		AckedByteCount: uint64(ackedByteCount),
@@ -582,6 +991,96 @@ func (self *ContractManager) CompleteContractWithCheckpoint(
 	)
 }
 
+// records the current byte counts of an open contract for the next usage report
+// this is a no-op unless `UsageReportInterval` is set
+func (self *ContractManager) updateContractUsage(
+	contractId Id,
+	ackedByteCount ByteCount,
+	unackedByteCount ByteCount,
+) {
+	if self.settings.UsageReportInterval <= 0 {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	usage, ok := self.contractUsages[contractId]
+	if !ok {
+		usage = &contractUsage{}
+		self.contractUsages[contractId] = usage
+	}
+	usage.ackedByteCount = ackedByteCount
+	usage.unackedByteCount = unackedByteCount
+}
+
+func (self *ContractManager) runUsageReport() {
+	for {
+		select {
+		case <- self.ctx.Done():
+			return
+		case <- time.After(self.settings.UsageReportInterval):
+		}
+
+		self.reportUsage()
+	}
+}
+
+// checkpoints the open contracts that have new acked bytes since the last report
+func (self *ContractManager) reportUsage() {
+	closeContracts, contractEvents := func()([]*protocol.CloseContract, []*ContractEvent) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		closeContracts := []*protocol.CloseContract{}
+		contractEvents := []*ContractEvent{}
+		for contractId, usage := range self.contractUsages {
+			if usage.ackedByteCount <= usage.reportedAckedByteCount {
+				continue
+			}
+			usage.reportedAckedByteCount = usage.ackedByteCount
+			closeContracts = append(closeContracts, &protocol.CloseContract{
+				ContractId: contractId.Bytes(),
+				AckedByteCount: uint64(usage.ackedByteCount),
+				UnackedByteCount: uint64(usage.unackedByteCount),
+				Checkpoint: true,
+			})
+			// the same event as `CheckpointContract`
+			contractEvents = append(contractEvents, &ContractEvent{
+				EventType: ContractEventCheckpoint,
+				ContractId: contractId,
+				DestinationId: self.localStats.ContractOpenDestinationIds[contractId],
+				TransferByteCount: self.localStats.ContractOpenByteCounts[contractId],
+				AckedByteCount: usage.ackedByteCount,
+				UnackedByteCount: usage.unackedByteCount,
+			})
+		}
+		return closeContracts, contractEvents
+	}()
+	if len(closeContracts) == 0 {
+		return
+	}
+
+	for _, contractEvent := range contractEvents {
+		self.contractEvent(contractEvent)
+	}
+
+	glog.V(2).Infof("[contract]usage report %d contracts\n", len(closeContracts))
+
+	frames := []*protocol.Frame{}
+	for _, closeContract := range closeContracts {
+		frames = append(frames, RequireToFrame(closeContract))
+	}
+	self.client.ClientOob().SendControl(
+		frames,
+		func(resultFrames []*protocol.Frame, err error) {
+			if err != nil {
+				glog.Infof("[contract]usage report err = %s\n", err)
+			}
+		},
+	)
+}
+
 func (self *ContractManager) LocalStats() *ContractManagerStats {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -645,14 +1144,162 @@ func (self *ContractManager) closeContracts(contracts []*protocol.Contract) []Id
 }
 
 
+// the state of a contract manager that can be restored into a new client with the same client id,
+// so that senders can resume checkpointed receive contracts after a restart
+type ContractManagerState struct {
+	ProvideSecretKeys map[protocol.ProvideMode][]byte
+	ReceiveContractCheckpoints []*ReceiveContractCheckpoint
+}
+
+
+type contractUsage struct {
+	ackedByteCount ByteCount
+	unackedByteCount ByteCount
+	reportedAckedByteCount ByteCount
+}
+
+
+// a receive contract checkpointed when the receive sequence closed
+type ReceiveContractCheckpoint struct {
+	SourceId Id
+	SequenceId Id
+	// the next sequence number expected from the sender
+	NextSequenceNumber uint64
+	Contract *protocol.Contract
+	// unacked bytes are not included since the sender will retransmit those messages
+	AckedByteCount ByteCount
+	// see `ContractManagerSettings.ReceiveContractCheckpointTimeout`
+	CheckpointTime time.Time
+}
+
+
+// call after the client sequences have closed to include all checkpointed receive contracts
+func (self *ContractManager) ExportState() *ContractManagerState {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	provideSecretKeys := map[protocol.ProvideMode][]byte{}
+	for provideMode, provideSecretKey := range self.provideSecretKeys {
+		provideSecretKeys[provideMode] = slices.Clone(provideSecretKey)
+	}
+
+	self.expireReceiveContractCheckpoints(time.Now())
+	receiveContractCheckpoints := []*ReceiveContractCheckpoint{}
+	for e := self.receiveContractCheckpointOrder.Front(); e != nil; e = e.Next() {
+		receiveContractCheckpoints = append(receiveContractCheckpoints, e.Value.(*ReceiveContractCheckpoint))
+	}
+
+	return &ContractManagerState{
+		ProvideSecretKeys: provideSecretKeys,
+		ReceiveContractCheckpoints: receiveContractCheckpoints,
+	}
+}
+
+// call before setting the provide modes so that the existing provide secret keys are kept
+func (self *ContractManager) ImportState(state *ContractManagerState) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for provideMode, provideSecretKey := range state.ProvideSecretKeys {
+		self.provideSecretKeys[provideMode] = slices.Clone(provideSecretKey)
+	}
+	importTime := time.Now()
+	for _, receiveContractCheckpoint := range state.ReceiveContractCheckpoints {
+		if receiveContractCheckpoint.CheckpointTime.IsZero() {
+			// the age is unknown. Start the timeout from the import
+			receiveContractCheckpoint.CheckpointTime = importTime
+		}
+		self.addReceiveContractCheckpoint(receiveContractCheckpoint)
+	}
+	self.expireReceiveContractCheckpoints(importTime)
+}
+
+func (self *ContractManager) checkpointReceiveContract(receiveContractCheckpoint *ReceiveContractCheckpoint) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	checkpointTime := time.Now()
+	receiveContractCheckpoint.CheckpointTime = checkpointTime
+	self.addReceiveContractCheckpoint(receiveContractCheckpoint)
+	self.expireReceiveContractCheckpoints(checkpointTime)
+}
+
+// must be called with the mutex
+// replaces the checkpoint for the source. Checkpoints are kept in order of checkpoint time
+func (self *ContractManager) addReceiveContractCheckpoint(receiveContractCheckpoint *ReceiveContractCheckpoint) {
+	if e, ok := self.receiveContractCheckpoints[receiveContractCheckpoint.SourceId]; ok {
+		self.receiveContractCheckpointOrder.Remove(e)
+	}
+	// find the position from the back, which is the common case
+	e := self.receiveContractCheckpointOrder.Back()
+	for e != nil && receiveContractCheckpoint.CheckpointTime.Before(e.Value.(*ReceiveContractCheckpoint).CheckpointTime) {
+		e = e.Prev()
+	}
+	if e == nil {
+		self.receiveContractCheckpoints[receiveContractCheckpoint.SourceId] = self.receiveContractCheckpointOrder.PushFront(receiveContractCheckpoint)
+	} else {
+		self.receiveContractCheckpoints[receiveContractCheckpoint.SourceId] = self.receiveContractCheckpointOrder.InsertAfter(receiveContractCheckpoint, e)
+	}
+}
+
+// must be called with the mutex
+// drops the oldest checkpoints past the timeout or over the max count
+func (self *ContractManager) expireReceiveContractCheckpoints(now time.Time) {
+	for e := self.receiveContractCheckpointOrder.Front(); e != nil; e = self.receiveContractCheckpointOrder.Front() {
+		receiveContractCheckpoint := e.Value.(*ReceiveContractCheckpoint)
+		expired := 0 < self.settings.ReceiveContractCheckpointTimeout &&
+			self.settings.ReceiveContractCheckpointTimeout <= now.Sub(receiveContractCheckpoint.CheckpointTime)
+		over := 0 < self.settings.MaxReceiveContractCheckpoints &&
+			self.settings.MaxReceiveContractCheckpoints < self.receiveContractCheckpointOrder.Len()
+		if !expired && !over {
+			return
+		}
+		self.receiveContractCheckpointOrder.Remove(e)
+		delete(self.receiveContractCheckpoints, receiveContractCheckpoint.SourceId)
+	}
+}
+
+// the number of receive contract checkpoints that have not been taken or expired
+func (self *ContractManager) receiveContractCheckpointCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.expireReceiveContractCheckpoints(time.Now())
+	return self.receiveContractCheckpointOrder.Len()
+}
+
+// removes the checkpoint for the source
+// returns the checkpoint only if it matches the sequence, since a new sequence from the source starts a new contract
+func (self *ContractManager) takeReceiveContractCheckpoint(sourceId Id, sequenceId Id) (*ReceiveContractCheckpoint, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.expireReceiveContractCheckpoints(time.Now())
+	e, ok := self.receiveContractCheckpoints[sourceId]
+	if !ok {
+		return nil, false
+	}
+	receiveContractCheckpoint := e.Value.(*ReceiveContractCheckpoint)
+	self.receiveContractCheckpointOrder.Remove(e)
+	delete(self.receiveContractCheckpoints, sourceId)
+	if receiveContractCheckpoint.SequenceId != sequenceId {
+		return nil, false
+	}
+	return receiveContractCheckpoint, true
+}
+
+
 type contractQueue struct {
 	updateMonitor *Monitor
 
 	mutex sync.Mutex
 	openCount int
 	contracts map[Id]*protocol.Contract
+	contractTransferByteCounts map[Id]ByteCount
 	// remember all added contract ids
 	usedContractIds map[Id]bool
+	// the definitive error of the last contract request, if any
+	contractError *protocol.ContractError
 }
 
 func newContractQueue() *contractQueue {
@@ -660,6 +1307,7 @@ func newContractQueue() *contractQueue {
 		updateMonitor: NewMonitor(),
 		openCount: 0,
 		contracts: map[Id]*protocol.Contract{},
+		contractTransferByteCounts: map[Id]ByteCount{},
 		usedContractIds: map[Id]bool{},
 	}
 }
@@ -679,19 +1327,23 @@ func (self *contractQueue) Close() {
 }
 
 func (self *contractQueue) Poll() *protocol.Contract {
+	return self.PollWithMinByteCount(0)
+}
+
+func (self *contractQueue) PollWithMinByteCount(minTransferByteCount ByteCount) *protocol.Contract {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 
-	if len(self.contracts) == 0 {
-		return nil
-	}
-
-	contractIds := maps.Keys(self.contracts)
 	// choose arbitrarily
-	contractId := contractIds[0]
-	contract := self.contracts[contractId]
-	delete(self.contracts, contractId)
-	return contract
+	for contractId, contract := range self.contracts {
+		if self.contractTransferByteCounts[contractId] < minTransferByteCount {
+			continue
+		}
+		delete(self.contracts, contractId)
+		delete(self.contractTransferByteCounts, contractId)
+		return contract
+	}
+	return nil
 }
 
 func (self *contractQueue) Add(contract *protocol.Contract, storedContract *protocol.StoredContract) error {
@@ -714,11 +1366,39 @@ func (self *contractQueue) Add(contract *protocol.Contract, storedContract *prot
 		glog.V(2).Infof("[contract]add %s\n", contractId)
 		self.usedContractIds[contractId] = true
 		self.contracts[contractId] = contract
+		self.contractTransferByteCounts[contractId] = ByteCount(storedContract.TransferByteCount)
+		self.contractError = nil
 		self.updateMonitor.NotifyAll()
 	}
 	return nil
 }
 
+func (self *contractQueue) SetContractError(contractError protocol.ContractError) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.contractError = &contractError
+	self.updateMonitor.NotifyAll()
+}
+
+func (self *contractQueue) ClearContractError() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.contractError = nil
+}
+
+func (self *contractQueue) ContractError() (protocol.ContractError, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.contractError == nil {
+		var contractError protocol.ContractError
+		return contractError, false
+	}
+	return *self.contractError, true
+}
+
 func (self *contractQueue) RemoveUsedContract(contractId Id) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
@@ -732,6 +1412,7 @@ func (self *contractQueue) Flush(removeUsedContractIds bool) []*protocol.Contrac
 
 	contracts := maps.Values(self.contracts)
 	self.contracts = map[Id]*protocol.Contract{}
+	self.contractTransferByteCounts = map[Id]ByteCount{}
 	if removeUsedContractIds {
 		self.usedContractIds = map[Id]bool{}
 	}
@@ -739,6 +1420,13 @@ func (self *contractQueue) Flush(removeUsedContractIds bool) []*protocol.Contrac
 	return contracts
 }
 
+func (self *contractQueue) Len() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.contracts)
+}
+
 func (self *contractQueue) IsDone() bool {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
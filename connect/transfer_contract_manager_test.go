@@ -133,3 +133,592 @@ func TestTakeContract(t *testing.T) {
 	// all the contracts are accounted for
 }
 
+
+
+func TestVerifyFailureCallback(t *testing.T) {
+	// a contract signed with the wrong secret fails verification
+	// the callback fires and the sequence closes without delivering the message
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	b := NewClientWithDefaults(ctx, bClientId, NewNoContractClientOob())
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+	})
+
+	type verifyFailure struct {
+		source TransferPath
+		provideMode protocol.ProvideMode
+	}
+	verifyFailures := make(chan *verifyFailure, 16)
+	b.ContractManager().SetVerifyFailureCallback(func(source TransferPath, provideMode protocol.ProvideMode) {
+		verifyFailures <- &verifyFailure{
+			source: source,
+			provideMode: provideMode,
+		}
+	})
+
+	receives := make(chan *protocol.SimpleMessage, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- v
+			}
+		}
+	})
+
+	contract := requireContract(
+		protocol.ProvideMode_Network,
+		[]byte("bad secret"),
+		aClientId,
+		bClientId,
+	)
+	pack := &protocol.Pack{
+		MessageId: NewId().Bytes(),
+		SequenceId: NewId().Bytes(),
+		SequenceNumber: 0,
+		Head: true,
+		Frames: []*protocol.Frame{
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+		},
+		ContractFrame: RequireToFrame(contract),
+	}
+	bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId)
+
+	select {
+	case v := <- verifyFailures:
+		assert.Equal(t, aClientId, v.source.Source().ClientId)
+		assert.Equal(t, bClientId, v.source.Destination().ClientId)
+		assert.Equal(t, protocol.ProvideMode_Network, v.provideMode)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// the sequence closes
+	receiveSequenceCount := func()(int) {
+		b.receiveBuffer.mutex.Lock()
+		defer b.receiveBuffer.mutex.Unlock()
+		return len(b.receiveBuffer.receiveSequences)
+	}
+	endTime := time.Now().Add(timeout)
+	for 0 < receiveSequenceCount() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, receiveSequenceCount())
+
+	select {
+	case <- receives:
+		t.FailNow()
+	default:
+	}
+}
+
+
+func TestResumeReceiveContract(t *testing.T) {
+	// the receiver checkpoints a contract and restarts from the exported state
+	// the sender resumes the sequence without a new contract
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	newReceiver := func(state *ContractManagerState)(*Client, chan []byte, chan string) {
+		b := NewClientWithDefaults(ctx, bClientId, NewNoContractClientOob())
+
+		bReceive := make(chan []byte)
+		b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+		if state != nil {
+			b.ContractManager().ImportState(state)
+		}
+		b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+			protocol.ProvideMode_Network: true,
+		})
+
+		receives := make(chan string, 16)
+		b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+			for _, frame := range frames {
+				switch v := RequireFromFrame(frame).(type) {
+				case *protocol.SimpleMessage:
+					receives <- v.Content
+				}
+			}
+		})
+		return b, bReceive, receives
+	}
+
+	b, bReceive, receives := newReceiver(nil)
+
+	provideSecretKey, ok := b.ContractManager().GetProvideSecretKey(protocol.ProvideMode_Network)
+	assert.Equal(t, true, ok)
+	contract := requireContract(
+		protocol.ProvideMode_Network,
+		provideSecretKey,
+		aClientId,
+		bClientId,
+	)
+
+	sequenceId := NewId()
+	packBytes := func(sequenceNumber uint64, content string, contract *protocol.Contract)([]byte) {
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: sequenceNumber,
+			Head: sequenceNumber == 0,
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: content,
+				}),
+			},
+		}
+		if contract != nil {
+			pack.ContractFrame = RequireToFrame(contract)
+		}
+		return requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId)
+	}
+
+	bReceive <- packBytes(0, "a", contract)
+	select {
+	case content := <- receives:
+		assert.Equal(t, "a", content)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	b.Cancel()
+
+	var state *ContractManagerState
+	endTime := time.Now().Add(timeout)
+	for {
+		state = b.ContractManager().ExportState()
+		if 0 < len(state.ReceiveContractCheckpoints) || endTime.Before(time.Now()) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(state.ReceiveContractCheckpoints))
+	receiveContractCheckpoint := state.ReceiveContractCheckpoints[0]
+	assert.Equal(t, aClientId, receiveContractCheckpoint.SourceId)
+	assert.Equal(t, sequenceId, receiveContractCheckpoint.SequenceId)
+	assert.Equal(t, uint64(1), receiveContractCheckpoint.NextSequenceNumber)
+
+	// without the state, the receiver waits for the head of the sequence
+	b2, b2Receive, b2Receives := newReceiver(nil)
+	b2Receive <- packBytes(1, "b", nil)
+	select {
+	case <- b2Receives:
+		t.FailNow()
+	case <- time.After(500 * time.Millisecond):
+	}
+	b2.Cancel()
+
+	// with the state, the sequence resumes
+	b3, b3Receive, b3Receives := newReceiver(state)
+	defer b3.Cancel()
+	b3ProvideSecretKey, ok := b3.ContractManager().GetProvideSecretKey(protocol.ProvideMode_Network)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, provideSecretKey, b3ProvideSecretKey)
+
+	b3Receive <- packBytes(1, "b", nil)
+	b3Receive <- packBytes(2, "c", nil)
+	for _, expectedContent := range []string{"b", "c"} {
+		select {
+		case content := <- b3Receives:
+			assert.Equal(t, expectedContent, content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+}
+
+
+func TestReceiveContractCheckpointLimit(t *testing.T) {
+	// receive contract checkpoints are dropped past the timeout and over the max count,
+	// so that checkpoints from sources that never resume do not accumulate
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	checkpointTimeout := 200 * time.Millisecond
+	maxCheckpoints := 4
+	n := 10
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.ReceiveContractCheckpointTimeout = checkpointTimeout
+	settings.ContractManagerSettings.MaxReceiveContractCheckpoints = maxCheckpoints
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+
+	contractManager := client.ContractManager()
+
+	sourceIds := []Id{}
+	sequenceIds := []Id{}
+	for i := 0; i < n; i += 1 {
+		sourceId := NewId()
+		sequenceId := NewId()
+		sourceIds = append(sourceIds, sourceId)
+		sequenceIds = append(sequenceIds, sequenceId)
+		contractManager.checkpointReceiveContract(&ReceiveContractCheckpoint{
+			SourceId: sourceId,
+			SequenceId: sequenceId,
+		})
+		assert.Equal(t, min(i + 1, maxCheckpoints), contractManager.receiveContractCheckpointCount())
+	}
+	assert.Equal(t, maxCheckpoints, len(contractManager.ExportState().ReceiveContractCheckpoints))
+
+	// the oldest were dropped
+	_, ok := contractManager.takeReceiveContractCheckpoint(sourceIds[0], sequenceIds[0])
+	assert.Equal(t, false, ok)
+	receiveContractCheckpoint, ok := contractManager.takeReceiveContractCheckpoint(sourceIds[n - 1], sequenceIds[n - 1])
+	assert.Equal(t, true, ok)
+	assert.Equal(t, sourceIds[n - 1], receiveContractCheckpoint.SourceId)
+	assert.Equal(t, maxCheckpoints - 1, contractManager.receiveContractCheckpointCount())
+
+	// the rest expire
+	time.Sleep(checkpointTimeout + 50 * time.Millisecond)
+	assert.Equal(t, 0, contractManager.receiveContractCheckpointCount())
+	_, ok = contractManager.takeReceiveContractCheckpoint(sourceIds[n - 2], sequenceIds[n - 2])
+	assert.Equal(t, false, ok)
+
+	// imported checkpoints with no checkpoint time start the timeout from the import
+	contractManager.ImportState(&ContractManagerState{
+		ReceiveContractCheckpoints: []*ReceiveContractCheckpoint{
+			&ReceiveContractCheckpoint{
+				SourceId: sourceIds[0],
+				SequenceId: sequenceIds[0],
+			},
+		},
+	})
+	assert.Equal(t, 1, contractManager.receiveContractCheckpointCount())
+	_, ok = contractManager.takeReceiveContractCheckpoint(sourceIds[0], sequenceIds[0])
+	assert.Equal(t, true, ok)
+}
+
+
+func TestContractManagerQuiesce(t *testing.T) {
+	// while quiesced, contracts are refused from new sources,
+	// and sources with an open contract may continue to rotate contracts
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer client.Cancel()
+
+	contractManager := client.ContractManager()
+
+	existingSourceId := NewId()
+	newSourceId := NewId()
+	contractManager.OpenSourceContract(existingSourceId)
+
+	assert.Equal(t, true, contractManager.allowSourceContract(existingSourceId))
+	assert.Equal(t, true, contractManager.allowSourceContract(newSourceId))
+
+	contractManager.Quiesce()
+	assert.Equal(t, true, contractManager.IsQuiesced())
+	assert.Equal(t, true, contractManager.allowSourceContract(existingSourceId))
+	assert.Equal(t, false, contractManager.allowSourceContract(newSourceId))
+
+	// once the existing source closes, it is a new source
+	contractManager.CloseSourceContract(existingSourceId)
+	assert.Equal(t, false, contractManager.allowSourceContract(existingSourceId))
+}
+
+
+// records close contract reports
+type closeContractOob struct {
+	closeContracts chan *protocol.CloseContract
+}
+
+func (self *closeContractOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	for _, frame := range frames {
+		if closeContract, ok := RequireFromFrame(frame).(*protocol.CloseContract); ok {
+			self.closeContracts <- closeContract
+		}
+	}
+	go callback([]*protocol.Frame{}, nil)
+}
+
+
+func TestUsageReportInterval(t *testing.T) {
+	// the receiver periodically checkpoints the cumulative acked byte count of an open contract
+	// and reports nothing when there is no new usage
+
+	timeout := 5 * time.Second
+	usageReportInterval := 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &closeContractOob{
+		closeContracts: make(chan *protocol.CloseContract, 16),
+	}
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.UsageReportInterval = usageReportInterval
+	b := NewClient(ctx, bClientId, oob, settings)
+	defer b.Cancel()
+
+	checkpointEvents := make(chan *ContractEvent, 16)
+	b.ContractManager().AddContractEventCallback(func(contractEvent *ContractEvent) {
+		if contractEvent.EventType == ContractEventCheckpoint {
+			checkpointEvents <- contractEvent
+		}
+	})
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+	})
+
+	provideSecretKey, ok := b.ContractManager().GetProvideSecretKey(protocol.ProvideMode_Network)
+	assert.Equal(t, true, ok)
+	contract := requireContract(
+		protocol.ProvideMode_Network,
+		provideSecretKey,
+		aClientId,
+		bClientId,
+	)
+	storedContract := &protocol.StoredContract{}
+	err := proto.Unmarshal(contract.StoredContractBytes, storedContract)
+	assert.Equal(t, nil, err)
+
+	sequenceId := NewId()
+	ackedByteCount := ByteCount(0)
+	sendPack := func(sequenceNumber uint64, content string) {
+		frames := []*protocol.Frame{
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: content,
+			}),
+		}
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: sequenceNumber,
+			Head: sequenceNumber == 0,
+			Frames: frames,
+		}
+		if sequenceNumber == 0 {
+			pack.ContractFrame = RequireToFrame(contract)
+		}
+		ackedByteCount += max(settings.ReceiveBufferSettings.MinMessageByteCount, MessageByteCount(frames))
+		select {
+		case bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	requireReport := func(ackedByteCount ByteCount) {
+		select {
+		case closeContract := <- oob.closeContracts:
+			assert.Equal(t, storedContract.ContractId, closeContract.ContractId)
+			assert.Equal(t, true, closeContract.Checkpoint)
+			assert.Equal(t, uint64(ackedByteCount), closeContract.AckedByteCount)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	sendPack(0, "a")
+	requireReport(ackedByteCount)
+	// each report is also a checkpoint event
+	select {
+	case contractEvent := <- checkpointEvents:
+		assert.Equal(t, storedContract.ContractId, contractEvent.ContractId.Bytes())
+		assert.Equal(t, ackedByteCount, contractEvent.AckedByteCount)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// no new usage, no report
+	select {
+	case <- oob.closeContracts:
+		t.FailNow()
+	case <- time.After(4 * usageReportInterval):
+	}
+
+	sendPack(1, "bb")
+	sendPack(2, "ccc")
+	// the report is cumulative for the contract
+	// the acks may be split across reports
+	reportedAckedByteCount := uint64(0)
+	for reportedAckedByteCount < uint64(ackedByteCount) {
+		select {
+		case closeContract := <- oob.closeContracts:
+			assert.Equal(t, true, reportedAckedByteCount < closeContract.AckedByteCount)
+			reportedAckedByteCount = closeContract.AckedByteCount
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	assert.Equal(t, uint64(ackedByteCount), reportedAckedByteCount)
+}
+
+
+func TestPrewarmContract(t *testing.T) {
+	// a prewarmed contract is queued before the first send,
+	// and the first send takes it without another request
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	a := NewClientWithDefaults(ctx, aClientId, &contractClientOob{
+		clientId: aClientId,
+	})
+	defer a.Cancel()
+
+	bClientId := NewId()
+	noContractClientId := NewId()
+	a.ContractManager().AddNoContractPeer(noContractClientId)
+
+	// the send is never acked
+	bReceive := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+
+	contractEvents := make(chan *ContractEvent, 16)
+	a.ContractManager().AddContractEventCallback(func(contractEvent *ContractEvent) {
+		contractEvents <- contractEvent
+	})
+	nextContractEvent := func()(*ContractEvent) {
+		select {
+		case contractEvent := <- contractEvents:
+			return contractEvent
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	pathTo := func(destinationId Id)(TransferPath) {
+		return NewTransferPath(Path{ClientId: aClientId}, Path{ClientId: destinationId})
+	}
+
+	// stream destinations cannot be prewarmed
+	err := a.PrewarmContract(NewTransferPath(Path{ClientId: aClientId}, Path{StreamId: NewId()}))
+	assert.NotEqual(t, nil, err)
+
+	// these do not need a contract
+	assert.Equal(t, nil, a.PrewarmContract(pathTo(aClientId)))
+	assert.Equal(t, nil, a.PrewarmContract(pathTo(noContractClientId)))
+
+	assert.Equal(t, nil, a.PrewarmContract(pathTo(bClientId)))
+	contractEvent := nextContractEvent()
+	assert.Equal(t, ContractEventCreate, contractEvent.EventType)
+	assert.Equal(t, bClientId, contractEvent.DestinationId)
+
+	endTime := time.Now().Add(timeout)
+	for a.ContractManager().QueuedContractCount(bClientId) == 0 && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, a.ContractManager().QueuedContractCount(bClientId))
+
+	// already queued
+	assert.Equal(t, nil, a.PrewarmContract(pathTo(bClientId)))
+
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		bClientId,
+		func(err error) {},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	// the first event of the send is the take of the prewarmed contract
+	contractEvent = nextContractEvent()
+	assert.Equal(t, ContractEventTake, contractEvent.EventType)
+	assert.Equal(t, bClientId, contractEvent.DestinationId)
+	// then the sequence queues up its next contract
+	contractEvent = nextContractEvent()
+	assert.Equal(t, ContractEventCreate, contractEvent.EventType)
+	assert.Equal(t, bClientId, contractEvent.DestinationId)
+}
+
+
+// responds to each contract request with a new contract,
+// and holds the results until `releaseResults` is closed
+type heldContractOob struct {
+	contractClientOob
+	createContracts chan *protocol.CreateContract
+	releaseResults chan struct{}
+}
+
+func (self *heldContractOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	for _, frame := range frames {
+		if createContract, ok := RequireFromFrame(frame).(*protocol.CreateContract); ok {
+			self.createContracts <- createContract
+		}
+	}
+	self.contractClientOob.SendControl(frames, func(resultFrames []*protocol.Frame, err error) {
+		<- self.releaseResults
+		callback(resultFrames, err)
+	})
+}
+
+
+func TestPrewarmContractOutstanding(t *testing.T) {
+	// prewarms before the first contract arrives do not request more contracts
+
+	timeout := 5 * time.Second
+	n := 8
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	oob := &heldContractOob{
+		contractClientOob: contractClientOob{
+			clientId: aClientId,
+		},
+		createContracts: make(chan *protocol.CreateContract, 2 * n),
+		releaseResults: make(chan struct{}),
+	}
+	a := NewClientWithDefaults(ctx, aClientId, oob)
+	defer a.Cancel()
+
+	bClientId := NewId()
+	bPath := NewTransferPath(Path{ClientId: aClientId}, Path{ClientId: bClientId})
+	for i := 0; i < n; i += 1 {
+		assert.Equal(t, nil, a.PrewarmContract(bPath))
+	}
+	assert.Equal(t, 1, len(oob.createContracts))
+	assert.Equal(t, 0, a.ContractManager().QueuedContractCount(bClientId))
+
+	close(oob.releaseResults)
+	endTime := time.Now().Add(timeout)
+	for a.ContractManager().QueuedContractCount(bClientId) == 0 && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, a.ContractManager().QueuedContractCount(bClientId))
+
+	for i := 0; i < n; i += 1 {
+		assert.Equal(t, nil, a.PrewarmContract(bPath))
+	}
+	assert.Equal(t, 1, len(oob.createContracts))
+	assert.Equal(t, 1, a.ContractManager().QueuedContractCount(bClientId))
+}
@@ -0,0 +1,162 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+
+// A shared worker pool that runs forward sequences,
+// as an alternative to one goroutine per forward sequence.
+// This bounds the goroutine count for intermediaries that forward to many destinations.
+// The tradeoff is that a slow write to one destination occupies a worker,
+// which delays other destinations when all workers are busy.
+// Enable by setting `ForwardBufferSettings.WorkerCount`.
+
+
+// the max packs a worker writes for a sequence before moving to the next ready sequence
+const forwardWorkerBatchSize = 16
+
+
+type forwardWorkerPool struct {
+	ctx context.Context
+	forwardBufferSettings *ForwardBufferSettings
+
+	mutex sync.Mutex
+	// sequence -> called once the sequence is closed
+	sequences map[*ForwardSequence]func()
+	// sequences with pending packs, in order
+	readySequences []*ForwardSequence
+	readyMonitor *Monitor
+}
+
+func newForwardWorkerPool(ctx context.Context, forwardBufferSettings *ForwardBufferSettings) *forwardWorkerPool {
+	forwardWorkerPool := &forwardWorkerPool{
+		ctx: ctx,
+		forwardBufferSettings: forwardBufferSettings,
+		sequences: map[*ForwardSequence]func(){},
+		readySequences: []*ForwardSequence{},
+		readyMonitor: NewMonitor(),
+	}
+	for i := 0; i < forwardBufferSettings.WorkerCount; i += 1 {
+		go HandleError(forwardWorkerPool.runWorker)
+	}
+	go HandleError(forwardWorkerPool.runSweep)
+	return forwardWorkerPool
+}
+
+// the pool closes the sequence when it is idle or canceled
+func (self *forwardWorkerPool) add(forwardSequence *ForwardSequence, onClose func()) {
+	forwardSequence.workerPool = self
+	forwardSequence.openWriter()
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.sequences[forwardSequence] = onClose
+}
+
+// must be called with the sequence state lock
+func (self *forwardWorkerPool) ready(forwardSequence *ForwardSequence) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.readySequences = append(self.readySequences, forwardSequence)
+	self.readyMonitor.NotifyAll()
+}
+
+func (self *forwardWorkerPool) takeReady() (*ForwardSequence, chan struct{}) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.readySequences) == 0 {
+		return nil, self.readyMonitor.NotifyChannel()
+	}
+	forwardSequence := self.readySequences[0]
+	self.readySequences[0] = nil
+	self.readySequences = self.readySequences[1:]
+	return forwardSequence, nil
+}
+
+func (self *forwardWorkerPool) runWorker() {
+	for {
+		forwardSequence, notify := self.takeReady()
+		if forwardSequence == nil {
+			select {
+			case <- self.ctx.Done():
+				return
+			case <- notify:
+			}
+			continue
+		}
+
+		forwardSequence.work(forwardWorkerBatchSize)
+	}
+}
+
+// closes sequences that are canceled or idle
+func (self *forwardWorkerPool) runSweep() {
+	for {
+		select {
+		case <- self.ctx.Done():
+			self.closeAll()
+			return
+		case <- time.After(self.forwardBufferSettings.WorkerSweepInterval):
+		}
+
+		sequences := func()([]*ForwardSequence) {
+			self.mutex.Lock()
+			defer self.mutex.Unlock()
+
+			sequences := []*ForwardSequence{}
+			for forwardSequence, _ := range self.sequences {
+				sequences = append(sequences, forwardSequence)
+			}
+			return sequences
+		}()
+
+		now := time.Now()
+		for _, forwardSequence := range sequences {
+			if forwardSequence.sweep(now) {
+				self.close(forwardSequence)
+			}
+		}
+	}
+}
+
+func (self *forwardWorkerPool) close(forwardSequence *ForwardSequence) {
+	onClose := func()(func()) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		onClose := self.sequences[forwardSequence]
+		delete(self.sequences, forwardSequence)
+		return onClose
+	}()
+
+	glog.V(2).Infof("[fp]%s->%s close\n", forwardSequence.clientTag, forwardSequence.destinationId)
+	forwardSequence.cancel()
+	forwardSequence.closeWriter()
+	if onClose != nil {
+		onClose()
+	}
+}
+
+func (self *forwardWorkerPool) closeAll() {
+	sequences := func()([]*ForwardSequence) {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+
+		sequences := []*ForwardSequence{}
+		for forwardSequence, _ := range self.sequences {
+			sequences = append(sequences, forwardSequence)
+		}
+		return sequences
+	}()
+	for _, forwardSequence := range sequences {
+		self.close(forwardSequence)
+	}
+}
@@ -0,0 +1,127 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestForwardWorkerPool(t *testing.T) {
+	// forward to many destinations on a small worker pool
+	// all forwards are written, and idle sequences close
+
+	timeout := 5 * time.Second
+	destinationCount := 256
+	forwardCount := 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.ForwardBufferSettings.WorkerCount = 4
+	settings.ForwardBufferSettings.WorkerSweepInterval = 50 * time.Millisecond
+	settings.ForwardBufferSettings.IdleTimeout = 200 * time.Millisecond
+
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+
+	route := make(chan []byte, destinationCount * forwardCount)
+	client.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{route})
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+	for i := 0; i < destinationCount; i += 1 {
+		transferFrameBytes := requireTransferFrameBytes(frame, NewId(), NewId())
+		for j := 0; j < forwardCount; j += 1 {
+			success, err := client.ForwardWithTimeoutDetailed(transferFrameBytes, timeout)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, success)
+		}
+	}
+
+	for i := 0; i < destinationCount * forwardCount; i += 1 {
+		select {
+		case <- route:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	forwardSequenceCount := func()(int) {
+		client.forwardBuffer.mutex.Lock()
+		defer client.forwardBuffer.mutex.Unlock()
+		return len(client.forwardBuffer.forwardSequences)
+	}
+
+	endTime := time.Now().Add(timeout)
+	for 0 < forwardSequenceCount() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, forwardSequenceCount())
+	assert.Equal(t, ByteCount(0), client.forwardBuffer.TotalByteCount())
+}
+
+
+func BenchmarkForwardSequences(b *testing.B) {
+	// compares a goroutine per forward sequence with a shared worker pool
+	// reports the goroutine count with all destinations open
+
+	destinationCount := 1024
+
+	for _, workerCount := range []int{0, runtime.NumCPU()} {
+		name := "goroutine"
+		if 0 < workerCount {
+			name = fmt.Sprintf("pool%d", workerCount)
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			settings := DefaultClientSettings()
+			settings.ForwardBufferSettings.WorkerCount = workerCount
+
+			client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+			defer client.Cancel()
+
+			route := make(chan []byte)
+			client.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{route})
+			go func() {
+				for {
+					select {
+					case <- ctx.Done():
+						return
+					case <- route:
+					}
+				}
+			}()
+
+			frame := RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			})
+			transferFramesBytes := [][]byte{}
+			for i := 0; i < destinationCount; i += 1 {
+				transferFramesBytes = append(transferFramesBytes, requireTransferFrameBytes(frame, NewId(), NewId()))
+			}
+
+			b.ResetTimer()
+			maxGoroutineCount := 0
+			for i := 0; i < b.N; i += 1 {
+				client.ForwardWithTimeout(transferFramesBytes[i % destinationCount], -1)
+				if i % destinationCount == destinationCount - 1 {
+					maxGoroutineCount = max(maxGoroutineCount, runtime.NumGoroutine())
+				}
+			}
+			b.StopTimer()
+			maxGoroutineCount = max(maxGoroutineCount, runtime.NumGoroutine())
+			b.ReportMetric(float64(maxGoroutineCount), "goroutines")
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"bringyour.com/protocol"
+)
+
+
+// a send to a group id fans out to the current members of the group
+// the app maps group ids to members with a `GroupResolver`
+// each member is a normal destination with its own send sequence,
+// and the acks of the members are aggregated into a single ack for the send
+
+
+type GroupResolver interface {
+	// returns false if the id is not a group
+	// the members are resolved on each send
+	ResolveGroup(groupId Id) (memberIds []Id, ok bool)
+}
+
+
+func (self *Client) SetGroupResolver(groupResolver GroupResolver) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.groupResolver = groupResolver
+}
+
+func (self *Client) GroupResolver() GroupResolver {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	return self.groupResolver
+}
+
+// all members share one deadline of `timeout`
+// returns true if at least one member send was queued,
+// and members that cannot be queued are reported as errors in the aggregate ack.
+// if no member send is queued, returns false and the ack callback is never called,
+// which is the same contract as a single destination send
+func (self *Client) sendGroupWithTimeoutDetailed(
+	frame *protocol.Frame,
+	groupId Id,
+	memberIds []Id,
+	ackCallback AckFunction,
+	timeout time.Duration,
+	opts ...any,
+) (bool, error) {
+	if len(memberIds) == 0 {
+		// an empty group acks immediately
+		newGroupAck(groupId, 0, ackCallback)
+		return true, nil
+	}
+
+	groupAck := newGroupAck(groupId, len(memberIds), ackCallback)
+
+	var deadline time.Time
+	if 0 < timeout {
+		deadline = time.Now().Add(timeout)
+	}
+
+	queuedCount := 0
+	var memberErrs []error
+	var lastErr error
+	for _, memberId := range memberIds {
+		memberTimeout := timeout
+		if 0 < timeout {
+			// once the deadline passes, the remaining members are only queued if there is space now
+			memberTimeout = max(time.Until(deadline), 0)
+		}
+		success, err := self.sendWithTimeoutDetailed(frame, memberId, groupAck.ackMember, memberTimeout, opts...)
+		if success && err == nil {
+			queuedCount += 1
+		} else {
+			if err != nil {
+				lastErr = err
+			} else {
+				err = errors.New("Drop")
+			}
+			memberErrs = append(memberErrs, fmt.Errorf("Member %s: %w", memberId, err))
+		}
+	}
+
+	if queuedCount == 0 {
+		// the failure is reported only in the return value
+		return false, lastErr
+	}
+	// the pending count includes the failed members,
+	// so the aggregate ack cannot complete until these are added
+	for _, memberErr := range memberErrs {
+		groupAck.ackMember(memberErr)
+	}
+	return true, nil
+}
+
+
+// calls the ack callback once after all members ack
+// the aggregate error is nil only if all members acked with no error
+type groupAck struct {
+	groupId Id
+	ackCallback AckFunction
+
+	stateLock sync.Mutex
+	pendingCount int
+	errs []error
+}
+
+func newGroupAck(groupId Id, memberCount int, ackCallback AckFunction) *groupAck {
+	groupAck := &groupAck{
+		groupId: groupId,
+		ackCallback: ackCallback,
+		pendingCount: memberCount,
+	}
+	if memberCount == 0 {
+		groupAck.complete()
+	}
+	return groupAck
+}
+
+// AckFunction
+func (self *groupAck) ackMember(err error) {
+	done := func()(bool) {
+		self.stateLock.Lock()
+		defer self.stateLock.Unlock()
+
+		if self.pendingCount == 0 {
+			return false
+		}
+		if err != nil {
+			self.errs = append(self.errs, err)
+		}
+		self.pendingCount -= 1
+		return self.pendingCount == 0
+	}()
+	if done {
+		self.complete()
+	}
+}
+
+func (self *groupAck) complete() {
+	if self.ackCallback == nil {
+		return
+	}
+	var err error
+	if 0 < len(self.errs) {
+		err = fmt.Errorf("Group %s: %w", self.groupId, errors.Join(self.errs...))
+	}
+	HandleError(func() {
+		self.ackCallback(err)
+	})
+}
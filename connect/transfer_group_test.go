@@ -0,0 +1,238 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+type testingGroupResolver struct {
+	groups map[Id][]Id
+}
+
+func (self *testingGroupResolver) ResolveGroup(groupId Id) ([]Id, bool) {
+	memberIds, ok := self.groups[groupId]
+	return memberIds, ok
+}
+
+
+func TestGroupSend(t *testing.T) {
+	timeout := 5 * time.Second
+	memberCount := 3
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+
+	aSend := make(chan []byte)
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	type receive struct {
+		memberId Id
+		content string
+	}
+	receives := make(chan *receive, memberCount * n)
+
+	memberIds := []Id{}
+	memberReceives := map[Id]chan []byte{}
+	for i := 0; i < memberCount; i += 1 {
+		b := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+		defer b.Cancel()
+
+		bReceive := make(chan []byte)
+		b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aReceive})
+		b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+
+		a.ContractManager().AddNoContractPeer(b.ClientId())
+		b.ContractManager().AddNoContractPeer(a.ClientId())
+
+		memberId := b.ClientId()
+		b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+			for _, frame := range frames {
+				switch v := RequireFromFrame(frame).(type) {
+				case *protocol.SimpleMessage:
+					receives <- &receive{
+						memberId: memberId,
+						content: v.Content,
+					}
+				}
+			}
+		})
+
+		memberIds = append(memberIds, memberId)
+		memberReceives[memberId] = bReceive
+	}
+
+	// route the sends of `a` to the members
+	go func() {
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case transferFrameBytes := <- aSend:
+				var filteredTransferFrame protocol.FilteredTransferFrame
+				if err := proto.Unmarshal(transferFrameBytes, &filteredTransferFrame); err != nil {
+					continue
+				}
+				destinationId, err := IdFromBytes(filteredTransferFrame.TransferPath.DestinationId)
+				if err != nil {
+					continue
+				}
+				if bReceive, ok := memberReceives[destinationId]; ok {
+					select {
+					case <- ctx.Done():
+						return
+					case bReceive <- transferFrameBytes:
+					}
+				}
+			}
+		}
+	}()
+
+	groupId := NewId()
+	a.SetGroupResolver(&testingGroupResolver{
+		groups: map[Id][]Id{
+			groupId: memberIds,
+		},
+	})
+
+	acks := make(chan error, n)
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			groupId,
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	memberContents := map[Id][]string{}
+	for i := 0; i < memberCount * n; i += 1 {
+		select {
+		case receive := <- receives:
+			memberContents[receive.memberId] = append(memberContents[receive.memberId], receive.content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	for _, memberId := range memberIds {
+		contents := memberContents[memberId]
+		assert.Equal(t, n, len(contents))
+		for i, content := range contents {
+			assert.Equal(t, fmt.Sprintf("hi %d", i), content)
+		}
+	}
+
+	// one aggregate ack per send
+	for i := 0; i < n; i += 1 {
+		select {
+		case err := <- acks:
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	select {
+	case <- acks:
+		t.FailNow()
+	case <- time.After(100 * time.Millisecond):
+	}
+}
+
+
+func TestGroupAck(t *testing.T) {
+	groupId := NewId()
+
+	acks := make(chan error, 4)
+	ackCallback := func(err error) {
+		acks <- err
+	}
+
+	groupAck := newGroupAck(groupId, 3, ackCallback)
+	groupAck.ackMember(nil)
+	groupAck.ackMember(nil)
+	assert.Equal(t, 0, len(acks))
+	groupAck.ackMember(nil)
+	assert.Equal(t, nil, <- acks)
+
+	memberErr := errors.New("test")
+	groupAck = newGroupAck(groupId, 3, ackCallback)
+	groupAck.ackMember(nil)
+	groupAck.ackMember(memberErr)
+	groupAck.ackMember(nil)
+	// extra acks are ignored
+	groupAck.ackMember(nil)
+	err := <- acks
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, errors.Is(err, memberErr))
+	assert.Equal(t, 0, len(acks))
+
+	// empty group acks immediately
+	newGroupAck(groupId, 0, ackCallback)
+	assert.Equal(t, nil, <- acks)
+}
+
+
+func TestGroupSendNoMembersQueued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+
+	groupId := NewId()
+	emptyGroupId := NewId()
+	a.SetGroupResolver(&testingGroupResolver{
+		groups: map[Id][]Id{
+			groupId: []Id{NewId(), NewId(), NewId()},
+			emptyGroupId: []Id{},
+		},
+	})
+
+	acks := make(chan error, 4)
+	ackCallback := func(err error) {
+		acks <- err
+	}
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+
+	// an empty group is queued and acks immediately
+	success := a.SendWithTimeout(frame, emptyGroupId, ackCallback, 0)
+	assert.Equal(t, true, success)
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(time.Second):
+		t.FailNow()
+	}
+
+	// when no member is queued, the failure is only returned and the ack is not called
+	a.Cancel()
+	success = a.SendWithTimeout(frame, groupId, ackCallback, time.Second)
+	assert.Equal(t, false, success)
+	select {
+	case <- acks:
+		t.FailNow()
+	case <- time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,115 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+
+// Counts and optionally limits the rate of loopback sends, which are delivered directly
+// to the client receive callbacks without a route.
+// A flood of loopback sends is paced on the send side, so that the sender sees backpressure
+// as a blocked or timed out send. The transport read loop that processes remote receives
+// is independent of the loopback delivery and is not slowed down.
+// Enable the limit by setting `ClientSettings.LoopbackRateLimit`.
+
+
+type ClientStats struct {
+	// loopback sends queued for delivery
+	LoopbackSendCount uint64
+	LoopbackSendByteCount ByteCount
+	// loopback sends that were delayed by the rate limit
+	LoopbackLimitedCount uint64
+	// loopback sends that were not queued because of the timeout
+	LoopbackDropCount uint64
+}
+
+
+type loopbackLimit struct {
+	// messages per second. 0 is no limit
+	rateLimit float64
+
+	mutex sync.Mutex
+	// the earliest time the next loopback send may be queued
+	nextSendTime time.Time
+	stats ClientStats
+}
+
+func newLoopbackLimit(rateLimit float64) *loopbackLimit {
+	return &loopbackLimit{
+		rateLimit: rateLimit,
+	}
+}
+
+func (self *loopbackLimit) enabled() bool {
+	return 0 < self.rateLimit
+}
+
+// reserves the next send slot and returns the delay until the slot,
+// or false if the delay would exceed the timeout. A negative timeout waits forever
+func (self *loopbackLimit) reserve(timeout time.Duration) (time.Duration, bool) {
+	if !self.enabled() {
+		return 0, true
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	if self.nextSendTime.Before(now) {
+		self.nextSendTime = now
+	}
+	delay := self.nextSendTime.Sub(now)
+	if 0 <= timeout && timeout < delay {
+		return 0, false
+	}
+	self.nextSendTime = self.nextSendTime.Add(time.Duration(float64(time.Second) / self.rateLimit))
+	if 0 < delay {
+		self.stats.LoopbackLimitedCount += 1
+	}
+	return delay, true
+}
+
+// waits for a send slot and returns the remaining timeout,
+// or false if the send should be dropped
+func (self *loopbackLimit) wait(ctx context.Context, timeout time.Duration) (time.Duration, bool) {
+	delay, ok := self.reserve(timeout)
+	if !ok {
+		self.drop()
+		return 0, false
+	}
+	if 0 < delay {
+		select {
+		case <- ctx.Done():
+			return 0, false
+		case <- time.After(delay):
+		}
+		if 0 <= timeout {
+			timeout = max(0, timeout - delay)
+		}
+	}
+	return timeout, true
+}
+
+func (self *loopbackLimit) send(byteCount ByteCount) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.stats.LoopbackSendCount += 1
+	self.stats.LoopbackSendByteCount += byteCount
+}
+
+func (self *loopbackLimit) drop() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.stats.LoopbackDropCount += 1
+}
+
+func (self *loopbackLimit) Stats() ClientStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.stats
+}
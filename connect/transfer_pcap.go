@@ -0,0 +1,97 @@
+package connect
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+
+// writes transfer frames as a pcap file for inspection in wireshark
+// each packet is the raw bytes of a `protocol.TransferFrame`, with link type `PcapLinkType`
+// The dissector in `pcap/connect.lua` decodes the packets with the wireshark protobuf dissector,
+// using the schema in `protocol/*.proto`.
+
+
+// DLT_USER0
+const PcapLinkType = 147
+
+const pcapMagic = 0xa1b2c3d4
+const pcapVersionMajor = 2
+const pcapVersionMinor = 4
+const pcapSnapLength = 65535
+
+
+type PcapWriter struct {
+	mutex sync.Mutex
+	w io.Writer
+}
+
+// writes the pcap file header
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(header[6:8], pcapVersionMinor)
+	// thiszone and sigfigs are 0
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLength)
+	binary.LittleEndian.PutUint32(header[20:24], PcapLinkType)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{
+		w: w,
+	}, nil
+}
+
+func (self *PcapWriter) WriteTransferFrame(captureTime time.Time, transferFrameBytes []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	captureByteCount := min(len(transferFrameBytes), pcapSnapLength)
+
+	recordHeader := make([]byte, 16)
+	binary.LittleEndian.PutUint32(recordHeader[0:4], uint32(captureTime.Unix()))
+	binary.LittleEndian.PutUint32(recordHeader[4:8], uint32(captureTime.Nanosecond() / 1000))
+	binary.LittleEndian.PutUint32(recordHeader[8:12], uint32(captureByteCount))
+	binary.LittleEndian.PutUint32(recordHeader[12:16], uint32(len(transferFrameBytes)))
+	if _, err := self.w.Write(recordHeader); err != nil {
+		return err
+	}
+	_, err := self.w.Write(transferFrameBytes[:captureByteCount])
+	return err
+}
+
+
+// copies frames from `route` to the returned route, writing each frame to the pcap
+// for a send route, the client writes `route` and the transport reads the returned route
+// for a receive route, the transport writes `route` and the client reads the returned route
+func TapRoute(ctx context.Context, route Route, pcapWriter *PcapWriter) Route {
+	tapRoute := make(Route)
+	go func() {
+		defer close(tapRoute)
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case transferFrameBytes, ok := <- route:
+				if !ok {
+					return
+				}
+				if err := pcapWriter.WriteTransferFrame(time.Now(), transferFrameBytes); err != nil {
+					glog.Infof("[pcap]write error = %s\n", err)
+				}
+				select {
+				case <- ctx.Done():
+					return
+				case tapRoute <- transferFrameBytes:
+				}
+			}
+		}
+	}()
+	return tapRoute
+}
@@ -0,0 +1,164 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestPcapWriter(t *testing.T) {
+	b := &bytes.Buffer{}
+	pcapWriter, err := NewPcapWriter(b)
+	assert.Equal(t, nil, err)
+
+	transferFrameBytesList := [][]byte{}
+	for i := 0; i < 8; i += 1 {
+		transferFrameBytes := requireTransferFrameBytes(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			NewId(),
+			NewId(),
+		)
+		err := pcapWriter.WriteTransferFrame(time.Now(), transferFrameBytes)
+		assert.Equal(t, nil, err)
+		transferFrameBytesList = append(transferFrameBytesList, transferFrameBytes)
+	}
+
+	linkType, packets, err := readPcap(b.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(PcapLinkType), linkType)
+	assert.Equal(t, transferFrameBytesList, packets)
+}
+
+
+func TestTapRoute(t *testing.T) {
+	timeout := 5 * time.Second
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+	b := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer b.Cancel()
+
+	buffer := &bytes.Buffer{}
+	pcapWriter, err := NewPcapWriter(buffer)
+	assert.Equal(t, nil, err)
+
+	aToB := make(chan []byte)
+	bToA := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aToB})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bToA})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bToA})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{TapRoute(ctx, aToB, pcapWriter)})
+
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	receives := make(chan string, n)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- v.Content
+			}
+		}
+	})
+
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			b.ClientId(),
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+	for i := 0; i < n; i += 1 {
+		select {
+		case content := <- receives:
+			assert.Equal(t, fmt.Sprintf("hi %d", i), content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// the tap writes before forwarding, so all received frames are in the capture
+	pcapWriter.mutex.Lock()
+	captureBytes := bytes.Clone(buffer.Bytes())
+	pcapWriter.mutex.Unlock()
+
+	_, packets, err := readPcap(captureBytes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, n <= len(packets))
+	for _, packet := range packets {
+		transferFrame := &protocol.TransferFrame{}
+		err := proto.Unmarshal(packet, transferFrame)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, a.ClientId().Bytes(), transferFrame.TransferPath.SourceId)
+		assert.Equal(t, b.ClientId().Bytes(), transferFrame.TransferPath.DestinationId)
+		assert.Equal(t, protocol.MessageType_TransferPack, transferFrame.Frame.MessageType)
+	}
+}
+
+
+func TestPcapSampleCapture(t *testing.T) {
+	// the sample capture for the wireshark dissector in `pcap/connect.lua`
+	captureBytes, err := os.ReadFile("testdata/transfer.pcap")
+	assert.Equal(t, nil, err)
+
+	linkType, packets, err := readPcap(captureBytes)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(PcapLinkType), linkType)
+	assert.NotEqual(t, 0, len(packets))
+	for _, packet := range packets {
+		transferFrame := &protocol.TransferFrame{}
+		err := proto.Unmarshal(packet, transferFrame)
+		assert.Equal(t, nil, err)
+		assert.NotEqual(t, nil, transferFrame.TransferPath)
+		assert.NotEqual(t, nil, transferFrame.Frame)
+	}
+}
+
+
+// returns the link type and packets
+func readPcap(b []byte) (uint32, [][]byte, error) {
+	if len(b) < 24 {
+		return 0, nil, errors.New("Missing header.")
+	}
+	if binary.LittleEndian.Uint32(b[0:4]) != pcapMagic {
+		return 0, nil, errors.New("Bad magic.")
+	}
+	linkType := binary.LittleEndian.Uint32(b[20:24])
+	packets := [][]byte{}
+	for i := 24; i < len(b); {
+		if len(b) < i + 16 {
+			return 0, nil, errors.New("Truncated record header.")
+		}
+		captureByteCount := int(binary.LittleEndian.Uint32(b[i + 8:i + 12]))
+		i += 16
+		if len(b) < i + captureByteCount {
+			return 0, nil, errors.New("Truncated record.")
+		}
+		packets = append(packets, b[i:i + captureByteCount])
+		i += captureByteCount
+	}
+	return linkType, packets, nil
+}
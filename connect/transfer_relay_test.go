@@ -0,0 +1,153 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+// an in-process client that forwards all frames not addressed to itself
+// connect peers with `linkInProcess`
+func NewRelayClient(ctx context.Context, clientId Id) *Client {
+	settings := DefaultClientSettings()
+	client := NewClient(ctx, clientId, NewNoContractClientOob(), settings)
+	client.AddForwardCallback(func(sourceId Id, destinationId Id, transferFrameBytes []byte) {
+		client.ForwardWithTimeout(transferFrameBytes, settings.BufferTimeout)
+	})
+	return client
+}
+
+
+// routes frames from `a` to `b` over an in-memory route,
+// for `b` and any `destinationIds` reached through `b`
+func linkInProcess(a *Client, b *Client, destinationIds ...Id) {
+	route := make(chan []byte)
+	sendTransport := NewSendClientTransport(append([]Id{b.ClientId()}, destinationIds...)...)
+	a.RouteManager().UpdateTransport(sendTransport, []Route{route})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{route})
+}
+
+
+func TestRelay(t *testing.T) {
+	// sender -> relay -> destination
+	// the destination acks back through the relay
+	// the relay only forwards the transfer frames and never receives the messages
+
+	timeout := 5 * time.Second
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer sender.Cancel()
+	relay := NewRelayClient(ctx, NewId())
+	defer relay.Cancel()
+	destination := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer destination.Cancel()
+
+	linkInProcess(sender, relay, destination.ClientId())
+	linkInProcess(relay, destination)
+	linkInProcess(destination, relay, sender.ClientId())
+	linkInProcess(relay, sender)
+
+	sender.ContractManager().AddNoContractPeer(destination.ClientId())
+	destination.ContractManager().AddNoContractPeer(sender.ClientId())
+
+	relayReceives := make(chan *protocol.Frame, 16)
+	relay.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			relayReceives <- frame
+		}
+	})
+	type forward struct {
+		sourceId Id
+		destinationId Id
+	}
+	relayForwards := make(chan *forward, 1024)
+	relay.AddForwardCallback(func(sourceId Id, destinationId Id, transferFrameBytes []byte) {
+		relayForwards <- &forward{
+			sourceId: sourceId,
+			destinationId: destinationId,
+		}
+	})
+
+	receives := make(chan string, n)
+	destination.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		assert.Equal(t, sender.ClientId(), sourceId)
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- v.Content
+			}
+		}
+	})
+
+	acks := make(chan error, n)
+	for i := 0; i < n; i += 1 {
+		success := sender.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				MessageIndex: uint32(i),
+				Content: "secret",
+			}),
+			destination.ClientId(),
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	for i := 0; i < n; i += 1 {
+		select {
+		case content := <- receives:
+			assert.Equal(t, "secret", content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	for i := 0; i < n; i += 1 {
+		select {
+		case err := <- acks:
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// the relay forwarded in both directions
+	forwardDestinationIds := map[Id]bool{}
+	for done := false; !done; {
+		select {
+		case f := <- relayForwards:
+			switch f.destinationId {
+			case destination.ClientId():
+				assert.Equal(t, sender.ClientId(), f.sourceId)
+			case sender.ClientId():
+				assert.Equal(t, destination.ClientId(), f.sourceId)
+			default:
+				t.FailNow()
+			}
+			forwardDestinationIds[f.destinationId] = true
+		default:
+			done = true
+		}
+	}
+	assert.Equal(t, map[Id]bool{
+		destination.ClientId(): true,
+		sender.ClientId(): true,
+	}, forwardDestinationIds)
+
+	// the messages were never delivered to the relay
+	select {
+	case <- relayReceives:
+		t.FailNow()
+	default:
+	}
+}
@@ -0,0 +1,59 @@
+package connect
+
+import (
+	"sync"
+)
+
+
+// Counts of the sequences and goroutines held by a client, for leak detection.
+// Each send, receive, and forward sequence runs in a buffer goroutine
+// (or a forward worker, see `ForwardBufferSettings.WorkerCount`) until the sequence closes.
+// After all traffic is idle and the sequences time out, the counts return to zero,
+// and the created and closed counts converge.
+
+
+type ResourceStats struct {
+	SendSequenceCount int
+	ReceiveSequenceCount int
+	ForwardSequenceCount int
+	// goroutines that the buffers run for the sequences, including forward workers
+	BufferGoroutineCount int
+	// forward sequences evicted by the client for `ForwardBufferSettings.MaxSequences`
+	ForwardSequenceEvictCount uint64
+
+	// sequences created and closed since the process started, across all clients
+	// a closed sequence has returned from its run
+	SequenceCreateCount uint64
+	SequenceCloseCount uint64
+}
+
+
+var globalSequenceCounts = &sequenceCounts{}
+
+
+type sequenceCounts struct {
+	mutex sync.Mutex
+	createCount uint64
+	closeCount uint64
+}
+
+func (self *sequenceCounts) created() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.createCount += 1
+}
+
+func (self *sequenceCounts) closed() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closeCount += 1
+}
+
+func (self *sequenceCounts) counts() (createCount uint64, closeCount uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.createCount, self.closeCount
+}
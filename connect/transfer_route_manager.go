@@ -49,20 +49,68 @@ type Transport interface {
 }
 
 
+// a transport that carries a single ip version
+// transports that do not implement this carry either ip version
+type IpVersionTransport interface {
+    // 4, 6, or 0 for either
+    IpVersion() int
+}
+
+func transportIpVersion(transport Transport) int {
+    if ipVersionTransport, ok := transport.(IpVersionTransport); ok {
+        return ipVersionTransport.IpVersion()
+    }
+    return 0
+}
+
+
 type MultiRouteWriter interface {
     Write(ctx context.Context, transportFrameBytes []byte, timeout time.Duration) error
     GetActiveRoutes() []Route
     GetInactiveRoutes() []Route
+    GetRouteBackpressure() map[Route]RouteBackpressure
+    // the fraction of writes each active route is tried first, for debugging
+    GetRouteWeights() map[Route]float32
 }
 
 
 type MultiRouteReader interface {
     Read(ctx context.Context, timeout time.Duration) ([]byte, error)
+    // reads at least one and up to `maxCount` frames
+    ReadBatch(ctx context.Context, timeout time.Duration, maxCount int) ([][]byte, error)
     GetActiveRoutes() []Route
     GetInactiveRoutes() []Route
 }
 
 
+func DefaultRouteManagerSettings() *RouteManagerSettings {
+    return &RouteManagerSettings{
+        // skipping is off by default
+        BackpressureWriteThreshold: 0,
+        BackpressureCooldown: 1 * time.Second,
+        // latency weighting is off by default
+        LatencyWeightedWrites: false,
+        LatencyWeightMinWriteWait: 1 * time.Millisecond,
+    }
+}
+
+
+type RouteManagerSettings struct {
+    // a route that refuses this many consecutive writes is skipped by the writer for `BackpressureCooldown`
+    // routes are never skipped when all routes would be skipped
+    // 0 disables skipping. The backpressure is still measured
+    BackpressureWriteThreshold int
+    BackpressureCooldown time.Duration
+    // the writer tries routes first in proportion to the inverse of the route `WriteWait`,
+    // so that routes that accept writes faster are favored
+    // when off, routes are tried in a shuffled order
+    LatencyWeightedWrites bool
+    // write waits under this count as this, so that a route with no wait does not take all writes
+    // must be positive
+    LatencyWeightMinWriteWait time.Duration
+}
+
+
 type RouteManager struct {
 	ctx context.Context
 
@@ -73,13 +121,17 @@ type RouteManager struct {
     readerMatchState *MatchState
 }
 
-func NewRouteManager(ctx context.Context, clientTag string) *RouteManager {
+func NewRouteManagerWithDefaults(ctx context.Context, clientTag string) *RouteManager {
+    return NewRouteManager(ctx, clientTag, DefaultRouteManagerSettings())
+}
+
+func NewRouteManager(ctx context.Context, clientTag string, routeManagerSettings *RouteManagerSettings) *RouteManager {
     return &RouteManager{
     	ctx: ctx,
         clientTag: clientTag,
-        writerMatchState: NewMatchState(ctx, clientTag, true, Transport.MatchesSend),
+        writerMatchState: NewMatchState(ctx, clientTag, true, Transport.MatchesSend, routeManagerSettings),
         // `weightedRoutes=false` because unless there is a cpu limit this is not needed
-        readerMatchState: NewMatchState(ctx, clientTag, false, Transport.MatchesReceive),
+        readerMatchState: NewMatchState(ctx, clientTag, false, Transport.MatchesReceive, routeManagerSettings),
     }
 }
 
@@ -88,10 +140,18 @@ func (self *RouteManager) DowngradeReceiverConnection(sourceId Id) {
 }
 
 func (self *RouteManager) OpenMultiRouteWriter(destinationId Id) MultiRouteWriter {
+    return self.OpenMultiRouteWriterWithIpVersion(destinationId, 0)
+}
+
+// opens a writer window that uses only routes that carry the ip version, or either ip version
+// a client can keep separate ipv4 and ipv6 windows to the same destination,
+// and write each `TransferPath` to the window that matches its traffic, e.g. by the dns A or AAAA selection
+// use 0 for a window with all routes
+func (self *RouteManager) OpenMultiRouteWriterWithIpVersion(destinationId Id, ipVersion int) MultiRouteWriter {
     self.mutex.Lock()
     defer self.mutex.Unlock()
 
-    return MultiRouteWriter(self.writerMatchState.openMultiRouteSelector(destinationId))
+    return MultiRouteWriter(self.writerMatchState.openMultiRouteSelector(destinationId, ipVersion))
 }
 
 func (self *RouteManager) CloseMultiRouteWriter(w MultiRouteWriter) {
@@ -102,10 +162,16 @@ func (self *RouteManager) CloseMultiRouteWriter(w MultiRouteWriter) {
 }
 
 func (self *RouteManager) OpenMultiRouteReader(destinationId Id) MultiRouteReader {
+    return self.OpenMultiRouteReaderWithIpVersion(destinationId, 0)
+}
+
+// opens a reader window that uses only routes that carry the ip version, or either ip version
+// use 0 for a window with all routes
+func (self *RouteManager) OpenMultiRouteReaderWithIpVersion(destinationId Id, ipVersion int) MultiRouteReader {
     self.mutex.Lock()
     defer self.mutex.Unlock()
 
-    return MultiRouteReader(self.readerMatchState.openMultiRouteSelector(destinationId))
+    return MultiRouteReader(self.readerMatchState.openMultiRouteSelector(destinationId, ipVersion))
 }
 
 func (self *RouteManager) CloseMultiRouteReader(r MultiRouteReader) {
@@ -115,12 +181,56 @@ func (self *RouteManager) CloseMultiRouteReader(r MultiRouteReader) {
     self.readerMatchState.closeMultiRouteSelector(r.(*MultiRouteSelector))
 }
 
+// the preferred ip version of the send routes to the destination, e.g. derived from the dns response
+// if no transport with the preferred ip version is available, transports with the other ip version are used
+// use 0 to clear the preference
+func (self *RouteManager) SetDestinationIpVersion(destinationId Id, ipVersion int) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.writerMatchState.setDestinationIpVersion(destinationId, ipVersion)
+}
+
+// pins the send routes to the destination to a single route, e.g. for sticky sessions
+// writes use only the pinned route while it is active,
+// and fall back to all routes while the pinned route is removed from the transports
+func (self *RouteManager) PinDestination(destinationId Id, route Route) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.writerMatchState.setDestinationPinnedRoute(destinationId, route)
+}
+
+func (self *RouteManager) UnpinDestination(destinationId Id) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.writerMatchState.setDestinationPinnedRoute(destinationId, nil)
+}
+
+// limits the send routes for all destinations to the ip version
+// this overrides the per destination preferences
+// use 0 to clear the override
+func (self *RouteManager) ForceIpVersion(ipVersion int) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.writerMatchState.setForceIpVersion(ipVersion)
+}
+
 func (self *RouteManager) UpdateTransport(transport Transport, routes []Route) {
+    self.UpdateTransportWithIpVersion(transport, transportIpVersion(transport), routes)
+}
+
+// annotates the routes of the transport with the ip version they carry, 4 or 6
+// this takes precedence over the transport `IpVersionTransport`
+// use 0 for routes that carry either ip version
+func (self *RouteManager) UpdateTransportWithIpVersion(transport Transport, ipVersion int, routes []Route) {
     self.mutex.Lock()
     defer self.mutex.Unlock()
 
-    self.writerMatchState.updateTransport(transport, routes)
-    self.readerMatchState.updateTransport(transport, routes)
+    self.writerMatchState.updateTransport(transport, ipVersion, routes)
+    self.readerMatchState.updateTransport(transport, ipVersion, routes)
 }
 
 func (self *RouteManager) RemoveTransport(transport Transport) {
@@ -143,26 +253,46 @@ type MatchState struct {
 
     weightedRoutes bool
     matches func(Transport, Id)(bool)
+    routeManagerSettings *RouteManagerSettings
 
     transportRoutes map[Transport][]Route
+    // transport -> 4 or 6. Transports that carry either ip version are not present
+    transportIpVersions map[Transport]int
 
     // destination id -> multi route selectors
     destinationMultiRouteSelectors map[Id]map[*MultiRouteSelector]bool
 
     // transport -> destination ids
     transportMatchedDestinations map[Transport]map[Id]bool
+
+    // 0 means no override
+    forceIpVersion int
+    destinationIpVersions map[Id]int
+
+    destinationPinnedRoutes map[Id]Route
 }
 
 // note weighted routes typically are used by the sender not receiver
-func NewMatchState(ctx context.Context, clientTag string, weightedRoutes bool, matches func(Transport, Id)(bool)) *MatchState {
+func NewMatchState(
+    ctx context.Context,
+    clientTag string,
+    weightedRoutes bool,
+    matches func(Transport, Id)(bool),
+    routeManagerSettings *RouteManagerSettings,
+) *MatchState {
     return &MatchState{
     	ctx: ctx,
         clientTag: clientTag,
         weightedRoutes: weightedRoutes,
         matches: matches,
+        routeManagerSettings: routeManagerSettings,
         transportRoutes: map[Transport][]Route{},
+        transportIpVersions: map[Transport]int{},
         destinationMultiRouteSelectors: map[Id]map[*MultiRouteSelector]bool{},
         transportMatchedDestinations: map[Transport]map[Id]bool{},
+        forceIpVersion: 0,
+        destinationIpVersions: map[Id]int{},
+        destinationPinnedRoutes: map[Id]Route{},
     }
 }
 
@@ -180,6 +310,7 @@ func (self *MatchState) getTransportStats(transport Transport) *RouteStats {
                     netStats.sendByteCount += stats.sendByteCount
                     netStats.receiveCount += stats.receiveCount
                     netStats.receiveByteCount += stats.receiveByteCount
+                    netStats.blockedWriteCount += stats.blockedWriteCount
                 }
             }
         }
@@ -187,8 +318,11 @@ func (self *MatchState) getTransportStats(transport Transport) *RouteStats {
     return netStats
 }
 
-func (self *MatchState) openMultiRouteSelector(destinationId Id) *MultiRouteSelector {
-    multiRouteSelector := NewMultiRouteSelector(self.ctx, self.clientTag, destinationId, self.weightedRoutes)
+func (self *MatchState) openMultiRouteSelector(destinationId Id, ipVersion int) *MultiRouteSelector {
+    multiRouteSelector := NewMultiRouteSelector(self.ctx, self.clientTag, destinationId, ipVersion, self.weightedRoutes, self.routeManagerSettings)
+    if pinnedRoute, ok := self.destinationPinnedRoutes[destinationId]; ok {
+        multiRouteSelector.setPinnedRoute(pinnedRoute)
+    }
 
     multiRouteSelectors, ok := self.destinationMultiRouteSelectors[destinationId]
     if !ok {
@@ -205,9 +339,11 @@ func (self *MatchState) openMultiRouteSelector(destinationId Id) *MultiRouteSele
         }
 
         // use the latest matches state
-        if self.matches(transport, destinationId) {
+        if self.matchesTransport(transport, destinationId) {
             matchedDestinations[destinationId] = true
-            multiRouteSelector.updateTransport(transport, routes)
+            if self.matchesSelectorIpVersion(transport, multiRouteSelector) {
+                multiRouteSelector.updateTransport(transport, routes)
+            }
         }
     }
 
@@ -233,7 +369,101 @@ func (self *MatchState) closeMultiRouteSelector(multiRouteSelector *MultiRouteSe
     }
 }
 
-func (self *MatchState) updateTransport(transport Transport, routes []Route) {
+func (self *MatchState) setDestinationIpVersion(destinationId Id, ipVersion int) {
+    if ipVersion == 0 {
+        delete(self.destinationIpVersions, destinationId)
+    } else {
+        self.destinationIpVersions[destinationId] = ipVersion
+    }
+    self.rematchTransports()
+}
+
+func (self *MatchState) setDestinationPinnedRoute(destinationId Id, route Route) {
+    if route == nil {
+        delete(self.destinationPinnedRoutes, destinationId)
+    } else {
+        self.destinationPinnedRoutes[destinationId] = route
+    }
+    if multiRouteSelectors, ok := self.destinationMultiRouteSelectors[destinationId]; ok {
+        for multiRouteSelector, _ := range multiRouteSelectors {
+            multiRouteSelector.setPinnedRoute(route)
+        }
+    }
+}
+
+func (self *MatchState) setForceIpVersion(ipVersion int) {
+    self.forceIpVersion = ipVersion
+    self.rematchTransports()
+}
+
+func (self *MatchState) matchesTransport(transport Transport, destinationId Id) bool {
+    return self.matches(transport, destinationId) && self.matchesIpVersion(transport, destinationId)
+}
+
+func (self *MatchState) matchesIpVersion(transport Transport, destinationId Id) bool {
+    ipVersion := self.forceIpVersion
+    if ipVersion == 0 {
+        ipVersion = self.destinationIpVersions[destinationId]
+    }
+    if ipVersion == 0 {
+        return true
+    }
+
+    switch self.transportIpVersion(transport) {
+    case 0, ipVersion:
+        return true
+    }
+
+    if self.forceIpVersion != 0 {
+        return false
+    }
+    // the destination preference falls back to the other ip version
+    // when there are no transports with the preferred ip version
+    for otherTransport, _ := range self.transportRoutes {
+        if self.transportIpVersion(otherTransport) == ipVersion && self.matches(otherTransport, destinationId) {
+            return false
+        }
+    }
+    return true
+}
+
+func (self *MatchState) transportIpVersion(transport Transport) int {
+    return self.transportIpVersions[transport]
+}
+
+// an ip version window uses only the transports that carry the ip version or either ip version
+func (self *MatchState) matchesSelectorIpVersion(transport Transport, multiRouteSelector *MultiRouteSelector) bool {
+    switch self.transportIpVersion(transport) {
+    case 0, multiRouteSelector.ipVersion:
+        return true
+    }
+    return multiRouteSelector.ipVersion == 0
+}
+
+// must be called after changing the ip version preferences
+func (self *MatchState) rematchTransports() {
+    for transport, routes := range self.transportRoutes {
+        self.updateTransportMatches(transport, routes)
+    }
+}
+
+func (self *MatchState) updateTransport(transport Transport, ipVersion int, routes []Route) {
+    previousIpVersion := self.transportIpVersion(transport)
+    if ipVersion == 0 || len(routes) == 0 {
+        delete(self.transportIpVersions, transport)
+    } else {
+        self.transportIpVersions[transport] = ipVersion
+    }
+
+    self.updateTransportMatches(transport, routes)
+
+    if (previousIpVersion != 0 || ipVersion != 0) && (self.forceIpVersion != 0 || 0 < len(self.destinationIpVersions)) {
+        // the ip version fallback of the other transports depends on this transport
+        self.rematchTransports()
+    }
+}
+
+func (self *MatchState) updateTransportMatches(transport Transport, routes []Route) {
     if len(routes) == 0 {
         if currentMatchedDestinations, ok := self.transportMatchedDestinations[transport]; ok {
             for destinationId, _ := range currentMatchedDestinations {
@@ -256,10 +486,14 @@ func (self *MatchState) updateTransport(transport Transport, routes []Route) {
         }
 
         for destinationId, multiRouteSelectors := range self.destinationMultiRouteSelectors {
-            if self.matches(transport, destinationId) {
+            if self.matchesTransport(transport, destinationId) {
                 matchedDestinations[destinationId] = true
                 for multiRouteSelector, _ := range multiRouteSelectors {
-                    multiRouteSelector.updateTransport(transport, routes)
+                    if self.matchesSelectorIpVersion(transport, multiRouteSelector) {
+                        multiRouteSelector.updateTransport(transport, routes)
+                    } else {
+                        multiRouteSelector.updateTransport(transport, nil)
+                    }
                 }
             } else if _, ok := currentMatchedDestinations[destinationId]; ok {
                 // no longer matches
@@ -285,7 +519,10 @@ type MultiRouteSelector struct {
     clientTag string
 
     destinationId Id
+    // 4 or 6 for a window that uses only routes with the ip version. 0 uses all routes
+    ipVersion int
     weightedRoutes bool
+    routeManagerSettings *RouteManagerSettings
 
     transportUpdate *Monitor
 
@@ -294,21 +531,34 @@ type MultiRouteSelector struct {
     routeStats map[Route]*RouteStats
     routeActive map[Route]bool
     routeWeight map[Route]float32
+    routeBackpressure map[Route]*RouteBackpressure
+    // nil when not pinned
+    pinnedRoute Route
 }
 
-func NewMultiRouteSelector(ctx context.Context, clientTag string, destinationId Id, weightedRoutes bool) *MultiRouteSelector {
+func NewMultiRouteSelector(
+    ctx context.Context,
+    clientTag string,
+    destinationId Id,
+    ipVersion int,
+    weightedRoutes bool,
+    routeManagerSettings *RouteManagerSettings,
+) *MultiRouteSelector {
 	cancelCtx, cancel := context.WithCancel(ctx)
     return &MultiRouteSelector{
         ctx: cancelCtx,
         cancel: cancel,
         clientTag: clientTag,
         destinationId: destinationId,
+        ipVersion: ipVersion,
         weightedRoutes: weightedRoutes,
+        routeManagerSettings: routeManagerSettings,
         transportUpdate: NewMonitor(),
         transportRoutes: map[Transport][]Route{},
         routeStats: map[Route]*RouteStats{},
         routeActive: map[Route]bool{},
         routeWeight: map[Route]float32{},
+        routeBackpressure: map[Route]*RouteBackpressure{},
     }
 }
 
@@ -327,6 +577,7 @@ func (self *MultiRouteSelector) getTransportStats(transport Transport) *RouteSta
             netStats.sendByteCount += stats.sendByteCount
             netStats.receiveCount += stats.receiveCount
             netStats.receiveByteCount += stats.receiveByteCount
+            netStats.blockedWriteCount += stats.blockedWriteCount
         }
     }
     return netStats
@@ -359,6 +610,7 @@ func (self *MultiRouteSelector) updateTransport(transport Transport, routes []Ro
                 delete(self.routeStats, currentRoute)
                 delete(self.routeActive, currentRoute)
                 delete(self.routeWeight, currentRoute)
+                delete(self.routeBackpressure, currentRoute)
             }
             delete(self.transportRoutes, transport)
         } else {
@@ -373,6 +625,7 @@ func (self *MultiRouteSelector) updateTransport(transport Transport, routes []Ro
                     delete(self.routeStats, currentRoute)
                     delete(self.routeActive, currentRoute)
                     delete(self.routeWeight, currentRoute)
+                    delete(self.routeBackpressure, currentRoute)
                 }
             }
             for _, route := range routes {
@@ -413,6 +666,7 @@ func (self *MultiRouteSelector) updateRouteWeights() {
                 netStats.sendByteCount += stats.sendByteCount
                 netStats.receiveCount += stats.receiveCount
                 netStats.receiveByteCount += stats.receiveByteCount
+                netStats.blockedWriteCount += stats.blockedWriteCount
             }
         }
         transportStats[transport] = netStats
@@ -550,13 +804,171 @@ func (self *MultiRouteSelector) updateReceiveStats(route Route, receiveCount int
     stats.receiveByteCount += receiveByteCount
 }
 
+func (self *MultiRouteSelector) setPinnedRoute(route Route) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    self.pinnedRoute = route
+    self.transportUpdate.NotifyAll()
+}
+
+// the pinned route if it is active,
+// else the active routes that are not skipped for backpressure
+// if all active routes are skipped, returns all active routes
+func (self *MultiRouteSelector) getWriteRoutes() []Route {
+    activeRoutes := self.GetActiveRoutes()
+
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if self.pinnedRoute != nil && self.routeActive[self.pinnedRoute] {
+        return []Route{self.pinnedRoute}
+    }
+
+    now := time.Now()
+    writeRoutes := []Route{}
+    for _, route := range activeRoutes {
+        if backpressure, ok := self.routeBackpressure[route]; ok && now.Before(backpressure.SkipEndTime) {
+            continue
+        }
+        writeRoutes = append(writeRoutes, route)
+    }
+    if len(writeRoutes) == 0 {
+        writeRoutes = activeRoutes
+    }
+    if self.routeManagerSettings.LatencyWeightedWrites {
+        WeightedShuffle(writeRoutes, self.writeWeights(writeRoutes))
+    }
+    return writeRoutes
+}
+
+// the route weight, if weighted, times the inverse write wait, if latency weighted
+// must be called with the mutex
+func (self *MultiRouteSelector) writeWeights(routes []Route) map[Route]float32 {
+    minWriteWait := self.routeManagerSettings.LatencyWeightMinWriteWait
+
+    weights := map[Route]float32{}
+    for _, route := range routes {
+        var weight float32
+        weight = 1.0
+        if self.weightedRoutes {
+            if routeWeight, ok := self.routeWeight[route]; ok {
+                weight = routeWeight
+            }
+        }
+        if self.routeManagerSettings.LatencyWeightedWrites {
+            writeWait := minWriteWait
+            if backpressure, ok := self.routeBackpressure[route]; ok {
+                writeWait = max(writeWait, backpressure.WriteWait)
+            }
+            weight *= float32(float64(minWriteWait) / float64(writeWait))
+        }
+        weights[route] = weight
+    }
+    return weights
+}
+
+// MultiRouteWriter
+func (self *MultiRouteSelector) GetRouteWeights() map[Route]float32 {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    activeRoutes := []Route{}
+    for _, routes := range self.transportRoutes {
+        for _, route := range routes {
+            if self.routeActive[route] {
+                activeRoutes = append(activeRoutes, route)
+            }
+        }
+    }
+
+    weights := self.writeWeights(activeRoutes)
+    var net float32
+    net = 0
+    for _, weight := range weights {
+        net += weight
+    }
+    if 0 < net {
+        for route, weight := range weights {
+            weights[route] = weight / net
+        }
+    }
+    return weights
+}
+
+// must be called with the mutex
+func (self *MultiRouteSelector) getBackpressure(route Route) *RouteBackpressure {
+    backpressure, ok := self.routeBackpressure[route]
+    if !ok {
+        backpressure = &RouteBackpressure{}
+        self.routeBackpressure[route] = backpressure
+    }
+    return backpressure
+}
+
+// the route refused a non-blocking write
+func (self *MultiRouteSelector) updateBlockedWrite(route Route) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, ok := self.routeActive[route]; !ok {
+        // the route was removed
+        return
+    }
+
+    stats, ok := self.routeStats[route]
+    if !ok {
+        stats = NewRouteStats()
+        self.routeStats[route] = stats
+    }
+    stats.blockedWriteCount += 1
+
+    backpressure := self.getBackpressure(route)
+    backpressure.BlockedWriteCount += 1
+    threshold := self.routeManagerSettings.BackpressureWriteThreshold
+    if 0 < threshold && threshold <= backpressure.BlockedWriteCount {
+        glog.V(1).Infof("[mrw]%s->%s skip route after %d blocked writes\n", self.clientTag, self.destinationId, backpressure.BlockedWriteCount)
+        backpressure.BlockedWriteCount = 0
+        backpressure.SkipEndTime = time.Now().Add(self.routeManagerSettings.BackpressureCooldown)
+    }
+}
+
+// the route accepted a write `writeWait` after the write started
+func (self *MultiRouteSelector) updateAcceptedWrite(route Route, writeWait time.Duration) {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    if _, ok := self.routeActive[route]; !ok {
+        // the route was removed
+        return
+    }
+
+    backpressure := self.getBackpressure(route)
+    backpressure.BlockedWriteCount = 0
+    backpressure.WriteWait = time.Duration(
+        (1 - routeWriteWaitWeight) * float64(backpressure.WriteWait) + routeWriteWaitWeight * float64(writeWait),
+    )
+}
+
+// MultiRouteWriter
+func (self *MultiRouteSelector) GetRouteBackpressure() map[Route]RouteBackpressure {
+    self.mutex.Lock()
+    defer self.mutex.Unlock()
+
+    routeBackpressure := map[Route]RouteBackpressure{}
+    for route, backpressure := range self.routeBackpressure {
+        routeBackpressure[route] = *backpressure
+    }
+    return routeBackpressure
+}
+
 // MultiRouteWriter
 func (self *MultiRouteSelector) Write(ctx context.Context, transportFrameBytes []byte, timeout time.Duration) error {
     // write to the first channel available, in random priority
     enterTime := time.Now()
     for {
         notify := self.transportUpdate.NotifyChannel()
-        activeRoutes := self.GetActiveRoutes()
+        activeRoutes := self.getWriteRoutes()
 
         glog.V(2).Infof("[mrw] %s->%s routes = %d\n", self.clientTag, self.destinationId, len(activeRoutes))
 
@@ -566,8 +978,10 @@ func (self *MultiRouteSelector) Write(ctx context.Context, transportFrameBytes [
             case route <- transportFrameBytes:
                 glog.V(2).Infof("[mrw]nb %s->%s\n", self.clientTag, self.destinationId)
                 self.updateSendStats(route, 1, ByteCount(len(transportFrameBytes)))
+                self.updateAcceptedWrite(route, time.Now().Sub(enterTime))
                 return nil
             default:
+                self.updateBlockedWrite(route)
             }
         }
 
@@ -648,6 +1062,7 @@ func (self *MultiRouteSelector) Write(ctx context.Context, transportFrameBytes [
             routeIndex := chosenIndex - routeStartIndex
             route := activeRoutes[routeIndex]
             self.updateSendStats(route, 1, ByteCount(len(transportFrameBytes)))
+            self.updateAcceptedWrite(route, time.Now().Sub(enterTime))
             return nil
         }
     }
@@ -771,6 +1186,43 @@ func (self *MultiRouteSelector) Read(ctx context.Context, timeout time.Duration)
     }
 }
 
+// MultiRouteReader
+// blocks for the first frame as `Read`,
+// then takes the frames already queued on the active routes without blocking
+func (self *MultiRouteSelector) ReadBatch(ctx context.Context, timeout time.Duration, maxCount int) ([][]byte, error) {
+    transportFrameBytes, err := self.Read(ctx, timeout)
+    if err != nil {
+        return nil, err
+    }
+    transportFramesBytes := [][]byte{transportFrameBytes}
+
+    activeRoutes := self.GetActiveRoutes()
+    for len(transportFramesBytes) < maxCount && 0 < len(activeRoutes) {
+        batchCount := len(transportFramesBytes)
+        for i := 0; i < len(activeRoutes) && len(transportFramesBytes) < maxCount; {
+            route := activeRoutes[i]
+            select {
+            case transportFrameBytes, ok := <- route:
+                if ok {
+                    self.updateReceiveStats(route, 1, ByteCount(len(transportFrameBytes)))
+                    transportFramesBytes = append(transportFramesBytes, transportFrameBytes)
+                    i += 1
+                } else {
+                    self.setActive(route, false)
+                    activeRoutes = slices.Delete(activeRoutes, i, i + 1)
+                }
+            default:
+                i += 1
+            }
+        }
+        if batchCount == len(transportFramesBytes) {
+            // no route has a queued frame
+            break
+        }
+    }
+    return transportFramesBytes, nil
+}
+
 func (self *MultiRouteSelector) Close() {
     self.cancel()
 }
@@ -781,6 +1233,8 @@ type RouteStats struct {
     sendByteCount ByteCount
     receiveCount int
     receiveByteCount ByteCount
+    // writes refused by the route. This signals congestion
+    blockedWriteCount int
 }
 
 func NewRouteStats() *RouteStats {
@@ -789,10 +1243,26 @@ func NewRouteStats() *RouteStats {
         sendByteCount: ByteCount(0),
         receiveCount: 0,
         receiveByteCount: ByteCount(0),
+        blockedWriteCount: 0,
     }
 }
 
 
+// the weight of each write in the `WriteWait` moving average
+const routeWriteWaitWeight = 0.1
+
+
+// the write congestion of a route
+type RouteBackpressure struct {
+    // consecutive writes refused by the route
+    BlockedWriteCount int
+    // moving average of the time for the route to accept a write
+    WriteWait time.Duration
+    // the writer skips the route until this time
+    SkipEndTime time.Time
+}
+
+
 // conforms to `Transport`
 type sendGatewayTransport struct {
 	transportId Id
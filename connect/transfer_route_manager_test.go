@@ -7,8 +7,11 @@ import (
     "bytes"
     "time"
     "slices"
+    "fmt"
 
     "github.com/go-playground/assert/v2"
+
+    "bringyour.com/protocol"
 )
 
 
@@ -27,7 +30,7 @@ func TestMultiRoute(t *testing.T) {
 	clientId := NewId()
 	// client := NewClientWithDefaults(ctx, clientId)
 
-	routeManager := NewRouteManager(ctx, "test")
+	routeManager := NewRouteManagerWithDefaults(ctx, "test")
 
 
 	sendTransports := map[Transport][]Route{}
@@ -124,3 +127,653 @@ func TestMultiRoute(t *testing.T) {
 }
 
 
+
+
+func TestMultiRouteIpVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientId := NewId()
+	otherClientId := NewId()
+
+	routeManager := NewRouteManagerWithDefaults(ctx, "test")
+
+	routeManager.SetDestinationIpVersion(clientId, 4)
+
+	multiRouteWriter := routeManager.OpenMultiRouteWriter(clientId)
+	otherMultiRouteWriter := routeManager.OpenMultiRouteWriter(otherClientId)
+
+	route4 := make(chan []byte)
+	route6 := make(chan []byte)
+	routeAny := make(chan []byte)
+	transport4 := newTestingIpVersionTransport(4)
+	transport6 := newTestingIpVersionTransport(6)
+	transportAny := NewSendGatewayTransport()
+
+	routeManager.UpdateTransport(transport4, []Route{route4})
+	routeManager.UpdateTransport(transport6, []Route{route6})
+	routeManager.UpdateTransport(transportAny, []Route{routeAny})
+
+	sortedRoutes := func(routes []Route)([]Route) {
+		slices.SortFunc(routes, func(a Route, b Route)(int) {
+			return routeOrder(a, route4, route6, routeAny) - routeOrder(b, route4, route6, routeAny)
+		})
+		return routes
+	}
+
+	// v4 preference
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4, route6, routeAny}, sortedRoutes(otherMultiRouteWriter.GetActiveRoutes()))
+
+	// the force override wins over the preference
+	routeManager.ForceIpVersion(6)
+	assert.Equal(t, []Route{route6, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+	assert.Equal(t, []Route{route6, routeAny}, sortedRoutes(otherMultiRouteWriter.GetActiveRoutes()))
+
+	routeManager.ForceIpVersion(0)
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4, route6, routeAny}, sortedRoutes(otherMultiRouteWriter.GetActiveRoutes()))
+
+	// the preference falls back when there are no v4 transports
+	routeManager.RemoveTransport(transport4)
+	assert.Equal(t, []Route{route6, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+
+	routeManager.UpdateTransport(transport4, []Route{route4})
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+
+	// the force override does not fall back
+	routeManager.ForceIpVersion(6)
+	routeManager.RemoveTransport(transport6)
+	assert.Equal(t, []Route{routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+
+	routeManager.SetDestinationIpVersion(clientId, 0)
+	routeManager.ForceIpVersion(0)
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+}
+
+
+func TestMultiRouteIpVersionWindows(t *testing.T) {
+	// separate ipv4 and ipv6 windows to the same destination do not mix routes
+	// routes that carry either ip version are in both windows
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientId := NewId()
+
+	routeManager := NewRouteManagerWithDefaults(ctx, "test")
+
+	multiRouteWriter4 := routeManager.OpenMultiRouteWriterWithIpVersion(clientId, 4)
+	multiRouteWriter6 := routeManager.OpenMultiRouteWriterWithIpVersion(clientId, 6)
+	multiRouteWriter := routeManager.OpenMultiRouteWriter(clientId)
+	multiRouteReader6 := routeManager.OpenMultiRouteReaderWithIpVersion(clientId, 6)
+
+	route4 := make(chan []byte)
+	route6 := make(chan []byte)
+	routeAny := make(chan []byte)
+	transport4 := NewSendGatewayTransport()
+	transport6 := newTestingIpVersionTransport(6)
+	transportAny := NewSendGatewayTransport()
+
+	// annotated routes and an `IpVersionTransport`
+	routeManager.UpdateTransportWithIpVersion(transport4, 4, []Route{route4})
+	routeManager.UpdateTransport(transport6, []Route{route6})
+	routeManager.UpdateTransport(transportAny, []Route{routeAny})
+
+	sortedRoutes := func(routes []Route)([]Route) {
+		slices.SortFunc(routes, func(a Route, b Route)(int) {
+			return routeOrder(a, route4, route6, routeAny) - routeOrder(b, route4, route6, routeAny)
+		})
+		return routes
+	}
+
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter4.GetActiveRoutes()))
+	assert.Equal(t, []Route{route6, routeAny}, sortedRoutes(multiRouteWriter6.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4, route6, routeAny}, sortedRoutes(multiRouteWriter.GetActiveRoutes()))
+	assert.Equal(t, 0, len(multiRouteReader6.GetActiveRoutes()))
+
+	receiveRoute4 := make(chan []byte)
+	receiveRoute6 := make(chan []byte)
+	receiveTransport4 := NewReceiveGatewayTransport()
+	receiveTransport6 := NewReceiveGatewayTransport()
+	routeManager.UpdateTransportWithIpVersion(receiveTransport4, 4, []Route{receiveRoute4})
+	routeManager.UpdateTransportWithIpVersion(receiveTransport6, 6, []Route{receiveRoute6})
+	assert.Equal(t, []Route{receiveRoute6}, multiRouteReader6.GetActiveRoutes())
+
+	// the annotation can change
+	routeManager.UpdateTransportWithIpVersion(transport4, 6, []Route{route4})
+	assert.Equal(t, []Route{routeAny}, sortedRoutes(multiRouteWriter4.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4, route6, routeAny}, sortedRoutes(multiRouteWriter6.GetActiveRoutes()))
+
+	routeManager.UpdateTransportWithIpVersion(transport4, 0, []Route{route4})
+	assert.Equal(t, []Route{route4, routeAny}, sortedRoutes(multiRouteWriter4.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4, route6, routeAny}, sortedRoutes(multiRouteWriter6.GetActiveRoutes()))
+
+	// a window without a matching route does not fall back to the other ip version
+	routeManager.RemoveTransport(transport6)
+	routeManager.RemoveTransport(transport4)
+	routeManager.RemoveTransport(transportAny)
+	routeManager.UpdateTransportWithIpVersion(transport4, 4, []Route{route4})
+	assert.Equal(t, 0, len(multiRouteWriter6.GetActiveRoutes()))
+	assert.Equal(t, []Route{route4}, sortedRoutes(multiRouteWriter4.GetActiveRoutes()))
+}
+
+
+func TestClientIpVersion(t *testing.T) {
+	// client sends to a destination use the routes of the preferred ip version,
+	// and the force override wins over the preference
+
+	timeout := 1 * time.Second
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer client.Cancel()
+
+	destinationId := NewId()
+	client.ContractManager().AddNoContractPeer(destinationId)
+
+	route4 := make(chan []byte, 4 * n)
+	route6 := make(chan []byte, 4 * n)
+	client.RouteManager().UpdateTransport(newTestingIpVersionTransport(4), []Route{route4})
+	client.RouteManager().UpdateTransport(newTestingIpVersionTransport(6), []Route{route6})
+
+	sendAndCount := func()(int, int) {
+		for i := 0; i < n; i += 1 {
+			success := client.SendWithTimeout(
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: fmt.Sprintf("hi %d", i),
+				}),
+				destinationId,
+				func(err error) {},
+				timeout,
+				NoAck(),
+			)
+			assert.Equal(t, true, success)
+		}
+		count4 := 0
+		count6 := 0
+		for count4 + count6 < n {
+			select {
+			case <- route4:
+				count4 += 1
+			case <- route6:
+				count6 += 1
+			case <- time.After(timeout):
+				t.Fatal("Missing send.")
+			}
+		}
+		return count4, count6
+	}
+
+	client.SetDestinationIpVersion(destinationId, 4)
+	count4, count6 := sendAndCount()
+	assert.Equal(t, n, count4)
+	assert.Equal(t, 0, count6)
+
+	client.ForceIpVersion(6)
+	count4, count6 = sendAndCount()
+	assert.Equal(t, 0, count4)
+	assert.Equal(t, n, count6)
+}
+
+
+func routeOrder(route Route, orderedRoutes ...Route) int {
+	return slices.Index(orderedRoutes, route)
+}
+
+
+// conforms to `Transport` and `IpVersionTransport`
+type testingIpVersionTransport struct {
+	sendGatewayTransport
+	ipVersion int
+}
+
+func newTestingIpVersionTransport(ipVersion int) *testingIpVersionTransport {
+	return &testingIpVersionTransport{
+		sendGatewayTransport: sendGatewayTransport{
+			transportId: NewId(),
+		},
+		ipVersion: ipVersion,
+	}
+}
+
+func (self *testingIpVersionTransport) IpVersion() int {
+	return self.ipVersion
+}
+
+
+func TestMultiRouteBackpressure(t *testing.T) {
+	// one fast route and one slow route that never accepts writes
+	// the slow route is skipped for the cooldown, then tried again
+
+	writeTimeout := 1 * time.Second
+	cooldown := 500 * time.Millisecond
+	n := 128
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultRouteManagerSettings()
+	settings.BackpressureWriteThreshold = 4
+	settings.BackpressureCooldown = cooldown
+	routeManager := NewRouteManager(ctx, "test", settings)
+
+	destinationId := NewId()
+	multiRouteWriter := routeManager.OpenMultiRouteWriter(destinationId)
+	defer routeManager.CloseMultiRouteWriter(multiRouteWriter)
+
+	fastRoute := make(chan []byte, 2 * n)
+	slowRoute := make(chan []byte)
+	fastTransport := NewSendGatewayTransport()
+	slowTransport := NewSendGatewayTransport()
+	routeManager.UpdateTransport(fastTransport, []Route{fastRoute})
+	routeManager.UpdateTransport(slowTransport, []Route{slowRoute})
+
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, n, len(fastRoute))
+
+	backpressure := multiRouteWriter.GetRouteBackpressure()[slowRoute]
+	assert.Equal(t, true, time.Now().Before(backpressure.SkipEndTime))
+	skipEndTime := backpressure.SkipEndTime
+
+	slowStats, _ := routeManager.getTransportStats(slowTransport)
+	assert.Equal(t, true, settings.BackpressureWriteThreshold <= slowStats.blockedWriteCount)
+	fastStats, _ := routeManager.getTransportStats(fastTransport)
+	assert.Equal(t, 0, fastStats.blockedWriteCount)
+
+	// the skipped route is not tried during the cooldown
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	backpressure = multiRouteWriter.GetRouteBackpressure()[slowRoute]
+	if time.Now().Before(skipEndTime) {
+		assert.Equal(t, 0, backpressure.BlockedWriteCount)
+		assert.Equal(t, skipEndTime, backpressure.SkipEndTime)
+	}
+	for len(fastRoute) > 0 {
+		<- fastRoute
+	}
+
+	// after the cooldown the route is tried again
+	time.Sleep(skipEndTime.Sub(time.Now()))
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	backpressure = multiRouteWriter.GetRouteBackpressure()[slowRoute]
+	assert.Equal(t, true, skipEndTime.Before(backpressure.SkipEndTime))
+
+	// the fast route accepts without waiting
+	assert.Equal(t, true, multiRouteWriter.GetRouteBackpressure()[fastRoute].WriteWait < writeTimeout)
+}
+
+
+func TestMultiRoutePinDestination(t *testing.T) {
+	// writes to a pinned destination use only the pinned route
+	// and fall back to the other routes when the pinned route is removed
+
+	writeTimeout := 1 * time.Second
+	n := 64
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+	routeManager := client.RouteManager()
+
+	destinationId := NewId()
+	otherDestinationId := NewId()
+
+	aRoute := make(chan []byte, 4 * n)
+	bRoute := make(chan []byte, 4 * n)
+	aTransport := NewSendGatewayTransport()
+	bTransport := NewSendGatewayTransport()
+	routeManager.UpdateTransport(aTransport, []Route{aRoute})
+	routeManager.UpdateTransport(bTransport, []Route{bRoute})
+
+	destination := NewTransferPath(Path{ClientId: client.ClientId()}, Path{ClientId: destinationId})
+	otherDestination := NewTransferPath(Path{ClientId: client.ClientId()}, Path{ClientId: otherDestinationId})
+
+	// stream destinations cannot be pinned
+	err := client.PinDestination(NewTransferPath(Path{ClientId: client.ClientId()}, Path{StreamId: NewId()}), aRoute)
+	assert.NotEqual(t, nil, err)
+
+	// pin before and after the writer is opened
+	err = client.PinDestination(otherDestination, aRoute)
+	assert.Equal(t, nil, err)
+
+	multiRouteWriter := routeManager.OpenMultiRouteWriter(destinationId)
+	defer routeManager.CloseMultiRouteWriter(multiRouteWriter)
+	otherMultiRouteWriter := routeManager.OpenMultiRouteWriter(otherDestinationId)
+	defer routeManager.CloseMultiRouteWriter(otherMultiRouteWriter)
+
+	err = client.PinDestination(destination, bRoute)
+	assert.Equal(t, nil, err)
+
+	drain := func(route Route)(int) {
+		count := 0
+		for 0 < len(route) {
+			<- route
+			count += 1
+		}
+		return count
+	}
+
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 0, drain(aRoute))
+	assert.Equal(t, n, drain(bRoute))
+
+	for i := 0; i < n; i += 1 {
+		err := otherMultiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, n, drain(aRoute))
+	assert.Equal(t, 0, drain(bRoute))
+
+	// the pinned route is removed, fall back to the other routes
+	routeManager.RemoveTransport(bTransport)
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, n, drain(aRoute))
+
+	// the pinned route returns
+	routeManager.UpdateTransport(bTransport, []Route{bRoute})
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, 0, drain(aRoute))
+	assert.Equal(t, n, drain(bRoute))
+
+	// unpinned writes use all routes
+	err = client.UnpinDestination(destination)
+	assert.Equal(t, nil, err)
+	for i := 0; i < n; i += 1 {
+		err := multiRouteWriter.Write(ctx, []byte{byte(i)}, writeTimeout)
+		assert.Equal(t, nil, err)
+	}
+	aCount := drain(aRoute)
+	bCount := drain(bRoute)
+	assert.Equal(t, n, aCount + bCount)
+	assert.Equal(t, true, 0 < aCount)
+	assert.Equal(t, true, 0 < bCount)
+}
+
+
+func TestMultiRouteLatencyWeightedWrites(t *testing.T) {
+	// with latency weighting, the route with the lower write wait is tried first more often
+	// without, the routes are tried first evenly
+
+	n := 4096
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, latencyWeighted := range []bool{false, true} {
+		settings := DefaultRouteManagerSettings()
+		settings.LatencyWeightedWrites = latencyWeighted
+		routeManager := NewRouteManager(ctx, "test", settings)
+
+		destinationId := NewId()
+		multiRouteWriter := routeManager.OpenMultiRouteWriter(destinationId)
+
+		fastRoute := make(chan []byte)
+		slowRoute := make(chan []byte)
+		routeManager.UpdateTransport(NewSendGatewayTransport(), []Route{fastRoute})
+		routeManager.UpdateTransport(NewSendGatewayTransport(), []Route{slowRoute})
+
+		multiRouteSelector := multiRouteWriter.(*MultiRouteSelector)
+		for i := 0; i < 64; i += 1 {
+			multiRouteSelector.updateAcceptedWrite(fastRoute, 1 * time.Millisecond)
+			multiRouteSelector.updateAcceptedWrite(slowRoute, 9 * time.Millisecond)
+		}
+
+		weights := multiRouteWriter.GetRouteWeights()
+		fastFirstCount := 0
+		for i := 0; i < n; i += 1 {
+			if writeRoutes := multiRouteSelector.getWriteRoutes(); writeRoutes[0] == fastRoute {
+				fastFirstCount += 1
+			}
+		}
+		fastFirst := float64(fastFirstCount) / float64(n)
+
+		if latencyWeighted {
+			// the weights are inversely proportional to the write wait, 9:1
+			assert.Equal(t, true, 0.85 < weights[fastRoute] && weights[fastRoute] < 0.95)
+			assert.Equal(t, true, 0.8 < fastFirst)
+		} else {
+			assert.Equal(t, weights[fastRoute], weights[slowRoute])
+			assert.Equal(t, true, 0.4 < fastFirst && fastFirst < 0.6)
+		}
+
+		routeManager.CloseMultiRouteWriter(multiRouteWriter)
+	}
+}
+
+
+func TestDumpRoutes(t *testing.T) {
+	// the dump lists each transport with its routes and matched destinations,
+	// and each destination with its writers and readers
+
+	writeTimeout := 1 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeManager := NewRouteManagerWithDefaults(ctx, "test")
+
+	// order the destinations to match the dump
+	destinationIds := []Id{NewId(), NewId()}
+	slices.SortFunc(destinationIds, compareIds)
+	aDestinationId := destinationIds[0]
+	bDestinationId := destinationIds[1]
+
+	platformRoute := make(chan []byte, 16)
+	clientRoutes := []Route{make(chan []byte, 16), make(chan []byte, 16)}
+	sendTransport := NewSendGatewayTransport()
+	receiveTransport := NewReceiveGatewayTransport()
+	clientTransport := NewSendClientTransport(aDestinationId)
+	routeManager.UpdateTransport(sendTransport, []Route{platformRoute})
+	routeManager.UpdateTransport(receiveTransport, []Route{platformRoute})
+	routeManager.UpdateTransport(clientTransport, clientRoutes)
+
+	aWriter := routeManager.OpenMultiRouteWriter(aDestinationId)
+	defer routeManager.CloseMultiRouteWriter(aWriter)
+	bWriter := routeManager.OpenMultiRouteWriter(bDestinationId)
+	aReader := routeManager.OpenMultiRouteReader(aDestinationId)
+	defer routeManager.CloseMultiRouteReader(aReader)
+	routeManager.SetDestinationIpVersion(bDestinationId, 4)
+
+	err := bWriter.Write(ctx, []byte{1}, writeTimeout)
+	assert.Equal(t, nil, err)
+
+	transportSnapshots := func(snapshot *RoutingTableSnapshot)(map[Id]*TransportSnapshot) {
+		transportSnapshots := map[Id]*TransportSnapshot{}
+		for _, transportSnapshot := range snapshot.Transports {
+			transportSnapshots[transportSnapshot.TransportId] = transportSnapshot
+		}
+		return transportSnapshots
+	}
+
+	snapshot := routeManager.DumpRoutes()
+	assert.Equal(t, 0, snapshot.ForceIpVersion)
+	assert.Equal(t, 3, len(snapshot.Transports))
+	transports := transportSnapshots(snapshot)
+
+	sendSnapshot := transports[sendTransport.TransportId()]
+	assert.Equal(t, "platform", sendSnapshot.TransportType)
+	assert.Equal(t, 1, sendSnapshot.RouteCount)
+	assert.Equal(t, []Id{aDestinationId, bDestinationId}, sendSnapshot.WriterDestinationIds)
+	assert.Equal(t, []Id{}, sendSnapshot.ReaderDestinationIds)
+	// the write to b used the only route
+	assert.Equal(t, 1, sendSnapshot.SendCount)
+	assert.Equal(t, ByteCount(1), sendSnapshot.SendByteCount)
+
+	receiveSnapshot := transports[receiveTransport.TransportId()]
+	assert.Equal(t, "platform", receiveSnapshot.TransportType)
+	assert.Equal(t, 1, receiveSnapshot.RouteCount)
+	assert.Equal(t, []Id{}, receiveSnapshot.WriterDestinationIds)
+	assert.Equal(t, []Id{aDestinationId}, receiveSnapshot.ReaderDestinationIds)
+
+	clientSnapshot := transports[clientTransport.TransportId()]
+	assert.Equal(t, "client", clientSnapshot.TransportType)
+	assert.Equal(t, 2, clientSnapshot.RouteCount)
+	assert.Equal(t, []Id{aDestinationId}, clientSnapshot.WriterDestinationIds)
+
+	assert.Equal(t, []*DestinationRouteSnapshot{
+		&DestinationRouteSnapshot{
+			DestinationId: aDestinationId,
+			WriterCount: 1,
+			ReaderCount: 1,
+			ActiveWriterRouteCount: 3,
+			ActiveReaderRouteCount: 1,
+		},
+		&DestinationRouteSnapshot{
+			DestinationId: bDestinationId,
+			IpVersion: 4,
+			WriterCount: 1,
+			ActiveWriterRouteCount: 1,
+		},
+	}, snapshot.Destinations)
+
+	// the dump follows the changes
+	routeManager.CloseMultiRouteWriter(bWriter)
+	routeManager.RemoveTransport(clientTransport)
+	routeManager.PinDestination(aDestinationId, platformRoute)
+
+	snapshot = routeManager.DumpRoutes()
+	assert.Equal(t, 2, len(snapshot.Transports))
+	transports = transportSnapshots(snapshot)
+	assert.Equal(t, []Id{aDestinationId}, transports[sendTransport.TransportId()].WriterDestinationIds)
+	assert.Equal(t, []*DestinationRouteSnapshot{
+		&DestinationRouteSnapshot{
+			DestinationId: aDestinationId,
+			Pinned: true,
+			WriterCount: 1,
+			ReaderCount: 1,
+			ActiveWriterRouteCount: 1,
+			ActiveReaderRouteCount: 1,
+		},
+		&DestinationRouteSnapshot{
+			DestinationId: bDestinationId,
+			IpVersion: 4,
+		},
+	}, snapshot.Destinations)
+}
+
+
+func TestMultiRouteReadBatch(t *testing.T) {
+	// a batch has the first frame and then the frames already queued on the routes, up to the max count
+
+	timeout := 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routeManager := NewRouteManagerWithDefaults(ctx, "test")
+
+	clientId := NewId()
+	multiRouteReader := routeManager.OpenMultiRouteReader(clientId)
+	defer routeManager.CloseMultiRouteReader(multiRouteReader)
+
+	aRoute := make(chan []byte, 8)
+	bRoute := make(chan []byte, 8)
+	routeManager.UpdateTransport(NewReceiveGatewayTransport(), []Route{aRoute})
+	routeManager.UpdateTransport(NewReceiveGatewayTransport(), []Route{bRoute})
+
+	for i := 0; i < 5; i += 1 {
+		aRoute <- []byte{byte(i)}
+		bRoute <- []byte{byte(5 + i)}
+	}
+
+	messages := [][]byte{}
+	b, err := multiRouteReader.ReadBatch(ctx, timeout, 8)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 8, len(b))
+	messages = append(messages, b...)
+
+	// a route that closes is dropped from the batch
+	close(aRoute)
+	b, err = multiRouteReader.ReadBatch(ctx, timeout, 8)
+	assert.Equal(t, nil, err)
+	messages = append(messages, b...)
+	for len(messages) < 10 {
+		b, err = multiRouteReader.ReadBatch(ctx, timeout, 8)
+		assert.Equal(t, nil, err)
+		messages = append(messages, b...)
+	}
+
+	slices.SortFunc(messages, bytes.Compare)
+	for i := 0; i < 10; i += 1 {
+		assert.Equal(t, []byte{byte(i)}, messages[i])
+	}
+
+	_, err = multiRouteReader.ReadBatch(ctx, timeout, 8)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, []Route{bRoute}, multiRouteReader.GetActiveRoutes())
+}
+
+
+func BenchmarkMultiRouteRead(b *testing.B) {
+	// compares reading one frame per read with reading a batch per read
+	// the routes are filled before the timer starts
+
+	routeCount := 4
+	transportFrameBytes := make([]byte, 1024)
+
+	for _, batchSize := range []int{1, 32} {
+		name := "read"
+		if 1 < batchSize {
+			name = fmt.Sprintf("batch%d", batchSize)
+		}
+		b.Run(name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			routeManager := NewRouteManagerWithDefaults(ctx, "test")
+
+			clientId := NewId()
+			multiRouteReader := routeManager.OpenMultiRouteReader(clientId)
+			defer routeManager.CloseMultiRouteReader(multiRouteReader)
+
+			for i := 0; i < routeCount; i += 1 {
+				route := make(chan []byte, b.N / routeCount + 1)
+				for j := i; j < b.N; j += routeCount {
+					route <- transportFrameBytes
+				}
+				routeManager.UpdateTransport(NewReceiveGatewayTransport(), []Route{route})
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; {
+				if batchSize <= 1 {
+					_, err := multiRouteReader.Read(ctx, -1)
+					if err != nil {
+						b.Fatal(err)
+					}
+					n += 1
+				} else {
+					transportFramesBytes, err := multiRouteReader.ReadBatch(ctx, -1, batchSize)
+					if err != nil {
+						b.Fatal(err)
+					}
+					n += len(transportFramesBytes)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package connect
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+
+// A snapshot of the route manager for diagnosing why traffic is not flowing.
+// Each transport lists its routes and the destinations it is matched to,
+// and each destination lists its open writers and readers and the state of their routes.
+// A destination with open writers but no active routes has no transport that matches it.
+
+
+type RoutingTableSnapshot struct {
+	// 4 or 6 if set with `ForceIpVersion`
+	ForceIpVersion int
+	// ordered by transport id
+	Transports []*TransportSnapshot
+	// ordered by destination id
+	Destinations []*DestinationRouteSnapshot
+}
+
+
+type TransportSnapshot struct {
+	TransportId Id
+	// "platform", "client", or the go type of other transports
+	TransportType string
+	Priority int
+	// 4, 6, or 0 for either
+	IpVersion int
+	RouteCount int
+	// destinations with open writers or readers that the transport matches
+	WriterDestinationIds []Id
+	ReaderDestinationIds []Id
+	// summed over the matched writers and readers since the last route weight update
+	SendCount int
+	SendByteCount ByteCount
+	ReceiveCount int
+	ReceiveByteCount ByteCount
+	// writes refused by the routes. This signals congestion
+	BlockedWriteCount int
+}
+
+
+type DestinationRouteSnapshot struct {
+	DestinationId Id
+	// 4 or 6 if set with `SetDestinationIpVersion`
+	IpVersion int
+	// pinned with `PinDestination`
+	Pinned bool
+	// open multi route writers and readers
+	WriterCount int
+	ReaderCount int
+	// routes summed over the open writers and readers
+	ActiveWriterRouteCount int
+	InactiveWriterRouteCount int
+	ActiveReaderRouteCount int
+	InactiveReaderRouteCount int
+}
+
+
+func (self *RouteManager) DumpRoutes() *RoutingTableSnapshot {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	transportSnapshots := map[Transport]*TransportSnapshot{}
+	destinationSnapshots := map[Id]*DestinationRouteSnapshot{}
+	self.writerMatchState.snapshot(true, transportSnapshots, destinationSnapshots)
+	self.readerMatchState.snapshot(false, transportSnapshots, destinationSnapshots)
+
+	routingTableSnapshot := &RoutingTableSnapshot{
+		ForceIpVersion: self.writerMatchState.forceIpVersion,
+		Transports: []*TransportSnapshot{},
+		Destinations: []*DestinationRouteSnapshot{},
+	}
+	for _, transportSnapshot := range transportSnapshots {
+		slices.SortFunc(transportSnapshot.WriterDestinationIds, compareIds)
+		slices.SortFunc(transportSnapshot.ReaderDestinationIds, compareIds)
+		routingTableSnapshot.Transports = append(routingTableSnapshot.Transports, transportSnapshot)
+	}
+	slices.SortFunc(routingTableSnapshot.Transports, func(a *TransportSnapshot, b *TransportSnapshot)(int) {
+		return compareIds(a.TransportId, b.TransportId)
+	})
+	for _, destinationSnapshot := range destinationSnapshots {
+		routingTableSnapshot.Destinations = append(routingTableSnapshot.Destinations, destinationSnapshot)
+	}
+	slices.SortFunc(routingTableSnapshot.Destinations, func(a *DestinationRouteSnapshot, b *DestinationRouteSnapshot)(int) {
+		return compareIds(a.DestinationId, b.DestinationId)
+	})
+	return routingTableSnapshot
+}
+
+
+func (self *MatchState) snapshot(
+	writer bool,
+	transportSnapshots map[Transport]*TransportSnapshot,
+	destinationSnapshots map[Id]*DestinationRouteSnapshot,
+) {
+	destinationSnapshot := func(destinationId Id)(*DestinationRouteSnapshot) {
+		snapshot, ok := destinationSnapshots[destinationId]
+		if !ok {
+			snapshot = &DestinationRouteSnapshot{
+				DestinationId: destinationId,
+				IpVersion: self.destinationIpVersions[destinationId],
+			}
+			_, snapshot.Pinned = self.destinationPinnedRoutes[destinationId]
+			destinationSnapshots[destinationId] = snapshot
+		}
+		return snapshot
+	}
+
+	for transport, routes := range self.transportRoutes {
+		snapshot, ok := transportSnapshots[transport]
+		if !ok {
+			snapshot = &TransportSnapshot{
+				TransportId: transport.TransportId(),
+				TransportType: transportType(transport),
+				Priority: transport.Priority(),
+				IpVersion: self.transportIpVersion(transport),
+				RouteCount: len(routes),
+				WriterDestinationIds: []Id{},
+				ReaderDestinationIds: []Id{},
+			}
+			transportSnapshots[transport] = snapshot
+		}
+		destinationIds := []Id{}
+		for destinationId, _ := range self.transportMatchedDestinations[transport] {
+			destinationIds = append(destinationIds, destinationId)
+		}
+		if writer {
+			snapshot.WriterDestinationIds = destinationIds
+		} else {
+			snapshot.ReaderDestinationIds = destinationIds
+		}
+		if stats := self.getTransportStats(transport); stats != nil {
+			snapshot.SendCount += stats.sendCount
+			snapshot.SendByteCount += stats.sendByteCount
+			snapshot.ReceiveCount += stats.receiveCount
+			snapshot.ReceiveByteCount += stats.receiveByteCount
+			snapshot.BlockedWriteCount += stats.blockedWriteCount
+		}
+	}
+
+	for destinationId, multiRouteSelectors := range self.destinationMultiRouteSelectors {
+		snapshot := destinationSnapshot(destinationId)
+		for multiRouteSelector, _ := range multiRouteSelectors {
+			activeCount, inactiveCount := multiRouteSelector.routeCounts()
+			if writer {
+				snapshot.WriterCount += 1
+				snapshot.ActiveWriterRouteCount += activeCount
+				snapshot.InactiveWriterRouteCount += inactiveCount
+			} else {
+				snapshot.ReaderCount += 1
+				snapshot.ActiveReaderRouteCount += activeCount
+				snapshot.InactiveReaderRouteCount += inactiveCount
+			}
+		}
+	}
+	// destinations with settings but no open writers or readers
+	for destinationId, _ := range self.destinationIpVersions {
+		destinationSnapshot(destinationId)
+	}
+	for destinationId, _ := range self.destinationPinnedRoutes {
+		destinationSnapshot(destinationId)
+	}
+}
+
+
+func (self *MultiRouteSelector) routeCounts() (activeCount int, inactiveCount int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, routes := range self.transportRoutes {
+		for _, route := range routes {
+			if self.routeActive[route] {
+				activeCount += 1
+			} else {
+				inactiveCount += 1
+			}
+		}
+	}
+	return
+}
+
+
+func transportType(transport Transport) string {
+	switch transport.(type) {
+	case *sendGatewayTransport, *receiveGatewayTransport:
+		return "platform"
+	case *sendClientTransport:
+		return "client"
+	default:
+		return fmt.Sprintf("%T", transport)
+	}
+}
+
+
+func compareIds(a Id, b Id) int {
+	return strings.Compare(a.String(), b.String())
+}
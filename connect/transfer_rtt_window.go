@@ -0,0 +1,183 @@
+package connect
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+
+// The most recent rtt samples of a send sequence, for monitoring the rtt distribution.
+// The smoothed rtt of the sequence (`TransferStats.Rtt`) is used for timing,
+// and this window shows the spread of the samples behind it.
+// With a half life, older samples are weighted down continuously,
+// so that the stats follow a path change, e.g. wifi to cellular, before the old samples leave the window.
+// See `SendBufferSettings.RttWindowSize`, `SendBufferSettings.RttWindowHalfLife`, and `Client.RttStats`
+
+
+type RttStats struct {
+	// samples in the window
+	SampleCount int
+	Mean time.Duration
+	P50 time.Duration
+	P95 time.Duration
+}
+
+func newRttStats(samples []time.Duration) *RttStats {
+	return newWeightedRttStats(samples, nil)
+}
+
+// nil weights weight all samples equally
+func newWeightedRttStats(samples []time.Duration, weights []float64) *RttStats {
+	stats := &RttStats{
+		SampleCount: len(samples),
+	}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	if weights == nil {
+		sortedSamples := slices.Clone(samples)
+		slices.Sort(sortedSamples)
+
+		var sum time.Duration
+		for _, sample := range sortedSamples {
+			sum += sample
+		}
+		stats.Mean = sum / time.Duration(len(sortedSamples))
+		stats.P50 = rttPercentile(sortedSamples, 0.5)
+		stats.P95 = rttPercentile(sortedSamples, 0.95)
+		return stats
+	}
+
+	order := make([]int, len(samples))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a int, b int)(int) {
+		return int(samples[a] - samples[b])
+	})
+
+	var weightSum float64
+	var sum float64
+	for _, i := range order {
+		weightSum += weights[i]
+		sum += weights[i] * float64(samples[i])
+	}
+	if weightSum <= 0 {
+		return newWeightedRttStats(samples, nil)
+	}
+	stats.Mean = time.Duration(math.Round(sum / weightSum))
+	stats.P50 = rttWeightedPercentile(samples, weights, order, weightSum, 0.5)
+	stats.P95 = rttWeightedPercentile(samples, weights, order, weightSum, 0.95)
+	return stats
+}
+
+// nearest rank percentile of sorted samples
+func rttPercentile(sortedSamples []time.Duration, p float64) time.Duration {
+	rank := int(float64(len(sortedSamples)) * p + 0.5)
+	rank = min(max(rank, 1), len(sortedSamples))
+	return sortedSamples[rank - 1]
+}
+
+
+// the first sample, in sorted order, where the cumulative weight reaches `p` of the total
+func rttWeightedPercentile(samples []time.Duration, weights []float64, order []int, weightSum float64, p float64) time.Duration {
+	target := weightSum * p
+	var cumulativeWeight float64
+	for _, i := range order {
+		cumulativeWeight += weights[i]
+		if target <= cumulativeWeight {
+			return samples[i]
+		}
+	}
+	return samples[order[len(order) - 1]]
+}
+
+
+// a ring of the last `size` samples
+// not safe for concurrent use
+type RttWindow struct {
+	size int
+	// 0 weights all samples equally
+	halfLife time.Duration
+	clock Clock
+	samples []time.Duration
+	sampleTimes []time.Time
+	// the index of the next sample when the window is full
+	next int
+}
+
+func NewRttWindow(size int) *RttWindow {
+	return NewRttWindowWithHalfLife(size, 0, RealClock)
+}
+
+// each sample is weighted by 1/2 for every `halfLife` of its age on `clock`
+// 0 weights all samples equally
+func NewRttWindowWithHalfLife(size int, halfLife time.Duration, clock Clock) *RttWindow {
+	return &RttWindow{
+		size: size,
+		halfLife: halfLife,
+		clock: clock,
+		samples: []time.Duration{},
+		sampleTimes: []time.Time{},
+	}
+}
+
+func (self *RttWindow) Add(rtt time.Duration) {
+	if self.size <= 0 {
+		return
+	}
+	now := self.clock.Now()
+	if len(self.samples) < self.size {
+		self.samples = append(self.samples, rtt)
+		self.sampleTimes = append(self.sampleTimes, now)
+	} else {
+		self.samples[self.next] = rtt
+		self.sampleTimes[self.next] = now
+		self.next = (self.next + 1) % self.size
+	}
+}
+
+func (self *RttWindow) SampleCount() int {
+	return len(self.samples)
+}
+
+// 0 if no samples
+func (self *RttWindow) Mean() time.Duration {
+	return self.Stats().Mean
+}
+
+// 0 if no samples
+func (self *RttWindow) P50() time.Duration {
+	return self.Stats().P50
+}
+
+// 0 if no samples
+func (self *RttWindow) P95() time.Duration {
+	return self.Stats().P95
+}
+
+func (self *RttWindow) Stats() *RttStats {
+	return newWeightedRttStats(self.samples, self.Weights())
+}
+
+// a copy of the samples, in no particular order
+func (self *RttWindow) Samples() []time.Duration {
+	return slices.Clone(self.samples)
+}
+
+// the current weight of each sample, in the order of `Samples`
+// nil when all samples are weighted equally
+func (self *RttWindow) Weights() []float64 {
+	if self.halfLife <= 0 {
+		return nil
+	}
+	now := self.clock.Now()
+	weights := make([]float64, len(self.sampleTimes))
+	for i, sampleTime := range self.sampleTimes {
+		age := max(0, now.Sub(sampleTime))
+		weights[i] = math.Pow(0.5, float64(age) / float64(self.halfLife))
+	}
+	return weights
+}
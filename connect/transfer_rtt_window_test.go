@@ -0,0 +1,151 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestRttWindow(t *testing.T) {
+	// the window keeps the last samples, and the stats are over the window
+
+	rttWindow := NewRttWindow(20)
+	assert.Equal(t, 0, rttWindow.SampleCount())
+	assert.Equal(t, time.Duration(0), rttWindow.Mean())
+	assert.Equal(t, time.Duration(0), rttWindow.P95())
+
+	// these are replaced
+	for i := 0; i < 10; i += 1 {
+		rttWindow.Add(time.Hour)
+	}
+	for i := 1; i <= 20; i += 1 {
+		rttWindow.Add(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 20, rttWindow.SampleCount())
+	// (1 + ... + 20) / 20
+	assert.Equal(t, 10500 * time.Microsecond, rttWindow.Mean())
+	assert.Equal(t, 10 * time.Millisecond, rttWindow.P50())
+	assert.Equal(t, 19 * time.Millisecond, rttWindow.P95())
+
+	stats := rttWindow.Stats()
+	assert.Equal(t, 20, stats.SampleCount)
+	assert.Equal(t, rttWindow.Mean(), stats.Mean)
+	assert.Equal(t, rttWindow.P50(), stats.P50)
+	assert.Equal(t, rttWindow.P95(), stats.P95)
+
+	// disabled
+	rttWindow = NewRttWindow(0)
+	rttWindow.Add(time.Millisecond)
+	assert.Equal(t, 0, rttWindow.SampleCount())
+}
+
+
+func TestRttWindowHalfLife(t *testing.T) {
+	// after a step change of the rtt, the stats of a window with a half life
+	// converge to the new rtt faster than a window that weights samples equally
+
+	interval := 100 * time.Millisecond
+	halfLife := 500 * time.Millisecond
+
+	clock := NewFakeClock(time.Now())
+	rttWindow := NewRttWindowWithHalfLife(128, 0, clock)
+	decayRttWindow := NewRttWindowWithHalfLife(128, halfLife, clock)
+
+	for i := 0; i < 64; i += 1 {
+		rttWindow.Add(100 * time.Millisecond)
+		decayRttWindow.Add(100 * time.Millisecond)
+		clock.Advance(interval)
+	}
+	assert.Equal(t, 100 * time.Millisecond, rttWindow.P50())
+	assert.Equal(t, 100 * time.Millisecond, decayRttWindow.P50())
+	assert.Equal(t, 100 * time.Millisecond, decayRttWindow.Mean())
+
+	// the number of samples after the step until the median is the new rtt
+	convergeCount := 0
+	decayConvergeCount := 0
+	for i := 1; i <= 128 && (convergeCount == 0 || decayConvergeCount == 0); i += 1 {
+		rttWindow.Add(10 * time.Millisecond)
+		decayRttWindow.Add(10 * time.Millisecond)
+		clock.Advance(interval)
+		if convergeCount == 0 && rttWindow.P50() == 10 * time.Millisecond {
+			convergeCount = i
+		}
+		if decayConvergeCount == 0 && decayRttWindow.P50() == 10 * time.Millisecond {
+			decayConvergeCount = i
+		}
+	}
+	// equal weights need as many new samples as old samples
+	assert.Equal(t, 64, convergeCount)
+	assert.Equal(t, true, 0 < decayConvergeCount && decayConvergeCount < 16)
+
+	// old samples still count for the full weight in the equal window
+	assert.Equal(t, 128, rttWindow.SampleCount())
+	assert.Equal(t, 128, decayRttWindow.SampleCount())
+	assert.Equal(t, true, 10 * time.Millisecond < rttWindow.Mean())
+	assert.Equal(t, true, decayRttWindow.Mean() < 11 * time.Millisecond)
+	assert.Equal(t, 10 * time.Millisecond, decayRttWindow.P95())
+}
+
+
+func TestClientRttStats(t *testing.T) {
+	// each message acked on the first send is an rtt sample for the destination
+
+	timeout := 5 * time.Second
+	n := 16
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+	b := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer b.Cancel()
+
+	aReceive := make(chan []byte)
+	bReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	assert.Equal(t, 0, len(a.RttStats()))
+
+	for i := 0; i < n; i += 1 {
+		acks := make(chan error, 1)
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+			b.ClientId(),
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+		select {
+		case err := <- acks:
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	path := NewTransferPath(Path{ClientId: a.ClientId()}, Path{ClientId: b.ClientId()})
+	rttStats := a.RttStats()
+	assert.Equal(t, 1, len(rttStats))
+	stats := rttStats[path]
+	assert.NotEqual(t, nil, stats)
+	assert.Equal(t, n, stats.SampleCount)
+	assert.Equal(t, true, 0 < stats.P50)
+	assert.Equal(t, true, stats.P50 <= stats.P95)
+	assert.Equal(t, true, 0 < stats.Mean)
+	assert.Equal(t, true, stats.P95 < timeout)
+}
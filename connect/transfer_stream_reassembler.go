@@ -0,0 +1,280 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"bringyour.com/protocol"
+)
+
+
+// reassembles the `protocol.StreamChunk` frames sent with `Client.SendStream` into complete messages
+// add `Receive` as a receive callback to the client, and read the complete messages from `Messages`
+// the receive buffer delivers the chunks of a message in order since they are on one sequence,
+// but the chunks are buffered by index so that the reassembly does not depend on the order
+// a partial message is dropped when it does not receive a chunk within `PartialTimeout`
+// chunks past the last chunk index are dropped, and each source has at most `MaxPartialMessagesPerSource`
+
+
+type StreamReassemblerSettings struct {
+	// partial messages without a new chunk in this time are dropped
+	// the check runs every timeout, so a partial message is dropped within twice the timeout
+	PartialTimeout time.Duration
+	// partial messages larger than this are dropped
+	MaxMessageByteCount ByteCount
+	// new messages from a source with this many partial messages are dropped
+	MaxPartialMessagesPerSource int
+	MessageBufferSize int
+}
+
+func DefaultStreamReassemblerSettings() *StreamReassemblerSettings {
+	return &StreamReassemblerSettings{
+		PartialTimeout: 60 * time.Second,
+		MaxMessageByteCount: mib(64),
+		MaxPartialMessagesPerSource: 16,
+		MessageBufferSize: 32,
+	}
+}
+
+
+type StreamMessage struct {
+	SourceId Id
+	MessageId Id
+	// the provide mode of the last chunk
+	ProvideMode protocol.ProvideMode
+	MessageBytes []byte
+}
+
+
+type streamMessageId struct {
+	sourceId Id
+	messageId Id
+}
+
+
+type partialStreamMessage struct {
+	// chunk index -> chunk bytes
+	chunks map[uint32][]byte
+	byteCount ByteCount
+	// set when the last chunk is received
+	lastChunkIndex uint32
+	hasLast bool
+	updateTime time.Time
+}
+
+func (self *partialStreamMessage) complete() bool {
+	if !self.hasLast {
+		return false
+	}
+	for chunkIndex := uint32(0); chunkIndex <= self.lastChunkIndex; chunkIndex += 1 {
+		if _, ok := self.chunks[chunkIndex]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// chunks past the last chunk are dropped
+func (self *partialStreamMessage) setLast(lastChunkIndex uint32) {
+	self.lastChunkIndex = lastChunkIndex
+	self.hasLast = true
+	for chunkIndex, chunkBytes := range self.chunks {
+		if lastChunkIndex < chunkIndex {
+			delete(self.chunks, chunkIndex)
+			self.byteCount -= ByteCount(len(chunkBytes))
+		}
+	}
+}
+
+func (self *partialStreamMessage) messageBytes() []byte {
+	messageBytes := make([]byte, 0, self.byteCount)
+	for chunkIndex := uint32(0); chunkIndex <= self.lastChunkIndex; chunkIndex += 1 {
+		messageBytes = append(messageBytes, self.chunks[chunkIndex]...)
+	}
+	return messageBytes
+}
+
+
+type StreamReassembler struct {
+	ctx context.Context
+	cancel context.CancelFunc
+
+	settings *StreamReassemblerSettings
+
+	messages chan *StreamMessage
+
+	mutex sync.Mutex
+	partialMessages map[streamMessageId]*partialStreamMessage
+	// source id -> partial message count
+	sourcePartialMessageCounts map[Id]int
+	droppedMessageCount int
+}
+
+func NewStreamReassemblerWithDefaults(ctx context.Context) *StreamReassembler {
+	return NewStreamReassembler(ctx, DefaultStreamReassemblerSettings())
+}
+
+func NewStreamReassembler(ctx context.Context, settings *StreamReassemblerSettings) *StreamReassembler {
+	cancelCtx, cancel := context.WithCancel(ctx)
+	streamReassembler := &StreamReassembler{
+		ctx: cancelCtx,
+		cancel: cancel,
+		settings: settings,
+		messages: make(chan *StreamMessage, settings.MessageBufferSize),
+		partialMessages: map[streamMessageId]*partialStreamMessage{},
+		sourcePartialMessageCounts: map[Id]int{},
+	}
+	go streamReassembler.run()
+	return streamReassembler
+}
+
+func (self *StreamReassembler) run() {
+	for {
+		select {
+		case <- self.ctx.Done():
+			return
+		case <- time.After(self.settings.PartialTimeout):
+		}
+		self.expirePartialMessages()
+	}
+}
+
+func (self *StreamReassembler) expirePartialMessages() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	for id, partialMessage := range self.partialMessages {
+		if self.settings.PartialTimeout <= now.Sub(partialMessage.updateTime) {
+			glog.V(1).Infof("[sr]drop partial message %s<-%s timeout\n", id.messageId, id.sourceId)
+			self.removePartialMessage(id)
+			self.droppedMessageCount += 1
+		}
+	}
+}
+
+// the complete messages, in order of completion
+func (self *StreamReassembler) Messages() <-chan *StreamMessage {
+	return self.messages
+}
+
+// ReceiveFunction
+// frames other than `protocol.StreamChunk` are ignored
+// blocks while the message buffer is full
+func (self *StreamReassembler) Receive(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+	for _, frame := range frames {
+		if frame.MessageType != protocol.MessageType_TransferStreamChunk {
+			continue
+		}
+		message, err := FromFrame(frame)
+		if err != nil {
+			continue
+		}
+		chunk := message.(*protocol.StreamChunk)
+		messageId, err := IdFromBytes(chunk.MessageId)
+		if err != nil {
+			continue
+		}
+		if streamMessage := self.addChunk(sourceId, messageId, chunk, provideMode); streamMessage != nil {
+			select {
+			case <- self.ctx.Done():
+				return
+			case self.messages <- streamMessage:
+			}
+		}
+	}
+}
+
+// returns the message if the chunk completes it
+func (self *StreamReassembler) addChunk(
+	sourceId Id,
+	messageId Id,
+	chunk *protocol.StreamChunk,
+	provideMode protocol.ProvideMode,
+) *StreamMessage {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	id := streamMessageId{
+		sourceId: sourceId,
+		messageId: messageId,
+	}
+	partialMessage, ok := self.partialMessages[id]
+	if !ok {
+		if self.settings.MaxPartialMessagesPerSource <= self.sourcePartialMessageCounts[sourceId] {
+			glog.V(1).Infof("[sr]drop message %s<-%s max partial messages\n", messageId, sourceId)
+			self.droppedMessageCount += 1
+			return nil
+		}
+		partialMessage = &partialStreamMessage{
+			chunks: map[uint32][]byte{},
+		}
+		self.partialMessages[id] = partialMessage
+		self.sourcePartialMessageCounts[sourceId] += 1
+	}
+	if partialMessage.hasLast && (
+		partialMessage.lastChunkIndex < chunk.ChunkIndex ||
+		chunk.Last && chunk.ChunkIndex != partialMessage.lastChunkIndex) {
+		// the chunk is past or conflicts with the last chunk
+		glog.V(1).Infof("[sr]drop chunk %d past last %d %s<-%s\n", chunk.ChunkIndex, partialMessage.lastChunkIndex, messageId, sourceId)
+		return nil
+	}
+	if _, ok := partialMessage.chunks[chunk.ChunkIndex]; !ok {
+		partialMessage.chunks[chunk.ChunkIndex] = chunk.ChunkBytes
+		partialMessage.byteCount += ByteCount(len(chunk.ChunkBytes))
+	}
+	if chunk.Last {
+		partialMessage.setLast(chunk.ChunkIndex)
+	}
+	partialMessage.updateTime = time.Now()
+
+	if self.settings.MaxMessageByteCount < partialMessage.byteCount {
+		glog.V(1).Infof("[sr]drop partial message %s<-%s max byte count\n", messageId, sourceId)
+		self.removePartialMessage(id)
+		self.droppedMessageCount += 1
+		return nil
+	}
+	if !partialMessage.complete() {
+		return nil
+	}
+	self.removePartialMessage(id)
+	return &StreamMessage{
+		SourceId: sourceId,
+		MessageId: messageId,
+		ProvideMode: provideMode,
+		MessageBytes: partialMessage.messageBytes(),
+	}
+}
+
+// must be called with the mutex
+func (self *StreamReassembler) removePartialMessage(id streamMessageId) {
+	delete(self.partialMessages, id)
+	if count := self.sourcePartialMessageCounts[id.sourceId]; count <= 1 {
+		delete(self.sourcePartialMessageCounts, id.sourceId)
+	} else {
+		self.sourcePartialMessageCounts[id.sourceId] = count - 1
+	}
+}
+
+// partial messages that are buffered
+func (self *StreamReassembler) PartialMessageCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return len(self.partialMessages)
+}
+
+// partial messages dropped for the timeout, max byte count, or max partial messages per source
+func (self *StreamReassembler) DroppedMessageCount() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.droppedMessageCount
+}
+
+func (self *StreamReassembler) Close() {
+	self.cancel()
+}
@@ -0,0 +1,224 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	mathrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestStreamReassemblerSendStream(t *testing.T) {
+	// streams sent with `SendStream` are reassembled into complete messages
+
+	timeout := 5 * time.Second
+	n := 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+	b := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer b.Cancel()
+
+	aReceive := make(chan []byte)
+	bReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	streamReassembler := NewStreamReassemblerWithDefaults(ctx)
+	defer streamReassembler.Close()
+	b.AddReceiveCallback(streamReassembler.Receive)
+
+	destination := NewTransferPath(
+		Path{ClientId: a.ClientId()},
+		Path{ClientId: b.ClientId()},
+	)
+	for i := 0; i < n; i += 1 {
+		streamBytes := make([]byte, int(kib(16)) * i)
+		mathrand.Read(streamBytes)
+		success := a.SendStream(bytes.NewReader(streamBytes), destination, 0, nil)
+		assert.Equal(t, true, success)
+
+		select {
+		case message := <- streamReassembler.Messages():
+			assert.Equal(t, a.ClientId(), message.SourceId)
+			assert.Equal(t, streamBytes, message.MessageBytes)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	assert.Equal(t, 0, streamReassembler.PartialMessageCount())
+	assert.Equal(t, 0, streamReassembler.DroppedMessageCount())
+}
+
+
+func TestStreamReassembler(t *testing.T) {
+	// chunks are reassembled in any order, duplicates and other frames are ignored,
+	// and partial messages are dropped on the timeout and max byte count
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultStreamReassemblerSettings()
+	settings.PartialTimeout = 100 * time.Millisecond
+	settings.MaxMessageByteCount = ByteCount(1000)
+	streamReassembler := NewStreamReassembler(ctx, settings)
+	defer streamReassembler.Close()
+
+	sourceId := NewId()
+
+	chunkFrame := func(messageId Id, chunkIndex uint32, last bool, chunkBytes []byte) *protocol.Frame {
+		return RequireToFrame(&protocol.StreamChunk{
+			MessageId: messageId.Bytes(),
+			ChunkIndex: chunkIndex,
+			Last: last,
+			ChunkBytes: chunkBytes,
+		})
+	}
+
+	nextMessage := func() *StreamMessage {
+		select {
+		case message := <- streamReassembler.Messages():
+			return message
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	// out of order, with a duplicate and another frame
+	messageId := NewId()
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 2, true, []byte("c")),
+		RequireToFrame(&protocol.SimpleMessage{Content: "hi"}),
+		chunkFrame(messageId, 0, false, []byte("a")),
+	}, protocol.ProvideMode_Network)
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 0, false, []byte("x")),
+	}, protocol.ProvideMode_Network)
+	assert.Equal(t, 1, streamReassembler.PartialMessageCount())
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 1, false, []byte("b")),
+	}, protocol.ProvideMode_Public)
+	message := nextMessage()
+	assert.Equal(t, sourceId, message.SourceId)
+	assert.Equal(t, messageId, message.MessageId)
+	assert.Equal(t, protocol.ProvideMode_Public, message.ProvideMode)
+	assert.Equal(t, []byte("abc"), message.MessageBytes)
+	assert.Equal(t, 0, streamReassembler.PartialMessageCount())
+
+	// the same message id from different sources are different messages
+	otherSourceId := NewId()
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 0, false, []byte("a")),
+	}, protocol.ProvideMode_Network)
+	streamReassembler.Receive(otherSourceId, []*protocol.Frame{
+		chunkFrame(messageId, 0, true, []byte("z")),
+	}, protocol.ProvideMode_Network)
+	message = nextMessage()
+	assert.Equal(t, otherSourceId, message.SourceId)
+	assert.Equal(t, []byte("z"), message.MessageBytes)
+
+	// the partial message times out
+	time.Sleep(4 * settings.PartialTimeout)
+	assert.Equal(t, 0, streamReassembler.PartialMessageCount())
+	assert.Equal(t, 1, streamReassembler.DroppedMessageCount())
+
+	// over the max byte count
+	messageId = NewId()
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 0, false, make([]byte, 600)),
+		chunkFrame(messageId, 1, true, make([]byte, 600)),
+	}, protocol.ProvideMode_Network)
+	assert.Equal(t, 0, streamReassembler.PartialMessageCount())
+	assert.Equal(t, 2, streamReassembler.DroppedMessageCount())
+
+	select {
+	case <- streamReassembler.Messages():
+		t.FailNow()
+	default:
+	}
+}
+
+
+func TestStreamReassemblerChunkIndex(t *testing.T) {
+	// a message completes only when every chunk up to the last is received,
+	// chunks past the last are dropped, and partial messages are limited per source
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultStreamReassemblerSettings()
+	settings.MaxPartialMessagesPerSource = 2
+	streamReassembler := NewStreamReassembler(ctx, settings)
+	defer streamReassembler.Close()
+
+	sourceId := NewId()
+
+	chunkFrame := func(messageId Id, chunkIndex uint32, last bool, chunkBytes []byte) *protocol.Frame {
+		return RequireToFrame(&protocol.StreamChunk{
+			MessageId: messageId.Bytes(),
+			ChunkIndex: chunkIndex,
+			Last: last,
+			ChunkBytes: chunkBytes,
+		})
+	}
+
+	// a chunk past the last does not fill in a missing chunk
+	messageId := NewId()
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 0, false, []byte("a")),
+		chunkFrame(messageId, 5, false, []byte("x")),
+		chunkFrame(messageId, 2, true, []byte("c")),
+		chunkFrame(messageId, 7, false, []byte("y")),
+		chunkFrame(messageId, 1, true, []byte("z")),
+	}, protocol.ProvideMode_Network)
+	select {
+	case <- streamReassembler.Messages():
+		t.FailNow()
+	default:
+	}
+	assert.Equal(t, 1, streamReassembler.PartialMessageCount())
+
+	streamReassembler.Receive(sourceId, []*protocol.Frame{
+		chunkFrame(messageId, 1, false, []byte("b")),
+	}, protocol.ProvideMode_Network)
+	select {
+	case message := <- streamReassembler.Messages():
+		assert.Equal(t, messageId, message.MessageId)
+		assert.Equal(t, []byte("abc"), message.MessageBytes)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	assert.Equal(t, 0, streamReassembler.PartialMessageCount())
+
+	// at most `MaxPartialMessagesPerSource` per source
+	for i := 0; i < 3; i += 1 {
+		streamReassembler.Receive(sourceId, []*protocol.Frame{
+			chunkFrame(NewId(), 1, true, []byte("b")),
+		}, protocol.ProvideMode_Network)
+	}
+	assert.Equal(t, 2, streamReassembler.PartialMessageCount())
+	assert.Equal(t, 1, streamReassembler.DroppedMessageCount())
+
+	streamReassembler.Receive(NewId(), []*protocol.Frame{
+		chunkFrame(NewId(), 1, true, []byte("b")),
+	}, protocol.ProvideMode_Network)
+	assert.Equal(t, 3, streamReassembler.PartialMessageCount())
+	assert.Equal(t, 1, streamReassembler.DroppedMessageCount())
+}
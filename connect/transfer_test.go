@@ -4,11 +4,18 @@ import (
 	"context"
     "testing"
     "time"
+	"math"
     mathrand "math/rand"
     "fmt"
     "crypto/hmac"
 	"crypto/sha256"
 	"sync"
+	"errors"
+	"slices"
+	"bytes"
+	"io"
+
+	"golang.org/x/exp/maps"
 
 	"google.golang.org/protobuf/proto"
 
@@ -271,215 +278,3600 @@ func TestSendReceiveSenderReset(t *testing.T) {
 }
 
 
-func createContractResultInitialPack(
-	provideMode protocol.ProvideMode,
-	provideSecretKey []byte,
-	sourceId Id,
-	destinationId Id,
-) (*protocol.Frame, error) {
-	contractId := NewId()
-	contractByteCount := 8 * 1024 * 1024 * 1024
+func TestSendDone(t *testing.T) {
+	// sends on a cancelled client fail with `ErrDone`
 
-	storedContract := &protocol.StoredContract{
-		ContractId: contractId.Bytes(),
-		TransferByteCount: uint64(contractByteCount),
-		SourceId: sourceId.Bytes(),
-		DestinationId: destinationId.Bytes(),
-	}
-	storedContractBytes, err := proto.Marshal(storedContract)
-	if err != nil {
-		return nil, err
-	}
-	mac := hmac.New(sha256.New, provideSecretKey)
-	storedContractHmac := mac.Sum(storedContractBytes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	message := &protocol.CreateContractResult{
-		Contract: &protocol.Contract{
-			StoredContractBytes: storedContractBytes,
-			StoredContractHmac: storedContractHmac,
-			ProvideMode: provideMode,
-		},
+	clientId := NewId()
+	client := NewClientWithDefaults(ctx, clientId, NewNoContractClientOob())
+	client.Cancel()
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+	for _, destinationId := range []Id{clientId, NewId()} {
+		success, err := client.SendWithTimeoutDetailed(frame, destinationId, func(err error) {}, -1)
+		assert.Equal(t, false, success)
+		assert.Equal(t, true, errors.Is(err, ErrDone))
 	}
 
-	frame, err := ToFrame(message)
-	if err != nil {
-		return nil, err
+	success, err := client.ForwardWithTimeoutDetailed([]byte{}, -1)
+	assert.Equal(t, false, success)
+	assert.Equal(t, true, errors.Is(err, ErrDone))
+}
+
+
+func TestLoopbackProvideMode(t *testing.T) {
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientId := NewId()
+	client := NewClientWithDefaults(ctx, clientId, NewNoContractClientOob())
+	defer client.Cancel()
+
+	type receive struct {
+		sourceId Id
+		content string
+		provideMode protocol.ProvideMode
 	}
 
-	messageId := NewId()
-	sequenceId := NewId()
-	pack := &protocol.Pack{
-		MessageId: messageId.Bytes(),
-		SequenceId: sequenceId.Bytes(),
-		SequenceNumber: 0,
-		Head: true,
-		Frames: []*protocol.Frame{frame},
+	receives := make(chan *receive)
+	client.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- &receive{
+					sourceId: sourceId,
+					content: v.Content,
+					provideMode: provideMode,
+				}
+			}
+		}
+	})
+
+	sendOpts := [][]any{
+		[]any{},
+		[]any{LoopbackProvideMode(protocol.ProvideMode_Public)},
+		[]any{LoopbackProvideMode(protocol.ProvideMode_FriendsAndFamily)},
+		// the zero value is the default
+		[]any{TransferOptions{}},
+	}
+	expectedProvideModes := []protocol.ProvideMode{
+		protocol.ProvideMode_Network,
+		protocol.ProvideMode_Public,
+		protocol.ProvideMode_FriendsAndFamily,
+		protocol.ProvideMode_Network,
 	}
 
-	return ToFrame(pack)
-}
+	for i, opts := range sendOpts {
+		acks := make(chan error, 1)
+		content := fmt.Sprintf("hi %d", i)
+		success := client.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: content,
+			}),
+			clientId,
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+			opts...,
+		)
+		assert.Equal(t, true, success)
 
+		select {
+		case r := <- receives:
+			assert.Equal(t, clientId, r.sourceId)
+			assert.Equal(t, content, r.content)
+			assert.Equal(t, expectedProvideModes[i], r.provideMode)
+		case <- time.After(timeout):
+			t.Fatal("Timeout.")
+		}
 
-func requireContractResultInitialPack(
-	provideMode protocol.ProvideMode,
-	provideSecretKey []byte,
-	sourceId Id,
-	destinationId Id,
-) *protocol.Frame {
-	frame, err := createContractResultInitialPack(provideMode, provideSecretKey, sourceId, destinationId)
-	if err != nil {
-		panic(err)
+		select {
+		case err := <- acks:
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.Fatal("Timeout.")
+		}
 	}
-	return frame
 }
 
 
-func createTransferFrameBytes(frame *protocol.Frame, sourceId Id, destinationId Id) ([]byte, error) {
-	transferFrame := &protocol.TransferFrame{
-		TransferPath: &protocol.TransferPath{
-			SourceId: sourceId.Bytes(),
-			DestinationId: destinationId.Bytes(),
-			StreamId: DirectStreamId.Bytes(),
-		},
-		Frame: frame,
-	}
+func TestLoopbackSelfDestination(t *testing.T) {
+	// sends and streams to self are delivered in process,
+	// or through the transports when loopback is disabled
+
+	timeout := 5 * time.Second
+
+	for _, disableLoopback := range []bool{false, true} {
+		func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientId := NewId()
+			settings := DefaultClientSettings()
+			settings.DisableLoopback = disableLoopback
+			client := NewClient(ctx, clientId, NewNoContractClientOob(), settings)
+			defer client.Cancel()
+			client.ContractManager().AddNoContractPeer(clientId)
+
+			// the transports route the client back to itself, and count the transfer frames
+			send := make(chan []byte)
+			receive := make(chan []byte)
+			client.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{send})
+			client.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{receive})
+			var transportLock sync.Mutex
+			transportCount := 0
+			go func() {
+				for {
+					select {
+					case <- ctx.Done():
+						return
+					case transferFrameBytes := <- send:
+						func() {
+							transportLock.Lock()
+							defer transportLock.Unlock()
+							transportCount += 1
+						}()
+						select {
+						case <- ctx.Done():
+							return
+						case receive <- transferFrameBytes:
+						}
+					}
+				}
+			}()
 
-	return proto.Marshal(transferFrame)
-}
+			receives := make(chan proto.Message, 16)
+			client.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+				assert.Equal(t, clientId, sourceId)
+				for _, frame := range frames {
+					receives <- RequireFromFrame(frame)
+				}
+			})
 
+			nextReceive := func() proto.Message {
+				select {
+				case message := <- receives:
+					return message
+				case <- time.After(timeout):
+					t.FailNow()
+					return nil
+				}
+			}
 
-func requireTransferFrameBytes(frame *protocol.Frame, sourceId Id, destinationId Id) []byte {
-	b, err := createTransferFrameBytes(frame, sourceId, destinationId)
-	if err != nil {
-		panic(err)
-	}
+			nextAck := func(acks chan error) error {
+				select {
+				case err := <- acks:
+					return err
+				case <- time.After(timeout):
+					t.FailNow()
+					return nil
+				}
+			}
 
-	var filteredTransferFrame protocol.FilteredTransferFrame
-	if err := proto.Unmarshal(b, &filteredTransferFrame); err != nil {
-		panic(err)
-	}
-	sourceId_, err := IdFromBytes(filteredTransferFrame.TransferPath.SourceId)
-	if err != nil {
-		panic(err)
-	}
-	destinationId_, err := IdFromBytes(filteredTransferFrame.TransferPath.DestinationId)
-	if err != nil {
-		panic(err)
+			// direct to self
+			acks := make(chan error, 1)
+			success := client.SendWithTimeout(
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: "hi",
+				}),
+				clientId,
+				func(err error) {
+					acks <- err
+				},
+				timeout,
+			)
+			assert.Equal(t, true, success)
+			message, ok := nextReceive().(*protocol.SimpleMessage)
+			assert.Equal(t, true, ok)
+			assert.Equal(t, "hi", message.Content)
+			assert.Equal(t, nil, nextAck(acks))
+
+			// stream to self
+			streamBytes := make([]byte, 4 * 1000)
+			mathrand.Read(streamBytes)
+			acks = make(chan error, 1)
+			success = client.SendStream(
+				bytes.NewReader(streamBytes),
+				NewTransferPath(Path{ClientId: clientId}, Path{ClientId: clientId}),
+				1000,
+				func(err error) {
+					acks <- err
+				},
+			)
+			assert.Equal(t, true, success)
+			receiveBytes := []byte{}
+			for i := 0; i < 4; i += 1 {
+				chunk, ok := nextReceive().(*protocol.StreamChunk)
+				assert.Equal(t, true, ok)
+				assert.Equal(t, i == 3, chunk.Last)
+				receiveBytes = append(receiveBytes, chunk.ChunkBytes...)
+			}
+			assert.Equal(t, streamBytes, receiveBytes)
+			assert.Equal(t, nil, nextAck(acks))
+
+			func() {
+				transportLock.Lock()
+				defer transportLock.Unlock()
+				if disableLoopback {
+					assert.Equal(t, true, 0 < transportCount)
+				} else {
+					assert.Equal(t, 0, transportCount)
+				}
+			}()
+
+			// stream destinations are not addressed to a client
+			acks = make(chan error, 1)
+			success = client.SendStream(
+				bytes.NewReader(streamBytes),
+				StreamDestination(NewId()),
+				1000,
+				func(err error) {
+					acks <- err
+				},
+			)
+			assert.Equal(t, false, success)
+			assert.NotEqual(t, nil, nextAck(acks))
+		}()
 	}
+}
 
-	if sourceId != sourceId_ {
-		panic(fmt.Errorf("%s <> %s", sourceId, sourceId_))
-	}
 
-	if destinationId != destinationId_ {
-		panic(fmt.Errorf("%s <> %s", destinationId, destinationId_))
-	}
+func TestForwardTotalMaxByteCount(t *testing.T) {
+	// forward to many destinations that have no routes
+	// each forward sequence blocks on write, so the forwards are buffered
 
-	return b
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	totalMaxByteCount := kib(64)
 
+	settings := DefaultClientSettings()
+	settings.ForwardBufferSettings.SequenceBufferSize = 32
+	settings.ForwardBufferSettings.WriteTimeout = 30 * time.Second
+	settings.ForwardBufferSettings.TotalMaxByteCount = totalMaxByteCount
 
-type conditioner struct {
-	ctx context.Context
-	fixedDelay time.Duration
-	randomDelay time.Duration
-	hold bool
-	inversionWindow time.Duration
-	invertFraction float32
-	lossProbability float32
-	monitor *Monitor
-	mutex sync.Mutex
-}
+	clientId := NewId()
+	client := NewClient(ctx, clientId, NewNoContractClientOob(), settings)
+	defer client.Cancel()
 
-func newConditioner(ctx context.Context, in chan []byte) (*conditioner, chan []byte) {
-	c := &conditioner{
-		ctx: ctx,
-		fixedDelay: 0,
-		randomDelay: 0,
-		lossProbability: 0,
-		monitor: NewMonitor(),
+	destinationCount := 64
+	forwardCount := 32
+
+	messageBytes := make([]byte, 1024)
+	mathrand.Read(messageBytes)
+	frame := &protocol.Frame{
+		MessageType: protocol.MessageType_TestSimpleMessage,
+		MessageBytes: messageBytes,
 	}
-	out := make(chan []byte)
-	go c.run(in, out)
-	return c, out
-}
 
-func (self *conditioner) update(callback func()) {
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
+	successCount := 0
+	dropCount := 0
+	for i := 0; i < destinationCount; i += 1 {
+		destinationId := NewId()
+		transferFrameBytes := requireTransferFrameBytes(frame, NewId(), destinationId)
+		for j := 0; j < forwardCount; j += 1 {
+			success, err := client.ForwardWithTimeoutDetailed(transferFrameBytes, 0)
+			assert.Equal(t, nil, err)
+			if success {
+				successCount += 1
+			} else {
+				dropCount += 1
+			}
+			assert.Equal(t, true, client.forwardBuffer.TotalByteCount() <= totalMaxByteCount)
+		}
+	}
 
-	callback()
-	self.monitor.NotifyAll()
+	assert.NotEqual(t, 0, successCount)
+	assert.NotEqual(t, 0, dropCount)
+	assert.Equal(t, true, client.forwardBuffer.TotalByteCount() <= totalMaxByteCount)
+
+	// closing the sequences releases all buffered bytes
+	client.forwardBuffer.Cancel()
+	endTime := time.Now().Add(5 * time.Second)
+	for 0 < client.forwardBuffer.TotalByteCount() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, ByteCount(0), client.forwardBuffer.TotalByteCount())
 }
 
-func (self *conditioner) calcLoss() bool {
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
 
-	return mathrand.Float32() < self.lossProbability
-}
+func TestReceiveProvideModeChange(t *testing.T) {
+	// one sequence sends under two contracts with different provide modes
+	// the receiver should surface the provide mode change before the frames with the new mode
 
-func (self *conditioner) calcDelay() time.Duration {
-	self.mutex.Lock()
-	defer self.mutex.Unlock()
+	timeout := 5 * time.Second
 
-	delay := self.fixedDelay
-	if 0 < self.randomDelay {
-		delay += time.Duration(mathrand.Intn(int(self.randomDelay)))
-	}
-	return delay
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-func (self *conditioner) run(in chan []byte, out chan []byte) {
-	// defer close(out)
+	aClientId := NewId()
+	bClientId := NewId()
 
-	for {
-		select {
-		case <- self.ctx.Done():
-			return
-		case <- self.monitor.NotifyChannel():
-			continue
-		case b, ok := <- in:
-			if !ok {
-				return
-			}
+	b := NewClientWithDefaults(ctx, bClientId, NewNoContractClientOob())
+	defer b.Cancel()
 
-			if self.calcLoss() {
-				continue
-			}
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+		protocol.ProvideMode_Public: true,
+	})
 
-			delay := self.calcDelay()
+	type receive struct {
+		content string
+		provideMode protocol.ProvideMode
+	}
+	type provideModeChange struct {
+		sourceId Id
+		previousProvideMode protocol.ProvideMode
+		provideMode protocol.ProvideMode
+	}
 
-			if delay <= 0 {
-				select {
-				case <- self.ctx.Done():
-					return
-				case out <- b:
+	events := make(chan any, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				events <- &receive{
+					content: v.Content,
+					provideMode: provideMode,
 				}
-			} else {
-				go func() {
-					select {
-					case <- self.ctx.Done():
-						return
-					case <- time.After(delay):
-					}
+			}
+		}
+	})
+	b.AddProvideModeChangeCallback(func(sourceId Id, previousProvideMode protocol.ProvideMode, provideMode protocol.ProvideMode) {
+		events <- &provideModeChange{
+			sourceId: sourceId,
+			previousProvideMode: previousProvideMode,
+			provideMode: provideMode,
+		}
+	})
 
-					select {
-					case <- self.ctx.Done():
-						return
-					case out <- b:
-					}
-				}()
-			}				
+	sequenceId := NewId()
+	sendPack := func(sequenceNumber uint64, provideMode protocol.ProvideMode, content string) {
+		contract := requireContract(
+			provideMode,
+			b.ContractManager().RequireProvideSecretKey(provideMode),
+			aClientId,
+			bClientId,
+		)
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: sequenceNumber,
+			Head: (sequenceNumber == 0),
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: content,
+				}),
+			},
+			ContractFrame: RequireToFrame(contract),
+		}
+		bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId)
+	}
+
+	sendPack(0, protocol.ProvideMode_Network, "a")
+	sendPack(1, protocol.ProvideMode_Network, "b")
+	sendPack(2, protocol.ProvideMode_Public, "c")
+
+	expectedEvents := []any{
+		&receive{content: "a", provideMode: protocol.ProvideMode_Network},
+		&receive{content: "b", provideMode: protocol.ProvideMode_Network},
+		&provideModeChange{
+			sourceId: aClientId,
+			previousProvideMode: protocol.ProvideMode_Network,
+			provideMode: protocol.ProvideMode_Public,
+		},
+		&receive{content: "c", provideMode: protocol.ProvideMode_Public},
+	}
+	for _, expectedEvent := range expectedEvents {
+		select {
+		case event := <- events:
+			assert.Equal(t, expectedEvent, event)
+		case <- time.After(timeout):
+			t.FailNow()
 		}
 	}
 }
 
 
+func TestReceiveNoContractPeerSmallContract(t *testing.T) {
+	// a peer that is allowed to send with no contract attaches a contract too small for the message
+	// the receiver should deliver the message with no contract and keep the sequence open
 
-// FIXME TestAckTimeout
+	timeout := 5 * time.Second
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
 
+	b := NewClientWithDefaults(ctx, bClientId, NewNoContractClientOob())
+	defer b.Cancel()
 
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+	})
+	b.ContractManager().AddNoContractPeer(aClientId)
 
+	receives := make(chan string, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- v.Content
+			}
+		}
+	})
+
+	contract := requireContractWithByteCount(
+		protocol.ProvideMode_Network,
+		b.ContractManager().RequireProvideSecretKey(protocol.ProvideMode_Network),
+		aClientId,
+		bClientId,
+		ByteCount(1),
+	)
+
+	sequenceId := NewId()
+	for i := 0; i < 4; i += 1 {
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: uint64(i),
+			Head: (i == 0),
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: fmt.Sprintf("hi %d", i),
+				}),
+			},
+			ContractFrame: RequireToFrame(contract),
+		}
+		bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId)
+	}
+
+	for i := 0; i < 4; i += 1 {
+		select {
+		case content := <- receives:
+			assert.Equal(t, fmt.Sprintf("hi %d", i), content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+}
+
+
+func TestNackAccountingPolicy(t *testing.T) {
+	// a high rate stream of tiny no-ack messages
+	// count the contract consumption under each policy
+
+	minMessageByteCount := ByteCount(100)
+	messageByteCount := ByteCount(10)
+	contractByteCount := ByteCount(50000)
+
+	expectedMessageCounts := map[NackAccountingPolicy]int{
+		NackAccountingMinMessage: 500,
+		NackAccountingBytes: 5000,
+		NackAccountingBatch: 5000,
+	}
+
+	for nackAccountingPolicy, expectedMessageCount := range expectedMessageCounts {
+		contract := requireContractWithByteCount(
+			protocol.ProvideMode_Network,
+			[]byte("test"),
+			NewId(),
+			NewId(),
+			contractByteCount,
+		)
+		sendContract, err := newSequenceContract("s", contract, minMessageByteCount, 1.0)
+		assert.Equal(t, nil, err)
+
+		contractByteCounts := []ByteCount{}
+		for {
+			c, ok := sendContract.updateWithPolicy(messageByteCount, nackAccountingPolicy)
+			if !ok {
+				break
+			}
+			contractByteCounts = append(contractByteCounts, c)
+		}
+		assert.Equal(t, expectedMessageCount, len(contractByteCounts))
+		assert.Equal(t, contractByteCount, sendContract.unackedByteCount)
+
+		for _, c := range contractByteCounts {
+			assert.Equal(t, nil, sendContract.settle(c))
+		}
+		assert.Equal(t, ByteCount(0), sendContract.unackedByteCount)
+		assert.Equal(t, contractByteCount, sendContract.ackedByteCount)
+	}
+}
+
+
+func TestBadAccounting(t *testing.T) {
+	// a settle or refund of more than the unacked byte count is an error and leaves the contract unchanged
+	// duplicate acks from the peer do not settle the contract again
+
+	timeout := 5 * time.Second
+	messageByteCount := 100
+
+	contract := requireContractWithByteCount(
+		protocol.ProvideMode_Network,
+		[]byte("test"),
+		NewId(),
+		NewId(),
+		kib(4),
+	)
+	sendContract, err := newSequenceContract("s", contract, ByteCount(1), 1.0)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, true, sendContract.update(ByteCount(messageByteCount)))
+
+	var badAccountingError *BadAccountingError
+	err = sendContract.settle(ByteCount(2 * messageByteCount))
+	assert.Equal(t, true, errors.As(err, &badAccountingError))
+	assert.Equal(t, sendContract.contractId, badAccountingError.ContractId)
+	assert.Equal(t, ByteCount(messageByteCount), badAccountingError.UnackedByteCount)
+	assert.Equal(t, ByteCount(2 * messageByteCount), badAccountingError.EffectiveByteCount)
+	err = sendContract.refund(ByteCount(2 * messageByteCount))
+	assert.Equal(t, true, errors.As(err, &badAccountingError))
+	assert.Equal(t, ByteCount(messageByteCount), sendContract.unackedByteCount)
+	assert.Equal(t, ByteCount(0), sendContract.ackedByteCount)
+
+	assert.Equal(t, nil, sendContract.ack(ByteCount(messageByteCount)))
+	err = sendContract.ack(ByteCount(messageByteCount))
+	assert.Equal(t, true, errors.As(err, &badAccountingError))
+	assert.Equal(t, ByteCount(0), sendContract.unackedByteCount)
+	assert.Equal(t, ByteCount(messageByteCount), sendContract.ackedByteCount)
+
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.StandardContractTransferByteCount = kib(4)
+	a := NewClient(ctx, aClientId, &sizedContractOob{clientId: aClientId}, settings)
+	defer a.Cancel()
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	// the contract is sent in its own pack before the first message
+	nextMessagePack := func() *protocol.Pack {
+		for {
+			select {
+			case transferFrameBytes := <- aSend:
+				transferFrame := &protocol.TransferFrame{}
+				err := proto.Unmarshal(transferFrameBytes, transferFrame)
+				assert.Equal(t, nil, err)
+				pack := &protocol.Pack{}
+				err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+				assert.Equal(t, nil, err)
+				if 0 < len(pack.Frames) {
+					return pack
+				}
+			case <- time.After(timeout):
+				t.FailNow()
+				return nil
+			}
+		}
+	}
+
+	ack := func(pack *protocol.Pack) {
+		ackFrame := RequireToFrame(&protocol.Ack{
+			MessageId: pack.MessageId,
+			SequenceId: pack.SequenceId,
+			Selective: false,
+		})
+		select {
+		case aReceive <- requireTransferFrameBytes(ackFrame, bClientId, aClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	frame := &protocol.Frame{
+		MessageType: protocol.MessageType_TestSimpleMessage,
+		MessageBytes: make([]byte, messageByteCount),
+	}
+	acks := make(chan error, 2)
+	for i := 0; i < 2; i += 1 {
+		success := a.SendWithTimeout(frame, bClientId, func(err error) {
+			acks <- err
+		}, timeout)
+		assert.Equal(t, true, success)
+	}
+	firstPack := nextMessagePack()
+	secondPack := nextMessagePack()
+
+	for i := 0; i < 4; i += 1 {
+		ack(firstPack)
+	}
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// the sequence is still open after the duplicate acks
+	ack(secondPack)
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+}
+
+
+func TestReceiveSequenceBadAccounting(t *testing.T) {
+	// a pack whose contract accounting does not match exits the receive sequence with bad accounting
+	// and audits the peer with a bad contract
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &peerAuditOob{
+		peerAudits: make(chan *protocol.PeerAudit, 16),
+	}
+
+	b := NewClient(ctx, bClientId, oob, DefaultClientSettings())
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().SetProvideModes(map[protocol.ProvideMode]bool{
+		protocol.ProvideMode_Network: true,
+	})
+
+	sequenceId := NewId()
+
+	// the receive callback runs on the sequence goroutine before the ack settles the contract
+	// clear the debit so that the ack settles more than the unacked byte count
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		b.receiveBuffer.mutex.Lock()
+		receiveSequence := b.receiveBuffer.receiveSequences[receiveSequenceId{
+			SourceId: aClientId,
+			SequenceId: sequenceId,
+		}]
+		b.receiveBuffer.mutex.Unlock()
+		receiveSequence.receiveContract.unackedByteCount = 0
+	})
+
+	sequenceErrors := make(chan string, 16)
+	b.AddSequenceErrorCallback(func(source TransferPath, sequenceId Id, reason string) {
+		sequenceErrors <- reason
+	})
+
+	contract := requireContract(
+		protocol.ProvideMode_Network,
+		b.ContractManager().RequireProvideSecretKey(protocol.ProvideMode_Network),
+		aClientId,
+		bClientId,
+	)
+	pack := &protocol.Pack{
+		MessageId: NewId().Bytes(),
+		SequenceId: sequenceId.Bytes(),
+		SequenceNumber: 0,
+		Head: true,
+		Frames: []*protocol.Frame{
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+		},
+		ContractFrame: RequireToFrame(contract),
+	}
+	select {
+	case bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId):
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case reason := <- sequenceErrors:
+		assert.Equal(t, ReceiveSequenceExitBadAccounting, reason)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case peerAudit := <- oob.peerAudits:
+		auditPeerId, err := IdFromBytes(peerAudit.PeerId)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, aClientId, auditPeerId)
+		assert.Equal(t, uint64(1), peerAudit.BadContractCount)
+		assert.Equal(t, false, peerAudit.Abuse)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+}
+
+
+// responds to each contract request with a contract error
+type contractErrorOob struct {
+	contractError protocol.ContractError
+	requests chan *protocol.CreateContract
+}
+
+func (self *contractErrorOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	resultFrames := []*protocol.Frame{}
+	for _, frame := range frames {
+		if createContract, ok := RequireFromFrame(frame).(*protocol.CreateContract); ok {
+			self.requests <- createContract
+			resultFrames = append(resultFrames, RequireToFrame(&protocol.CreateContractResult{
+				Error: &self.contractError,
+			}))
+		}
+	}
+	go callback(resultFrames, nil)
+}
+
+
+func TestCreateContractError(t *testing.T) {
+	// a definitive contract error fails the send after the retry budget
+	// a transient contract error retries until the create contract timeout
+
+	timeout := 5 * time.Second
+
+	type testCase struct {
+		contractError protocol.ContractError
+		errorRetryCount int
+		expectedRequestCount int
+		definitive bool
+	}
+	testCases := []*testCase{
+		&testCase{
+			contractError: protocol.ContractError_InsufficientBalance,
+			errorRetryCount: 0,
+			expectedRequestCount: 1,
+			definitive: true,
+		},
+		&testCase{
+			contractError: protocol.ContractError_NoPermission,
+			errorRetryCount: 2,
+			expectedRequestCount: 3,
+			definitive: true,
+		},
+		&testCase{
+			contractError: protocol.ContractError_Setup,
+		},
+	}
+
+	for _, c := range testCases {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		oob := &contractErrorOob{
+			contractError: c.contractError,
+			requests: make(chan *protocol.CreateContract, 1024),
+		}
+
+		settings := DefaultClientSettings()
+		settings.SendBufferSettings.CreateContractTimeout = 1 * time.Second
+		settings.SendBufferSettings.CreateContractRetryInterval = 100 * time.Millisecond
+		settings.SendBufferSettings.CreateContractErrorRetryCount = c.errorRetryCount
+
+		a := NewClient(ctx, NewId(), oob, settings)
+
+		acks := make(chan error, 1)
+		startTime := time.Now()
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+			NewId(),
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+
+		var err error
+		select {
+		case err = <- acks:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+		duration := time.Now().Sub(startTime)
+		assert.NotEqual(t, nil, err)
+
+		var definitiveErr *DefinitiveContractError
+		if c.definitive {
+			assert.Equal(t, true, errors.As(err, &definitiveErr))
+			assert.Equal(t, c.contractError, definitiveErr.ContractError)
+			// failed fast
+			assert.Equal(t, true, duration < settings.SendBufferSettings.CreateContractTimeout)
+			assert.Equal(t, c.expectedRequestCount, len(oob.requests))
+		} else {
+			assert.Equal(t, false, errors.As(err, &definitiveErr))
+			// retried until the timeout
+			assert.Equal(t, true, settings.SendBufferSettings.CreateContractTimeout <= duration)
+			assert.Equal(t, true, 1 < len(oob.requests))
+		}
+
+		a.Cancel()
+		cancel()
+	}
+}
+
+
+func TestNoCompanionContract(t *testing.T) {
+	// a companion send fails with `ErrNoCompanionContract` when the destination has no open contract to the client
+	// other sends fail with the generic contract errors
+
+	timeout := 5 * time.Second
+
+	type testCase struct {
+		contractError protocol.ContractError
+		companionContract bool
+		sourceContract bool
+		noCompanionContract bool
+		definitive bool
+	}
+	testCases := []*testCase{
+		&testCase{
+			contractError: protocol.ContractError_Setup,
+			companionContract: true,
+			noCompanionContract: true,
+		},
+		&testCase{
+			contractError: protocol.ContractError_NoPermission,
+			companionContract: true,
+			noCompanionContract: true,
+			definitive: true,
+		},
+		&testCase{
+			contractError: protocol.ContractError_NoPermission,
+			companionContract: true,
+			sourceContract: true,
+			definitive: true,
+		},
+		&testCase{
+			contractError: protocol.ContractError_Setup,
+		},
+	}
+
+	for _, c := range testCases {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		oob := &contractErrorOob{
+			contractError: c.contractError,
+			requests: make(chan *protocol.CreateContract, 1024),
+		}
+
+		settings := DefaultClientSettings()
+		settings.SendBufferSettings.CreateContractTimeout = 200 * time.Millisecond
+		settings.SendBufferSettings.CreateContractRetryInterval = 50 * time.Millisecond
+		settings.SendBufferSettings.CreateContractErrorRetryCount = 0
+
+		a := NewClient(ctx, NewId(), oob, settings)
+
+		destinationId := NewId()
+		if c.sourceContract {
+			a.ContractManager().OpenSourceContract(destinationId)
+		}
+
+		opts := []any{}
+		if c.companionContract {
+			opts = append(opts, CompanionContract())
+		}
+		acks := make(chan error, 1)
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+			destinationId,
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+			opts...,
+		)
+		assert.Equal(t, true, success)
+
+		var err error
+		select {
+		case err = <- acks:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+		assert.NotEqual(t, nil, err)
+		assert.Equal(t, c.noCompanionContract, errors.Is(err, ErrNoCompanionContract))
+		var definitiveErr *DefinitiveContractError
+		assert.Equal(t, c.definitive, errors.As(err, &definitiveErr))
+
+		a.Cancel()
+		cancel()
+	}
+}
+
+func TestReceivePanicPolicy(t *testing.T) {
+	// the receive callback panics on the first delivery of each message
+	// with the ack policy the message is acked and not delivered again
+	// with the no ack policy the message is retransmitted and delivered again,
+	// to every receive callback including the callbacks that did not panic
+
+	timeout := 5 * time.Second
+
+	for _, receivePanicPolicy := range []ReceivePanicPolicy{ReceivePanicPolicyAck, ReceivePanicPolicyNoAck} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		receivePanics := make(chan *ReceivePanic, 16)
+
+		settings := DefaultClientSettings()
+		settings.SendBufferSettings.ResendInterval = 100 * time.Millisecond
+		settings.SendBufferSettings.SelectiveAckTimeout = 100 * time.Millisecond
+		settings.ReceiveBufferSettings.ReceivePanicPolicy = receivePanicPolicy
+		settings.ReceiveBufferSettings.ReceivePanicCallback = func(receivePanic *ReceivePanic) {
+			receivePanics <- receivePanic
+		}
+
+		a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+		b := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+
+		aToB := make(chan []byte)
+		bToA := make(chan []byte)
+		a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aToB})
+		a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bToA})
+		b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bToA})
+		b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aToB})
+
+		a.ContractManager().AddNoContractPeer(b.ClientId())
+		b.ContractManager().AddNoContractPeer(a.ClientId())
+
+		receiveCounts := map[string]int{}
+		receives := make(chan string, 16)
+		b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+			for _, frame := range frames {
+				switch v := RequireFromFrame(frame).(type) {
+				case *protocol.SimpleMessage:
+					receives <- v.Content
+					receiveCounts[v.Content] += 1
+					if receiveCounts[v.Content] == 1 {
+						panic(fmt.Errorf("Panic %s", v.Content))
+					}
+				}
+			}
+		})
+		otherReceives := make(chan string, 16)
+		b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+			for _, frame := range frames {
+				switch v := RequireFromFrame(frame).(type) {
+				case *protocol.SimpleMessage:
+					otherReceives <- v.Content
+				}
+			}
+		})
+
+		acks := make(chan error, 16)
+		for _, content := range []string{"a", "b"} {
+			success := a.SendWithTimeout(
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: content,
+				}),
+				b.ClientId(),
+				func(err error) {
+					acks <- err
+				},
+				timeout,
+			)
+			assert.Equal(t, true, success)
+		}
+
+		for i := 0; i < 2; i += 1 {
+			select {
+			case err := <- acks:
+				assert.Equal(t, nil, err)
+			case <- time.After(timeout):
+				t.FailNow()
+			}
+		}
+
+		receivedContents := []string{}
+		otherReceivedContents := []string{}
+		for done := false; !done; {
+			select {
+			case content := <- receives:
+				receivedContents = append(receivedContents, content)
+			case content := <- otherReceives:
+				otherReceivedContents = append(otherReceivedContents, content)
+			case <- time.After(500 * time.Millisecond):
+				done = true
+			}
+		}
+
+		switch receivePanicPolicy {
+		case ReceivePanicPolicyAck:
+			assert.Equal(t, []string{"a", "b"}, receivedContents)
+			assert.Equal(t, []string{"a", "b"}, otherReceivedContents)
+		case ReceivePanicPolicyNoAck:
+			// the sequence does not advance past a message that panicked
+			assert.Equal(t, []string{"a", "a", "b", "b"}, receivedContents)
+			// the callback that did not panic receives the retransmit also
+			assert.Equal(t, []string{"a", "a", "b", "b"}, otherReceivedContents)
+		}
+
+		for _, content := range []string{"a", "b"} {
+			select {
+			case receivePanic := <- receivePanics:
+				assert.Equal(t, a.ClientId(), receivePanic.SourceId)
+				assert.Equal(t, true, receivePanic.Ack)
+				assert.Equal(t, receivePanicPolicy == ReceivePanicPolicyAck, receivePanic.Acked)
+				assert.Equal(t, 1, len(receivePanic.Frames))
+				assert.Equal(t, fmt.Sprintf("Panic %s", content), receivePanic.Err.Error())
+			default:
+				t.FailNow()
+			}
+		}
+		select {
+		case <- receivePanics:
+			t.FailNow()
+		default:
+		}
+
+		a.Cancel()
+		b.Cancel()
+		cancel()
+	}
+}
+
+
+func TestForwardIdleTimeout(t *testing.T) {
+	// a destination specific idle timeout closes its forward sequence before the default
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.ForwardBufferSettings.IdleTimeout = 30 * time.Second
+	// there are no routes, so writes drop
+	settings.ForwardBufferSettings.WriteTimeout = 10 * time.Millisecond
+
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+
+	shortDestinationId := NewId()
+	defaultDestinationId := NewId()
+
+	client.SetForwardIdleTimeout(shortDestinationId, 200 * time.Millisecond)
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+	for _, destinationId := range []Id{shortDestinationId, defaultDestinationId} {
+		success, err := client.ForwardWithTimeoutDetailed(
+			requireTransferFrameBytes(frame, NewId(), destinationId),
+			-1,
+		)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+	}
+
+	hasForwardSequence := func(destinationId Id)(bool) {
+		client.forwardBuffer.mutex.Lock()
+		defer client.forwardBuffer.mutex.Unlock()
+		_, ok := client.forwardBuffer.forwardSequences[destinationId]
+		return ok
+	}
+
+	assert.Equal(t, true, hasForwardSequence(shortDestinationId))
+	assert.Equal(t, true, hasForwardSequence(defaultDestinationId))
+
+	endTime := time.Now().Add(5 * time.Second)
+	for hasForwardSequence(shortDestinationId) && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, false, hasForwardSequence(shortDestinationId))
+	assert.Equal(t, true, hasForwardSequence(defaultDestinationId))
+
+	// the override is removed with the closed sequence
+	func() {
+		client.forwardBuffer.mutex.Lock()
+		defer client.forwardBuffer.mutex.Unlock()
+		assert.Equal(t, 0, len(client.forwardBuffer.destinationIdleTimeouts))
+	}()
+}
+
+
+func TestForwardMaxSequences(t *testing.T) {
+	// a new destination over the max sequences evicts the least recently used forward sequence
+	// the evicted sequence closes and releases its packs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.ForwardBufferSettings.MaxSequences = 2
+	// there are no routes, so writes drop
+	settings.ForwardBufferSettings.WriteTimeout = 10 * time.Millisecond
+
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+	forward := func(destinationId Id) {
+		success, err := client.ForwardWithTimeoutDetailed(
+			requireTransferFrameBytes(frame, NewId(), destinationId),
+			-1,
+		)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+	}
+
+	hasForwardSequence := func(destinationId Id)(bool) {
+		client.forwardBuffer.mutex.Lock()
+		defer client.forwardBuffer.mutex.Unlock()
+		_, ok := client.forwardBuffer.forwardSequences[destinationId]
+		return ok
+	}
+
+	aDestinationId := NewId()
+	bDestinationId := NewId()
+	cDestinationId := NewId()
+	dDestinationId := NewId()
+
+	forward(aDestinationId)
+	forward(bDestinationId)
+	// a is now more recently used than b
+	forward(aDestinationId)
+	forward(cDestinationId)
+
+	assert.Equal(t, true, hasForwardSequence(aDestinationId))
+	assert.Equal(t, false, hasForwardSequence(bDestinationId))
+	assert.Equal(t, true, hasForwardSequence(cDestinationId))
+	resourceStats := client.ResourceStats()
+	assert.Equal(t, 2, resourceStats.ForwardSequenceCount)
+	assert.Equal(t, uint64(1), resourceStats.ForwardSequenceEvictCount)
+
+	forward(dDestinationId)
+
+	assert.Equal(t, false, hasForwardSequence(aDestinationId))
+	assert.Equal(t, true, hasForwardSequence(cDestinationId))
+	assert.Equal(t, true, hasForwardSequence(dDestinationId))
+	resourceStats = client.ResourceStats()
+	assert.Equal(t, 2, resourceStats.ForwardSequenceCount)
+	assert.Equal(t, uint64(2), resourceStats.ForwardSequenceEvictCount)
+
+	// the use order tracks only the open sequences, least recently used first
+	func() {
+		client.forwardBuffer.mutex.Lock()
+		defer client.forwardBuffer.mutex.Unlock()
+		assert.Equal(t, 2, len(client.forwardBuffer.forwardSequenceUses))
+		assert.Equal(t, 2, client.forwardBuffer.forwardSequenceUseOrder.Len())
+		assert.Equal(t, cDestinationId, client.forwardBuffer.forwardSequenceUseOrder.Front().Value.(Id))
+		assert.Equal(t, dDestinationId, client.forwardBuffer.forwardSequenceUseOrder.Back().Value.(Id))
+	}()
+
+	// the evicted sequences exit, and all packs are released
+	endTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(endTime) {
+		if client.ResourceStats().BufferGoroutineCount <= 2 && client.forwardBuffer.TotalByteCount() == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, client.ResourceStats().BufferGoroutineCount)
+	assert.Equal(t, ByteCount(0), client.forwardBuffer.TotalByteCount())
+}
+
+func TestForwardWriterFailover(t *testing.T) {
+	// a writer that fails the first writes, then succeeds
+	// failed writes are retried after a backoff before the pack drops,
+	// and consecutive dropped packs reopen the writer
+
+	timeout := 5 * time.Second
+	failCount := 4
+	retryBackoff := 1 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	settings.ForwardBufferSettings.WriteRetryCount = 1
+	settings.ForwardBufferSettings.WriteRetryBackoff = retryBackoff
+	settings.ForwardBufferSettings.MaxConsecutiveDrops = 2
+
+	client := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer client.Cancel()
+
+	destinationId := NewId()
+
+	writer := &testingFailWriter{
+		failCount: failCount,
+		attempts: make(chan struct{}, 16),
+		writes: make(chan []byte, 16),
+	}
+	openCount := 0
+	closeCount := 0
+	forwardSequence := NewForwardSequence(
+		ctx,
+		client,
+		client.RouteManager(),
+		client.ContractManager(),
+		destinationId,
+		settings.ForwardBufferSettings,
+		nil,
+	)
+	clock := NewFakeClock(time.Now())
+	forwardSequence.clock = clock
+	// these are called from the sequence goroutine
+	forwardSequence.openMultiRouteWriter = func(destinationId Id) MultiRouteWriter {
+		openCount += 1
+		return writer
+	}
+	forwardSequence.closeMultiRouteWriter = func(multiRouteWriter MultiRouteWriter) {
+		closeCount += 1
+	}
+	sequenceDone := make(chan struct{})
+	go func() {
+		defer close(sequenceDone)
+		forwardSequence.Run()
+	}()
+
+	for i := 0; i < 4; i += 1 {
+		success, err := forwardSequence.Pack(&ForwardPack{
+			DestinationId: destinationId,
+			TransferFrameBytes: []byte{byte(i)},
+		}, -1)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, success)
+	}
+
+	awaitAttempt := func() {
+		select {
+		case <- writer.attempts:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	awaitRetryTimer := func() {
+		endTime := time.Now().Add(timeout)
+		for clock.TimerCount() == 0 {
+			if endTime.Before(time.Now()) {
+				t.FailNow()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the first and second packs each fail a write and a retry, then drop
+	// the second drop reopens the writer
+	for i := 0; i < 2; i += 1 {
+		awaitAttempt()
+		awaitRetryTimer()
+		// the retry waits for the backoff
+		clock.Advance(retryBackoff - time.Millisecond)
+		select {
+		case <- writer.attempts:
+			t.FailNow()
+		case <- time.After(100 * time.Millisecond):
+		}
+		clock.Advance(time.Millisecond)
+		awaitAttempt()
+	}
+
+	// the third and fourth packs are written on the first try
+	for i := 2; i < 4; i += 1 {
+		select {
+		case b := <- writer.writes:
+			assert.Equal(t, []byte{byte(i)}, b)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	forwardSequence.Cancel()
+	select {
+	case <- sequenceDone:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	// the writer is reopened once
+	assert.Equal(t, 2, openCount)
+	assert.Equal(t, 2, closeCount)
+	assert.Equal(t, failCount + 2, writer.writeCount)
+}
+
+
+type testingFailWriter struct {
+	failCount int
+	writeCount int
+	// failed writes
+	attempts chan struct{}
+	writes chan []byte
+}
+
+func (self *testingFailWriter) Write(ctx context.Context, transportFrameBytes []byte, timeout time.Duration) error {
+	self.writeCount += 1
+	if self.writeCount <= self.failCount {
+		self.attempts <- struct{}{}
+		return errors.New("Fail.")
+	}
+	self.writes <- transportFrameBytes
+	return nil
+}
+
+func (self *testingFailWriter) GetActiveRoutes() []Route {
+	return []Route{}
+}
+
+func (self *testingFailWriter) GetInactiveRoutes() []Route {
+	return []Route{}
+}
+
+func (self *testingFailWriter) GetRouteBackpressure() map[Route]RouteBackpressure {
+	return map[Route]RouteBackpressure{}
+}
+
+func (self *testingFailWriter) GetRouteWeights() map[Route]float32 {
+	return map[Route]float32{}
+}
+
+
+func createContractResultInitialPack(
+	provideMode protocol.ProvideMode,
+	provideSecretKey []byte,
+	sourceId Id,
+	destinationId Id,
+) (*protocol.Frame, error) {
+	contractId := NewId()
+	contractByteCount := 8 * 1024 * 1024 * 1024
+
+	storedContract := &protocol.StoredContract{
+		ContractId: contractId.Bytes(),
+		TransferByteCount: uint64(contractByteCount),
+		SourceId: sourceId.Bytes(),
+		DestinationId: destinationId.Bytes(),
+	}
+	storedContractBytes, err := proto.Marshal(storedContract)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, provideSecretKey)
+	storedContractHmac := mac.Sum(storedContractBytes)
+
+	message := &protocol.CreateContractResult{
+		Contract: &protocol.Contract{
+			StoredContractBytes: storedContractBytes,
+			StoredContractHmac: storedContractHmac,
+			ProvideMode: provideMode,
+		},
+	}
+
+	frame, err := ToFrame(message)
+	if err != nil {
+		return nil, err
+	}
+
+	messageId := NewId()
+	sequenceId := NewId()
+	pack := &protocol.Pack{
+		MessageId: messageId.Bytes(),
+		SequenceId: sequenceId.Bytes(),
+		SequenceNumber: 0,
+		Head: true,
+		Frames: []*protocol.Frame{frame},
+	}
+
+	return ToFrame(pack)
+}
+
+
+func requireContractResultInitialPack(
+	provideMode protocol.ProvideMode,
+	provideSecretKey []byte,
+	sourceId Id,
+	destinationId Id,
+) *protocol.Frame {
+	frame, err := createContractResultInitialPack(provideMode, provideSecretKey, sourceId, destinationId)
+	if err != nil {
+		panic(err)
+	}
+	return frame
+}
+
+
+func requireContract(
+	provideMode protocol.ProvideMode,
+	provideSecretKey []byte,
+	sourceId Id,
+	destinationId Id,
+) *protocol.Contract {
+	return requireContractWithByteCount(
+		provideMode,
+		provideSecretKey,
+		sourceId,
+		destinationId,
+		8 * 1024 * 1024 * 1024,
+	)
+}
+
+
+func requireContractWithByteCount(
+	provideMode protocol.ProvideMode,
+	provideSecretKey []byte,
+	sourceId Id,
+	destinationId Id,
+	contractByteCount ByteCount,
+) *protocol.Contract {
+	storedContract := &protocol.StoredContract{
+		ContractId: NewId().Bytes(),
+		TransferByteCount: uint64(contractByteCount),
+		SourceId: sourceId.Bytes(),
+		DestinationId: destinationId.Bytes(),
+	}
+	storedContractBytes, err := proto.Marshal(storedContract)
+	if err != nil {
+		panic(err)
+	}
+	mac := hmac.New(sha256.New, provideSecretKey)
+	storedContractHmac := mac.Sum(storedContractBytes)
+
+	return &protocol.Contract{
+		StoredContractBytes: storedContractBytes,
+		StoredContractHmac: storedContractHmac,
+		ProvideMode: provideMode,
+	}
+}
+
+
+func createTransferFrameBytes(frame *protocol.Frame, sourceId Id, destinationId Id) ([]byte, error) {
+	transferFrame := &protocol.TransferFrame{
+		TransferPath: &protocol.TransferPath{
+			SourceId: sourceId.Bytes(),
+			DestinationId: destinationId.Bytes(),
+			StreamId: DirectStreamId.Bytes(),
+		},
+		Frame: frame,
+	}
+
+	return proto.Marshal(transferFrame)
+}
+
+
+func requireTransferFrameBytes(frame *protocol.Frame, sourceId Id, destinationId Id) []byte {
+	b, err := createTransferFrameBytes(frame, sourceId, destinationId)
+	if err != nil {
+		panic(err)
+	}
+
+	var filteredTransferFrame protocol.FilteredTransferFrame
+	if err := proto.Unmarshal(b, &filteredTransferFrame); err != nil {
+		panic(err)
+	}
+	sourceId_, err := IdFromBytes(filteredTransferFrame.TransferPath.SourceId)
+	if err != nil {
+		panic(err)
+	}
+	destinationId_, err := IdFromBytes(filteredTransferFrame.TransferPath.DestinationId)
+	if err != nil {
+		panic(err)
+	}
+
+	if sourceId != sourceId_ {
+		panic(fmt.Errorf("%s <> %s", sourceId, sourceId_))
+	}
+
+	if destinationId != destinationId_ {
+		panic(fmt.Errorf("%s <> %s", destinationId, destinationId_))
+	}
+
+	return b
+}
+
+
+
+type conditioner struct {
+	ctx context.Context
+	fixedDelay time.Duration
+	randomDelay time.Duration
+	hold bool
+	inversionWindow time.Duration
+	invertFraction float32
+	lossProbability float32
+	monitor *Monitor
+	mutex sync.Mutex
+}
+
+func newConditioner(ctx context.Context, in chan []byte) (*conditioner, chan []byte) {
+	c := &conditioner{
+		ctx: ctx,
+		fixedDelay: 0,
+		randomDelay: 0,
+		lossProbability: 0,
+		monitor: NewMonitor(),
+	}
+	out := make(chan []byte)
+	go c.run(in, out)
+	return c, out
+}
+
+func (self *conditioner) update(callback func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	callback()
+	self.monitor.NotifyAll()
+}
+
+func (self *conditioner) calcLoss() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return mathrand.Float32() < self.lossProbability
+}
+
+func (self *conditioner) calcDelay() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delay := self.fixedDelay
+	if 0 < self.randomDelay {
+		delay += time.Duration(mathrand.Intn(int(self.randomDelay)))
+	}
+	return delay
+}
+
+func (self *conditioner) run(in chan []byte, out chan []byte) {
+	// defer close(out)
+
+	for {
+		select {
+		case <- self.ctx.Done():
+			return
+		case <- self.monitor.NotifyChannel():
+			continue
+		case b, ok := <- in:
+			if !ok {
+				return
+			}
+
+			if self.calcLoss() {
+				continue
+			}
+
+			delay := self.calcDelay()
+
+			if delay <= 0 {
+				select {
+				case <- self.ctx.Done():
+					return
+				case out <- b:
+				}
+			} else {
+				go func() {
+					select {
+					case <- self.ctx.Done():
+						return
+					case <- time.After(delay):
+					}
+
+					select {
+					case <- self.ctx.Done():
+						return
+					case out <- b:
+					}
+				}()
+			}				
+		}
+	}
+}
+
+
+
+// FIXME TestAckTimeout
+
+
+
+
+
+
+func TestEffectivePayloadSize(t *testing.T) {
+	// a frame of the effective payload size fits in the transport mtu
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	settings := DefaultClientSettings()
+	a := NewClient(ctx, aClientId, &contractClientOob{clientId: aClientId}, settings)
+	defer a.Cancel()
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+
+	payloadSize := a.EffectivePayloadSize(NewTransferPath(
+		Path{ClientId: aClientId, StreamId: DirectStreamId},
+		Path{ClientId: bClientId, StreamId: DirectStreamId},
+	))
+	assert.Equal(t, true, 0 < payloadSize)
+	assert.Equal(t, true, payloadSize < settings.TransportMtu)
+
+	messageBytes := make([]byte, payloadSize)
+	mathrand.Read(messageBytes)
+	for i := 0; i < 2; i += 1 {
+		success := a.SendWithTimeout(
+			&protocol.Frame{
+				MessageType: protocol.MessageType_TestSimpleMessage,
+				MessageBytes: messageBytes,
+			},
+			bClientId,
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	// the contract is sent in its own pack before the messages
+	for messageCount := 0; messageCount < 2; {
+		select {
+		case transferFrameBytes := <- aSend:
+			assert.Equal(t, true, len(transferFrameBytes) <= settings.TransportMtu)
+
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack := &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+			for _, frame := range pack.Frames {
+				assert.Equal(t, payloadSize, len(frame.MessageBytes))
+				messageCount += 1
+			}
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// a transport mtu that cannot fit the overhead
+	settings.TransportMtu = 64
+	assert.Equal(t, 0, a.EffectivePayloadSize(NewTransferPath(
+		Path{ClientId: aClientId, StreamId: DirectStreamId},
+		Path{ClientId: bClientId, StreamId: DirectStreamId},
+	)))
+}
+
+
+// records the peer audits sent to the platform
+type peerAuditOob struct {
+	peerAudits chan *protocol.PeerAudit
+}
+
+func (self *peerAuditOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	for _, frame := range frames {
+		if peerAudit, ok := RequireFromFrame(frame).(*protocol.PeerAudit); ok {
+			self.peerAudits <- peerAudit
+		}
+	}
+	go callback(nil, nil)
+}
+
+
+func TestInvalidAckFlood(t *testing.T) {
+	// a flood of invalid acks is dropped and the peer is audited
+	// the sequence still processes the valid ack
+
+	timeout := 5 * time.Second
+	invalidAckLimit := 16
+	n := 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &peerAuditOob{
+		peerAudits: make(chan *protocol.PeerAudit, n),
+	}
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.InvalidAckLimit = invalidAckLimit
+	settings.SendBufferSettings.InvalidAckWindow = 60 * time.Second
+	// the ack channel would fill without the invalid ack filter
+	settings.SendBufferSettings.AckBufferSize = 0
+	settings.BufferTimeout = 1 * time.Second
+	a := NewClient(ctx, aClientId, oob, settings)
+	defer a.Cancel()
+
+	a.ContractManager().AddNoContractPeer(bClientId)
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	acks := make(chan error, 1)
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		bClientId,
+		func(err error) {
+			acks <- err
+		},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	var pack *protocol.Pack
+	select {
+	case transferFrameBytes := <- aSend:
+		transferFrame := &protocol.TransferFrame{}
+		err := proto.Unmarshal(transferFrameBytes, transferFrame)
+		assert.Equal(t, nil, err)
+		pack = &protocol.Pack{}
+		err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	floodStartTime := time.Now()
+	for i := 0; i < n; i += 1 {
+		sequenceId := pack.SequenceId
+		if i % 2 == 1 {
+			// an unknown sequence
+			sequenceId = NewId().Bytes()
+		}
+		ack := &protocol.Ack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId,
+		}
+		select {
+		case aReceive <- requireTransferFrameBytes(RequireToFrame(ack), bClientId, aClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	// invalid acks are dropped without waiting on the sequence
+	assert.Equal(t, true, time.Now().Sub(floodStartTime) < settings.BufferTimeout)
+
+	auditCount := 0
+	for i := 0; i < n / (invalidAckLimit + 1); i += 1 {
+		select {
+		case peerAudit := <- oob.peerAudits:
+			peerId, err := IdFromBytes(peerAudit.PeerId)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, bClientId, peerId)
+			assert.Equal(t, uint64(invalidAckLimit + 1), peerAudit.BadMessageCount)
+			auditCount += int(peerAudit.BadMessageCount)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	assert.Equal(t, n - n % (invalidAckLimit + 1), auditCount)
+
+	// the valid ack
+	ack := &protocol.Ack{
+		MessageId: pack.MessageId,
+		SequenceId: pack.SequenceId,
+	}
+	select {
+	case aReceive <- requireTransferFrameBytes(RequireToFrame(ack), bClientId, aClientId):
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+}
+
+
+func TestPeerAuditLabel(t *testing.T) {
+	// peer audits carry the client label, or the label of the peer when set
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oob := &peerAuditOob{
+		peerAudits: make(chan *protocol.PeerAudit, 16),
+	}
+
+	settings := DefaultClientSettings()
+	settings.PeerAuditLabel = "provider"
+	client := NewClient(ctx, NewId(), oob, settings)
+	defer client.Cancel()
+
+	aPeerId := NewId()
+	bPeerId := NewId()
+	client.SetPeerAuditLabel(bPeerId, "tenant")
+
+	requireLabel := func(peerId Id, label string) {
+		client.ReportAbuse(peerId)
+		select {
+		case peerAudit := <- oob.peerAudits:
+			auditPeerId, err := IdFromBytes(peerAudit.PeerId)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, peerId, auditPeerId)
+			assert.Equal(t, true, peerAudit.Abuse)
+			assert.Equal(t, label, peerAudit.GetLabel())
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	requireLabel(aPeerId, "provider")
+	requireLabel(bPeerId, "tenant")
+
+	client.SetPeerAuditLabel(bPeerId, "")
+	requireLabel(bPeerId, "provider")
+
+	settings.PeerAuditLabel = ""
+	requireLabel(aPeerId, "")
+}
+
+
+func TestResendJitter(t *testing.T) {
+	// items queued at the same time under total loss
+	// resend spread over the jitter range rather than in one burst
+
+	timeout := 5 * time.Second
+	n := 64
+	resendInterval := 400 * time.Millisecond
+	jitterFraction := 0.5
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.ResendInterval = resendInterval
+	settings.SendBufferSettings.ResendJitterFraction = jitterFraction
+	a := NewClient(ctx, aClientId, NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	a.ContractManager().AddNoContractPeer(bClientId)
+
+	// no acks are returned
+	aSend := make(chan []byte, 4 * n)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			bClientId,
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	// message id -> first send time
+	sendTimes := map[Id]time.Time{}
+	resendTimeouts := map[Id]time.Duration{}
+	for len(resendTimeouts) < n {
+		select {
+		case transferFrameBytes := <- aSend:
+			receiveTime := time.Now()
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack := &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+			messageId, err := IdFromBytes(pack.MessageId)
+			assert.Equal(t, nil, err)
+
+			if sendTime, ok := sendTimes[messageId]; !ok {
+				sendTimes[messageId] = receiveTime
+			} else if _, ok := resendTimeouts[messageId]; !ok {
+				resendTimeouts[messageId] = receiveTime.Sub(sendTime)
+			}
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	minResendTimeout := time.Duration(math.MaxInt64)
+	maxResendTimeout := time.Duration(0)
+	for _, resendTimeout := range resendTimeouts {
+		minResendTimeout = min(minResendTimeout, resendTimeout)
+		maxResendTimeout = max(maxResendTimeout, resendTimeout)
+	}
+	slack := 50 * time.Millisecond
+	jitter := time.Duration(float64(resendInterval) * jitterFraction)
+	assert.Equal(t, true, resendInterval - jitter - slack <= minResendTimeout)
+	assert.Equal(t, true, maxResendTimeout <= resendInterval + jitter + slack)
+	// without jitter all items resend within a few milliseconds of each other
+	assert.Equal(t, true, jitter <= maxResendTimeout - minResendTimeout)
+}
+
+
+func TestStreamTransferPath(t *testing.T) {
+	// stream paths are constructed, masked, validated, and round trip through protobuf
+
+	streamId := NewId()
+
+	destination := StreamDestination(streamId)
+	assert.Equal(t, true, destination.IsStream())
+	assert.Equal(t, Path{StreamId: streamId}, destination.Destination())
+	assert.Equal(t, Path{}, destination.Source())
+	assert.Equal(t, nil, destination.Validate())
+
+	source := StreamSource(streamId)
+	assert.Equal(t, true, source.IsStream())
+	assert.Equal(t, Path{StreamId: streamId}, source.Source())
+	assert.Equal(t, Path{}, source.Destination())
+	assert.Equal(t, nil, source.Validate())
+
+	// masks
+	path := NewTransferPath(Path{StreamId: streamId}, Path{StreamId: streamId})
+	assert.Equal(t, nil, path.Validate())
+	assert.Equal(t, destination, path.DestinationMask())
+	assert.Equal(t, source, path.SourceMask())
+
+	clientPath := NewTransferPath(Path{ClientId: NewId()}, Path{ClientId: NewId()})
+	assert.Equal(t, false, clientPath.IsStream())
+	assert.Equal(t, nil, clientPath.Validate())
+	assert.Equal(t, NewTransferPath(Path{}, clientPath.Destination()), clientPath.DestinationMask())
+	assert.Equal(t, NewTransferPath(clientPath.Source(), Path{}), clientPath.SourceMask())
+
+	// malformed stream paths
+	assert.NotEqual(t, nil, NewTransferPath(Path{ClientId: NewId()}, Path{StreamId: streamId}).Validate())
+	assert.NotEqual(t, nil, NewTransferPath(Path{StreamId: streamId}, Path{ClientId: NewId(), StreamId: streamId}).Validate())
+	assert.NotEqual(t, nil, NewTransferPath(Path{StreamId: streamId}, Path{StreamId: NewId()}).Validate())
+
+	roundTrip := func(path TransferPath)(TransferPath) {
+		protoPathBytes, err := proto.Marshal(path.ToProtobuf())
+		assert.Equal(t, nil, err)
+		protoPath := &protocol.TransferPath{}
+		err = proto.Unmarshal(protoPathBytes, protoPath)
+		assert.Equal(t, nil, err)
+		roundTripPath, err := TransferPathFromProtobuf(protoPath)
+		assert.Equal(t, nil, err)
+		return roundTripPath
+	}
+
+	assert.Equal(t, clientPath, roundTrip(clientPath))
+	assert.Equal(t, path, roundTrip(path))
+	// the protobuf has one stream id, so compare the masks
+	assert.Equal(t, destination, roundTrip(destination).DestinationMask())
+	assert.Equal(t, source, roundTrip(source).SourceMask())
+
+	// a malformed protobuf path
+	_, err := TransferPathFromProtobuf(&protocol.TransferPath{
+		DestinationId: NewId().Bytes(),
+		SourceId: NewId().Bytes(),
+		StreamId: streamId.Bytes(),
+	})
+	assert.NotEqual(t, nil, err)
+	_, err = TransferPathFromProtobuf(&protocol.TransferPath{
+		DestinationId: []byte{1},
+	})
+	assert.NotEqual(t, nil, err)
+}
+
+
+// records the contract requests for each destination, and never returns a contract
+type createContractTimesOob struct {
+	mutex sync.Mutex
+	// destination id -> request times
+	createContractTimes map[Id][]time.Time
+}
+
+func (self *createContractTimesOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	requestTime := time.Now()
+	for _, frame := range frames {
+		if createContract, ok := RequireFromFrame(frame).(*protocol.CreateContract); ok {
+			destinationId, err := IdFromBytes(createContract.DestinationId)
+			if err != nil {
+				panic(err)
+			}
+			func() {
+				self.mutex.Lock()
+				defer self.mutex.Unlock()
+				self.createContractTimes[destinationId] = append(self.createContractTimes[destinationId], requestTime)
+			}()
+		}
+	}
+	go callback([]*protocol.Frame{}, nil)
+}
+
+
+func TestCreateContractRetryJitter(t *testing.T) {
+	// many sequences that retry contract creation at the same time
+	// spread their retries over the jitter range, and back off on each retry
+
+	n := 32
+	retryInterval := 200 * time.Millisecond
+	jitterFraction := 0.5
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oob := &createContractTimesOob{
+		createContractTimes: map[Id][]time.Time{},
+	}
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.CreateContractTimeout = 2 * time.Second
+	settings.SendBufferSettings.CreateContractRetryInterval = retryInterval
+	settings.SendBufferSettings.CreateContractRetryBackoffScale = 1
+	settings.SendBufferSettings.CreateContractRetryJitterFraction = jitterFraction
+	a := NewClient(ctx, NewId(), oob, settings)
+	defer a.Cancel()
+
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: "hi",
+			}),
+			NewId(),
+			func(err error) {},
+			-1,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	// the first retry is at 1x the interval and the second at 2x, each +-jitter
+	time.Sleep(time.Duration(3 * float64(retryInterval) * (1 + jitterFraction)) + 200 * time.Millisecond)
+
+	createContractTimes := func()(map[Id][]time.Time) {
+		oob.mutex.Lock()
+		defer oob.mutex.Unlock()
+		return maps.Clone(oob.createContractTimes)
+	}()
+	assert.Equal(t, n, len(createContractTimes))
+
+	slack := 50 * time.Millisecond
+	jitter := time.Duration(float64(retryInterval) * jitterFraction)
+	minRetryWait := time.Duration(math.MaxInt64)
+	maxRetryWait := time.Duration(0)
+	netRetryWaits := [2]time.Duration{}
+	for _, requestTimes := range createContractTimes {
+		assert.Equal(t, true, 3 <= len(requestTimes))
+		for i := 0; i < 2; i += 1 {
+			retryWait := requestTimes[i + 1].Sub(requestTimes[i])
+			scale := time.Duration(i + 1)
+			assert.Equal(t, true, scale * (retryInterval - jitter) - slack <= retryWait)
+			assert.Equal(t, true, retryWait <= scale * (retryInterval + jitter) + slack)
+			netRetryWaits[i] += retryWait
+			if i == 0 {
+				minRetryWait = min(minRetryWait, retryWait)
+				maxRetryWait = max(maxRetryWait, retryWait)
+			}
+		}
+	}
+	// without jitter all sequences retry within a few milliseconds of each other
+	assert.Equal(t, true, jitter <= maxRetryWait - minRetryWait)
+	// backoff
+	assert.Equal(t, true, netRetryWaits[0] < netRetryWaits[1])
+}
+
+
+func TestLoopbackRateLimit(t *testing.T) {
+	// flood loopback sends over the rate limit
+	// the limit applies backpressure to the senders, and remote receives are still processed
+
+	timeout := 5 * time.Second
+	rateLimit := 50
+	floodDuration := 1 * time.Second
+	floodCount := 4
+	remoteCount := 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	clientSettings := DefaultClientSettings()
+	clientSettings.LoopbackRateLimit = float64(rateLimit)
+	b := NewClient(ctx, bClientId, NewNoContractClientOob(), clientSettings)
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().AddNoContractPeer(aClientId)
+
+	var receiveLock sync.Mutex
+	loopbackReceiveCount := 0
+	remoteReceives := make(chan string, remoteCount)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				if sourceId == bClientId {
+					receiveLock.Lock()
+					loopbackReceiveCount += 1
+					receiveLock.Unlock()
+				} else {
+					remoteReceives <- v.Content
+				}
+			}
+		}
+	})
+
+	var wg sync.WaitGroup
+	var sendLock sync.Mutex
+	sendCount := 0
+	notSendCount := 0
+	endTime := time.Now().Add(floodDuration)
+	for i := 0; i < floodCount; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(endTime) {
+				success := b.SendWithTimeout(
+					RequireToFrame(&protocol.SimpleMessage{
+						Content: "loopback",
+					}),
+					bClientId,
+					nil,
+					10 * time.Millisecond,
+				)
+				sendLock.Lock()
+				if success {
+					sendCount += 1
+				} else {
+					notSendCount += 1
+				}
+				sendLock.Unlock()
+			}
+		}()
+	}
+
+	// remote receives are processed during the flood
+	sequenceId := NewId()
+	for i := 0; i < remoteCount; i += 1 {
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: uint64(i),
+			Head: (i == 0),
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: fmt.Sprintf("hi %d", i),
+				}),
+			},
+		}
+		select {
+		case bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	for i := 0; i < remoteCount; i += 1 {
+		select {
+		case content := <- remoteReceives:
+			assert.Equal(t, fmt.Sprintf("hi %d", i), content)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	// the remote receives were not queued behind the loopback flood
+	assert.Equal(t, true, time.Now().Before(endTime))
+
+	wg.Wait()
+
+	// one slot per interval, plus the first slot
+	maxSendCount := int(float64(rateLimit) * floodDuration.Seconds()) + 1
+	assert.Equal(t, true, 0 < sendCount)
+	assert.Equal(t, true, sendCount <= maxSendCount)
+	assert.Equal(t, true, 0 < notSendCount)
+
+	stats := b.Stats()
+	assert.Equal(t, uint64(sendCount), stats.LoopbackSendCount)
+	assert.Equal(t, uint64(notSendCount), stats.LoopbackDropCount)
+	assert.Equal(t, true, 0 < stats.LoopbackLimitedCount)
+	assert.Equal(t, ByteCount(sendCount) * ByteCount(len(RequireToFrame(&protocol.SimpleMessage{Content: "loopback"}).MessageBytes)), stats.LoopbackSendByteCount)
+
+	endTime = time.Now().Add(timeout)
+	for {
+		receiveLock.Lock()
+		c := loopbackReceiveCount
+		receiveLock.Unlock()
+		if c == sendCount || !time.Now().Before(endTime) {
+			assert.Equal(t, sendCount, c)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+
+func TestTransferStats(t *testing.T) {
+	// acked bytes, unacked bytes, resends, and rtt are reported for the open send sequence
+	// after the sequence closes it is not included
+
+	timeout := 5 * time.Second
+	n := 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.ResendInterval = 200 * time.Millisecond
+	settings.SendBufferSettings.IdleTimeout = 200 * time.Millisecond
+	a := NewClient(ctx, aClientId, NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	a.ContractManager().AddNoContractPeer(bClientId)
+
+	aSend := make(chan []byte, 16 * n)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+	messageByteCount := ByteCount(len(frame.MessageBytes))
+
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(frame, bClientId, func(err error) {}, timeout)
+		assert.Equal(t, true, success)
+	}
+
+	nextPack := func() *protocol.Pack {
+		select {
+		case transferFrameBytes := <- aSend:
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack := &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+			return pack
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+	ack := func(pack *protocol.Pack) {
+		ackFrame := RequireToFrame(&protocol.Ack{
+			MessageId: pack.MessageId,
+			SequenceId: pack.SequenceId,
+			Selective: false,
+		})
+		select {
+		case aReceive <- requireTransferFrameBytes(ackFrame, bClientId, aClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	packs := []*protocol.Pack{}
+	for i := 0; i < n; i += 1 {
+		packs = append(packs, nextPack())
+	}
+	// ack the first item before it is resent
+	ack(packs[0])
+
+	path := NewTransferPath(Path{ClientId: aClientId}, Path{ClientId: bClientId})
+
+	// wait for the remaining items to resend
+	var stats *TransferStats
+	endTime := time.Now().Add(timeout)
+	for {
+		transferStats := a.TransferStats()
+		assert.Equal(t, 1, len(transferStats))
+		stats = transferStats[path]
+		if stats != nil && n - 1 <= stats.ResendCount || !time.Now().Before(endTime) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, nil, stats)
+	assert.Equal(t, messageByteCount, stats.AckedByteCount)
+	assert.Equal(t, ByteCount(n - 1) * messageByteCount, stats.UnackedByteCount)
+	assert.Equal(t, true, n - 1 <= stats.ResendCount)
+	assert.Equal(t, true, 0 < stats.Rtt)
+	assert.Equal(t, true, stats.Rtt < settings.SendBufferSettings.ResendInterval)
+
+	// acks are cumulative
+	ack(packs[n - 1])
+
+	// the sequence closes on idle and is no longer reported
+	endTime = time.Now().Add(timeout)
+	for 0 < len(a.TransferStats()) && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(a.TransferStats()))
+}
+
+
+// responds to each create contract with a contract of the requested size
+type sizedContractOob struct {
+	clientId Id
+	// grants at most this size. 0 grants the requested size
+	maxTransferByteCount ByteCount
+
+	mutex sync.Mutex
+	// requested transfer byte counts, in order
+	transferByteCounts []ByteCount
+}
+
+func (self *sizedContractOob) SendControl(frames []*protocol.Frame, callback func(resultFrames []*protocol.Frame, err error)) {
+	resultFrames := []*protocol.Frame{}
+	for _, frame := range frames {
+		if createContract, ok := RequireFromFrame(frame).(*protocol.CreateContract); ok {
+			destinationId, err := IdFromBytes(createContract.DestinationId)
+			if err != nil {
+				panic(err)
+			}
+			transferByteCount := ByteCount(createContract.TransferByteCount)
+			func() {
+				self.mutex.Lock()
+				defer self.mutex.Unlock()
+				self.transferByteCounts = append(self.transferByteCounts, transferByteCount)
+			}()
+			grantedTransferByteCount := transferByteCount
+			if 0 < self.maxTransferByteCount {
+				grantedTransferByteCount = min(transferByteCount, self.maxTransferByteCount)
+			}
+			resultFrames = append(resultFrames, RequireToFrame(&protocol.CreateContractResult{
+				Contract: requireContractWithByteCount(
+					protocol.ProvideMode_Network,
+					make([]byte, 32),
+					self.clientId,
+					destinationId,
+					grantedTransferByteCount,
+				),
+			}))
+		}
+	}
+	go callback(resultFrames, nil)
+}
+
+func (self *sizedContractOob) TransferByteCounts() []ByteCount {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return slices.Clone(self.transferByteCounts)
+}
+
+
+func TestSendContractSizedToMessage(t *testing.T) {
+	// a message larger than a standard contract requests a contract sized to fit the message
+	// a message larger than the max contract fails the send without closing the client
+
+	timeout := 5 * time.Second
+	standardByteCount := kib(4)
+	maxByteCount := kib(64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &sizedContractOob{
+		clientId: aClientId,
+	}
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.StandardContractTransferByteCount = standardByteCount
+	settings.ContractManagerSettings.MaxContractTransferByteCount = maxByteCount
+	settings.SendBufferSettings.CreateContractTimeout = 1 * time.Second
+	a := NewClient(ctx, aClientId, oob, settings)
+	defer a.Cancel()
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+
+	send := func(messageByteCount int) chan error {
+		frame := &protocol.Frame{
+			MessageType: protocol.MessageType_TestSimpleMessage,
+			MessageBytes: make([]byte, messageByteCount),
+		}
+		acks := make(chan error, 1)
+		success := a.SendWithTimeout(frame, bClientId, func(err error) {
+			acks <- err
+		}, timeout)
+		assert.Equal(t, true, success)
+		return acks
+	}
+
+	// fits a sized contract. the send is written and waits for an ack
+	largeByteCount := int(standardByteCount)
+	acks := send(largeByteCount)
+	select {
+	case <- aSend:
+	case err := <- acks:
+		t.Fatal(err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	transferByteCounts := oob.TransferByteCounts()
+	assert.Equal(t, true, 0 < len(transferByteCounts))
+	effectiveByteCount := ByteCount(largeByteCount) + settings.SendBufferSettings.MinMessageByteCount
+	assert.Equal(t, true, effectiveByteCount <= ByteCount(float32(transferByteCounts[0]) * settings.SendBufferSettings.ContractFillFraction))
+	assert.Equal(t, true, transferByteCounts[0] <= maxByteCount)
+	// the next contract is queued at the standard size
+	assert.Equal(t, true, slices.Contains(transferByteCounts, standardByteCount))
+
+	// does not fit the max contract
+	acks = send(int(maxByteCount))
+	select {
+	case err := <- acks:
+		assert.NotEqual(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	assert.Equal(t, false, a.IsDone())
+}
+
+
+type recordingCongestionController struct {
+	windowByteCount ByteCount
+
+	mutex sync.Mutex
+	rtts []time.Duration
+	lossCount int
+}
+
+func (self *recordingCongestionController) OnAck(rtt time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.rtts = append(self.rtts, rtt)
+}
+
+func (self *recordingCongestionController) OnLoss() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.lossCount += 1
+}
+
+func (self *recordingCongestionController) WindowByteCount() ByteCount {
+	return self.windowByteCount
+}
+
+func (self *recordingCongestionController) state() ([]time.Duration, int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return slices.Clone(self.rtts), self.lossCount
+}
+
+
+func TestCongestionController(t *testing.T) {
+	// the send sequence queues new messages only within the controller window,
+	// and notifies the controller of acks and resends
+
+	timeout := 5 * time.Second
+	resendInterval := 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	// one item in flight
+	controller := &recordingCongestionController{
+		windowByteCount: ByteCount(1),
+	}
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.ResendInterval = resendInterval
+	settings.SendBufferSettings.ResendJitterFraction = 0
+	settings.SendBufferSettings.CongestionControllerGenerator = func(sendBufferSettings *SendBufferSettings) CongestionController {
+		return controller
+	}
+	a := NewClient(ctx, aClientId, NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	a.ContractManager().AddNoContractPeer(bClientId)
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	for i := 0; i < 2; i += 1 {
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			bClientId,
+			func(err error) {},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+	}
+
+	nextPack := func(timeout time.Duration) *protocol.Pack {
+		select {
+		case transferFrameBytes := <- aSend:
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack := &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+			return pack
+		case <- time.After(timeout):
+			return nil
+		}
+	}
+	ack := func(pack *protocol.Pack) {
+		ackFrame := RequireToFrame(&protocol.Ack{
+			MessageId: pack.MessageId,
+			SequenceId: pack.SequenceId,
+			Selective: false,
+		})
+		select {
+		case aReceive <- requireTransferFrameBytes(ackFrame, bClientId, aClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	pack0 := nextPack(timeout)
+	assert.NotEqual(t, nil, pack0)
+	// the window is full, so the next item is held until the resend
+	resend := nextPack(timeout)
+	assert.NotEqual(t, nil, resend)
+	assert.Equal(t, pack0.MessageId, resend.MessageId)
+	_, lossCount := controller.state()
+	assert.Equal(t, 1, lossCount)
+
+	// a resent item is acked with no rtt sample
+	ack(pack0)
+	pack1 := nextPack(timeout)
+	assert.NotEqual(t, nil, pack1)
+	assert.NotEqual(t, pack0.MessageId, pack1.MessageId)
+
+	ack(pack1)
+
+	var rtts []time.Duration
+	endTime := time.Now().Add(timeout)
+	for {
+		rtts, _ = controller.state()
+		if 2 <= len(rtts) || !time.Now().Before(endTime) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, len(rtts))
+	assert.Equal(t, time.Duration(0), rtts[0])
+	assert.Equal(t, true, 0 < rtts[1])
+	assert.Equal(t, true, rtts[1] < resendInterval)
+}
+
+
+func TestReceiveSequenceErrorCallback(t *testing.T) {
+	// a receive sequence that exits on gap timeout or idle timeout notifies the sequence error callbacks
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	settings := DefaultClientSettings()
+	settings.ReceiveBufferSettings.GapTimeout = 200 * time.Millisecond
+	settings.ReceiveBufferSettings.IdleTimeout = 500 * time.Millisecond
+	b := NewClient(ctx, bClientId, NewNoContractClientOob(), settings)
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().AddNoContractPeer(aClientId)
+
+	type sequenceError struct {
+		source TransferPath
+		sequenceId Id
+		reason string
+	}
+	sequenceErrors := make(chan *sequenceError, 16)
+	b.AddSequenceErrorCallback(func(source TransferPath, sequenceId Id, reason string) {
+		sequenceErrors <- &sequenceError{
+			source: source,
+			sequenceId: sequenceId,
+			reason: reason,
+		}
+	})
+	// a panicking callback does not affect the other callbacks
+	b.AddSequenceErrorCallback(func(source TransferPath, sequenceId Id, reason string) {
+		panic(errors.New("Test panic."))
+	})
+
+	receive := func(sequenceId Id, sequenceNumber int) {
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: sequenceId.Bytes(),
+			SequenceNumber: uint64(sequenceNumber),
+			Head: (sequenceNumber == 0),
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: fmt.Sprintf("hi %d", sequenceNumber),
+				}),
+			},
+		}
+		select {
+		case bReceive <- requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	source := NewTransferPath(Path{ClientId: aClientId}, Path{ClientId: bClientId})
+
+	// the gap at 1 is never filled
+	gapSequenceId := NewId()
+	receive(gapSequenceId, 0)
+	receive(gapSequenceId, 2)
+
+	select {
+	case e := <- sequenceErrors:
+		assert.Equal(t, source, e.source)
+		assert.Equal(t, gapSequenceId, e.sequenceId)
+		assert.Equal(t, ReceiveSequenceExitGapTimeout, e.reason)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	idleSequenceId := NewId()
+	receive(idleSequenceId, 0)
+
+	select {
+	case e := <- sequenceErrors:
+		assert.Equal(t, source, e.source)
+		assert.Equal(t, idleSequenceId, e.sequenceId)
+		assert.Equal(t, ReceiveSequenceExitIdleTimeout, e.reason)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+}
+
+
+func TestSendGracefulClose(t *testing.T) {
+	// a sender with graceful close closes the receive sequence when the send sequence closes idle,
+	// well before the receiver idle timeout
+	// the close marker of a closed sequence is ignored
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aSettings := DefaultClientSettings()
+	aSettings.SendBufferSettings.GracefulClose = true
+	aSettings.SendBufferSettings.IdleTimeout = 200 * time.Millisecond
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), aSettings)
+	defer a.Cancel()
+
+	bSettings := DefaultClientSettings()
+	bSettings.ReceiveBufferSettings.IdleTimeout = time.Hour
+	b := NewClient(ctx, NewId(), NewNoContractClientOob(), bSettings)
+	defer b.Cancel()
+
+	aReceive := make(chan []byte)
+	bReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	type sequenceError struct {
+		sequenceId Id
+		reason string
+	}
+	sequenceErrors := make(chan *sequenceError, 16)
+	b.AddSequenceErrorCallback(func(source TransferPath, sequenceId Id, reason string) {
+		sequenceErrors <- &sequenceError{
+			sequenceId: sequenceId,
+			reason: reason,
+		}
+	})
+
+	for i := 0; i < 4; i += 1 {
+		acks := make(chan error, 1)
+		success := a.SendWithTimeout(
+			RequireToFrame(&protocol.SimpleMessage{
+				Content: fmt.Sprintf("hi %d", i),
+			}),
+			b.ClientId(),
+			func(err error) {
+				acks <- err
+			},
+			timeout,
+		)
+		assert.Equal(t, true, success)
+		select {
+		case err := <- acks:
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	var closedSequenceId Id
+	select {
+	case e := <- sequenceErrors:
+		assert.Equal(t, ReceiveSequenceExitSenderClose, e.reason)
+		closedSequenceId = e.sequenceId
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	receiveSequenceCount := func()(int) {
+		sequenceCount, _ := b.receiveBuffer.resourceCounts()
+		return sequenceCount
+	}
+	endTime := time.Now().Add(timeout)
+	for 0 < receiveSequenceCount() && time.Now().Before(endTime) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, receiveSequenceCount())
+
+	// a repeated marker does not open a sequence
+	success, err := b.receiveBuffer.Pack(&ReceivePack{
+		SourceId: a.ClientId(),
+		SequenceId: closedSequenceId,
+		Pack: &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: closedSequenceId.Bytes(),
+			SequenceNumber: 4,
+			Close: true,
+		},
+	}, timeout)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, success)
+	assert.Equal(t, 0, receiveSequenceCount())
+
+	select {
+	case e := <- sequenceErrors:
+		t.Fatalf("Unexpected sequence error %s.", e.reason)
+	case <- time.After(200 * time.Millisecond):
+	}
+}
+
+
+func TestReceiveBadMessageAbuse(t *testing.T) {
+	// a source that spams bad messages is audited as abuse after `BadMessageAbuseLimit`
+	// the receive sequence exits, and packs from the source are dropped until the block ends
+
+	timeout := 5 * time.Second
+	badMessageAbuseLimit := 8
+	abuseBlockTimeout := 1 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &peerAuditOob{
+		peerAudits: make(chan *protocol.PeerAudit, 4 * badMessageAbuseLimit),
+	}
+
+	abuses := make(chan Id, 16)
+
+	settings := DefaultClientSettings()
+	// the limit is opt-in
+	assert.Equal(t, 0, settings.ReceiveBufferSettings.BadMessageAbuseLimit)
+	settings.ReceiveBufferSettings.BadMessageAbuseLimit = badMessageAbuseLimit
+	settings.ReceiveBufferSettings.BadMessageAbuseWindow = 60 * time.Second
+	settings.ReceiveBufferSettings.AbuseBlockTimeout = abuseBlockTimeout
+	settings.ReceiveBufferSettings.AbuseCallback = func(sourceId Id) {
+		abuses <- sourceId
+	}
+	b := NewClient(ctx, bClientId, oob, settings)
+	defer b.Cancel()
+
+	bReceive := make(chan []byte)
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	b.ContractManager().AddNoContractPeer(aClientId)
+
+	receives := make(chan string, 16)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			if v, ok := RequireFromFrame(frame).(*protocol.SimpleMessage); ok {
+				receives <- v.Content
+			}
+		}
+	})
+
+	sequenceErrors := make(chan string, 16)
+	b.AddSequenceErrorCallback(func(source TransferPath, sequenceId Id, reason string) {
+		sequenceErrors <- reason
+	})
+
+	write := func(transferFrameBytes []byte) {
+		select {
+		case bReceive <- transferFrameBytes:
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	writePack := func(pack *protocol.Pack) {
+		write(requireTransferFrameBytes(RequireToFrame(pack), aClientId, bClientId))
+	}
+	writeMessage := func(content string) {
+		writePack(&protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: NewId().Bytes(),
+			SequenceNumber: 0,
+			Head: true,
+			Frames: []*protocol.Frame{
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: content,
+				}),
+			},
+		})
+	}
+
+	// bad protobuf spam up to the limit
+	for i := 0; i < badMessageAbuseLimit - 1; i += 1 {
+		write(requireTransferFrameBytes(
+			&protocol.Frame{
+				MessageType: protocol.MessageType_TransferPack,
+				MessageBytes: []byte("bad protobuf"),
+			},
+			aClientId,
+			bClientId,
+		))
+	}
+	for i := 0; i < badMessageAbuseLimit - 1; i += 1 {
+		select {
+		case peerAudit := <- oob.peerAudits:
+			assert.Equal(t, uint64(1), peerAudit.BadMessageCount)
+			assert.Equal(t, false, peerAudit.Abuse)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// the source is still allowed
+	writeMessage("a")
+	select {
+	case content := <- receives:
+		assert.Equal(t, "a", content)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// a bad message in a receive sequence
+	writePack(&protocol.Pack{
+		MessageId: []byte("bad"),
+		SequenceId: NewId().Bytes(),
+		SequenceNumber: 0,
+		Head: true,
+	})
+	select {
+	case reason := <- sequenceErrors:
+		assert.Equal(t, ReceiveSequenceExitBadMessage, reason)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// over the limit
+	writePack(&protocol.Pack{
+		MessageId: []byte("bad"),
+		SequenceId: NewId().Bytes(),
+		SequenceNumber: 0,
+		Head: true,
+	})
+	select {
+	case reason := <- sequenceErrors:
+		assert.Equal(t, ReceiveSequenceExitAbuse, reason)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	select {
+	case sourceId := <- abuses:
+		assert.Equal(t, aClientId, sourceId)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	abuse := false
+	for !abuse {
+		select {
+		case peerAudit := <- oob.peerAudits:
+			abuse = peerAudit.Abuse
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+
+	// blocked, so the source cannot open a new sequence
+	writeMessage("b")
+	select {
+	case <- receives:
+		t.FailNow()
+	case <- time.After(abuseBlockTimeout / 2):
+	}
+
+	time.Sleep(abuseBlockTimeout)
+
+	writeMessage("c")
+	select {
+	case content := <- receives:
+		assert.Equal(t, "c", content)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case <- abuses:
+		t.FailNow()
+	default:
+	}
+}
+
+func TestClientDrain(t *testing.T) {
+	// drain waits for the pending sends to be acked and does not accept new sends
+	// a drain with unacked sends times out
+
+	timeout := 5 * time.Second
+	n := 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bClientId := NewId()
+
+	newClient := func() (*Client, chan []byte, chan []byte) {
+		settings := DefaultClientSettings()
+		a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+		a.ContractManager().AddNoContractPeer(bClientId)
+		aSend := make(chan []byte, 16 * n)
+		a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+		aReceive := make(chan []byte)
+		a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+		return a, aSend, aReceive
+	}
+
+	nextPack := func(aSend chan []byte) *protocol.Pack {
+		select {
+		case transferFrameBytes := <- aSend:
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack := &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+			return pack
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+
+	a, aSend, aReceive := newClient()
+	defer a.Cancel()
+
+	acks := make(chan error, n)
+	for i := 0; i < n; i += 1 {
+		success := a.SendWithTimeout(frame, bClientId, func(err error) {
+			acks <- err
+		}, timeout)
+		assert.Equal(t, true, success)
+	}
+	var lastPack *protocol.Pack
+	for i := 0; i < n; i += 1 {
+		lastPack = nextPack(aSend)
+	}
+
+	drained := make(chan bool)
+	go func() {
+		drained <- a.Drain(timeout)
+	}()
+	for !a.isDraining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// new sends are not accepted
+	success, err := a.SendWithTimeoutDetailed(frame, bClientId, nil, 0)
+	assert.Equal(t, false, success)
+	assert.NotEqual(t, nil, err)
+
+	select {
+	case <- drained:
+		t.Fatalf("Drain completed before the pending sends were acked.")
+	case <- time.After(100 * time.Millisecond):
+	}
+
+	// a cumulative ack of the last pack acks all
+	ackFrame := RequireToFrame(&protocol.Ack{
+		MessageId: lastPack.MessageId,
+		SequenceId: lastPack.SequenceId,
+		Selective: false,
+	})
+	select {
+	case aReceive <- requireTransferFrameBytes(ackFrame, bClientId, a.ClientId()):
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	select {
+	case d := <- drained:
+		assert.Equal(t, true, d)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	for i := 0; i < n; i += 1 {
+		assert.Equal(t, nil, <- acks)
+	}
+	assert.Equal(t, true, a.IsDone())
+
+
+	// unacked sends time out
+	c, cSend, _ := newClient()
+	defer c.Cancel()
+
+	success = c.SendWithTimeout(frame, bClientId, nil, timeout)
+	assert.Equal(t, true, success)
+	nextPack(cSend)
+
+	startTime := time.Now()
+	assert.Equal(t, false, c.Drain(200 * time.Millisecond))
+	assert.Equal(t, true, 200 * time.Millisecond <= time.Now().Sub(startTime))
+	assert.Equal(t, true, c.IsDone())
+}
+
+
+func TestClientDrainLoopback(t *testing.T) {
+	// drain waits for loopback sends in flight to be delivered
+
+	timeout := 5 * time.Second
+	receiveDelay := 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), DefaultClientSettings())
+	defer a.Cancel()
+
+	var receiveLock sync.Mutex
+	receiveCount := 0
+	a.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		time.Sleep(receiveDelay)
+		receiveLock.Lock()
+		defer receiveLock.Unlock()
+		receiveCount += 1
+	})
+
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "loopback",
+		}),
+		a.ClientId(),
+		nil,
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	assert.Equal(t, true, a.Drain(timeout))
+
+	receiveLock.Lock()
+	defer receiveLock.Unlock()
+	assert.Equal(t, 1, receiveCount)
+}
+
+
+func TestContractEvents(t *testing.T) {
+	// a send emits create, take, and close events for its contract,
+	// with the byte counts needed to compute the contract utilization
+
+	timeout := 5 * time.Second
+	standardByteCount := kib(4)
+	messageByteCount := 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &sizedContractOob{
+		clientId: aClientId,
+	}
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.StandardContractTransferByteCount = standardByteCount
+	settings.SendBufferSettings.IdleTimeout = 200 * time.Millisecond
+	a := NewClient(ctx, aClientId, oob, settings)
+	defer a.Cancel()
+
+	var eventLock sync.Mutex
+	contractEvents := []*ContractEvent{}
+	closed := make(chan struct{}, 16)
+	a.ContractManager().AddContractEventCallback(func(contractEvent *ContractEvent) {
+		eventLock.Lock()
+		defer eventLock.Unlock()
+		contractEvents = append(contractEvents, contractEvent)
+		if contractEvent.EventType == ContractEventClose {
+			closed <- struct{}{}
+		}
+	})
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+
+	frame := &protocol.Frame{
+		MessageType: protocol.MessageType_TestSimpleMessage,
+		MessageBytes: make([]byte, messageByteCount),
+	}
+	acks := make(chan error, 1)
+	success := a.SendWithTimeout(frame, bClientId, func(err error) {
+		acks <- err
+	}, timeout)
+	assert.Equal(t, true, success)
+
+	// the contract is sent in its own pack before the message
+	var pack *protocol.Pack
+	for pack == nil || len(pack.Frames) == 0 {
+		select {
+		case transferFrameBytes := <- aSend:
+			transferFrame := &protocol.TransferFrame{}
+			err := proto.Unmarshal(transferFrameBytes, transferFrame)
+			assert.Equal(t, nil, err)
+			pack = &protocol.Pack{}
+			err = proto.Unmarshal(transferFrame.Frame.MessageBytes, pack)
+			assert.Equal(t, nil, err)
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+	}
+	ackFrame := RequireToFrame(&protocol.Ack{
+		MessageId: pack.MessageId,
+		SequenceId: pack.SequenceId,
+		Selective: false,
+	})
+	select {
+	case aReceive <- requireTransferFrameBytes(ackFrame, bClientId, aClientId):
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// the sequence closes on idle and closes the contract
+	select {
+	case <- closed:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+
+	eventTypeEvents := map[string][]*ContractEvent{}
+	for _, contractEvent := range contractEvents {
+		eventTypeEvents[contractEvent.EventType] = append(eventTypeEvents[contractEvent.EventType], contractEvent)
+	}
+
+	assert.Equal(t, true, 0 < len(eventTypeEvents[ContractEventCreate]))
+	for _, createEvent := range eventTypeEvents[ContractEventCreate] {
+		assert.Equal(t, bClientId, createEvent.DestinationId)
+		assert.Equal(t, standardByteCount, createEvent.TransferByteCount)
+	}
+
+	assert.Equal(t, 1, len(eventTypeEvents[ContractEventTake]))
+	takeEvent := eventTypeEvents[ContractEventTake][0]
+	assert.Equal(t, bClientId, takeEvent.DestinationId)
+	assert.Equal(t, standardByteCount, takeEvent.TransferByteCount)
+
+	var closeEvent *ContractEvent
+	for _, contractEvent := range eventTypeEvents[ContractEventClose] {
+		if contractEvent.ContractId == takeEvent.ContractId {
+			closeEvent = contractEvent
+		}
+	}
+	assert.NotEqual(t, nil, closeEvent)
+	assert.Equal(t, bClientId, closeEvent.DestinationId)
+	assert.Equal(t, standardByteCount, closeEvent.TransferByteCount)
+	// the contract pack has no message and is billed at the min message byte count
+	assert.Equal(t, ByteCount(messageByteCount) + settings.SendBufferSettings.MinMessageByteCount, closeEvent.AckedByteCount)
+	assert.Equal(t, ByteCount(0), closeEvent.UnackedByteCount)
+}
+
+
+func TestClientResourceStats(t *testing.T) {
+	// open and close many send, receive, and forward sequences
+	// the sequence counts return to zero and the created and closed counts converge
+
+	timeout := 5 * time.Second
+	n := 32
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settings := DefaultClientSettings()
+	// the sends are never acked, so the send sequences close on the ack timeout
+	settings.SendBufferSettings.AckTimeout = 200 * time.Millisecond
+	settings.ReceiveBufferSettings.IdleTimeout = 200 * time.Millisecond
+	settings.ForwardBufferSettings.IdleTimeout = 200 * time.Millisecond
+
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer a.Cancel()
+
+	aSend := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+	aReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+	go func() {
+		for {
+			select {
+			case <- ctx.Done():
+				return
+			case <- aSend:
+			}
+		}
+	}()
+
+	startCreateCount, startCloseCount := globalSequenceCounts.counts()
+
+	frame := RequireToFrame(&protocol.SimpleMessage{
+		Content: "hi",
+	})
+
+	for i := 0; i < n; i += 1 {
+		destinationId := NewId()
+		a.ContractManager().AddNoContractPeer(destinationId)
+		success := a.SendWithTimeout(frame, destinationId, func(err error) {}, timeout)
+		assert.Equal(t, true, success)
+
+		sourceId := NewId()
+		a.ContractManager().AddNoContractPeer(sourceId)
+		pack := &protocol.Pack{
+			MessageId: NewId().Bytes(),
+			SequenceId: NewId().Bytes(),
+			SequenceNumber: 0,
+			Head: true,
+			Frames: []*protocol.Frame{frame},
+		}
+		select {
+		case aReceive <- requireTransferFrameBytes(RequireToFrame(pack), sourceId, a.ClientId()):
+		case <- time.After(timeout):
+			t.FailNow()
+		}
+
+		success = a.ForwardWithTimeout(requireTransferFrameBytes(frame, NewId(), NewId()), timeout)
+		assert.Equal(t, true, success)
+	}
+
+	endTime := time.Now().Add(timeout)
+	for {
+		resourceStats := a.ResourceStats()
+		// sequences of other clients may close while this runs, so only the closed count of this test is bounded
+		converged := uint64(3 * n) <= resourceStats.SequenceCreateCount - startCreateCount &&
+			resourceStats.SendSequenceCount == 0 &&
+			resourceStats.ReceiveSequenceCount == 0 &&
+			resourceStats.ForwardSequenceCount == 0 &&
+			resourceStats.BufferGoroutineCount == 0 &&
+			resourceStats.SequenceCreateCount - startCreateCount <= resourceStats.SequenceCloseCount - startCloseCount
+		if converged {
+			break
+		}
+		if endTime.Before(time.Now()) {
+			t.Fatalf("Sequences did not close: %+v", resourceStats)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+
+// fails after `n` bytes
+type failingReader struct {
+	n int
+}
+
+func (self *failingReader) Read(b []byte) (int, error) {
+	if self.n <= 0 {
+		return 0, errors.New("Read failed.")
+	}
+	n := min(len(b), self.n)
+	self.n -= n
+	return n, nil
+}
+
+
+func TestSendStream(t *testing.T) {
+	// the stream is sent as ordered chunks that fit the transport mtu,
+	// and the ack callback is called once after all chunks are acked
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer a.Cancel()
+	b := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer b.Cancel()
+
+	aReceive := make(chan []byte)
+	bReceive := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bReceive})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aReceive})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bReceive})
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	chunks := make(chan *protocol.StreamChunk, 1024)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.StreamChunk:
+				chunks <- v
+			}
+		}
+	})
+
+	destination := NewTransferPath(
+		Path{ClientId: a.ClientId(), StreamId: DirectStreamId},
+		Path{ClientId: b.ClientId(), StreamId: DirectStreamId},
+	)
+	maxChunkSize := a.StreamChunkSize(destination)
+	assert.Equal(t, true, 0 < maxChunkSize)
+	assert.Equal(t, true, maxChunkSize < a.EffectivePayloadSize(destination))
+
+	sendStream := func(reader io.Reader, chunkSize int) (bool, chan error) {
+		acks := make(chan error, 16)
+		success := a.SendStream(reader, destination, chunkSize, func(err error) {
+			acks <- err
+		})
+		return success, acks
+	}
+
+	receiveMessage := func(expectedChunkSize int) []byte {
+		var messageId []byte
+		messageBytes := []byte{}
+		for chunkIndex := uint32(0); ; chunkIndex += 1 {
+			select {
+			case chunk := <- chunks:
+				if chunkIndex == 0 {
+					messageId = chunk.MessageId
+				}
+				assert.Equal(t, messageId, chunk.MessageId)
+				assert.Equal(t, chunkIndex, chunk.ChunkIndex)
+				assert.Equal(t, true, len(chunk.ChunkBytes) <= expectedChunkSize)
+				if !chunk.Last {
+					assert.Equal(t, expectedChunkSize, len(chunk.ChunkBytes))
+				}
+				messageBytes = append(messageBytes, chunk.ChunkBytes...)
+				if chunk.Last {
+					return messageBytes
+				}
+			case <- time.After(timeout):
+				t.FailNow()
+			}
+		}
+	}
+
+	nextAck := func(acks chan error) error {
+		select {
+		case err := <- acks:
+			return err
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	// the largest chunks by default, and chunk sizes over the max are reduced
+	for _, chunkSize := range []int{0, 4 * maxChunkSize} {
+		streamBytes := make([]byte, kib(256))
+		mathrand.Read(streamBytes)
+		success, acks := sendStream(bytes.NewReader(streamBytes), chunkSize)
+		assert.Equal(t, true, success)
+		assert.Equal(t, streamBytes, receiveMessage(maxChunkSize))
+		assert.Equal(t, nil, nextAck(acks))
+	}
+
+	// a stream that is a multiple of the chunk size marks the last full chunk
+	streamBytes := make([]byte, 4 * 1000)
+	mathrand.Read(streamBytes)
+	success, acks := sendStream(bytes.NewReader(streamBytes), 1000)
+	assert.Equal(t, true, success)
+	assert.Equal(t, streamBytes, receiveMessage(1000))
+	assert.Equal(t, nil, nextAck(acks))
+
+	// an empty stream is one empty chunk
+	success, acks = sendStream(bytes.NewReader([]byte{}), 1000)
+	assert.Equal(t, true, success)
+	assert.Equal(t, []byte{}, receiveMessage(1000))
+	assert.Equal(t, nil, nextAck(acks))
+
+	// a read error stops the stream and is passed to the ack callback
+	success, acks = sendStream(&failingReader{n: 2500}, 1000)
+	assert.Equal(t, false, success)
+	assert.NotEqual(t, nil, nextAck(acks))
+
+	// the callback is called once
+	select {
+	case <- acks:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+}
+
+
+func TestClientOnResume(t *testing.T) {
+	// a suspend that elapses most of the ack timeout is simulated by sleeping without acks
+	// after resume, the pending send restarts its ack timeout and the sequence stays open
+	// without resume, the sequence closes on the ack timeout
+
+	timeout := 5 * time.Second
+	ackTimeout := 500 * time.Millisecond
+
+	for _, resume := range []bool{false, true} {
+		func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			bClientId := NewId()
+
+			settings := DefaultClientSettings()
+			settings.SendBufferSettings.AckTimeout = ackTimeout
+			a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+			defer a.Cancel()
+			a.ContractManager().AddNoContractPeer(bClientId)
+
+			// the destination never acks
+			aSend := make(chan []byte)
+			a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+			go func() {
+				for {
+					select {
+					case <- ctx.Done():
+						return
+					case <- aSend:
+					}
+				}
+			}()
+
+			acks := make(chan error, 1)
+			success := a.SendWithTimeout(
+				RequireToFrame(&protocol.SimpleMessage{
+					Content: "hi",
+				}),
+				bClientId,
+				func(err error) {
+					acks <- err
+				},
+				timeout,
+			)
+			assert.Equal(t, true, success)
+
+			// suspended
+			time.Sleep(ackTimeout * 4 / 5)
+			if resume {
+				a.OnResume()
+			}
+			time.Sleep(ackTimeout * 3 / 5)
+
+			if resume {
+				assert.Equal(t, 1, a.ResourceStats().SendSequenceCount)
+				select {
+				case <- acks:
+					t.FailNow()
+				default:
+				}
+
+				// the restarted ack timeout still applies
+				select {
+				case err := <- acks:
+					assert.NotEqual(t, nil, err)
+				case <- time.After(timeout):
+					t.FailNow()
+				}
+			} else {
+				select {
+				case err := <- acks:
+					assert.NotEqual(t, nil, err)
+				case <- time.After(timeout):
+					t.FailNow()
+				}
+			}
+		}()
+	}
+}
+
+
+func TestContractSizeResult(t *testing.T) {
+	// the platform grants smaller contracts than requested
+	// the size result of the taken contract reports the requested and granted sizes
+
+	timeout := 5 * time.Second
+	standardByteCount := kib(4)
+	grantedByteCount := kib(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aClientId := NewId()
+	bClientId := NewId()
+
+	oob := &sizedContractOob{
+		clientId: aClientId,
+		maxTransferByteCount: grantedByteCount,
+	}
+
+	settings := DefaultClientSettings()
+	settings.ContractManagerSettings.StandardContractTransferByteCount = standardByteCount
+	a := NewClient(ctx, aClientId, oob, settings)
+	defer a.Cancel()
+
+	contractSizeResults := make(chan *ContractSizeResult, 16)
+	a.ContractManager().AddContractSizeResultCallback(func(contractSizeResult *ContractSizeResult) {
+		contractSizeResults <- contractSizeResult
+	})
+
+	aSend := make(chan []byte, 16)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aSend})
+
+	success := a.SendWithTimeout(
+		&protocol.Frame{
+			MessageType: protocol.MessageType_TestSimpleMessage,
+			MessageBytes: make([]byte, 100),
+		},
+		bClientId,
+		func(err error) {},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	select {
+	case contractSizeResult := <- contractSizeResults:
+		assert.Equal(t, bClientId, contractSizeResult.DestinationId)
+		assert.NotEqual(t, Id{}, contractSizeResult.ContractId)
+		assert.Equal(t, standardByteCount, contractSizeResult.RequestedTransferByteCount)
+		assert.Equal(t, grantedByteCount, contractSizeResult.TransferByteCount)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// one result per taken contract
+	select {
+	case <- contractSizeResults:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+}
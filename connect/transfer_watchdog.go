@@ -0,0 +1,161 @@
+package connect
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+
+// a test-only watchdog for the sequence run loops
+// A run loop alternates between waiting for an event and working on the event.
+// The watchdog fires when the run loop works on a single event longer than the timeout,
+// which is typically a deadlock on an unbuffered channel (see `DefaultTransferBufferSize`).
+// When the watchdog fires, the last state of the sequence is logged and passed to the stall callback.
+
+
+type SequenceStallFunction func(stall *SequenceStall)
+
+
+// enable by setting `ClientSettings.WatchdogSettings`
+type WatchdogSettings struct {
+	// the max time a sequence can work on a single event
+	Timeout time.Duration
+	// optional
+	StallCallback SequenceStallFunction
+}
+
+
+type SequenceStall struct {
+	// send, receive, forward
+	SequenceType string
+	PeerId Id
+	SequenceId Id
+	// the time the run loop has been working on the current event
+	Duration time.Duration
+	// the sequence state at the start of the current event
+	State string
+}
+
+
+type sequenceWatchdog struct {
+	ctx context.Context
+	settings *WatchdogSettings
+
+	sequenceType string
+	clientTag string
+	peerId Id
+	sequenceId Id
+
+	stateLock sync.Mutex
+	working bool
+	workStartTime time.Time
+	workState string
+	// fire once per event
+	fired bool
+}
+
+// returns nil if the watchdog is not enabled
+// the methods of a nil watchdog do nothing
+func newSequenceWatchdog(
+	ctx context.Context,
+	settings *WatchdogSettings,
+	sequenceType string,
+	clientTag string,
+	peerId Id,
+	sequenceId Id,
+) *sequenceWatchdog {
+	if settings == nil || settings.Timeout <= 0 {
+		return nil
+	}
+	watchdog := &sequenceWatchdog{
+		ctx: ctx,
+		settings: settings,
+		sequenceType: sequenceType,
+		clientTag: clientTag,
+		peerId: peerId,
+		sequenceId: sequenceId,
+	}
+	go watchdog.run()
+	return watchdog
+}
+
+// marks the start of work on an event
+// `state` is only called when the watchdog is enabled
+func (self *sequenceWatchdog) Work(state func()(string)) {
+	if self == nil {
+		return
+	}
+
+	workState := state()
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.working = true
+	self.workStartTime = time.Now()
+	self.workState = workState
+	self.fired = false
+}
+
+// marks the run loop as waiting for the next event
+func (self *sequenceWatchdog) Wait() {
+	if self == nil {
+		return
+	}
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.working = false
+}
+
+func (self *sequenceWatchdog) run() {
+	checkInterval := self.settings.Timeout / 4
+	for {
+		select {
+		case <- self.ctx.Done():
+			return
+		case <- time.After(checkInterval):
+		}
+
+		stall := func()(*SequenceStall) {
+			self.stateLock.Lock()
+			defer self.stateLock.Unlock()
+
+			if !self.working || self.fired {
+				return nil
+			}
+			workDuration := time.Now().Sub(self.workStartTime)
+			if workDuration < self.settings.Timeout {
+				return nil
+			}
+			self.fired = true
+			return &SequenceStall{
+				SequenceType: self.sequenceType,
+				PeerId: self.peerId,
+				SequenceId: self.sequenceId,
+				Duration: workDuration,
+				State: self.workState,
+			}
+		}()
+
+		if stall != nil {
+			glog.Errorf(
+				"[watchdog]%s %s %s stalled %s: %s\n",
+				self.sequenceType,
+				self.clientTag,
+				self.peerId,
+				stall.Duration,
+				stall.State,
+			)
+			if self.settings.StallCallback != nil {
+				HandleError(func() {
+					self.settings.StallCallback(stall)
+				})
+			}
+		}
+	}
+}
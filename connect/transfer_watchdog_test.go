@@ -0,0 +1,109 @@
+package connect
+
+import (
+	"context"
+	"testing"
+	"time"
+	"strings"
+
+	"github.com/go-playground/assert/v2"
+
+	"bringyour.com/protocol"
+)
+
+
+func TestWatchdogReceiveDeadlock(t *testing.T) {
+	// the receive callback blocks, which stalls the receive sequence
+
+	timeout := 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stalls := make(chan *SequenceStall, 16)
+
+	settings := DefaultClientSettings()
+	settings.SendBufferSettings.SequenceBufferSize = 0
+	settings.SendBufferSettings.AckBufferSize = 0
+	settings.ReceiveBufferSettings.SequenceBufferSize = 0
+	settings.ForwardBufferSettings.SequenceBufferSize = 0
+	settings.WatchdogSettings = &WatchdogSettings{
+		Timeout: 200 * time.Millisecond,
+		StallCallback: func(stall *SequenceStall) {
+			stalls <- stall
+		},
+	}
+
+	a := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer a.Cancel()
+	b := NewClient(ctx, NewId(), NewNoContractClientOob(), settings)
+	defer b.Cancel()
+
+	aToB := make(chan []byte)
+	bToA := make(chan []byte)
+	a.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{aToB})
+	a.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{bToA})
+	b.RouteManager().UpdateTransport(NewSendGatewayTransport(), []Route{bToA})
+	b.RouteManager().UpdateTransport(NewReceiveGatewayTransport(), []Route{aToB})
+
+	a.ContractManager().AddNoContractPeer(b.ClientId())
+	b.ContractManager().AddNoContractPeer(a.ClientId())
+
+	unblock := make(chan struct{})
+	receives := make(chan string, 1)
+	b.AddReceiveCallback(func(sourceId Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+		for _, frame := range frames {
+			switch v := RequireFromFrame(frame).(type) {
+			case *protocol.SimpleMessage:
+				receives <- v.Content
+				<- unblock
+			}
+		}
+	})
+
+	acks := make(chan error, 1)
+	success := a.SendWithTimeout(
+		RequireToFrame(&protocol.SimpleMessage{
+			Content: "hi",
+		}),
+		b.ClientId(),
+		func(err error) {
+			acks <- err
+		},
+		timeout,
+	)
+	assert.Equal(t, true, success)
+
+	select {
+	case content := <- receives:
+		assert.Equal(t, "hi", content)
+	case <- time.After(timeout):
+		t.Fatal("Timeout.")
+	}
+
+	// the blocked receiver can also stall the sender write
+	var receiveStall *SequenceStall
+	for receiveStall == nil {
+		select {
+		case stall := <- stalls:
+			if stall.SequenceType == "receive" {
+				receiveStall = stall
+			}
+		case <- time.After(timeout):
+			t.Fatal("Watchdog did not fire.")
+		}
+	}
+	assert.Equal(t, a.ClientId(), receiveStall.PeerId)
+	assert.Equal(t, true, settings.WatchdogSettings.Timeout <= receiveStall.Duration)
+	assert.Equal(t, true, strings.Contains(receiveStall.State, "next_sequence_number="))
+	assert.Equal(t, true, strings.Contains(receiveStall.State, "pending_acks="))
+
+	close(unblock)
+
+	select {
+	case err := <- acks:
+		assert.Equal(t, nil, err)
+	case <- time.After(timeout):
+		t.Fatal("Timeout.")
+	}
+}
@@ -6,6 +6,12 @@ import (
     "net"
     "fmt"
     "bytes"
+    "bufio"
+    "errors"
+    "net/http"
+    "net/url"
+    "encoding/base64"
+    "sync"
 
     "github.com/gorilla/websocket"
 
@@ -35,10 +41,23 @@ type PlatformTransportSettings struct {
     HttpConnectTimeout time.Duration
     WsHandshakeTimeout time.Duration
     AuthTimeout time.Duration
+    // the wait before reconnecting after a connection closes or a connect fails
     ReconnectTimeout time.Duration
+    // consecutive connect failures double the reconnect wait up to this max
+    // a value at or under `ReconnectTimeout` is a fixed reconnect wait
+    MaxReconnectTimeout time.Duration
+    // the transport closes with an error after this many consecutive connect failures,
+    // see `PlatformTransport.Err`. 0 is no limit
+    MaxConsecutiveFailureCount int
     PingTimeout time.Duration
     WriteTimeout time.Duration
+    // the connection is dead and reconnects when nothing is read in this time,
+    // including the pings. This should be greater than `PingTimeout`
     ReadTimeout time.Duration
+    // the platform connection fails with `ErrTlsPinMismatch` unless the certificate chain matches a pin
+    // when using an extender, this applies to the platform connection inside the extender connection
+    // see `TlsPin`
+    TlsPins []string
 }
 
 
@@ -49,9 +68,13 @@ func DefaultPlatformTransportSettings() *PlatformTransportSettings {
         WsHandshakeTimeout: 2 * time.Second,
         AuthTimeout: 2 * time.Second,
         ReconnectTimeout: 5 * time.Second,
+        MaxReconnectTimeout: 5 * time.Second,
+        MaxConsecutiveFailureCount: 0,
         PingTimeout: pingTimeout,
         WriteTimeout: 5 * time.Second,
         ReadTimeout: 2 * pingTimeout,
+        // pinning is off by default
+        TlsPins: nil,
     }
 }
 
@@ -86,6 +109,9 @@ type PlatformTransport struct {
     settings *PlatformTransportSettings
 
     routeManager *RouteManager
+
+    stateLock sync.Mutex
+    err error
 }
 
 func NewPlatformTransportWithDefaults(
@@ -94,8 +120,23 @@ func NewPlatformTransportWithDefaults(
     auth *ClientAuth,
     routeManager *RouteManager,
 ) *PlatformTransport {
-    settings := DefaultPlatformTransportSettings()
+    return NewPlatformTransportWithDefaultDialer(
+        ctx,
+        platformUrl,
+        auth,
+        DefaultPlatformTransportSettings(),
+        routeManager,
+    )
+}
 
+// direct tcp dial with `settings.HttpConnectTimeout`
+func NewPlatformTransportWithDefaultDialer(
+    ctx context.Context,
+    platformUrl string,
+    auth *ClientAuth,
+    settings *PlatformTransportSettings,
+    routeManager *RouteManager,
+) *PlatformTransport {
     dialContextGen := func()(DialContextFunc) {
         dialer := &net.Dialer{
             Timeout: settings.HttpConnectTimeout,
@@ -131,6 +172,24 @@ func NewPlatformTransportWithExtender(
     )
 }
 
+func NewPlatformTransportWithHttpConnectProxy(
+    ctx context.Context,
+    proxyUrl string,
+    platformUrl string,
+    auth *ClientAuth,
+    settings *PlatformTransportSettings,
+    routeManager *RouteManager,
+) *PlatformTransport {
+    return NewPlatformTransport(
+        ctx,
+        platformUrl,
+        auth,
+        NewHttpConnectProxyDialContextGenerator(proxyUrl, settings),
+        settings,
+        routeManager,
+    )
+}
+
 func NewPlatformTransport(
     ctx context.Context,
     platformUrl string,
@@ -168,10 +227,13 @@ func (self *PlatformTransport) run() {
         return
     }
 
+    // consecutive connect failures
+    failureCount := 0
     for {
         wsDialer := &websocket.Dialer{
             NetDialContext: self.dialContextGen(),
             HandshakeTimeout: self.settings.WsHandshakeTimeout,
+            TLSClientConfig: newTlsPinConfig(self.settings.TlsPins),
         }
 
         ws, err := func()(*websocket.Conn, error) {
@@ -211,13 +273,19 @@ func (self *PlatformTransport) run() {
         }()
         if err != nil {
             glog.Infof("[t]auth error %s = %s\n", clientId, err)
+            failureCount += 1
+            if 0 < self.settings.MaxConsecutiveFailureCount && self.settings.MaxConsecutiveFailureCount <= failureCount {
+                self.setErr(errors.New(fmt.Sprintf("Platform connect failed %d times. Last error = %s", failureCount, err)))
+                return
+            }
             select {
             case <- self.ctx.Done():
                 return
-            case <- time.After(self.settings.ReconnectTimeout):
+            case <- time.After(self.reconnectTimeout(failureCount)):
                 continue
             }
         }
+        failureCount = 0
 
         c := func() {
             defer ws.Close()
@@ -331,6 +399,36 @@ func (self *PlatformTransport) run() {
     }
 }
 
+// doubles the reconnect timeout for each consecutive failure after the first, up to the max
+func (self *PlatformTransport) reconnectTimeout(failureCount int) time.Duration {
+    reconnectTimeout := self.settings.ReconnectTimeout
+    for i := 1; i < failureCount && reconnectTimeout < self.settings.MaxReconnectTimeout; i += 1 {
+        reconnectTimeout *= 2
+    }
+    return max(self.settings.ReconnectTimeout, min(reconnectTimeout, self.settings.MaxReconnectTimeout))
+}
+
+func (self *PlatformTransport) setErr(err error) {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    self.err = err
+}
+
+// closed when the transport stops, from `Close` or from too many consecutive connect failures
+func (self *PlatformTransport) Done() <-chan struct{} {
+    return self.ctx.Done()
+}
+
+// the error that stopped the transport, if any
+// see `PlatformTransportSettings.MaxConsecutiveFailureCount`
+func (self *PlatformTransport) Err() error {
+    self.stateLock.Lock()
+    defer self.stateLock.Unlock()
+
+    return self.err
+}
+
 func (self *PlatformTransport) Close() {
     self.cancel()
 }
@@ -373,6 +471,102 @@ func NewExtenderDialContextGenerator(
 }
 
 
+// an http proxy tunnels the connection to the platform with the CONNECT method
+// https://datatracker.ietf.org/doc/html/rfc9110#section-9.3.6
+// The user info of `proxyUrl`, if any, is sent as basic `Proxy-Authorization`.
+// The connection to the platform is end-to-end encrypted with TLS inside the tunnel,
+// using the hostname from `platformUrl`
+
+
+func NewHttpConnectProxyDialContextGenerator(
+    proxyUrl string,
+    settings *PlatformTransportSettings,
+) func()(DialContextFunc) {
+    return func()(DialContextFunc) {
+        return func(
+            ctx context.Context,
+            network string,
+            address string,
+        ) (net.Conn, error) {
+            proxy, err := url.Parse(proxyUrl)
+            if err != nil {
+                return nil, err
+            }
+            if proxy.Scheme != "http" {
+                return nil, errors.New(fmt.Sprintf("Proxy scheme must be http (%s).", proxy.Scheme))
+            }
+            proxyAddress := proxy.Host
+            if proxy.Port() == "" {
+                proxyAddress = net.JoinHostPort(proxy.Hostname(), "80")
+            }
+
+            dialer := &net.Dialer{
+                Timeout: settings.HttpConnectTimeout,
+            }
+            conn, err := dialer.DialContext(ctx, network, proxyAddress)
+            if err != nil {
+                return nil, err
+            }
+
+            // the CONNECT exchange counts against the connect timeout
+            conn.SetDeadline(time.Now().Add(settings.HttpConnectTimeout))
+
+            connectRequest := &http.Request{
+                Method: "CONNECT",
+                URL: &url.URL{Opaque: address},
+                Host: address,
+                Header: http.Header{},
+            }
+            if proxy.User != nil {
+                password, _ := proxy.User.Password()
+                credentials := base64.StdEncoding.EncodeToString([]byte(
+                    fmt.Sprintf("%s:%s", proxy.User.Username(), password),
+                ))
+                connectRequest.Header.Set("Proxy-Authorization", fmt.Sprintf("Basic %s", credentials))
+            }
+            if err := connectRequest.Write(conn); err != nil {
+                conn.Close()
+                return nil, err
+            }
+
+            reader := bufio.NewReader(conn)
+            connectResponse, err := http.ReadResponse(reader, connectRequest)
+            if err != nil {
+                conn.Close()
+                return nil, err
+            }
+            connectResponse.Body.Close()
+            if connectResponse.StatusCode != http.StatusOK {
+                conn.Close()
+                return nil, errors.New(fmt.Sprintf("Proxy CONNECT failed (%s).", connectResponse.Status))
+            }
+
+            conn.SetDeadline(time.Time{})
+
+            if 0 < reader.Buffered() {
+                // the proxy sent tunnel data with the response
+                return &bufferedConn{
+                    Conn: conn,
+                    reader: reader,
+                }, nil
+            }
+            return conn, nil
+        }
+    }
+}
+
+
+// a conn that reads from a buffered reader first
+type bufferedConn struct {
+    net.Conn
+    reader *bufio.Reader
+}
+
+func (self *bufferedConn) Read(b []byte) (int, error) {
+    return self.reader.Read(b)
+}
+
+
 // conforms to `net.Conn`
 type wsForwardingConn struct {
     ws *websocket.Conn
@@ -0,0 +1,303 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/go-playground/assert/v2"
+)
+
+
+// a CONNECT proxy that requires basic auth with `user:password`
+// the hosts of the tunnels are sent on `connects`
+func testingHttpConnectProxy(t *testing.T, connects chan string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+
+	proxyAuthorization := fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte("user:password")))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				request, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				if request.Method != "CONNECT" {
+					io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+					return
+				}
+				if request.Header.Get("Proxy-Authorization") != proxyAuthorization {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				connects <- request.Host
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+				go func() {
+					defer upstream.Close()
+					io.Copy(upstream, reader)
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+
+func TestPlatformTransportHttpConnectProxy(t *testing.T) {
+	// the platform transport connects and authenticates through the proxy
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	// the platform echoes the auth message
+	auths := make(chan []byte, 16)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		messageType, message, err := ws.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			return
+		}
+		auths <- message
+		ws.WriteMessage(websocket.BinaryMessage, message)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	platformUrl := strings.Replace(server.URL, "http://", "ws://", 1)
+	platformAddress := strings.TrimPrefix(server.URL, "http://")
+
+	connects := make(chan string, 16)
+	proxyListener := testingHttpConnectProxy(t, connects)
+	defer proxyListener.Close()
+	proxyUrl := fmt.Sprintf("http://user:password@%s", proxyListener.Addr())
+
+	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer client.Close()
+
+	transport := NewPlatformTransportWithHttpConnectProxy(
+		ctx,
+		proxyUrl,
+		platformUrl,
+		&ClientAuth{
+			ByJwt: "test",
+			InstanceId: NewId(),
+			AppVersion: "test",
+		},
+		DefaultPlatformTransportSettings(),
+		client.RouteManager(),
+	)
+	defer transport.Close()
+
+	select {
+	case host := <- connects:
+		assert.Equal(t, platformAddress, host)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	select {
+	case <- auths:
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+
+	// bad proxy auth is an error
+	settings := DefaultPlatformTransportSettings()
+	for _, badProxyUrl := range []string{
+		fmt.Sprintf("http://user:other@%s", proxyListener.Addr()),
+		fmt.Sprintf("http://%s", proxyListener.Addr()),
+		fmt.Sprintf("https://user:password@%s", proxyListener.Addr()),
+	} {
+		dialContext := NewHttpConnectProxyDialContextGenerator(badProxyUrl, settings)()
+		_, err := dialContext(ctx, "tcp", platformAddress)
+		assert.NotEqual(t, nil, err)
+	}
+
+	dialContext := NewHttpConnectProxyDialContextGenerator(proxyUrl, settings)()
+	conn, err := dialContext(ctx, "tcp", platformAddress)
+	assert.Equal(t, nil, err)
+	conn.Close()
+	select {
+	case host := <- connects:
+		assert.Equal(t, platformAddress, host)
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+}
+
+
+func TestPlatformTransportReconnect(t *testing.T) {
+	// the transport reconnects after the reconnect timeout when the connection drops,
+	// backs off on consecutive connect failures, and stops after the max failures
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeout := 5 * time.Second
+
+	type connect struct {
+		time time.Time
+		success bool
+	}
+
+	// the platform accepts `successCount` connections then fails
+	// each accepted connection echoes the auth then drops
+	testPlatform := func(successCount int) (*httptest.Server, chan *connect) {
+		connects := make(chan *connect, 64)
+		upgrader := websocket.Upgrader{}
+		var mutex sync.Mutex
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			success := func()(bool) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if successCount <= 0 {
+					return false
+				}
+				successCount -= 1
+				return true
+			}()
+			connects <- &connect{
+				time: time.Now(),
+				success: success,
+			}
+			if !success {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			messageType, message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(messageType, message)
+		}))
+		return server, connects
+	}
+
+	nextConnect := func(connects chan *connect) *connect {
+		select {
+		case c := <- connects:
+			return c
+		case <- time.After(timeout):
+			t.FailNow()
+			return nil
+		}
+	}
+
+	client := NewClientWithDefaults(ctx, NewId(), NewNoContractClientOob())
+	defer client.Close()
+
+	auth := &ClientAuth{
+		ByJwt: "test",
+		InstanceId: NewId(),
+		AppVersion: "test",
+	}
+
+	server, connects := testPlatform(3)
+	defer server.Close()
+
+	settings := DefaultPlatformTransportSettings()
+	settings.ReconnectTimeout = 20 * time.Millisecond
+	settings.MaxReconnectTimeout = 80 * time.Millisecond
+	settings.MaxConsecutiveFailureCount = 4
+
+	transport := NewPlatformTransportWithDefaultDialer(
+		ctx,
+		strings.Replace(server.URL, "http://", "ws://", 1),
+		auth,
+		settings,
+		client.RouteManager(),
+	)
+	defer transport.Close()
+
+	// drops reconnect after the reconnect timeout, and do not count as failures
+	c := nextConnect(connects)
+	assert.Equal(t, true, c.success)
+	for i := 0; i < 2; i += 1 {
+		nextC := nextConnect(connects)
+		assert.Equal(t, true, nextC.success)
+		assert.Equal(t, true, settings.ReconnectTimeout <= nextC.time.Sub(c.time))
+		c = nextC
+	}
+
+	// consecutive failures back off up to the max reconnect timeout
+	for _, reconnectTimeout := range []time.Duration{
+		20 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+	} {
+		nextC := nextConnect(connects)
+		assert.Equal(t, false, nextC.success)
+		assert.Equal(t, true, reconnectTimeout <= nextC.time.Sub(c.time))
+		c = nextC
+	}
+
+	select {
+	case <- transport.Done():
+	case <- time.After(timeout):
+		t.FailNow()
+	}
+	assert.NotEqual(t, nil, transport.Err())
+
+	// no more connects after the transport stops
+	select {
+	case <- connects:
+		t.FailNow()
+	case <- time.After(200 * time.Millisecond):
+	}
+
+	// a closed transport has no error
+	transport = NewPlatformTransportWithDefaultDialer(
+		ctx,
+		strings.Replace(server.URL, "http://", "ws://", 1),
+		auth,
+		DefaultPlatformTransportSettings(),
+		client.RouteManager(),
+	)
+	transport.Close()
+	<- transport.Done()
+	assert.Equal(t, nil, transport.Err())
+}
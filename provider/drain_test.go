@@ -0,0 +1,135 @@
+//go:build !windows
+
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+    "syscall"
+    "net/http"
+
+    "bringyour.com/connect"
+    "bringyour.com/protocol"
+)
+
+
+func TestDrainOnSignal(t *testing.T) {
+    // a send that is pending when the provider is signalled
+    // is delivered to the user before the client is cancelled
+
+    timeout := 5 * time.Second
+
+    cancelCtx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    event := connect.NewEventWithContext(cancelCtx)
+    stopSignals := event.SetOnSignals(syscall.SIGUSR2)
+    defer stopSignals()
+
+    statusServer := &http.Server{
+        Addr: "127.0.0.1:0",
+        Handler: http.NewServeMux(),
+    }
+    go serve(statusServer, "status")
+
+    userCtx, userCancel := context.WithCancel(context.Background())
+    defer userCancel()
+
+    connectClient := connect.NewClientWithDefaults(cancelCtx, connect.NewId(), connect.NewNoContractClientOob())
+    user := connect.NewClientWithDefaults(userCtx, connect.NewId(), connect.NewNoContractClientOob())
+    defer user.Cancel()
+
+    providerToUser := make(chan []byte)
+    userToProvider := make(chan []byte)
+    connectClient.RouteManager().UpdateTransport(connect.NewSendGatewayTransport(), []connect.Route{providerToUser})
+    connectClient.RouteManager().UpdateTransport(connect.NewReceiveGatewayTransport(), []connect.Route{userToProvider})
+    user.RouteManager().UpdateTransport(connect.NewSendGatewayTransport(), []connect.Route{userToProvider})
+
+    connectClient.ContractManager().AddNoContractPeer(user.ClientId())
+    user.ContractManager().AddNoContractPeer(connectClient.ClientId())
+
+    localUserNat := connect.NewLocalUserNatWithDefaults(cancelCtx, "test")
+    remoteUserNatProvider := connect.NewRemoteUserNatProviderWithDefaults(connectClient, localUserNat)
+
+    receives := make(chan string, 1)
+    user.AddReceiveCallback(func(sourceId connect.Id, frames []*protocol.Frame, provideMode protocol.ProvideMode) {
+        for _, frame := range frames {
+            if v, ok := connect.RequireFromFrame(frame).(*protocol.SimpleMessage); ok {
+                receives <- v.Content
+            }
+        }
+    })
+
+    // the user does not read until after the signal, so the send is pending
+    acks := make(chan error, 1)
+    success := connectClient.SendWithTimeout(
+        connect.RequireToFrame(&protocol.SimpleMessage{
+            Content: "bye",
+        }),
+        user.ClientId(),
+        func(err error) {
+            acks <- err
+        },
+        timeout,
+    )
+    if !success {
+        t.Fatalf("Send failed.")
+    }
+
+    drained := make(chan bool, 1)
+    go func() {
+        drained <- drainOnDone(
+            event.Ctx(),
+            cancel,
+            []*http.Server{statusServer},
+            remoteUserNatProvider,
+            localUserNat,
+            connectClient,
+            timeout,
+        )
+    }()
+
+    syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+    select {
+    case <- event.Ctx().Done():
+    case <- time.After(timeout):
+        t.Fatalf("Missing signal.")
+    }
+    // the status server has shut down and the drain is waiting on the pending send
+    time.Sleep(200 * time.Millisecond)
+    if connectClient.IsDone() {
+        t.Fatalf("Client cancelled before the drain.")
+    }
+
+    user.RouteManager().UpdateTransport(connect.NewReceiveGatewayTransport(), []connect.Route{providerToUser})
+
+    select {
+    case content := <- receives:
+        if content != "bye" {
+            t.Fatalf("%q <> bye", content)
+        }
+    case <- time.After(timeout):
+        t.Fatalf("Missing pending send.")
+    }
+    select {
+    case err := <- acks:
+        if err != nil {
+            t.Fatalf("Ack error: %s", err)
+        }
+    case <- time.After(timeout):
+        t.Fatalf("Missing ack.")
+    }
+    select {
+    case success := <- drained:
+        if !success {
+            t.Fatalf("Drain timeout.")
+        }
+    case <- time.After(2 * timeout):
+        t.Fatalf("Missing drain.")
+    }
+    // cancelled after the drain
+    if !connectClient.IsDone() {
+        t.Fatalf("Client not cancelled after the drain.")
+    }
+}
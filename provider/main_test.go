@@ -0,0 +1,52 @@
+package main
+
+import (
+    "testing"
+    "time"
+    "reflect"
+)
+
+
+func TestRequirePortTimeouts(t *testing.T) {
+    type portTimeoutsCase struct {
+        portTimeoutsStr string
+        portTimeouts map[int]time.Duration
+        // the parse panics
+        bad bool
+    }
+    for _, c := range []portTimeoutsCase{
+        {
+            portTimeoutsStr: "443:5m, 53:10s,",
+            portTimeouts: map[int]time.Duration{
+                443: 5 * time.Minute,
+                53: 10 * time.Second,
+            },
+        },
+        {
+            portTimeoutsStr: "",
+            portTimeouts: map[int]time.Duration{},
+        },
+        {portTimeoutsStr: "70000:5m", bad: true},
+        {portTimeoutsStr: "https:5m", bad: true},
+        {portTimeoutsStr: "443", bad: true},
+        {portTimeoutsStr: "443:5", bad: true},
+        {portTimeoutsStr: "443:0s", bad: true},
+    } {
+        var portTimeouts map[int]time.Duration
+        bad := func()(bad bool) {
+            defer func() {
+                if r := recover(); r != nil {
+                    bad = true
+                }
+            }()
+            portTimeouts = requirePortTimeouts(c.portTimeoutsStr)
+            return false
+        }()
+        if bad != c.bad {
+            t.Fatalf("%q bad %t <> %t", c.portTimeoutsStr, bad, c.bad)
+        }
+        if !c.bad && !reflect.DeepEqual(c.portTimeouts, portTimeouts) {
+            t.Fatalf("%q %v <> %v", c.portTimeoutsStr, portTimeouts, c.portTimeouts)
+        }
+    }
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+
+// signals that quiesce the provider
+var quiesceSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,9 @@
+package main
+
+import (
+    "os"
+)
+
+
+// windows has no user signals, so quiesce is not available
+var quiesceSignals = []os.Signal{}